@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/pkg/errors"
+)
+
+// appResourceName returns the name of the policy and token role granting an
+// application its private area of the instance.
+func (b *Broker) appResourceName(instanceID, appGUID string) string {
+	return b.resourceName(instanceID) + "-app-" + appGUID
+}
+
+// appPolicy renders the policy granting an application its private area of
+// the instance.
+func (b *Broker) appPolicy(instanceID, appGUID string) (string, error) {
+	var buf bytes.Buffer
+	if err := GenerateAppPolicy(&buf, &ServicePolicyTemplateInput{
+		Prefix:    b.mountPath(),
+		ServiceID: instanceID,
+		AppID:     appGUID,
+	}); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// ensureAppsBackend mounts the backend holding the private areas of the
+// applications bound to instances provisioned before it existed, and appends
+// the rule denying access to those areas to the instance's policy. The rest of
+// the policy is kept, so rules added to it by hand are not lost.
+func (b *Broker) ensureAppsBackend(client *api.Client, instanceID string, instance *instanceInfo, event *AuditEvent) error {
+	b.instancesLock.Lock()
+	exists := instance.AppsBackend
+	b.instancesLock.Unlock()
+	if exists {
+		return nil
+	}
+
+	// Mount the backend
+	path := "/" + b.mountPath(instanceID, "apps")
+	b.log.Printf("[DEBUG] creating mount %s", path)
+	if err := b.idempotentMount(client, map[string]string{path: "generic"}, b.instanceMountOptions(instance)); err != nil {
+		return errors.Wrapf(err, "failed to create mount %s", path)
+	}
+	event.addArtifact("mount", path)
+
+	// Deny access to the areas in the instance's policy
+	var buf bytes.Buffer
+	if err := GenerateAppsPolicy(&buf, &ServicePolicyTemplateInput{
+		Prefix:    b.mountPath(),
+		ServiceID: instanceID,
+	}); err != nil {
+		return errors.Wrapf(err, "failed to generate policy for %s", instanceID)
+	}
+	name := b.resourceName(instanceID)
+	rules, err := client.Sys().GetPolicy(name)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read policy %s", name)
+	}
+	if !strings.Contains(rules, buf.String()) {
+		b.log.Printf("[DEBUG] denying access to the application areas in policy %s", name)
+		if err := client.Sys().PutPolicy(name, rules+buf.String()); err != nil {
+			return errors.Wrapf(err, "failed to write policy %s", name)
+		}
+		event.addArtifact("policy", name)
+	}
+
+	b.instancesLock.Lock()
+	instance.AppsBackend = true
+	b.instancesLock.Unlock()
+	return b.storeInstance(instanceID, instance)
+}
+
+// appRole returns the token role of the bindings of an application. Their
+// tokens also have the instance's policy, or its shared policy if the
+// application is in another space.
+func (b *Broker) appRole(instanceID, appGUID string) map[string]interface{} {
+	return map[string]interface{}{
+		"allowed_policies": strings.Join([]string{
+			b.resourceName(instanceID),
+			b.sharedResourceName(instanceID),
+			b.appResourceName(instanceID, appGUID),
+		}, ","),
+		"period":    VaultPeriodicTTL,
+		"renewable": true,
+	}
+}
+
+// ensureAppRole writes the policy and token role of the bindings of an
+// application, and records the application on the instance so they are
+// removed with it. The policy and role are written on every binding of the
+// application, so they are not undone if the binding fails.
+func (b *Broker) ensureAppRole(client *api.Client, instanceID string, instance *instanceInfo, appGUID string, event *AuditEvent) error {
+	name := b.appResourceName(instanceID, appGUID)
+	rules, err := b.appPolicy(instanceID, appGUID)
+	if err != nil {
+		return errors.Wrapf(err, "failed to generate policy for %s", name)
+	}
+
+	b.log.Printf("[DEBUG] writing application policy %s", name)
+	if err := client.Sys().PutPolicy(name, rules); err != nil {
+		return err
+	}
+	event.addArtifact("policy", name)
+
+	path := "/auth/token/roles/" + name
+	b.log.Printf("[DEBUG] writing application token role %s", path)
+	if _, err := client.Logical().Write(path, b.appRole(instanceID, appGUID)); err != nil {
+		return err
+	}
+	event.addArtifact("token_role", path)
+
+	b.instancesLock.Lock()
+	known := containsString(instance.Apps, appGUID)
+	if !known {
+		instance.Apps = append(instance.Apps, appGUID)
+	}
+	b.instancesLock.Unlock()
+	if known {
+		return nil
+	}
+	return b.storeInstance(instanceID, instance)
+}
+
+// holdApp counts a binding of an application while it is created, so that
+// unbinding the other bindings of the application meanwhile does not delete its
+// area. If the application is being released, it waits until it has been, so
+// the binding recreates what was deleted. The returned function stops
+// counting the binding.
+func (b *Broker) holdApp(ctx context.Context, instanceID, bindingID, appGUID string) (func(), error) {
+	key := b.appResourceName(instanceID, appGUID)
+	for {
+		b.bindLock.Lock()
+		released, releasing := b.releasingApps[key]
+		if !releasing {
+			_, pending := b.pendingBinds[bindingID]
+			if !pending {
+				b.addPendingBind(bindingID, &bindingInfo{AppGUID: appGUID, instanceID: instanceID})
+			}
+			b.bindLock.Unlock()
+			if pending {
+				return func() {}, nil
+			}
+			return func() { b.removePendingBind(bindingID) }, nil
+		}
+		b.bindLock.Unlock()
+
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// releaseApp deletes the policy and token role of an application, and the
+// secrets in its private area, once none of the bindings to the instance are
+// for it. Bindings still being created count. The application is marked as
+// releasing until it is also removed from the instance, and bindings of it
+// created meanwhile wait in holdApp, so bindLock is not held during the calls
+// to Vault.
+func (b *Broker) releaseApp(client *api.Client, instanceID, appGUID string, event *AuditEvent) error {
+	key := b.appResourceName(instanceID, appGUID)
+
+	b.bindLock.Lock()
+	for _, binds := range []map[string]*bindingInfo{b.binds, b.pendingBinds} {
+		for _, info := range binds {
+			if info.instanceID == instanceID && info.AppGUID == appGUID {
+				b.bindLock.Unlock()
+				return nil
+			}
+		}
+	}
+	if released, ok := b.releasingApps[key]; ok {
+		b.bindLock.Unlock()
+		<-released
+		return nil
+	}
+	if b.releasingApps == nil {
+		b.releasingApps = make(map[string]chan struct{})
+	}
+	released := make(chan struct{})
+	b.releasingApps[key] = released
+	b.bindLock.Unlock()
+	defer func() {
+		b.bindLock.Lock()
+		delete(b.releasingApps, key)
+		close(released)
+		b.bindLock.Unlock()
+	}()
+
+	if err := b.deleteAppRole(client, instanceID, appGUID, event); err != nil {
+		return err
+	}
+	if err := b.deleteAppArea(client, instanceID, appGUID, event); err != nil {
+		return err
+	}
+
+	b.instancesLock.Lock()
+	instance, ok := b.instances[instanceID]
+	if !ok {
+		b.instancesLock.Unlock()
+		return nil
+	}
+	apps := make([]string, 0, len(instance.Apps))
+	for _, app := range instance.Apps {
+		if app != appGUID {
+			apps = append(apps, app)
+		}
+	}
+	instance.Apps = apps
+	b.instancesLock.Unlock()
+	return b.storeInstance(instanceID, instance)
+}
+
+// deleteAppArea deletes the secrets in the private area of an application.
+func (b *Broker) deleteAppArea(client *api.Client, instanceID, appGUID string, event *AuditEvent) error {
+	path := b.mountPath(instanceID, "apps", appGUID)
+	b.log.Printf("[DEBUG] deleting application area %s", path)
+	if err := deleteTree(client, path); err != nil {
+		return errors.Wrapf(err, "failed to delete application area %s", path)
+	}
+	event.addArtifact("secrets", path)
+	return nil
+}
+
+// deleteTree deletes the secrets under path in a generic backend.
+func deleteTree(client *api.Client, path string) error {
+	secret, err := client.Logical().List(path)
+	if err != nil {
+		return err
+	}
+	if secret == nil || secret.Data == nil {
+		return nil
+	}
+	keys, _ := secret.Data["keys"].([]interface{})
+	for _, k := range keys {
+		key, ok := k.(string)
+		if !ok {
+			continue
+		}
+		if strings.HasSuffix(key, "/") {
+			if err := deleteTree(client, path+"/"+strings.TrimSuffix(key, "/")); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err := client.Logical().Delete(path + "/" + key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteAppRole deletes the policy and token role of the bindings of an
+// application.
+func (b *Broker) deleteAppRole(client *api.Client, instanceID, appGUID string, event *AuditEvent) error {
+	name := b.appResourceName(instanceID, appGUID)
+
+	path := "/auth/token/roles/" + name
+	b.log.Printf("[DEBUG] deleting application token role %s", path)
+	if _, err := client.Logical().Delete(path); err != nil {
+		return err
+	}
+	event.addArtifact("token_role", path)
+
+	b.log.Printf("[DEBUG] deleting application policy %s", name)
+	if err := client.Sys().DeletePolicy(name); err != nil {
+		return err
+	}
+	event.addArtifact("policy", name)
+	return nil
+}
+
+// containsString returns whether l contains s.
+func containsString(l []string, s string) bool {
+	for _, v := range l {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
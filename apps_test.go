@@ -0,0 +1,322 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pivotal-cf/brokerapi"
+)
+
+func TestBroker_AppPolicy(t *testing.T) {
+	b := &Broker{}
+
+	rules, err := b.appPolicy("instance-id", "app-guid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(rules, `path "cf/instance-id/apps/app-guid/*"`) {
+		t.Fatalf("expected the application area in %s", rules)
+	}
+
+	// The policies of the instance deny access to every application area, so
+	// only the application's own policy grants it
+	rules, err = b.instancePolicy(&ServicePolicyTemplateInput{ServiceID: "instance-id"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(rules, "path \"cf/instance-id/apps/*\" {\n  capabilities = [\"deny\"]\n}") {
+		t.Fatalf("expected the application areas to be denied in %s", rules)
+	}
+}
+
+// appVault serves the binding records written by the broker and records the
+// policies and token roles it writes.
+type appVault struct {
+	*requestRecorder
+
+	lock     sync.Mutex
+	bindings map[string][]byte
+	bodies   map[string]string
+}
+
+func newAppVault(env *Environment, rules string) *appVault {
+	v := &appVault{
+		bindings: make(map[string][]byte),
+		bodies:   make(map[string]string),
+	}
+	v.requestRecorder = &requestRecorder{handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v.lock.Lock()
+		defer v.lock.Unlock()
+
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/v1/cf/broker/instance-id/"):
+			switch r.Method {
+			case "PUT":
+				body, _ := ioutil.ReadAll(r.Body)
+				v.bindings[r.URL.Path] = body
+				w.WriteHeader(204)
+			case "GET":
+				body, ok := v.bindings[r.URL.Path]
+				if !ok {
+					w.WriteHeader(404)
+					w.Write([]byte(`{"errors": []}`))
+					return
+				}
+				w.Write([]byte(`{"data": ` + string(body) + `}`))
+			case "DELETE":
+				delete(v.bindings, r.URL.Path)
+				w.WriteHeader(204)
+			}
+		case strings.HasPrefix(r.URL.Path, "/v1/cf/instance-id/apps/app-guid"):
+			// The area holds a secret and a nested one
+			switch {
+			case r.Method == "GET" && r.URL.Path == "/v1/cf/instance-id/apps/app-guid":
+				w.Write([]byte(`{"data": {"keys": ["config", "nested/"]}}`))
+			case r.Method == "GET" && r.URL.Path == "/v1/cf/instance-id/apps/app-guid/nested":
+				w.Write([]byte(`{"data": {"keys": ["key"]}}`))
+			default:
+				w.WriteHeader(204)
+			}
+		case r.URL.Path == "/v1/sys/policy/cf-instance-id" && r.Method == "GET":
+
+			json.NewEncoder(w).Encode(map[string]string{"rules": rules})
+		case strings.HasPrefix(r.URL.Path, "/v1/sys/policy/") && r.Method == "PUT",
+			strings.HasPrefix(r.URL.Path, "/v1/auth/token/create/"):
+			body, _ := ioutil.ReadAll(r.Body)
+			v.bodies[r.Method+" "+r.URL.Path] = string(body)
+			r.Body = ioutil.NopCloser(strings.NewReader(string(body)))
+			env.Handler.ServeHTTP(w, r)
+		default:
+			env.Handler.ServeHTTP(w, r)
+		}
+	})}
+	return v
+}
+
+func (v *appVault) body(request string) string {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return v.bodies[request]
+}
+
+func TestBroker_Bind_App(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	vault := newAppVault(env, "")
+	ts := httptest.NewServer(vault)
+	defer ts.Close()
+	env.Broker.vaultClient = boundableClient(t, ts)
+
+	details := brokerapi.ProvisionDetails{
+		SpaceGUID:        env.SpaceGUID,
+		OrganizationGUID: env.OrganizationGUID,
+	}
+	if _, err := env.Broker.Provision(env.Context, env.InstanceID, details, env.Async); err != nil {
+		t.Fatal(err)
+	}
+	if !vault.received("POST /v1/sys/mounts/cf/instance-id/apps") {
+		t.Fatal("expected the applications backend to be mounted")
+	}
+
+	// Both bindings of the application get tokens from its token role, with
+	// the instance's policy and its own
+	bindingIDs := []string{env.BindingID, "other-binding-id"}
+	for _, bindingID := range bindingIDs {
+		binding, err := env.Broker.Bind(env.Context, env.InstanceID, bindingID, brokerapi.BindDetails{AppGUID: "app-guid"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		backends := binding.Credentials.(map[string]interface{})["backends"].(map[string]interface{})
+		if backends["app"] != "cf/instance-id/apps/app-guid" {
+			t.Fatalf("expected cf/instance-id/apps/app-guid but received %v", backends["app"])
+		}
+	}
+	var request struct {
+		Policies []string `json:"policies"`
+	}
+	if err := json.Unmarshal([]byte(vault.body("POST /v1/auth/token/create/cf-instance-id-app-app-guid")), &request); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(request.Policies, ",") != "cf-instance-id,cf-instance-id-app-app-guid" {
+		t.Fatalf("expected the instance and application policies but received %v", request.Policies)
+	}
+	if !strings.Contains(vault.body("PUT /v1/sys/policy/cf-instance-id-app-app-guid"), "cf/instance-id/apps/app-guid/*") {
+		t.Fatal("expected the application policy to grant its area")
+	}
+	if apps := env.Broker.instances[env.InstanceID].Apps; len(apps) != 1 || apps[0] != "app-guid" {
+		t.Fatalf("expected [app-guid] but received %v", apps)
+	}
+
+	// Bindings without an application have no private area
+	binding, err := env.Broker.Bind(env.Context, env.InstanceID, "key-id", brokerapi.BindDetails{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := binding.Credentials.(map[string]interface{})["backends"].(map[string]interface{})["app"]; ok {
+		t.Fatal("expected no application backend")
+	}
+
+	// The policy, token role and secrets of the application are only deleted
+	// with its last binding
+	for i, bindingID := range bindingIDs {
+		if err := env.Broker.Unbind(env.Context, env.InstanceID, bindingID, brokerapi.UnbindDetails{}); err != nil {
+			t.Fatal(err)
+		}
+		last := i == len(bindingIDs)-1
+		for _, request := range []string{
+			"DELETE /v1/sys/policy/cf-instance-id-app-app-guid",
+			"DELETE /v1/auth/token/roles/cf-instance-id-app-app-guid",
+			"DELETE /v1/cf/instance-id/apps/app-guid/config",
+			"DELETE /v1/cf/instance-id/apps/app-guid/nested/key",
+		} {
+			if vault.received(request) != last {
+				t.Fatalf("expected %s %t after unbinding %s", request, last, bindingID)
+			}
+		}
+	}
+	if apps := env.Broker.instances[env.InstanceID].Apps; len(apps) != 0 {
+		t.Fatalf("expected no applications but received %v", apps)
+	}
+}
+
+func TestBroker_ReleaseApp_Pending(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	vault := newAppVault(env, "")
+	ts := httptest.NewServer(vault)
+	defer ts.Close()
+	client := boundableClient(t, ts)
+
+	// A binding of the application still being created keeps its area
+	env.Broker.pendingBinds = map[string]*bindingInfo{
+		"pending-id": {AppGUID: "app-guid", instanceID: env.InstanceID},
+	}
+	event := &AuditEvent{}
+	if err := env.Broker.releaseApp(client, env.InstanceID, "app-guid", event); err != nil {
+		t.Fatal(err)
+	}
+	if vault.received("DELETE /v1/auth/token/roles/cf-instance-id-app-app-guid") {
+		t.Fatal("expected the application to be kept")
+	}
+
+	delete(env.Broker.pendingBinds, "pending-id")
+	if err := env.Broker.releaseApp(client, env.InstanceID, "app-guid", event); err != nil {
+		t.Fatal(err)
+	}
+	if !vault.received("DELETE /v1/cf/instance-id/apps/app-guid/config") {
+		t.Fatal("expected the application area to be deleted")
+	}
+}
+
+func TestBroker_ReleaseApp_Releasing(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	// Hold the release in Vault until the test lets it go
+	vault := newAppVault(env, "")
+	entered := make(chan struct{})
+	unblock := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/auth/token/roles/cf-instance-id-app-app-guid" && r.Method == "DELETE" {
+			close(entered)
+			<-unblock
+		}
+		vault.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+	client := boundableClient(t, ts)
+
+	released := make(chan error, 1)
+	go func() {
+		released <- env.Broker.releaseApp(client, env.InstanceID, "app-guid", &AuditEvent{})
+	}()
+	<-entered
+
+	// The release does not hold bindLock while it calls Vault
+	env.Broker.bindLock.Lock()
+	env.Broker.bindLock.Unlock()
+
+	// A binding of the application waits until the release is done
+	held := make(chan error, 1)
+	go func() {
+		_, err := env.Broker.holdApp(env.Context, env.InstanceID, "pending-id", "app-guid")
+		held <- err
+	}()
+	select {
+	case <-held:
+		t.Fatal("expected the binding to wait for the release")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(unblock)
+	if err := <-released; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-held; err != nil {
+		t.Fatal(err)
+	}
+	env.Broker.bindLock.Lock()
+	_, pending := env.Broker.pendingBinds["pending-id"]
+	env.Broker.bindLock.Unlock()
+	if !pending {
+		t.Fatal("expected the binding to be counted once the release is done")
+	}
+}
+
+func TestBroker_Bind_App_OlderInstance(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	// Instances provisioned before the applications backend keep the rules
+	// added to their policy by hand
+	custom := "\npath \"secret/legacy/*\" {\n  capabilities = [\"read\"]\n}\n"
+	vault := newAppVault(env, custom)
+	ts := httptest.NewServer(vault)
+	defer ts.Close()
+	env.Broker.vaultClient = boundableClient(t, ts)
+	env.Broker.instances[env.InstanceID] = &instanceInfo{
+		OrganizationGUID: env.OrganizationGUID,
+		SpaceGUID:        env.SpaceGUID,
+		Cluster:          DefaultClusterName,
+	}
+
+	if _, err := env.Broker.Bind(env.Context, env.InstanceID, env.BindingID, brokerapi.BindDetails{AppGUID: "app-guid"}); err != nil {
+		t.Fatal(err)
+	}
+	if !vault.received("POST /v1/sys/mounts/cf/instance-id/apps") {
+		t.Fatal("expected the applications backend to be mounted")
+	}
+	var policy struct {
+		Rules string `json:"rules"`
+	}
+	if err := json.Unmarshal([]byte(vault.body("PUT /v1/sys/policy/cf-instance-id")), &policy); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(policy.Rules, custom) || !strings.Contains(policy.Rules, `path "cf/instance-id/apps/*"`) {
+		t.Fatalf("expected the application areas to be denied after the existing rules in %s", policy.Rules)
+	}
+	if !env.Broker.instances[env.InstanceID].AppsBackend {
+		t.Fatal("expected the instance to record its applications backend")
+	}
+
+	// The instance's remaining applications are removed with it
+	if _, err := env.Broker.Deprovision(env.Context, env.InstanceID, brokerapi.DeprovisionDetails{}, env.Async); err != nil {
+		t.Fatal(err)
+	}
+	for _, request := range []string{
+		"DELETE /v1/sys/policy/cf-instance-id-app-app-guid",
+		"DELETE /v1/auth/token/roles/cf-instance-id-app-app-guid",
+	} {
+		if !vault.received(request) {
+			t.Fatalf("expected %s", request)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+
+	"github.com/pivotal-cf/brokerapi"
+)
+
+const (
+	// BindOperation is the operation data returned for asynchronous bindings.
+	BindOperation = "bind"
+)
+
+// BindAsync starts creating the binding in the background and returns the
+// operation data the platform polls the binding's last operation with. The
+// binding is stored as in progress first, so it is resumed if the broker
+// restarts before it completes.
+//
+// Repeating the request is safe: a binding that already exists with the same
+// details is returned, and one that is still being created is not started
+// again. A binding with different details is refused.
+func (b *Broker) BindAsync(ctx context.Context, instanceID, bindingID string, details brokerapi.BindDetails) (*bindingResponse, string, error) {
+	b.log.Printf("[INFO] binding service %s to instance %s asynchronously",
+		bindingID, instanceID)
+
+	// Get the instance for this instanceID
+	b.log.Printf("[DEBUG] looking up instance %s from cache", instanceID)
+	b.instancesLock.Lock()
+	instance, ok := b.instances[instanceID]
+	b.instancesLock.Unlock()
+	if !ok {
+		return nil, "", errInstanceNotFound
+	}
+
+	// Check for an existing binding, and reserve the binding while it is
+	// created so a repeated request does not start it twice
+	b.bindLock.Lock()
+	if existing, ok := b.binds[bindingID]; ok {
+		b.bindLock.Unlock()
+		if !sameBinding(existing, instanceID, details) {
+			return nil, "", brokerapi.ErrBindingAlreadyExists
+		}
+		binding, err := b.GetBinding(ctx, instanceID, bindingID)
+		if err != nil {
+			return nil, "", err
+		}
+		return binding, "", nil
+	}
+	if pending, ok := b.pendingBinds[bindingID]; ok {
+		b.bindLock.Unlock()
+		if !sameBinding(pending, instanceID, details) {
+			return nil, "", brokerapi.ErrBindingAlreadyExists
+		}
+		return nil, BindOperation, nil
+	}
+
+	// Check the binding is allowed before accepting it
+	shared := b.foreignBinding(ctx, instance)
+	if shared && !b.sharingEnabled() {
+		b.bindLock.Unlock()
+		return nil, "", errSharingDisabled
+	}
+
+	info := &bindingInfo{
+		Organization: instance.OrganizationGUID,
+		Space:        instance.SpaceGUID,
+		Binding:      bindingID,
+		Parameters:   details.RawParameters,
+		State:        brokerapi.InProgress,
+
+		OriginatingIdentity: originatingIdentity(ctx),
+		FoundationID:        b.foundationID,
+		Shared:              shared,
+		AppGUID:             details.AppGUID,
+
+		instanceID: instanceID,
+	}
+	b.addPendingBind(bindingID, info)
+	b.bindLock.Unlock()
+
+	release, err := b.reserveBindingQuota(instanceID, bindingID, instance)
+	if err != nil {
+		b.removePendingBind(bindingID)
+		return nil, "", err
+	}
+	defer release()
+
+	// Store the binding as in progress
+	if err := b.writeBindingInfo(instanceID, bindingID, info); err != nil {
+		b.removePendingBind(bindingID)
+		return nil, "", err
+	}
+
+	// The request context is canceled once the response is sent, so only the
+	// originating identity, for the audit log, and the platform context are
+	// carried over.
+	bindCtx := withOriginatingIdentity(context.Background(), originatingIdentity(ctx))
+	bindCtx = withPlatformContext(bindCtx, platformContext(ctx))
+	go b.completeBind(bindCtx, instanceID, bindingID, details, info)
+
+	return nil, BindOperation, nil
+}
+
+// addPendingBind records a binding being created asynchronously. bindLock
+// must be held.
+func (b *Broker) addPendingBind(bindingID string, info *bindingInfo) {
+	if b.pendingBinds == nil {
+		b.pendingBinds = make(map[string]*bindingInfo)
+	}
+	b.pendingBinds[bindingID] = info
+}
+
+// removePendingBind removes a binding once it is no longer being created.
+func (b *Broker) removePendingBind(bindingID string) {
+	b.bindLock.Lock()
+	delete(b.pendingBinds, bindingID)
+	b.bindLock.Unlock()
+}
+
+// sameBinding returns whether the binding was created on the instance with
+// the given details.
+func sameBinding(info *bindingInfo, instanceID string, details brokerapi.BindDetails) bool {
+	if info.instanceID != instanceID || info.AppGUID != details.AppGUID {
+		return false
+	}
+	if len(info.Parameters) == 0 || len(details.RawParameters) == 0 {
+		return len(info.Parameters) == len(details.RawParameters)
+	}
+	var a, b interface{}
+	if err := json.Unmarshal(info.Parameters, &a); err != nil {
+		return false
+	}
+	if err := json.Unmarshal(details.RawParameters, &b); err != nil {
+		return false
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// completeBind creates the binding started by BindAsync. If it fails, the
+// stored binding is marked as failed with the reason.
+func (b *Broker) completeBind(ctx context.Context, instanceID, bindingID string, details brokerapi.BindDetails, info *bindingInfo) {
+	// Record the outcome in the audit log
+	event := &AuditEvent{
+		Operation:  "bind",
+		InstanceID: instanceID,
+		BindingID:  bindingID,
+		AppGUID:    details.AppGUID,
+	}
+
+	// The binding is no longer pending once it is created or marked as failed
+	defer b.removePendingBind(bindingID)
+
+	_, err := b.bind(ctx, instanceID, bindingID, details, event)
+	b.audit(ctx, event, err)
+	if err == nil {
+		return
+	}
+
+	info.State = brokerapi.Failed
+	info.StateDescription = err.Error()
+	if err := b.writeBindingInfo(instanceID, bindingID, info); err != nil {
+		b.log.Printf("[ERR] failed to mark bind %s as failed: %s", bindingID, err)
+	}
+}
+
+// BindingLastOperation returns the state of the operation creating the
+// binding.
+func (b *Broker) BindingLastOperation(ctx context.Context, instanceID, bindingID, operationData string) (_ brokerapi.LastOperation, err error) {
+	b.log.Printf("[INFO] returning last operation for binding %s", bindingID)
+
+	// Bound the operation by its deadline
+	ctx, cancel := b.operationContext(ctx, "binding_last_operation")
+	defer cancel()
+	defer func() { err = b.operationError(ctx, "binding_last_operation", err) }()
+
+	// Read the binding info
+	path := b.statePath(instanceID, bindingID)
+	b.log.Printf("[DEBUG] reading %s", path)
+	secret, err := withContext(ctx, b.vaultClient).Logical().Read(path)
+	if err != nil {
+		return brokerapi.LastOperation{}, b.wErrorf(err, "failed to read binding info for %s", path)
+	}
+	if secret == nil || len(secret.Data) == 0 {
+		return brokerapi.LastOperation{}, brokerapi.ErrBindingDoesNotExist
+	}
+
+	// Decode the binding info
+	info, err := decodeBindingInfo(secret.Data)
+	if err != nil {
+		return brokerapi.LastOperation{}, b.wErrorf(err, "failed to decode binding info for %s", path)
+	}
+
+	return brokerapi.LastOperation{
+		State:       info.State,
+		Description: info.StateDescription,
+	}, nil
+}
+
+// writeBindingInfo stores the binding info.
+func (b *Broker) writeBindingInfo(instanceID, bindingID string, info *bindingInfo) error {
+	data, err := encodeBindingInfo(info)
+	if err != nil {
+		return b.wErrorf(err, "failed to encode binding json")
+	}
+
+	path := b.statePath(instanceID, bindingID)
+	b.log.Printf("[DEBUG] storing binding metadata at %s", path)
+	if _, err := b.vaultClient.Logical().Write(path, data); err != nil {
+		return b.wErrorf(err, "failed to commit binding %s", path)
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/pivotal-cf/brokerapi"
+)
+
+// waitForBind waits for the binding to be saved to the broker's cache.
+func waitForBind(t *testing.T, b *Broker, bindingID string) *bindingInfo {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		b.bindLock.Lock()
+		info, ok := b.binds[bindingID]
+		b.bindLock.Unlock()
+		if ok {
+			return info
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for bind %s", bindingID)
+	return nil
+}
+
+func TestBroker_BindAsync(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	if _, _, err := env.Broker.BindAsync(env.Context, env.InstanceID, env.BindingID, brokerapi.BindDetails{}); err != errInstanceNotFound {
+		t.Fatalf("expected %s but received %v", errInstanceNotFound, err)
+	}
+
+	env.Broker.instances[env.InstanceID] = &instanceInfo{
+		SpaceGUID:        env.SpaceGUID,
+		OrganizationGUID: env.OrganizationGUID,
+	}
+
+	_, operation, err := env.Broker.BindAsync(env.Context, env.InstanceID, env.BindingID, brokerapi.BindDetails{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if operation != BindOperation {
+		t.Fatalf("expected %s but received %s", BindOperation, operation)
+	}
+
+	info := waitForBind(t, env.Broker, env.BindingID)
+	if info.State != brokerapi.Succeeded {
+		t.Fatalf("expected %s but received %s", brokerapi.Succeeded, info.State)
+	}
+	if info.EncryptedToken == "" {
+		t.Fatal("expected an encrypted token")
+	}
+}
+
+func TestBroker_BindAsync_Existing(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	env.Broker.instances[env.InstanceID] = &instanceInfo{
+		SpaceGUID:        env.SpaceGUID,
+		OrganizationGUID: env.OrganizationGUID,
+	}
+
+	// A binding still being created is not started again
+	pending := &bindingInfo{State: brokerapi.InProgress, instanceID: env.InstanceID}
+	env.Broker.pendingBinds = map[string]*bindingInfo{env.BindingID: pending}
+	binding, operation, err := env.Broker.BindAsync(env.Context, env.InstanceID, env.BindingID, brokerapi.BindDetails{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if binding != nil || operation != BindOperation {
+		t.Fatalf("expected operation %s but received %v, %s", BindOperation, binding, operation)
+	}
+	if _, ok := env.Broker.binds[env.BindingID]; ok {
+		t.Fatal("expected the pending binding not to be created again")
+	}
+
+	// A binding with different details is refused
+	details := brokerapi.BindDetails{AppGUID: "app-guid"}
+	if _, _, err := env.Broker.BindAsync(env.Context, env.InstanceID, env.BindingID, details); err != brokerapi.ErrBindingAlreadyExists {
+		t.Fatalf("expected %v but received %v", brokerapi.ErrBindingAlreadyExists, err)
+	}
+
+	// A binding that was created is returned as is, without a new token
+	delete(env.Broker.pendingBinds, env.BindingID)
+	if _, err := env.Broker.Bind(env.Context, env.InstanceID, env.BindingID, brokerapi.BindDetails{}); err != nil {
+		t.Fatal(err)
+	}
+	accessor := env.Broker.binds[env.BindingID].Accessor
+	binding, operation, err = env.Broker.BindAsync(env.Context, env.InstanceID, env.BindingID, brokerapi.BindDetails{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if binding == nil || operation != "" {
+		t.Fatalf("expected the existing binding but received %v, %s", binding, operation)
+	}
+	if env.Broker.binds[env.BindingID].Accessor != accessor {
+		t.Fatal("expected the existing token to be kept")
+	}
+	if _, _, err := env.Broker.BindAsync(env.Context, env.InstanceID, env.BindingID, details); err != brokerapi.ErrBindingAlreadyExists {
+		t.Fatalf("expected %v but received %v", brokerapi.ErrBindingAlreadyExists, err)
+	}
+}
+
+func TestBroker_BindingLastOperation(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	op, err := env.Broker.BindingLastOperation(env.Context, env.InstanceID, env.BindingID, BindOperation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if op.State != brokerapi.Succeeded {
+		t.Fatalf("expected %s but received %s", brokerapi.Succeeded, op.State)
+	}
+
+	if _, err := env.Broker.BindingLastOperation(env.Context, env.InstanceID, "unknown", BindOperation); err != brokerapi.ErrBindingDoesNotExist {
+		t.Fatalf("expected %s but received %v", brokerapi.ErrBindingDoesNotExist, err)
+	}
+}
+
+func TestHandler_BindAsync(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	path := "/v2/service_instances/" + env.InstanceID + "/service_bindings/" + env.BindingID
+	details := `{"service_id": "service-id", "plan_id": "plan-id"}`
+	if code := serveBroker(t, env, "PUT", path+"?accepts_incomplete=true", details, nil); code != http.StatusNotFound {
+		t.Fatalf("expected 404 but received %d", code)
+	}
+
+	env.Broker.instances[env.InstanceID] = &instanceInfo{
+		SpaceGUID:        env.SpaceGUID,
+		OrganizationGUID: env.OrganizationGUID,
+	}
+
+	var resp asyncResponse
+	if code := serveBroker(t, env, "PUT", path+"?accepts_incomplete=true", details, &resp); code != http.StatusAccepted {
+		t.Fatalf("expected 202 but received %d", code)
+	}
+	if resp.Operation != BindOperation {
+		t.Fatalf("expected %s but received %s", BindOperation, resp.Operation)
+	}
+	waitForBind(t, env.Broker, env.BindingID)
+
+	// Repeating the request returns the binding
+	if code := serveBroker(t, env, "PUT", path+"?accepts_incomplete=true", details, nil); code != http.StatusOK {
+		t.Fatalf("expected 200 but received %d", code)
+	}
+
+	var op brokerapi.LastOperationResponse
+	if code := serveBroker(t, env, "GET", path+"/last_operation?operation=bind", "", &op); code != http.StatusOK {
+		t.Fatalf("expected 200 but received %d", code)
+	}
+	if op.State != brokerapi.Succeeded {
+		t.Fatalf("expected %s but received %s", brokerapi.Succeeded, op.State)
+	}
+
+	// Without accepts_incomplete the binding is created synchronously
+	if code := serveBroker(t, env, "PUT", path, details, nil); code != http.StatusCreated {
+		t.Fatalf("expected 201 but received %d", code)
+	}
+}
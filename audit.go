@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-cleanhttp"
+)
+
+const (
+	// AuditSignatureHeader is the header carrying the HMAC-SHA256 signature of
+	// the body of an audit webhook request.
+	AuditSignatureHeader = "X-Broker-Audit-Signature"
+
+	// AuditOutcomeSuccess and AuditOutcomeFailure are the possible outcomes of
+	// an audited operation.
+	AuditOutcomeSuccess = "success"
+	AuditOutcomeFailure = "failure"
+)
+
+// AuditEvent is a structured record of a broker lifecycle operation.
+type AuditEvent struct {
+	Time                time.Time            `json:"time"`
+	Operation           string               `json:"operation"`
+	InstanceID          string               `json:"instance_id"`
+	BindingID           string               `json:"binding_id,omitempty"`
+	OriginatingIdentity *OriginatingIdentity `json:"originating_identity,omitempty"`
+	OrganizationGUID    string               `json:"organization_guid,omitempty"`
+	SpaceGUID           string               `json:"space_guid,omitempty"`
+	AppGUID             string               `json:"app_guid,omitempty"`
+
+	// Artifacts are the Vault objects created or removed by the operation, in
+	// the form "<kind>:<name>", for example "policy:cf-<instance_id>".
+	Artifacts []string `json:"artifacts,omitempty"`
+
+	Outcome string `json:"outcome"`
+	Error   string `json:"error,omitempty"`
+}
+
+// addArtifact records a Vault object touched by the operation.
+func (e *AuditEvent) addArtifact(kind, name string) {
+	e.Artifacts = append(e.Artifacts, kind+":"+name)
+}
+
+// AuditSink is a destination for audit events.
+type AuditSink interface {
+	// Send delivers a single event.
+	Send(event *AuditEvent) error
+
+	// Close releases any resources held by the sink.
+	Close() error
+}
+
+// audit completes the event with the request's originating identity and the
+// outcome of the operation, and delivers it to all configured sinks. Failing
+// to deliver an event is logged but does not fail the operation.
+func (b *Broker) audit(ctx context.Context, event *AuditEvent, err error) {
+	if len(b.auditSinks) == 0 {
+		return
+	}
+
+	event.Time = time.Now().UTC()
+	event.OriginatingIdentity = originatingIdentity(ctx)
+	event.Outcome = AuditOutcomeSuccess
+	if err != nil {
+		event.Outcome = AuditOutcomeFailure
+		event.Error = err.Error()
+	}
+
+	for _, sink := range b.auditSinks {
+		if err := sink.Send(event); err != nil {
+			b.log.Printf("[ERR] audit: failed to send %s event for %s: %s",
+				event.Operation, event.InstanceID, err)
+		}
+	}
+}
+
+// fileAuditSink appends events as JSON lines to a file.
+type fileAuditSink struct {
+	lock sync.Mutex
+	f    *os.File
+}
+
+// newFileAuditSink opens the file at path for appending, creating it if
+// necessary.
+func newFileAuditSink(path string) (*fileAuditSink, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &fileAuditSink{f: f}, nil
+}
+
+func (s *fileAuditSink) Send(event *AuditEvent) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	_, err = s.f.Write(append(payload, '\n'))
+	return err
+}
+
+func (s *fileAuditSink) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.f.Close()
+}
+
+// webhookAuditSink posts events as JSON to an HTTP endpoint. Each request is
+// signed with an HMAC-SHA256 of the body so the receiver can verify it came
+// from the broker.
+type webhookAuditSink struct {
+	url    string
+	secret []byte
+	client *http.Client
+}
+
+// newWebhookAuditSink returns a sink posting to url, signing with secret.
+func newWebhookAuditSink(url, secret string) *webhookAuditSink {
+	client := cleanhttp.DefaultClient()
+	client.Timeout = 10 * time.Second
+	return &webhookAuditSink{
+		url:    url,
+		secret: []byte(secret),
+		client: client,
+	}
+}
+
+func (s *webhookAuditSink) Send(event *AuditEvent) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", s.url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(AuditSignatureHeader, "sha256="+signAuditPayload(s.secret, payload))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (s *webhookAuditSink) Close() error {
+	return nil
+}
+
+// signAuditPayload returns the hex-encoded HMAC-SHA256 of payload.
+func signAuditPayload(secret, payload []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// newAuditSinks creates the audit sinks enabled in the configuration.
+func newAuditSinks(config *Configuration) ([]AuditSink, error) {
+	var sinks []AuditSink
+
+	if config.AuditFile != "" {
+		sink, err := newFileAuditSink(config.AuditFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open audit file: %s", err)
+		}
+		sinks = append(sinks, sink)
+	}
+
+	if config.AuditSyslog {
+		sink, err := newSyslogAuditSink(config.AuditSyslogAddr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to syslog: %s", err)
+		}
+		sinks = append(sinks, sink)
+	}
+
+	if config.AuditWebhookURL != "" {
+		sinks = append(sinks, newWebhookAuditSink(config.AuditWebhookURL, config.AuditWebhookSecret))
+	}
+
+	return sinks, nil
+}
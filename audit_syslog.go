@@ -0,0 +1,46 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package main
+
+import (
+	"encoding/json"
+	"log/syslog"
+	"net/url"
+)
+
+// syslogAuditSink writes events as JSON to syslog.
+type syslogAuditSink struct {
+	w *syslog.Writer
+}
+
+// newSyslogAuditSink connects to syslog. An empty address uses the local
+// syslog daemon, otherwise the address is a URL such as "udp://host:514".
+func newSyslogAuditSink(addr string) (AuditSink, error) {
+	var network, raddr string
+	if addr != "" {
+		u, err := url.Parse(addr)
+		if err != nil {
+			return nil, err
+		}
+		network, raddr = u.Scheme, u.Host
+	}
+
+	w, err := syslog.Dial(network, raddr, syslog.LOG_INFO|syslog.LOG_AUTH, "vault-service-broker")
+	if err != nil {
+		return nil, err
+	}
+	return &syslogAuditSink{w: w}, nil
+}
+
+func (s *syslogAuditSink) Send(event *AuditEvent) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return s.w.Info(string(payload))
+}
+
+func (s *syslogAuditSink) Close() error {
+	return s.w.Close()
+}
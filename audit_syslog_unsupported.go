@@ -0,0 +1,11 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package main
+
+import "errors"
+
+// newSyslogAuditSink is not supported on this platform.
+func newSyslogAuditSink(addr string) (AuditSink, error) {
+	return nil, errors.New("syslog is not supported on this platform")
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pivotal-cf/brokerapi"
+)
+
+// recordingAuditSink keeps all events in memory.
+type recordingAuditSink struct {
+	events []*AuditEvent
+}
+
+func (s *recordingAuditSink) Send(event *AuditEvent) error {
+	s.events = append(s.events, event)
+	return nil
+}
+
+func (s *recordingAuditSink) Close() error {
+	return nil
+}
+
+func TestBroker_Audit(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	sink := &recordingAuditSink{}
+	env.Broker.auditSinks = []AuditSink{sink}
+
+	ctx := withOriginatingIdentity(env.Context, &OriginatingIdentity{
+		Platform: "cloudfoundry",
+		Value:    map[string]interface{}{"user_id": "user-guid"},
+	})
+
+	details := brokerapi.ProvisionDetails{
+		SpaceGUID:        env.SpaceGUID,
+		OrganizationGUID: env.OrganizationGUID,
+	}
+	if _, err := env.Broker.Provision(ctx, env.InstanceID, details, env.Async); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := env.Broker.Bind(ctx, env.InstanceID, env.BindingID, brokerapi.BindDetails{AppGUID: "app-guid"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Binding to an unknown instance fails and is audited as a failure
+	if _, err := env.Broker.Bind(ctx, "unknown", env.BindingID, brokerapi.BindDetails{}); err == nil {
+		t.Fatal("expected error binding unknown instance")
+	}
+
+	if len(sink.events) != 3 {
+		t.Fatalf("expected 3 events but received %d", len(sink.events))
+	}
+
+	provision := sink.events[0]
+	if provision.Operation != "provision" || provision.Outcome != AuditOutcomeSuccess {
+		t.Fatalf("unexpected provision event %+v", provision)
+	}
+	if provision.OriginatingIdentity.UserID() != "user-guid" {
+		t.Fatalf("expected user-guid but received %+v", provision.OriginatingIdentity)
+	}
+	if provision.OrganizationGUID != env.OrganizationGUID || provision.SpaceGUID != env.SpaceGUID {
+		t.Fatalf("unexpected provision org/space %+v", provision)
+	}
+	if len(provision.Artifacts) == 0 {
+		t.Fatal("expected provision artifacts")
+	}
+
+	bind := sink.events[1]
+	if bind.Operation != "bind" || bind.AppGUID != "app-guid" || bind.SpaceGUID != env.SpaceGUID {
+		t.Fatalf("unexpected bind event %+v", bind)
+	}
+
+	failed := sink.events[2]
+	if failed.Outcome != AuditOutcomeFailure || failed.Error == "" {
+		t.Fatalf("expected failure event but received %+v", failed)
+	}
+}
+
+func TestFileAuditSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "audit.log")
+	sink, err := newFileAuditSink(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, op := range []string{"provision", "bind"} {
+		if err := sink.Send(&AuditEvent{Operation: op}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var ops []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var event AuditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatal(err)
+		}
+		ops = append(ops, event.Operation)
+	}
+	if len(ops) != 2 || ops[0] != "provision" || ops[1] != "bind" {
+		t.Fatalf("expected [provision bind] but received %v", ops)
+	}
+}
+
+func TestWebhookAuditSink(t *testing.T) {
+	var signature string
+	var body []byte
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		signature = r.Header.Get(AuditSignatureHeader)
+		body, _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(204)
+	}))
+	defer ts.Close()
+
+	sink := newWebhookAuditSink(ts.URL, "s3cr3t")
+	if err := sink.Send(&AuditEvent{Operation: "unbind"}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "sha256=" + signAuditPayload([]byte("s3cr3t"), body)
+	if signature != expected {
+		t.Fatalf("expected signature %s but received %s", expected, signature)
+	}
+}
@@ -1,12 +1,12 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"math/rand"
+	"net/http"
 	"sort"
 	"strings"
 	"sync"
@@ -26,19 +26,132 @@ const (
 var _ brokerapi.ServiceBroker = (*Broker)(nil)
 
 type bindingInfo struct {
-	Organization string
-	Space        string
-	Binding      string
-	ClientToken  string
-	Accessor     string
-	stopCh       chan struct{}
+	SchemaVersion int
+	Organization  string
+	Space         string
+	Binding       string
+
+	// ClientToken is only set on records written before tokens were encrypted.
+	// Newer records store the token in EncryptedToken instead.
+	ClientToken    string
+	EncryptedToken string
+	Accessor       string
+
+	// Parameters are the parameters the binding was created with.
+	Parameters json.RawMessage `json:",omitempty"`
+
+	// State is the state of the operation creating the binding. Bindings
+	// created asynchronously are stored while in progress, and record why
+	// they failed in StateDescription.
+	State            brokerapi.LastOperationState
+	StateDescription string `json:",omitempty"`
+
+	// OriginatingIdentity is the platform user that created the binding.
+	OriginatingIdentity *OriginatingIdentity `json:",omitempty"`
+
+	// FoundationID is the foundation of the broker that created the binding.
+	FoundationID string `json:",omitempty"`
+
+	// CredentialsFormat is the format of the binding's credentials, so they
+	// are returned in the same shape when the binding is fetched.
+	CredentialsFormat string
+
+	// Shared is set if the binding is from a space other than the one that
+	// owns the instance. Its token only has access to the instance's paths.
+	Shared bool `json:",omitempty"`
+
+	// AppGUID is the application the binding is for, if any. Its token also
+	// has access to the application's private area of the instance.
+	AppGUID string `json:",omitempty"`
+
+	// instanceID is the instance of the binding. It is not stored, since the
+	// binding is stored under the instance.
+	instanceID string
+
+	stopCh chan struct{}
 }
 
 type instanceInfo struct {
+	SchemaVersion    int
 	OrganizationGUID string
 	SpaceGUID        string
+
+	// Cluster is the name of the Vault cluster the instance's policy, token
+	// role, mounts and tokens live on.
+	Cluster string
+
+	// PlanID and Parameters are the plan and parameters the instance was
+	// provisioned with.
+	PlanID     string
+	Parameters json.RawMessage `json:",omitempty"`
+
+	// Platform is the platform the instance was provisioned from. Instances
+	// from platforms other than Cloud Foundry store the cluster ID in
+	// OrganizationGUID and the namespace in Namespace, with the SpaceGUID
+	// set to "<cluster_id>.<namespace>".
+	Platform  string
+	Namespace string `json:",omitempty"`
+
+	// OriginatingIdentity is the platform user that provisioned the instance.
+	OriginatingIdentity *OriginatingIdentity `json:",omitempty"`
+
+	// FoundationID is the foundation of the broker that provisioned the
+	// instance.
+	FoundationID string `json:",omitempty"`
+
+	// PKI is the PKI backend of the instance, if its plan enables one.
+	PKI *instancePKI `json:",omitempty"`
+
+	// Database is the database backend of the instance, if its parameters
+	// describe a database connection.
+	Database *instanceDatabase `json:",omitempty"`
+
+	// TransitKeys are the transit keys the broker created for the instance
+	// and its bindings.
+	TransitKeys []*transitKey `json:",omitempty"`
+
+	// Shared is set once an application in another space is bound to the
+	// instance, when its shared policy and token role are created.
+	Shared bool `json:",omitempty"`
+
+	// AppsBackend is set once the instance has the backend holding the
+	// private areas of its applications and its policy denies access to them.
+	AppsBackend bool `json:",omitempty"`
+
+	// Apps are the applications bound to the instance, each with a policy and
+	// token role granting it its private area.
+	Apps []string `json:",omitempty"`
+}
+
+// instanceResponse is the response to fetching an instance.
+type instanceResponse struct {
+	ServiceID    string          `json:"service_id"`
+	PlanID       string          `json:"plan_id,omitempty"`
+	Parameters   json.RawMessage `json:"parameters,omitempty"`
+	DashboardURL string          `json:"dashboard_url,omitempty"`
 }
 
+// bindingResponse is the response to fetching a binding.
+type bindingResponse struct {
+	Credentials interface{}     `json:"credentials"`
+	Parameters  json.RawMessage `json:"parameters,omitempty"`
+}
+
+var (
+	// errInstanceNotFound and errBindingNotFound are returned when fetching an
+	// instance or binding that does not exist.
+	errInstanceNotFound = brokerapi.NewFailureResponse(
+		errors.New("instance does not exist"), http.StatusNotFound, "instance-not-found")
+	errBindingNotFound = brokerapi.NewFailureResponse(
+		errors.New("binding does not exist"), http.StatusNotFound, "binding-not-found")
+
+	// errBindingInProgress is returned when unbinding a binding that is still
+	// being created asynchronously.
+	errBindingInProgress = brokerapi.NewFailureResponseBuilder(
+		errors.New("binding is still being created"), http.StatusUnprocessableEntity, "binding-in-progress",
+	).WithErrorKey("ConcurrencyError").Build()
+)
+
 type Broker struct {
 	log         *log.Logger
 	vaultClient *api.Client
@@ -49,17 +162,69 @@ type Broker struct {
 	serviceDescription string
 	serviceTags        []string
 
-	// plan-specific customization
-	planName        string
-	planDescription string
+	// plans are the plans offered in the catalog.
+	plans []*Plan
+
+	// shareInstances allows applications in other spaces to bind to the
+	// instances shared with them.
+	shareInstances bool
+
+	// catalogLock protects the service customization, the plans and
+	// shareInstances, which are replaced when the configuration is reloaded.
+	catalogLock sync.RWMutex
 
 	// vaultAdvertiseAddr is the address where Vault should be advertised to
 	// clients.
 	vaultAdvertiseAddr string
 
+	// clusters are the Vault clusters other than the default that instances
+	// can be placed on, keyed by name.
+	clusters map[string]*vaultCluster
+
+	// clusterOrgs maps organization GUIDs to the name of the cluster their
+	// instances are placed on.
+	clusterOrgs map[string]string
+
 	// vaultRenewToken toggles whether the broker should renew the supplied token.
 	vaultRenewToken bool
 
+	// mountPrefix is the path prefix of the mounts and state created by the
+	// broker, and namePrefix is the prefix of the names of its policies and
+	// token roles. They default to DefaultMountPrefix and DefaultNamePrefix.
+	mountPrefix string
+	namePrefix  string
+
+	// foundationID identifies the platform foundation the broker serves. It
+	// is stored with every record so that foundations sharing a Vault cluster
+	// can be told apart.
+	foundationID string
+
+	// dashboard configures the instance dashboard. It is nil if the dashboard
+	// is disabled.
+	dashboard *DashboardConfig
+
+	// quotas are the default quotas of organizations and spaces, and
+	// quotaOverrides replace them for individual organizations and spaces.
+	quotas         Quotas
+	quotaOverrides *quotaOverrides
+	quotaLock      sync.Mutex
+
+	// reservedInstances and reservedBindings count the instances and
+	// bindings being created against the quotas, keyed by their ID. They are
+	// protected by quotaLock.
+	reservedInstances map[string]*instanceInfo
+	reservedBindings  map[string]string
+
+	// operationTimeout is the deadline of each operation, after which its
+	// Vault requests are aborted and its changes rolled back.
+	// operationTimeouts replace it for individual operations. Zero disables
+	// the deadline.
+	operationTimeout  time.Duration
+	operationTimeouts OperationTimeouts
+
+	// auditSinks receive an event for every lifecycle operation.
+	auditSinks []AuditSink
+
 	// mountMutex is used to protect updates to the mount table
 	mountMutex sync.Mutex
 
@@ -68,10 +233,24 @@ type Broker struct {
 	binds    map[string]*bindingInfo
 	bindLock sync.Mutex
 
+	// pendingBinds tracks the bindings being created asynchronously. It is
+	// protected by bindLock.
+	pendingBinds map[string]*bindingInfo
+
+	// releasingApps are the applications whose policy, token role and area
+	// are being deleted, keyed by their resource name. The channel is closed
+	// once they have been. It is protected by bindLock.
+	releasingApps map[string]chan struct{}
+
 	// instances is used to map instances to their space and org GUID.
 	instances     map[string]*instanceInfo
 	instancesLock sync.Mutex
 
+	// stateLock serializes rewriting instance records with deleting them, so
+	// a deprovisioned instance is not written back. It is taken before
+	// instancesLock.
+	stateLock sync.Mutex
+
 	// stopLock, stopped, and stopCh are used to control the stopping behavior of
 	// the broker.
 	stopLock sync.Mutex
@@ -92,12 +271,25 @@ func (b *Broker) Start() error {
 		return nil
 	}
 
+	// Check the tokens can do everything the broker needs, so missing
+	// permissions are found now rather than when an operation fails
+	reports, err := b.preflight()
+	if err != nil {
+		return err
+	}
+	if err := b.logPreflight(reports); err != nil {
+		return err
+	}
+
 	// Create the stop channel
 	b.stopCh = make(chan struct{})
 
 	// Start background renewal
 	if b.vaultRenewToken {
-		go b.renewVaultToken()
+		go b.renewVaultToken(b.vaultClient)
+		for _, name := range b.clusterNames() {
+			go b.renewVaultToken(b.clusters[name].client)
+		}
 	}
 
 	// Ensure binds is initialized
@@ -110,29 +302,47 @@ func (b *Broker) Start() error {
 		b.instances = make(map[string]*instanceInfo)
 	}
 
-	// Ensure the generic secret backend at cf/broker is mounted.
+	// Ensure the generic secret backends for the broker's state and settings
+	// and the transit backend used to encrypt binding tokens are mounted.
 	mounts := map[string]string{
-		"cf/broker": "generic",
+		b.statePath():   "generic",
+		b.metaPath():    "generic",
+		b.transitPath(): "transit",
 	}
 	b.log.Printf("[DEBUG] creating mounts %s", mapToKV(mounts, ", "))
-	if err := b.idempotentMount(mounts); err != nil {
+	if err := b.idempotentMount(b.vaultClient, mounts, nil); err != nil {
 		return errors.Wrap(err, "failed to create mounts")
 	}
+	if err := b.ensureTransitKey(); err != nil {
+		return err
+	}
+	if err := b.restoreQuotas(); err != nil {
+		return err
+	}
 
 	// Restore timers
 	b.log.Printf("[DEBUG] restoring bindings")
-	instances, err := b.listDir("cf/broker/")
+	instances, err := b.listDir(b.statePath() + "/")
 	if err != nil {
 		return errors.Wrap(err, "failed to list instances")
 	}
 	for _, inst := range instances {
 		inst = strings.Trim(inst, "/")
-
 		if err := b.restoreInstance(inst); err != nil {
 			return errors.Wrapf(err, "failed to restore instance data for %q", inst)
 		}
+	}
+
+	// Finish the operations that were interrupted when the broker stopped.
+	// Rolling back a binding may change its instance, but must happen before
+	// the binding is restored.
+	if err := b.recoverTxns(); err != nil {
+		return err
+	}
 
-		binds, err := b.listDir("cf/broker/" + inst + "/")
+	for _, inst := range instances {
+		inst = strings.Trim(inst, "/")
+		binds, err := b.listDir(b.statePath(inst) + "/")
 		if err != nil {
 			return errors.Wrapf(err, "failed to list binds for instance %q", inst)
 		}
@@ -145,6 +355,23 @@ func (b *Broker) Start() error {
 		}
 	}
 
+	// Re-tune the instance backends that drifted from their plan. Failing to
+	// do so does not prevent the broker from serving requests.
+	b.instancesLock.Lock()
+	restored := make(map[string]*instanceInfo, len(b.instances))
+	for id, instance := range b.instances {
+		restored[id] = instance
+	}
+	b.instancesLock.Unlock()
+	for id, instance := range restored {
+		if err := b.tuneInstanceMounts(context.Background(), id, instance); err != nil {
+			b.log.Printf("[WARN] failed to tune mounts for %s: %s", id, err)
+		}
+	}
+
+	// Rotate the managed transit keys in the background
+	go b.runTransitKeyRotation(TransitKeyRotationInterval, b.stopCh)
+
 	// Log our restore status
 	b.bindLock.Lock()
 	b.log.Printf("[INFO] restored %d binds and %d instances",
@@ -160,7 +387,7 @@ func (b *Broker) Start() error {
 func (b *Broker) restoreInstance(instanceID string) error {
 	b.log.Printf("[INFO] restoring info for instance %s", instanceID)
 
-	path := "cf/broker/" + instanceID
+	path := b.statePath(instanceID)
 
 	secret, err := b.vaultClient.Logical().Read(path)
 	if err != nil {
@@ -178,6 +405,12 @@ func (b *Broker) restoreInstance(instanceID string) error {
 		return errors.Wrapf(err, "failed to decode instance info for %s", path)
 	}
 
+	// Refuse to take over the instances of another foundation
+	if info.FoundationID != "" && info.FoundationID != b.foundationID {
+		return fmt.Errorf("instance %s belongs to foundation %q, configure a different mount prefix",
+			instanceID, info.FoundationID)
+	}
+
 	// Store the info
 	b.instancesLock.Lock()
 	b.instances[instanceID] = info
@@ -220,7 +453,7 @@ func (b *Broker) restoreBind(instanceID, bindingID string) error {
 		instanceID, bindingID)
 
 	// Read from Vault
-	path := "cf/broker/" + instanceID + "/" + bindingID
+	path := b.statePath(instanceID, bindingID)
 	b.log.Printf("[DEBUG] reading bind from %s", path)
 	secret, err := b.vaultClient.Logical().Read(path)
 	if err != nil {
@@ -238,9 +471,48 @@ func (b *Broker) restoreBind(instanceID, bindingID string) error {
 		return errors.Wrapf(err, "failed to decode binding info for %s", path)
 	}
 
+	// Resume bindings that were being created when the broker stopped, and
+	// skip those that failed since they have no token.
+	switch info.State {
+	case brokerapi.InProgress:
+		b.log.Printf("[INFO] resuming bind %s", path)
+		details := brokerapi.BindDetails{AppGUID: info.AppGUID, RawParameters: info.Parameters}
+		ctx := withOriginatingIdentity(context.Background(), info.OriginatingIdentity)
+		if info.Shared {
+			ctx = withSharedBinding(ctx)
+		}
+		info.instanceID = instanceID
+		b.bindLock.Lock()
+		b.addPendingBind(bindingID, info)
+		b.bindLock.Unlock()
+		go b.completeBind(ctx, instanceID, bindingID, details, info)
+		return nil
+	case brokerapi.Failed:
+		b.log.Printf("[DEBUG] skipping failed bind %s", path)
+		return nil
+	}
+
+	// Decrypt the token. A token that cannot be decrypted, or that was
+	// removed when the state was imported from another cluster, is not
+	// renewed, but the binding is kept so it can be unbound.
+	token, err := b.bindingToken(info)
+	if err != nil {
+		b.log.Printf("[WARN] failed to decrypt token for %s, the application must be rebound: %s", path, err)
+		token = ""
+	}
+
+	// Find the cluster the token was created on
+	cluster, err := b.instanceCluster(instanceID)
+	if err != nil {
+		return errors.Wrapf(err, "failed to find cluster for %s", path)
+	}
+
 	// Start a renewer for this token
+	info.instanceID = instanceID
 	info.stopCh = make(chan struct{})
-	go b.renewAuth(info.ClientToken, info.Accessor, info.stopCh)
+	if token != "" {
+		go b.renewAuth(cluster.client, token, info.Accessor, info.stopCh)
+	}
 
 	// Store the info
 	b.bindLock.Lock()
@@ -269,6 +541,20 @@ func (b *Broker) Stop() error {
 
 func (b *Broker) Services(ctx context.Context) []brokerapi.Service {
 	b.log.Printf("[INFO] listing services")
+
+	b.catalogLock.RLock()
+	defer b.catalogLock.RUnlock()
+
+	plans := make([]brokerapi.ServicePlan, len(b.plans))
+	for i, plan := range b.plans {
+		plans[i] = brokerapi.ServicePlan{
+			ID:          b.planID(plan),
+			Name:        plan.Name,
+			Description: plan.Description,
+			Free:        brokerapi.FreeValue(true),
+		}
+	}
+
 	return []brokerapi.Service{
 		{
 			ID:            b.serviceID,
@@ -277,95 +563,256 @@ func (b *Broker) Services(ctx context.Context) []brokerapi.Service {
 			Tags:          b.serviceTags,
 			Bindable:      true,
 			PlanUpdatable: false,
-			Plans: []brokerapi.ServicePlan{
-				{
-					ID:          fmt.Sprintf("%s.%s", b.serviceID, b.planName),
-					Name:        b.planName,
-					Description: b.planDescription,
-					Free:        brokerapi.FreeValue(true),
-				},
-			},
+			Plans:         plans,
+
+			DashboardClient: b.dashboardClient(),
 		},
 	}
 }
 
 // Provision is used to setup a new instance of Vault tenant. For each
-// tenant we create a new Vault policy called "cf-instanceID". This is
+// tenant we create a new Vault policy called "<prefix>-instanceID". This is
 // granted access to the service, space, and org contexts. We then create
-// a token role called "cf-instanceID" which is periodic. Lastly, we mount
+// a token role called "<prefix>-instanceID" which is periodic. Lastly, we mount
 // the backends for the instance, and optionally for the space and org if
 // they do not exist yet.
-func (b *Broker) Provision(ctx context.Context, instanceID string, details brokerapi.ProvisionDetails, async bool) (brokerapi.ProvisionedServiceSpec, error) {
+func (b *Broker) Provision(ctx context.Context, instanceID string, details brokerapi.ProvisionDetails, async bool) (spec brokerapi.ProvisionedServiceSpec, err error) {
 	b.log.Printf("[INFO] provisioning instance %s in %s/%s",
 		instanceID, details.OrganizationGUID, details.SpaceGUID)
 
-	// Create the spec to return
-	var spec brokerapi.ProvisionedServiceSpec
+	// Record the outcome in the audit log
+	event := &AuditEvent{
+		Operation:        "provision",
+		InstanceID:       instanceID,
+		OrganizationGUID: details.OrganizationGUID,
+		SpaceGUID:        details.SpaceGUID,
+	}
+	defer func() { b.audit(ctx, event, err) }()
 
-	// Generate the new policy
-	var buf bytes.Buffer
-	inp := ServicePolicyTemplateInput{
-		ServiceID: instanceID,
-		SpaceID:   details.SpaceGUID,
-		OrgID:     details.OrganizationGUID,
+	// Bound the operation by its deadline
+	ctx, cancel := b.operationContext(ctx, "provision")
+	defer cancel()
+	defer func() { err = b.operationError(ctx, "provision", err) }()
+
+	// Map the platform context onto the organization and space
+	pc := platformContext(ctx)
+	tenant, err := pc.tenant(details.OrganizationGUID, details.SpaceGUID)
+	if err != nil {
+		return spec, brokerapi.NewFailureResponse(
+			b.wErrorf(err, "invalid %s context for %s", pc.platform(), instanceID),
+			http.StatusBadRequest, "invalid-context")
 	}
+	orgID, spaceID := tenant.OrganizationID, tenant.SpaceID
+	event.OrganizationGUID = orgID
+	event.SpaceGUID = spaceID
 
+	// Provisioning an existing instance again changes nothing. It must not
+	// reach the journal, or a failure would roll back the live instance.
+	b.instancesLock.Lock()
+	existing, ok := b.instances[instanceID]
+	b.instancesLock.Unlock()
+	if ok {
+		if existing.OrganizationGUID != orgID || existing.SpaceGUID != spaceID ||
+			(existing.PlanID != "" && existing.PlanID != details.PlanID) {
+			return spec, brokerapi.ErrInstanceAlreadyExists
+		}
+		b.log.Printf("[DEBUG] instance %s already exists", instanceID)
+		spec.DashboardURL = b.dashboardURL(instanceID)
+		return spec, nil
+	}
+
+	// Select the cluster to place the instance on
+	cluster, err := b.cluster(b.selectCluster(details.PlanID, orgID))
+	if err != nil {
+		return spec, b.wErrorf(err, "failed to select cluster for %s", instanceID)
+	}
+	b.log.Printf("[DEBUG] placing instance %s on cluster %s", instanceID, cluster.name)
+	client := withContext(ctx, cluster.client)
+
+	// Check the quotas of the organization and space
+	release, err := b.reserveInstanceQuota(instanceID, orgID, spaceID, details.PlanID)
+	if err != nil {
+		return spec, err
+	}
+	defer release()
+
+	// Check the PKI parameters if the plan enables a PKI backend
+	plan := b.plan(details.PlanID)
+	var pkiParams *pkiParameters
+	var pkiRole string
+	if plan != nil && plan.PKI != nil {
+		pkiParams, err = parsePKIParameters(details.RawParameters, plan.PKI)
+		if err != nil {
+			return spec, brokerapi.NewFailureResponse(
+				b.wErrorf(err, "invalid parameters for %s", instanceID),
+				http.StatusBadRequest, "invalid-parameters")
+		}
+		pkiRole = b.resourceName(instanceID)
+	}
+
+	// Check the database connection, if the parameters describe one. The
+	// root password is not stored with the instance.
+	dbParams, err := parseDatabaseParameters(details.RawParameters)
+	if err != nil {
+		return spec, brokerapi.NewFailureResponse(
+			b.wErrorf(err, "invalid parameters for %s", instanceID),
+			http.StatusBadRequest, "invalid-parameters")
+	}
+	keyParams, err := parseTransitKeyParameters(details.RawParameters)
+	if err != nil {
+		return spec, brokerapi.NewFailureResponse(
+			b.wErrorf(err, "invalid parameters for %s", instanceID),
+			http.StatusBadRequest, "invalid-parameters")
+	}
+	parameters, err := redactParameters(details.RawParameters)
+	if err != nil {
+		return spec, b.wErrorf(err, "failed to redact parameters for %s", instanceID)
+	}
+
+	// Generate the new policy
 	b.log.Printf("[DEBUG] generating policy for %s", instanceID)
-	if err := GeneratePolicy(&buf, &inp); err != nil {
+	rules, err := b.instancePolicy(&ServicePolicyTemplateInput{
+		ServiceID: instanceID,
+		SpaceID:   spaceID,
+		OrgID:     orgID,
+		PKIRole:   pkiRole,
+	})
+	if err != nil {
 		return spec, b.wErrorf(err, "failed to generate policy for %s", instanceID)
 	}
 
+	// Journal the changes to Vault so they are undone if provisioning fails or
+	// is aborted
+	tx, err := b.beginTxn("provision", instanceID, "", cluster.name)
+	if err != nil {
+		return spec, b.wErrorf(err, "failed to provision %s", instanceID)
+	}
+	defer func() { tx.end(err) }()
+
 	// Create the new policy
-	policyName := "cf-" + instanceID
+	policyName := b.resourceName(instanceID)
+	if err := tx.record("policy", policyName); err != nil {
+		return spec, b.wErrorf(err, "failed to provision %s", instanceID)
+	}
 	b.log.Printf("[DEBUG] creating new policy %s", policyName)
-	if err := b.vaultClient.Sys().PutPolicy(policyName, buf.String()); err != nil {
+	if err := client.Sys().PutPolicy(policyName, rules); err != nil {
 		return spec, b.wErrorf(err, "failed to create policy %s", policyName)
 	}
+	event.addArtifact("policy", policyName)
 
 	// Create the new token role
-	path := "/auth/token/roles/cf-" + instanceID
+	path := "/auth/token/roles/" + policyName
 	data := map[string]interface{}{
 		"allowed_policies": policyName,
 		"period":           VaultPeriodicTTL,
 		"renewable":        true,
 	}
+	if err := tx.record("token_role", path); err != nil {
+		return spec, b.wErrorf(err, "failed to provision %s", instanceID)
+	}
 	b.log.Printf("[DEBUG] creating new token role for %s", path)
-	if _, err := b.vaultClient.Logical().Write(path, data); err != nil {
+	if _, err := client.Logical().Write(path, data); err != nil {
 		return spec, b.wErrorf(err, "failed to create token role for %s", path)
 	}
+	event.addArtifact("token_role", path)
 
-	// Determine the mounts we need
-	mounts := map[string]string{
-		"/cf/" + details.OrganizationGUID + "/secret": "generic",
-		"/cf/" + details.SpaceGUID + "/secret":        "generic",
-		"/cf/" + instanceID + "/secret":               "generic",
-		"/cf/" + instanceID + "/transit":              "transit",
+	// Determine the mounts we need. The organization and space backends are
+	// shared between plans, so only the instance backends are configured with
+	// the mount options of the plan. The shared backends may be used by other
+	// instances, so they are not removed if provisioning fails.
+	sharedMounts := map[string]string{
+		"/" + b.mountPath(orgID, "secret"):   "generic",
+		"/" + b.mountPath(spaceID, "secret"): "generic",
+	}
+	mounts := b.instanceMounts(instanceID)
+	var opts *MountOptions
+	if plan != nil {
+		opts = plan.Mounts
+	}
+	for _, k := range sortedKeys(mounts) {
+		if err := tx.record("mount", k); err != nil {
+			return spec, b.wErrorf(err, "failed to provision %s", instanceID)
+		}
 	}
 
 	// Mount the backends
-	b.log.Printf("[DEBUG] creating mounts %s", mapToKV(mounts, ", "))
-	if err := b.idempotentMount(mounts); err != nil {
-		return spec, b.wErrorf(err, "failed to create mounts %s", mapToKV(mounts, ", "))
+	for _, m := range []struct {
+		mounts map[string]string
+		opts   *MountOptions
+	}{
+		{sharedMounts, nil},
+		{mounts, opts},
+	} {
+		b.log.Printf("[DEBUG] creating mounts %s", mapToKV(m.mounts, ", "))
+		if err := b.idempotentMount(client, m.mounts, m.opts); err != nil {
+			return spec, b.wErrorf(err, "failed to create mounts %s", mapToKV(m.mounts, ", "))
+		}
+		for _, k := range sortedKeys(m.mounts) {
+			event.addArtifact("mount", k)
+		}
+	}
+
+	// Setup the PKI backend
+	var pki *instancePKI
+	if pkiParams != nil {
+		if err := tx.record("mount", "/"+b.mountPath(instanceID, "pki")); err != nil {
+			return spec, b.wErrorf(err, "failed to provision %s", instanceID)
+		}
+		pki, err = b.provisionPKI(client, instanceID, plan.PKI, pkiParams, event)
+		if err != nil {
+			return spec, b.wErrorf(err, "failed to setup pki for %s", instanceID)
+		}
+	}
+
+	// Setup the database backend
+	var db *instanceDatabase
+	if dbParams != nil {
+		if err := tx.record("mount", "/"+b.mountPath(instanceID, "database")); err != nil {
+			return spec, b.wErrorf(err, "failed to provision %s", instanceID)
+		}
+		db, err = b.provisionDatabase(client, instanceID, dbParams, event)
+		if err != nil {
+			return spec, b.wErrorf(err, "failed to setup database for %s", instanceID)
+		}
+	}
+
+	// Create the transit keys. They are removed with the transit backend if
+	// provisioning fails.
+	keys, err := b.createTransitKeys(client, instanceID, nil, keyParams, event)
+	if err != nil {
+		return spec, b.wErrorf(err, "failed to create transit keys for %s", instanceID)
 	}
 
 	// Generate instance info
 	info := &instanceInfo{
-		OrganizationGUID: details.OrganizationGUID,
-		SpaceGUID:        details.SpaceGUID,
-	}
-	payload, err := json.Marshal(info)
+		OrganizationGUID: orgID,
+		SpaceGUID:        spaceID,
+		Platform:         pc.platform(),
+		Namespace:        tenant.Namespace,
+		Cluster:          cluster.name,
+		PlanID:           details.PlanID,
+		Parameters:       parameters,
+
+		OriginatingIdentity: originatingIdentity(ctx),
+		FoundationID:        b.foundationID,
+		PKI:                 pki,
+		Database:            db,
+		TransitKeys:         keys,
+		AppsBackend:         true,
+	}
+	payload, err := encodeInstanceInfo(info)
 	if err != nil {
 		return spec, b.wErrorf(err, "failed to encode instance json")
 	}
 
-	// Store the token and metadata in the generic secret backend
-	instancePath := "cf/broker/" + instanceID
+	// Store the token and metadata in the generic secret backend. This
+	// completes provisioning.
+	instancePath := b.statePath(instanceID)
 	b.log.Printf("[DEBUG] storing instance metadata at %s", instancePath)
-	if _, err := b.vaultClient.Logical().Write(instancePath, map[string]interface{}{
-		"json": string(payload),
-	}); err != nil {
+	if _, err := withContext(ctx, b.vaultClient).Logical().Write(instancePath, payload); err != nil {
 		return spec, b.wErrorf(err, "failed to commit instance %s", instancePath)
 	}
+	event.addArtifact("state", instancePath)
 
 	// Save the instance
 	b.log.Printf("[DEBUG] saving instance %s to cache", instanceID)
@@ -374,49 +821,97 @@ func (b *Broker) Provision(ctx context.Context, instanceID string, details broke
 	b.instancesLock.Unlock()
 
 	// Done
+	spec.DashboardURL = b.dashboardURL(instanceID)
 	return spec, nil
 }
 
 // Deprovision is used to remove a tenant of Vault. We use this to
 // remove all the backends of the tenant, delete the token role, and policy.
-func (b *Broker) Deprovision(ctx context.Context, instanceID string, details brokerapi.DeprovisionDetails, async bool) (brokerapi.DeprovisionServiceSpec, error) {
+func (b *Broker) Deprovision(ctx context.Context, instanceID string, details brokerapi.DeprovisionDetails, async bool) (spec brokerapi.DeprovisionServiceSpec, err error) {
 	b.log.Printf("[INFO] deprovisioning %s", instanceID)
 
-	// Create the spec to return
-	var spec brokerapi.DeprovisionServiceSpec
+	// Record the outcome in the audit log
+	event := &AuditEvent{
+		Operation:  "deprovision",
+		InstanceID: instanceID,
+	}
+	var shared bool
+	var apps []string
+	b.instancesLock.Lock()
+	if instance, ok := b.instances[instanceID]; ok {
+		event.OrganizationGUID = instance.OrganizationGUID
+		event.SpaceGUID = instance.SpaceGUID
+		shared = instance.Shared
+		apps = append(apps, instance.Apps...)
+	}
+	b.instancesLock.Unlock()
+	defer func() { b.audit(ctx, event, err) }()
+
+	// Bound the operation by its deadline
+	ctx, cancel := b.operationContext(ctx, "deprovision")
+	defer cancel()
+	defer func() { err = b.operationError(ctx, "deprovision", err) }()
 
-	// Unmount the backends
-	mounts := []string{
-		"/cf/" + instanceID + "/secret",
-		"/cf/" + instanceID + "/transit",
+	// Find the cluster the instance lives on
+	cluster, err := b.instanceCluster(instanceID)
+	if err != nil {
+		return spec, b.wErrorf(err, "failed to find cluster for %s", instanceID)
 	}
+	client := withContext(ctx, cluster.client)
+
+	// Unmount the backends
+	mounts := append(sortedKeys(b.instanceMounts(instanceID)),
+		"/"+b.mountPath(instanceID, "pki"),
+		"/"+b.mountPath(instanceID, "database"))
 	b.log.Printf("[DEBUG] removing mounts %s", strings.Join(mounts, ", "))
-	if err := b.idempotentUnmount(mounts); err != nil {
+	if err := b.idempotentUnmount(client, mounts); err != nil {
 		return spec, b.wErrorf(err, "failed to remove mounts")
 	}
+	for _, k := range mounts {
+		event.addArtifact("mount", k)
+	}
 
 	// Delete the token role
-	path := "/auth/token/roles/cf-" + instanceID
+	path := "/auth/token/roles/" + b.resourceName(instanceID)
 	b.log.Printf("[DEBUG] deleting token role %s", path)
-	if _, err := b.vaultClient.Logical().Delete(path); err != nil {
+	if _, err := client.Logical().Delete(path); err != nil {
 		return spec, b.wErrorf(err, "failed to delete token role %s", path)
 	}
+	event.addArtifact("token_role", path)
 
 	// Delete the token policy
-	policyName := "cf-" + instanceID
+	policyName := b.resourceName(instanceID)
 	b.log.Printf("[DEBUG] deleting policy %s", policyName)
-	if err := b.vaultClient.Sys().DeletePolicy(policyName); err != nil {
+	if err := client.Sys().DeletePolicy(policyName); err != nil {
 		return spec, b.wErrorf(err, "failed to delete policy %s", policyName)
 	}
+	event.addArtifact("policy", policyName)
+
+	// Delete the policy and token role of bindings from other spaces
+	if shared {
+		if err := b.deleteSharedRole(client, instanceID, event); err != nil {
+			return spec, b.wErrorf(err, "failed to delete shared token role for %s", instanceID)
+		}
+	}
+
+	// Delete the policies and token roles of the applications still bound
+	for _, app := range apps {
+		if err := b.deleteAppRole(client, instanceID, app, event); err != nil {
+			return spec, b.wErrorf(err, "failed to delete token role for application %s", app)
+		}
+	}
 
-	// Delete the instance info
-	instancePath := "cf/broker/" + instanceID
+	// Delete the instance info and the instance from the map together, so
+	// nothing writes the instance info back in between
+	b.stateLock.Lock()
+	defer b.stateLock.Unlock()
+	instancePath := b.statePath(instanceID)
 	b.log.Printf("[DEBUG] deleting instance info at %s", instancePath)
-	if _, err := b.vaultClient.Logical().Delete(instancePath); err != nil {
+	if _, err := withContext(ctx, b.vaultClient).Logical().Delete(instancePath); err != nil {
 		return spec, b.wErrorf(err, "failed to delete instance info at %s", instancePath)
 	}
+	event.addArtifact("state", instancePath)
 
-	// Delete the instance from the map
 	b.log.Printf("[DEBUG] removing instance %s from cache", instanceID)
 	b.instancesLock.Lock()
 	delete(b.instances, instanceID)
@@ -428,23 +923,186 @@ func (b *Broker) Deprovision(ctx context.Context, instanceID string, details bro
 
 // Bind is used to attach a tenant of Vault to an application in CloudFoundry.
 // This should create a credential that is used to authorize against Vault.
-func (b *Broker) Bind(ctx context.Context, instanceID, bindingID string, details brokerapi.BindDetails) (brokerapi.Binding, error) {
+func (b *Broker) Bind(ctx context.Context, instanceID, bindingID string, details brokerapi.BindDetails) (binding brokerapi.Binding, err error) {
 	b.log.Printf("[INFO] binding service %s to instance %s",
 		bindingID, instanceID)
 
-	// Create the binding to return
-	var binding brokerapi.Binding
+	// Record the outcome in the audit log
+	event := &AuditEvent{
+		Operation:  "bind",
+		InstanceID: instanceID,
+		BindingID:  bindingID,
+		AppGUID:    details.AppGUID,
+	}
+	defer func() { b.audit(ctx, event, err) }()
+
+	return b.bind(ctx, instanceID, bindingID, details, event)
+}
+
+// bind creates the token for the binding and stores the binding info. It is
+// shared by synchronous and asynchronous bindings.
+func (b *Broker) bind(ctx context.Context, instanceID, bindingID string, details brokerapi.BindDetails, event *AuditEvent) (binding brokerapi.Binding, err error) {
+	// Bound the operation by its deadline
+	ctx, cancel := b.operationContext(ctx, "bind")
+	defer cancel()
+	defer func() { err = b.operationError(ctx, "bind", err) }()
+
+	// Get the instance for this instanceID
+	b.log.Printf("[DEBUG] looking up instance %s from cache", instanceID)
+	b.instancesLock.Lock()
+	instance, ok := b.instances[instanceID]
+	b.instancesLock.Unlock()
+	if !ok {
+		return binding, b.errorf("no instance exists with ID %s", instanceID)
+	}
+	event.OrganizationGUID = instance.OrganizationGUID
+	event.SpaceGUID = instance.SpaceGUID
+
+	// Bindings from other spaces the instance is shared with only get access
+	// to the paths of the instance
+	shared := b.foreignBinding(ctx, instance)
+	if shared && !b.sharingEnabled() {
+		return binding, errSharingDisabled
+	}
+
+	// Check the binding quota of the instance
+	release, err := b.reserveBindingQuota(instanceID, bindingID, instance)
+	if err != nil {
+		return binding, err
+	}
+	defer release()
+
+	// Check the transit keys requested for the binding
+	keyParams, err := parseTransitKeyParameters(details.RawParameters)
+	if err != nil {
+		return binding, brokerapi.NewFailureResponse(
+			b.wErrorf(err, "invalid parameters for binding %s", bindingID),
+			http.StatusBadRequest, "invalid-parameters")
+	}
+
+	// Determine the format of the credentials
+	format, err := parseCredentialsFormat(details.RawParameters, b.plan(instance.PlanID))
+	if err != nil {
+		return binding, brokerapi.NewFailureResponse(
+			b.wErrorf(err, "invalid parameters for binding %s", bindingID),
+			http.StatusBadRequest, "invalid-parameters")
+	}
+
+	// Find the cluster the instance lives on
+	cluster, err := b.cluster(instance.Cluster)
+	if err != nil {
+		return binding, b.wErrorf(err, "failed to find cluster for %s", instanceID)
+	}
+	client := withContext(ctx, cluster.client)
+
+	// Journal the changes to Vault so they are undone if binding fails or is
+	// aborted
+	tx, err := b.beginTxn("bind", instanceID, bindingID, cluster.name)
+	if err != nil {
+		return binding, b.wErrorf(err, "failed to bind %s", bindingID)
+	}
+	defer func() { tx.end(err) }()
+
+	// Create the transit keys. They belong to the instance, so they outlive
+	// the binding and are available to every application bound to it. Keys
+	// the instance already has are refused, and must not be undone.
+	if len(keyParams) > 0 {
+		existing := make(map[string]bool)
+		for _, name := range b.transitKeyNames(instance) {
+			existing[name] = true
+		}
+		for _, p := range keyParams {
+			if existing[p.Name] {
+				continue
+			}
+			if err := tx.record("transit_key", p.Name); err != nil {
+				return binding, b.wErrorf(err, "failed to bind %s", bindingID)
+			}
+		}
+		keys, err := b.createTransitKeys(client, instanceID, instance, keyParams, event)
+		if err != nil {
+			return binding, b.wErrorf(err, "failed to create transit keys for binding %s", bindingID)
+		}
+		b.instancesLock.Lock()
+		instance.TransitKeys = append(instance.TransitKeys, keys...)
+		b.instancesLock.Unlock()
+		if err := b.storeInstance(instanceID, instance); err != nil {
+			return binding, b.wErrorf(err, "failed to store transit keys for binding %s", bindingID)
+		}
+	}
+
+	// Create the database role of the binding
+	if instance.Database != nil {
+		if err := tx.record("database_role", bindingID); err != nil {
+			return binding, b.wErrorf(err, "failed to bind %s", bindingID)
+		}
+		if err := b.createDatabaseRole(client, instanceID, bindingID, instance.Database); err != nil {
+			return binding, b.wErrorf(err, "failed to create database role for binding %s", bindingID)
+		}
+		event.addArtifact("database_role", b.mountPath(instanceID, "database", "roles", bindingID))
+	}
 
 	// Create the role name to create the token against
-	roleName := "cf-" + instanceID
+	roleName := b.resourceName(instanceID)
+	if shared {
+		if err := b.ensureSharedRole(client, instanceID, instance, event); err != nil {
+			return binding, b.wErrorf(err, "failed to create shared token role for %s", instanceID)
+		}
+		roleName = b.sharedResourceName(instanceID)
+	}
+
+	// Grant the application its private area of the instance with a token
+	// role of its own, whose tokens also have the policy of the role above
+	policies := []string{roleName}
+	if details.AppGUID != "" {
+		release, err := b.holdApp(ctx, instanceID, bindingID, details.AppGUID)
+		if err != nil {
+			return binding, b.wErrorf(err, "failed to wait for application %s", details.AppGUID)
+		}
+		defer release()
+
+		if err := b.ensureAppsBackend(client, instanceID, instance, event); err != nil {
+			return binding, b.wErrorf(err, "failed to create application backend for %s", instanceID)
+		}
+		if err := b.ensureAppRole(client, instanceID, instance, details.AppGUID, event); err != nil {
+			return binding, b.wErrorf(err, "failed to create token role for application %s", details.AppGUID)
+		}
+		roleName = b.appResourceName(instanceID, details.AppGUID)
+		policies = append(policies, roleName)
+	}
+
+	// Grant the binding the credentials of its database role with a token
+	// role of its own, whose tokens also have the policies above
+	if instance.Database != nil {
+		if err := tx.record("binding_role", bindingID); err != nil {
+			return binding, b.wErrorf(err, "failed to bind %s", bindingID)
+		}
+		if err := b.createBindingRole(client, instanceID, bindingID, details.AppGUID, event); err != nil {
+			return binding, b.wErrorf(err, "failed to create token role for binding %s", bindingID)
+		}
+		roleName = b.bindingResourceName(instanceID, bindingID)
+		policies = append(policies, roleName)
+	}
+
+	// Record the platform user creating the token so it shows in Vault's
+	// audit log
+	identity := originatingIdentity(ctx)
+	metadata := map[string]string{"cf-instance-id": instanceID, "cf-binding-id": bindingID}
+	if b.foundationID != "" {
+		metadata["cf-foundation-id"] = b.foundationID
+	}
+	if identity != nil {
+		metadata["cf-originating-platform"] = identity.Platform
+		metadata["cf-originating-user"] = identity.UserID()
+	}
 
 	// Create the token
 	renewable := true
 	b.log.Printf("[DEBUG] creating token with role %s", roleName)
-	secret, err := b.vaultClient.Auth().Token().CreateWithRole(&api.TokenCreateRequest{
-		Policies:    []string{roleName},
-		Metadata:    map[string]string{"cf-instance-id": instanceID, "cf-binding-id": bindingID},
-		DisplayName: "cf-bind-" + bindingID,
+	secret, err := client.Auth().Token().CreateWithRole(&api.TokenCreateRequest{
+		Policies:    policies,
+		Metadata:    metadata,
+		DisplayName: b.resourceName("bind-" + bindingID),
 		Renewable:   &renewable,
 	}, roleName)
 	if err != nil {
@@ -453,45 +1111,60 @@ func (b *Broker) Bind(ctx context.Context, instanceID, bindingID string, details
 	if secret.Auth == nil {
 		return binding, b.errorf("secret with role %s has no auth", roleName)
 	}
+	event.addArtifact("token_accessor", secret.Auth.Accessor)
 
-	// Get the instance for this instanceID
-	b.log.Printf("[DEBUG] looking up instance %s from cache", instanceID)
-	b.instancesLock.Lock()
-	instance, ok := b.instances[instanceID]
-	b.instancesLock.Unlock()
-	if !ok {
-		return binding, b.errorf("no instance exists with ID %s", instanceID)
+	// The accessor is only known once the token exists, so the token is
+	// revoked right away if it cannot be journaled
+	if err := tx.record("token", secret.Auth.Accessor); err != nil {
+		a := secret.Auth.Accessor
+		if err := cluster.client.Auth().Token().RevokeAccessor(a); err != nil {
+			b.log.Printf("[WARN] failed to revoke accessor %s", a)
+		}
+		return binding, b.wErrorf(err, "failed to bind %s", bindingID)
+	}
+
+	// Encrypt the token so it is not stored in plaintext
+	b.log.Printf("[DEBUG] encrypting token for binding %s", bindingID)
+	encryptedToken, err := b.encryptToken(secret.Auth.ClientToken)
+	if err != nil {
+		return binding, b.wErrorf(err, "failed to encrypt token for binding %s", bindingID)
 	}
 
 	// Create a binding info object
 	info := &bindingInfo{
-		Organization: instance.OrganizationGUID,
-		Space:        instance.SpaceGUID,
-		Binding:      bindingID,
-		ClientToken:  secret.Auth.ClientToken,
-		Accessor:     secret.Auth.Accessor,
-	}
-	data, err := json.Marshal(info)
+		Organization:   instance.OrganizationGUID,
+		Space:          instance.SpaceGUID,
+		Binding:        bindingID,
+		EncryptedToken: encryptedToken,
+		Accessor:       secret.Auth.Accessor,
+		Parameters:     details.RawParameters,
+		State:          brokerapi.Succeeded,
+
+		OriginatingIdentity: identity,
+		FoundationID:        b.foundationID,
+		CredentialsFormat:   format,
+		Shared:              shared,
+		AppGUID:             details.AppGUID,
+
+		instanceID: instanceID,
+	}
+	data, err := encodeBindingInfo(info)
 	if err != nil {
 		return binding, b.wErrorf(err, "failed to encode binding json")
 	}
 
-	// Store the token and metadata in the generic secret backend
-	path := "cf/broker/" + instanceID + "/" + bindingID
+	// Store the encrypted token and metadata in the generic secret backend.
+	// This completes the binding.
+	path := b.statePath(instanceID, bindingID)
 	b.log.Printf("[DEBUG] storing binding metadata at %s", path)
-	if _, err := b.vaultClient.Logical().Write(path, map[string]interface{}{
-		"json": string(data),
-	}); err != nil {
-		a := secret.Auth.Accessor
-		if err := b.vaultClient.Auth().Token().RevokeAccessor(a); err != nil {
-			b.log.Printf("[WARN] failed to revoke accessor %s", a)
-		}
+	if _, err := withContext(ctx, b.vaultClient).Logical().Write(path, data); err != nil {
 		return binding, errors.Wrapf(err, "failed to commit binding %s", path)
 	}
+	event.addArtifact("state", path)
 
 	// Setup Renew timer
 	info.stopCh = make(chan struct{})
-	go b.renewAuth(info.ClientToken, info.Accessor, info.stopCh)
+	go b.renewAuth(cluster.client, secret.Auth.ClientToken, info.Accessor, info.stopCh)
 
 	// Store the info
 	b.log.Printf("[DEBUG] saving bind %s to cache", bindingID)
@@ -500,33 +1173,87 @@ func (b *Broker) Bind(ctx context.Context, instanceID, bindingID string, details
 	b.bindLock.Unlock()
 
 	// Save the credentials
-	binding.Credentials = map[string]interface{}{
-		"address": b.vaultAdvertiseAddr,
+	binding.Credentials = b.bindingCredentials(cluster, instanceID, instance, info, secret.Auth.ClientToken)
+	return binding, nil
+}
+
+// bindingCredentials returns the credentials given to an application bound to
+// the instance in the format of the binding.
+func (b *Broker) bindingCredentials(cluster *vaultCluster, instanceID string, instance *instanceInfo, info *bindingInfo, token string) map[string]interface{} {
+	switch info.CredentialsFormat {
+	case CredentialsFormatSpring:
+		return b.springCredentials(cluster, instanceID, instance, info, token)
+	case CredentialsFormatEnv:
+		return b.envCredentials(cluster, instanceID, instance, info, token)
+	}
+
+	backends := map[string]interface{}{
+		"generic": b.mountPath(instanceID, "secret"),
+		"transit": b.mountPath(instanceID, "transit"),
+
+		"transit_keys": b.transitKeyNames(instance),
+	}
+	if info.AppGUID != "" {
+		backends["app"] = b.mountPath(instanceID, "apps", info.AppGUID)
+	}
+	credentials := map[string]interface{}{
+		"address": cluster.advertiseAddr,
 		"auth": map[string]interface{}{
-			"accessor": secret.Auth.Accessor,
-			"token":    secret.Auth.ClientToken,
-		},
-		"backends": map[string]interface{}{
-			"generic": "cf/" + instanceID + "/secret",
-			"transit": "cf/" + instanceID + "/transit",
-		},
-		"backends_shared": map[string]interface{}{
-			"organization": "cf/" + instance.OrganizationGUID + "/secret",
-			"space":        "cf/" + instance.SpaceGUID + "/secret",
+			"accessor": info.Accessor,
+			"token":    token,
 		},
+		"backends": backends,
+	}
+	if !info.Shared {
+		credentials["backends_shared"] = b.sharedBackends(instance)
+	}
+	if instance.PKI != nil {
+		credentials["pki"] = b.pkiCredentials(instanceID, instance.PKI)
+	}
+	if instance.Database != nil {
+		credentials["database"] = b.databaseCredentials(instanceID, info.Binding)
+	}
+	return credentials
+}
+
+// sharedBackends returns the shared backends of the instance. Instances mapped
+// from a namespace name them after the cluster and namespace instead of the
+// organization and space.
+func (b *Broker) sharedBackends(instance *instanceInfo) map[string]interface{} {
+	if instance.Namespace != "" {
+		return map[string]interface{}{
+			"cluster":   b.mountPath(instance.OrganizationGUID, "secret"),
+			"namespace": b.mountPath(instance.SpaceGUID, "secret"),
+		}
+	}
+	return map[string]interface{}{
+		"organization": b.mountPath(instance.OrganizationGUID, "secret"),
+		"space":        b.mountPath(instance.SpaceGUID, "secret"),
 	}
-	return binding, nil
 }
 
 // Unbind is used to detach an applicaiton from a tenant in Vault.
-func (b *Broker) Unbind(ctx context.Context, instanceID, bindingID string, details brokerapi.UnbindDetails) error {
+func (b *Broker) Unbind(ctx context.Context, instanceID, bindingID string, details brokerapi.UnbindDetails) (err error) {
 	b.log.Printf("[INFO] unbinding service %s for instance %s",
 		bindingID, instanceID)
 
+	// Record the outcome in the audit log
+	event := &AuditEvent{
+		Operation:  "unbind",
+		InstanceID: instanceID,
+		BindingID:  bindingID,
+	}
+	defer func() { b.audit(ctx, event, err) }()
+
+	// Bound the operation by its deadline
+	ctx, cancel := b.operationContext(ctx, "unbind")
+	defer cancel()
+	defer func() { err = b.operationError(ctx, "unbind", err) }()
+
 	// Read the binding info
-	path := "cf/broker/" + instanceID + "/" + bindingID
+	path := b.statePath(instanceID, bindingID)
 	b.log.Printf("[DEBUG] reading %s", path)
-	secret, err := b.vaultClient.Logical().Read(path)
+	secret, err := withContext(ctx, b.vaultClient).Logical().Read(path)
 	if err != nil {
 		return b.wErrorf(err, "failed to read binding info for %s", path)
 	}
@@ -540,19 +1267,53 @@ func (b *Broker) Unbind(ctx context.Context, instanceID, bindingID string, detai
 	if err != nil {
 		return b.wErrorf(err, "failed to decode binding info for %s", path)
 	}
+	event.OrganizationGUID = info.Organization
+	event.SpaceGUID = info.Space
+
+	// Refuse to unbind while the binding is still being created
+	if info.State == brokerapi.InProgress {
+		return errBindingInProgress
+	}
+
+	// Find the cluster the token was created on
+	cluster, err := b.instanceCluster(instanceID)
+	if err != nil {
+		return b.wErrorf(err, "failed to find cluster for %s", instanceID)
+	}
+	client := withContext(ctx, cluster.client)
 
-	// Revoke the token
-	a := info.Accessor
-	b.log.Printf("[DEBUG] revoking accessor %s for path %s", a, path)
-	if err := b.vaultClient.Auth().Token().RevokeAccessor(a); err != nil {
-		return b.wErrorf(err, "failed to revoke accessor %s", a)
+	// Revoke the token. Failed bindings never had one.
+	if a := info.Accessor; a != "" {
+		b.log.Printf("[DEBUG] revoking accessor %s for path %s", a, path)
+		if err := client.Auth().Token().RevokeAccessor(a); err != nil {
+			return b.wErrorf(err, "failed to revoke accessor %s", a)
+		}
+		event.addArtifact("token_accessor", a)
+	}
+
+	// Revoke the database credentials and delete the database role, policy
+	// and token role of the binding
+	b.instancesLock.Lock()
+	instance, ok := b.instances[instanceID]
+	b.instancesLock.Unlock()
+	if ok && instance.Database != nil {
+		if err := b.deleteDatabaseRole(client, instanceID, bindingID); err != nil {
+			return b.wErrorf(err, "failed to delete database role for binding %s", bindingID)
+		}
+		event.addArtifact("database_role", b.mountPath(instanceID, "database", "roles", bindingID))
+
+		if err := b.deleteBindingRole(client, instanceID, bindingID); err != nil {
+			return b.wErrorf(err, "failed to delete token role for binding %s", bindingID)
+		}
+		event.addArtifact("token_role", "/auth/token/roles/"+b.bindingResourceName(instanceID, bindingID))
 	}
 
 	// Delete the binding info
 	b.log.Printf("[DEBUG] deleting binding info at %s", path)
-	if _, err := b.vaultClient.Logical().Delete(path); err != nil {
+	if _, err := withContext(ctx, b.vaultClient).Logical().Delete(path); err != nil {
 		return b.wErrorf(err, "failed to delete binding info at %s", path)
 	}
+	event.addArtifact("state", path)
 
 	// Delete the bind if it exists, stopping any renewers
 	b.log.Printf("[DEBUG] removing binding %s from cache", bindingID)
@@ -566,14 +1327,69 @@ func (b *Broker) Unbind(ctx context.Context, instanceID, bindingID string, detai
 	}
 	b.bindLock.Unlock()
 
+	// Delete the policy and token role of the application once its last
+	// binding is removed
+	if info.AppGUID != "" {
+		if err := b.releaseApp(client, instanceID, info.AppGUID, event); err != nil {
+			return b.wErrorf(err, "failed to release application %s", info.AppGUID)
+		}
+	}
+
 	// Done
 	return nil
 }
 
-// Not implemented, only used for multiple plans
-func (b *Broker) Update(ctx context.Context, instanceID string, details brokerapi.UpdateDetails, async bool) (brokerapi.UpdateServiceSpec, error) {
+// Update re-tunes the backends of the instance whose settings drifted from the
+// mount options of its plan. Plans cannot be changed.
+func (b *Broker) Update(ctx context.Context, instanceID string, details brokerapi.UpdateDetails, async bool) (spec brokerapi.UpdateServiceSpec, err error) {
 	b.log.Printf("[INFO] updating service for instance %s", instanceID)
-	return brokerapi.UpdateServiceSpec{}, nil
+
+	// Record the outcome in the audit log
+	event := &AuditEvent{
+		Operation:        "update",
+		InstanceID:       instanceID,
+		OrganizationGUID: details.PreviousValues.OrgID,
+		SpaceGUID:        details.PreviousValues.SpaceID,
+	}
+	defer func() { b.audit(ctx, event, err) }()
+
+	// Bound the operation by its deadline
+	ctx, cancel := b.operationContext(ctx, "update")
+	defer cancel()
+	defer func() { err = b.operationError(ctx, "update", err) }()
+
+	// Get the instance for this instanceID
+	b.instancesLock.Lock()
+	instance, ok := b.instances[instanceID]
+	b.instancesLock.Unlock()
+	if !ok {
+		return spec, nil
+	}
+
+	// Re-tune the backends
+	if err := b.tuneInstanceMounts(ctx, instanceID, instance); err != nil {
+		return spec, b.wErrorf(err, "failed to tune mounts for %s", instanceID)
+	}
+	return spec, nil
+}
+
+// reload applies the settings of the configuration that can change while the
+// broker runs: the catalog and the default quotas. The service ID cannot
+// change, since the platform refers to the plans by it.
+func (b *Broker) reload(config *Configuration) {
+	b.log.Printf("[INFO] reloading catalog and quotas")
+
+	b.catalogLock.Lock()
+	b.serviceName = config.ServiceName
+	b.serviceDescription = config.ServiceDescription
+	b.serviceTags = config.ServiceTags
+	b.plans = config.Plans
+	b.shareInstances = config.ShareInstances
+	b.catalogLock.Unlock()
+
+	b.quotaLock.Lock()
+	b.quotas = config.Quotas
+	b.quotaLock.Unlock()
 }
 
 // Not implemented, only used for async
@@ -582,13 +1398,91 @@ func (b *Broker) LastOperation(ctx context.Context, instanceID, operationData st
 	return brokerapi.LastOperation{}, nil
 }
 
+// GetInstance returns the plan and parameters of the instance.
+func (b *Broker) GetInstance(ctx context.Context, instanceID string) (*instanceResponse, error) {
+	b.log.Printf("[INFO] fetching instance %s", instanceID)
+
+	b.instancesLock.Lock()
+	instance, ok := b.instances[instanceID]
+	b.instancesLock.Unlock()
+	if !ok {
+		return nil, errInstanceNotFound
+	}
+
+	return &instanceResponse{
+		ServiceID:    b.serviceID,
+		PlanID:       instance.PlanID,
+		Parameters:   instance.Parameters,
+		DashboardURL: b.dashboardURL(instanceID),
+	}, nil
+}
+
+// GetBinding returns the credentials and parameters of the binding. The token
+// is decrypted from the stored binding info, so the credentials are the same
+// as those returned when the binding was created.
+func (b *Broker) GetBinding(ctx context.Context, instanceID, bindingID string) (_ *bindingResponse, err error) {
+	b.log.Printf("[INFO] fetching binding %s for instance %s", bindingID, instanceID)
+
+	// Bound the operation by its deadline
+	ctx, cancel := b.operationContext(ctx, "get_binding")
+	defer cancel()
+	defer func() { err = b.operationError(ctx, "get_binding", err) }()
+
+	// Get the instance for this instanceID
+	b.instancesLock.Lock()
+	instance, ok := b.instances[instanceID]
+	b.instancesLock.Unlock()
+	if !ok {
+		return nil, errBindingNotFound
+	}
+
+	// Read the binding info
+	path := b.statePath(instanceID, bindingID)
+	b.log.Printf("[DEBUG] reading %s", path)
+	secret, err := withContext(ctx, b.vaultClient).Logical().Read(path)
+	if err != nil {
+		return nil, b.wErrorf(err, "failed to read binding info for %s", path)
+	}
+	if secret == nil || len(secret.Data) == 0 {
+		return nil, errBindingNotFound
+	}
+
+	// Decode the binding info
+	info, err := decodeBindingInfo(secret.Data)
+	if err != nil {
+		return nil, b.wErrorf(err, "failed to decode binding info for %s", path)
+	}
+
+	// Bindings that are still being created or failed do not exist yet
+	if info.State != brokerapi.Succeeded {
+		return nil, errBindingNotFound
+	}
+
+	// Decrypt the token
+	token, err := b.bindingToken(info)
+	if err != nil {
+		return nil, b.wErrorf(err, "failed to decrypt token for %s", path)
+	}
+
+	cluster, err := b.cluster(instance.Cluster)
+	if err != nil {
+		return nil, b.wErrorf(err, "failed to find cluster for %s", instanceID)
+	}
+
+	return &bindingResponse{
+		Credentials: b.bindingCredentials(cluster, instanceID, instance, info, token),
+		Parameters:  info.Parameters,
+	}, nil
+}
+
 // idempotentMount takes a list of mounts and their desired paths and mounts the
 // backend at that path. The key is the path and the value is the type of
-// backend to mount.
-func (b *Broker) idempotentMount(m map[string]string) error {
+// backend to mount. If opts is not nil, the backends are mounted with the
+// options.
+func (b *Broker) idempotentMount(client *api.Client, m map[string]string, opts *MountOptions) error {
 	b.mountMutex.Lock()
 	defer b.mountMutex.Unlock()
-	result, err := b.vaultClient.Sys().ListMounts()
+	result, err := client.Sys().ListMounts()
 	if err != nil {
 		return err
 	}
@@ -605,7 +1499,13 @@ func (b *Broker) idempotentMount(m map[string]string) error {
 		if _, ok := mounts[k]; ok {
 			continue
 		}
-		if err := b.vaultClient.Sys().Mount(k, &api.MountInput{
+		if opts != nil {
+			if _, err := client.Logical().Write("sys/mounts/"+k, opts.mountBody(v)); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := client.Sys().Mount(k, &api.MountInput{
 			Type: v,
 		}); err != nil {
 			return err
@@ -616,10 +1516,10 @@ func (b *Broker) idempotentMount(m map[string]string) error {
 
 // idempotentUnmount takes a list of mount paths and removes them if and only
 // if they currently exist.
-func (b *Broker) idempotentUnmount(l []string) error {
+func (b *Broker) idempotentUnmount(client *api.Client, l []string) error {
 	b.mountMutex.Lock()
 	defer b.mountMutex.Unlock()
-	result, err := b.vaultClient.Sys().ListMounts()
+	result, err := client.Sys().ListMounts()
 	if err != nil {
 		return err
 	}
@@ -636,29 +1536,29 @@ func (b *Broker) idempotentUnmount(l []string) error {
 		if _, ok := mounts[k]; !ok {
 			continue
 		}
-		if err := b.vaultClient.Sys().Unmount(k); err != nil {
+		if err := client.Sys().Unmount(k); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-// renewAuth renews the given token. It is designed to be called as a goroutine
-// and will log any errors it encounters.
-func (b *Broker) renewAuth(token, accessor string, stopCh <-chan struct{}) {
+// renewAuth renews the given token against the cluster of the client. It is
+// designed to be called as a goroutine and will log any errors it encounters.
+func (b *Broker) renewAuth(client *api.Client, token, accessor string, stopCh <-chan struct{}) {
 	// Sleep for a random number of milliseconds. This helps prevent a thundering
 	// herd in the event a broker is restarted with a lot of bindings.
 	time.Sleep(time.Duration(rand.Intn(5000)) * time.Millisecond)
 
 	// Use renew-self instead of lookup here because we want the freshest renew
 	// and we can find out if it's renewable or not.
-	secret, err := b.vaultClient.Auth().Token().RenewTokenAsSelf(token, 0)
+	secret, err := client.Auth().Token().RenewTokenAsSelf(token, 0)
 	if err != nil {
 		b.log.Printf("[ERR] renew-token (%s): error looking up self: %s", accessor, err)
 		return
 	}
 
-	renewer, err := b.vaultClient.NewRenewer(&api.RenewerInput{
+	renewer, err := client.NewRenewer(&api.RenewerInput{
 		Secret: secret,
 	})
 	if err != nil {
@@ -693,9 +1593,9 @@ func (b *Broker) renewAuth(token, accessor string, stopCh <-chan struct{}) {
 }
 
 // renewVaultToken is a convenience wrapper around renewAuth which looks up
-// metadata about the token attached to this broker and starts the renewer.
-func (b *Broker) renewVaultToken() {
-	secret, err := b.vaultClient.Auth().Token().LookupSelf()
+// metadata about the token attached to the client and starts the renewer.
+func (b *Broker) renewVaultToken(client *api.Client) {
+	secret, err := client.Auth().Token().LookupSelf()
 	if err != nil {
 		b.log.Printf("[ERR] renew-token: failed to lookup client vault token: %s", err)
 		return
@@ -705,7 +1605,7 @@ func (b *Broker) renewVaultToken() {
 		return
 	}
 
-	secret, err = b.vaultClient.Auth().Token().RenewSelf(0)
+	secret, err = client.Auth().Token().RenewSelf(0)
 	if err != nil {
 		b.log.Printf("[ERR] renew-token: failed to renew client vault token: %s", err)
 		return
@@ -714,66 +1614,36 @@ func (b *Broker) renewVaultToken() {
 		b.log.Printf("[ERR] renew-token: renew-self came back with empty auth")
 		return
 	}
-	b.renewAuth(secret.Auth.ClientToken, secret.Auth.Accessor, nil)
-}
-
-func decodeBindingInfo(m map[string]interface{}) (*bindingInfo, error) {
-	data, ok := m["json"]
-	if !ok {
-		return nil, fmt.Errorf("missing 'json' key")
-	}
-
-	typed, ok := data.(string)
-	if !ok {
-		return nil, fmt.Errorf("json data is %T, not string", data)
-	}
-
-	var info bindingInfo
-	if err := json.Unmarshal([]byte(typed), &info); err != nil {
-		return nil, err
-	}
-	return &info, nil
+	b.renewAuth(client, secret.Auth.ClientToken, secret.Auth.Accessor, nil)
 }
 
-func decodeInstanceInfo(m map[string]interface{}) (*instanceInfo, error) {
-	data, ok := m["json"]
-	if !ok {
-		return nil, fmt.Errorf("missing 'json' key")
-	}
-
-	typed, ok := data.(string)
-	if !ok {
-		return nil, fmt.Errorf("json data is %T, not string", data)
-	}
+func mapToKV(m map[string]string, joiner string) string {
+	keys := sortedKeys(m)
 
-	var info instanceInfo
-	if err := json.Unmarshal([]byte(typed), &info); err != nil {
-		return nil, err
+	r := make([]string, len(keys))
+	for i, k := range keys {
+		r[i] = fmt.Sprintf("%s=%s", k, m[k])
 	}
-	return &info, nil
+	return strings.Join(r, joiner)
 }
 
-func mapToKV(m map[string]string, joiner string) string {
+// sortedKeys returns the keys of the map in lexical order.
+func sortedKeys(m map[string]string) []string {
 	keys := make([]string, 0, len(m))
 	for k := range m {
 		keys = append(keys, k)
 	}
 	sort.Strings(keys)
-
-	r := make([]string, len(keys))
-	for i, k := range keys {
-		r[i] = fmt.Sprintf("%s=%s", k, m[k])
-	}
-	return strings.Join(r, joiner)
+	return keys
 }
 
 // error wraps the given error into the logger and returns it. Vault likes to
 // have multiline error messages, which don't mix well with the service broker's
 // logging model. Here we strip any newline characters and replace them with a
-// space.
+// space. Errors caused by the Vault circuit breaker are returned as a 503.
 func (b *Broker) error(err error) error {
 	b.log.Printf("[ERR] %s", strings.Replace(err.Error(), "\n", " ", -1))
-	return err
+	return vaultUnavailable(err)
 }
 
 // errorf creates a new error from the string and returns it.
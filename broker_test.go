@@ -9,6 +9,7 @@ import (
 	"net/http/httptest"
 	"os"
 	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/hashicorp/vault/api"
@@ -138,6 +139,7 @@ func TestBroker_LastOperation(t *testing.T) {
 
 type Environment struct {
 	Context          context.Context
+	Handler          http.Handler
 	Broker           *Broker
 	InstanceID       string
 	BindingID        string
@@ -148,7 +150,7 @@ type Environment struct {
 
 func defaultEnvironment(t *testing.T) (*Environment, func()) {
 
-	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
 		reqURL := r.URL.String()
 
@@ -177,7 +179,8 @@ func defaultEnvironment(t *testing.T) (*Environment, func()) {
 			w.WriteHeader(204)
 			return
 
-		case reqURL == "/v1/auth/token/create/cf-instance-id" && r.Method == "POST":
+		case (reqURL == "/v1/auth/token/create/cf-instance-id" ||
+			reqURL == "/v1/auth/token/create/cf-instance-id-app-app-guid") && r.Method == "POST":
 			w.WriteHeader(200)
 			w.Write([]byte(`{
 				"auth": {
@@ -212,6 +215,10 @@ func defaultEnvironment(t *testing.T) (*Environment, func()) {
 			w.WriteHeader(204)
 			return
 
+		case reqURL == "/v1/auth/token/roles/cf-instance-id-app-app-guid" && (r.Method == "PUT" || r.Method == "DELETE"):
+			w.WriteHeader(204)
+			return
+
 		// The following calls to cf/broker are all for the generic KV store (v1).
 		case reqURL == "/v1/cf/broker?list=true" && r.Method == "GET":
 			w.WriteHeader(200)
@@ -265,6 +272,14 @@ func defaultEnvironment(t *testing.T) (*Environment, func()) {
 			}`))
 			return
 
+		case reqURL == "/v1/cf/broker/foo" && r.Method == "PUT":
+			w.WriteHeader(204)
+			return
+
+		case reqURL == "/v1/cf/broker/foo/foo" && r.Method == "PUT":
+			w.WriteHeader(204)
+			return
+
 		case reqURL == "/v1/cf/broker/instance-id" && r.Method == "PUT":
 			w.WriteHeader(204)
 			return
@@ -282,7 +297,7 @@ func defaultEnvironment(t *testing.T) (*Environment, func()) {
 			w.Write([]byte(`{
 				"auth": null,
 				"data": {
-					"json": "{\"OrganizationGUID\": \"organization-guid\", \"SpaceGUID\": \"space-guid\"}"
+					"json": "{\"Organization\": \"organization-guid\", \"Space\": \"space-guid\", \"EncryptedToken\": \"vault:v1:QUJDRA==\", \"Accessor\": \"accessor\"}"
 				},
 				"lease_duration": 2764800,
 				"lease_id": "",
@@ -290,10 +305,43 @@ func defaultEnvironment(t *testing.T) (*Environment, func()) {
 			}`))
 			return
 
+		case reqURL == "/v1/cf/broker/instance-id/unknown" && r.Method == "GET":
+			w.WriteHeader(404)
+			w.Write([]byte(`{"errors": []}`))
+			return
+
 		case reqURL == "/v1/cf/broker/instance-id/binding-id" && r.Method == "DELETE":
 			w.WriteHeader(204)
 			return
 
+		// The following calls are for the transit backend encrypting tokens.
+		case reqURL == "/v1/cf/broker-transit/keys/broker" && r.Method == "PUT":
+			w.WriteHeader(204)
+			return
+
+		case reqURL == "/v1/cf/broker-transit/keys/broker/rotate" && r.Method == "PUT":
+			w.WriteHeader(204)
+			return
+
+		case reqURL == "/v1/cf/broker-transit/encrypt/broker" && r.Method == "PUT",
+			reqURL == "/v1/cf/broker-transit/rewrap/broker" && r.Method == "PUT":
+			w.WriteHeader(200)
+			w.Write([]byte(`{
+				"data": {
+					"ciphertext": "vault:v1:QUJDRA=="
+				}
+			}`))
+			return
+
+		case reqURL == "/v1/cf/broker-transit/decrypt/broker" && r.Method == "PUT":
+			w.WriteHeader(200)
+			w.Write([]byte(`{
+				"data": {
+					"plaintext": "QUJDRA=="
+				}
+			}`))
+			return
+
 		// This call is for listing mounts themselves.
 		case reqURL == "/v1/sys/mounts" && r.Method == "GET":
 			w.WriteHeader(200)
@@ -327,6 +375,32 @@ func defaultEnvironment(t *testing.T) (*Environment, func()) {
 			w.WriteHeader(204)
 			return
 
+		case reqURL == "/v1/sys/mounts/cf/broker-transit" && r.Method == "POST":
+			w.WriteHeader(204)
+			return
+
+		case reqURL == "/v1/sys/mounts/cf/broker-meta" && r.Method == "POST":
+			w.WriteHeader(204)
+			return
+
+		// The quota overrides are stored in the broker's meta backend.
+		case reqURL == "/v1/cf/broker-meta/quotas" && r.Method == "GET":
+			w.WriteHeader(404)
+			return
+
+		case reqURL == "/v1/cf/broker-meta/quotas" && r.Method == "PUT":
+			w.WriteHeader(204)
+			return
+
+		// Operations journal their changes in the meta backend.
+		case reqURL == "/v1/cf/broker-meta/journal?list=true" && r.Method == "GET":
+			w.WriteHeader(404)
+			return
+
+		case strings.HasPrefix(reqURL, "/v1/cf/broker-meta/journal/") && (r.Method == "PUT" || r.Method == "DELETE"):
+			w.WriteHeader(204)
+			return
+
 		case reqURL == "/v1/sys/mounts/cf/instance-id/secret" && r.Method == "POST":
 			w.WriteHeader(204)
 			return
@@ -335,6 +409,10 @@ func defaultEnvironment(t *testing.T) (*Environment, func()) {
 			w.WriteHeader(204)
 			return
 
+		case reqURL == "/v1/sys/mounts/cf/instance-id/apps" && r.Method == "POST":
+			w.WriteHeader(204)
+			return
+
 		case reqURL == "/v1/sys/mounts/cf/organization-guid/secret" && r.Method == "POST":
 			w.WriteHeader(204)
 			return
@@ -351,6 +429,15 @@ func defaultEnvironment(t *testing.T) (*Environment, func()) {
 			w.WriteHeader(204)
 			return
 
+		case reqURL == "/v1/sys/policy/cf-instance-id-app-app-guid" && (r.Method == "PUT" || r.Method == "DELETE"):
+			w.WriteHeader(204)
+			return
+
+		case reqURL == "/v1/sys/capabilities-self" && r.Method == "POST":
+			w.WriteHeader(200)
+			w.Write([]byte(`{"capabilities": ["root"]}`))
+			return
+
 		case reqURL == "/v1/auth/token/lookup-self" && r.Method == "GET":
 			w.WriteHeader(200)
 			w.Write([]byte(`{
@@ -390,27 +477,37 @@ func defaultEnvironment(t *testing.T) (*Environment, func()) {
 			w.Write([]byte(fmt.Sprintf(`{"not_implemented": "%s"}`, b)))
 			return
 		}
-	}))
+	})
+	ts := httptest.NewServer(handler)
 
 	// To mimic main's behavior as closely as possible,
 	// Vault's address is passed to the vaultClient via an env variable.
 	os.Setenv("VAULT_ADDR", ts.URL)
 
-	client, err := api.NewClient(nil)
+	vaultConfig := api.DefaultConfig()
+	if err := vaultConfig.ReadEnvironment(); err != nil {
+		t.Fatal(err)
+	}
+	client, err := newVaultClient(log.New(os.Stdout, "", 0), DefaultClusterName, vaultConfig, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	return &Environment{
 		Context: context.Background(),
+		Handler: handler,
 		Broker: &Broker{
 			log:                log.New(os.Stdout, "", 0),
 			vaultClient:        client,
 			serviceID:          "0654695e-0760-a1d4-1cad-5dd87b75ed99",
 			serviceName:        "hashicorp-vault",
 			serviceDescription: "HashiCorp Vault Service Broker",
-			planName:           "shared",
-			planDescription:    "Secure access to Vault's storage and transit backends",
+			plans: []*Plan{
+				{
+					Name:        "shared",
+					Description: "Secure access to Vault's storage and transit backends",
+				},
+			},
 			vaultAdvertiseAddr: "https://127.0.0.1:8200",
 			vaultRenewToken:    true,
 			instances:          make(map[string]*instanceInfo),
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/hashicorp/vault/api"
+)
+
+const (
+	// DefaultClusterName is the name of the Vault cluster configured by
+	// VAULT_ADDR and VAULT_TOKEN. The broker stores its own state on this
+	// cluster, and instances are placed on it unless a plan or organization is
+	// mapped to another cluster.
+	DefaultClusterName = "default"
+)
+
+// ClusterConfig is the configuration of an additional Vault cluster that
+// instances can be placed on.
+type ClusterConfig struct {
+	// Address is the address the broker uses to talk to the cluster.
+	Address string `json:"address"`
+
+	// AdvertiseAddress is the address given to applications in their
+	// credentials. It defaults to Address.
+	AdvertiseAddress string `json:"advertise_address"`
+
+	// Token authenticates the broker to the cluster. It needs the same
+	// permissions as VAULT_TOKEN.
+	Token string `json:"token"`
+
+	// CACert is the path to a PEM-encoded CA certificate used to verify the
+	// cluster's TLS certificate.
+	CACert string `json:"ca_cert"`
+
+	// TLSSkipVerify disables verification of the cluster's TLS certificate.
+	TLSSkipVerify bool `json:"tls_skip_verify"`
+}
+
+// ClusterConfigs are the additional Vault clusters keyed by name. It is
+// decoded from a JSON object by envconfig.
+type ClusterConfigs map[string]*ClusterConfig
+
+// Decode implements envconfig.Decoder.
+func (c *ClusterConfigs) Decode(value string) error {
+	clusters := make(ClusterConfigs)
+	if err := json.Unmarshal([]byte(value), &clusters); err != nil {
+		return fmt.Errorf("failed to parse clusters: %s", err)
+	}
+	*c = clusters
+	return nil
+}
+
+// Validate checks the cluster configurations and normalizes their addresses.
+func (c ClusterConfigs) Validate() error {
+	for name, config := range c {
+		if name == "" || name == DefaultClusterName {
+			return fmt.Errorf("invalid cluster name %q", name)
+		}
+		if config == nil || config.Address == "" {
+			return fmt.Errorf("missing address for cluster %q", name)
+		}
+		if config.Token == "" {
+			return fmt.Errorf("missing token for cluster %q", name)
+		}
+		if config.AdvertiseAddress == "" {
+			config.AdvertiseAddress = config.Address
+		}
+		config.Address = normalizeAddr(config.Address)
+		config.AdvertiseAddress = normalizeAddr(config.AdvertiseAddress)
+	}
+	return nil
+}
+
+// vaultCluster is a Vault cluster instances can be placed on.
+type vaultCluster struct {
+	name          string
+	client        *api.Client
+	advertiseAddr string
+}
+
+// newVaultClusters creates a client for each configured cluster. Each client
+// retries requests and has its own circuit breaker.
+func newVaultClusters(logger *log.Logger, configs ClusterConfigs, retry *RetryConfig) (map[string]*vaultCluster, error) {
+	clusters := make(map[string]*vaultCluster, len(configs))
+	for name, config := range configs {
+		vaultConfig := api.DefaultConfig()
+		vaultConfig.Address = config.Address
+		if err := vaultConfig.ConfigureTLS(&api.TLSConfig{
+			CACert:   config.CACert,
+			Insecure: config.TLSSkipVerify,
+		}); err != nil {
+			return nil, fmt.Errorf("failed to configure TLS for cluster %q: %s", name, err)
+		}
+
+		client, err := newVaultClient(logger, name, vaultConfig, retry)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create client for cluster %q: %s", name, err)
+		}
+		client.SetToken(config.Token)
+
+		clusters[name] = &vaultCluster{
+			name:          name,
+			client:        client,
+			advertiseAddr: config.AdvertiseAddress,
+		}
+	}
+	return clusters, nil
+}
+
+// cluster returns the cluster with the given name. The empty string and
+// DefaultClusterName refer to the default cluster.
+func (b *Broker) cluster(name string) (*vaultCluster, error) {
+	if name == "" || name == DefaultClusterName {
+		return &vaultCluster{
+			name:          DefaultClusterName,
+			client:        b.vaultClient,
+			advertiseAddr: b.vaultAdvertiseAddr,
+		}, nil
+	}
+
+	c, ok := b.clusters[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown cluster %q", name)
+	}
+	return c, nil
+}
+
+// instanceCluster returns the cluster the instance was placed on. Instances
+// that are not known to the broker are assumed to be on the default cluster.
+func (b *Broker) instanceCluster(instanceID string) (*vaultCluster, error) {
+	b.instancesLock.Lock()
+	instance, ok := b.instances[instanceID]
+	b.instancesLock.Unlock()
+	if !ok {
+		return b.cluster("")
+	}
+	return b.cluster(instance.Cluster)
+}
+
+// selectCluster returns the name of the cluster a new instance should be
+// placed on. A mapping for the organization takes precedence over the cluster
+// of the plan. The empty string means the default cluster.
+func (b *Broker) selectCluster(planID, organizationGUID string) string {
+	if name, ok := b.clusterOrgs[organizationGUID]; ok {
+		return name
+	}
+	if plan := b.plan(planID); plan != nil {
+		return plan.Cluster
+	}
+	return ""
+}
+
+// clusterNames returns the names of the additional clusters in lexical order.
+func (b *Broker) clusterNames() []string {
+	names := make([]string, 0, len(b.clusters))
+	for name := range b.clusters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/pivotal-cf/brokerapi"
+)
+
+// requestRecorder records the method and path of every request before
+// passing it to the wrapped handler.
+type requestRecorder struct {
+	handler http.Handler
+
+	lock     sync.Mutex
+	requests map[string]bool
+}
+
+func (r *requestRecorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.lock.Lock()
+	if r.requests == nil {
+		r.requests = make(map[string]bool)
+	}
+	r.requests[req.Method+" "+req.URL.Path] = true
+	r.lock.Unlock()
+	r.handler.ServeHTTP(w, req)
+}
+
+func (r *requestRecorder) received(request string) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.requests[request]
+}
+
+func TestBroker_Clusters(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	east := &requestRecorder{handler: env.Handler}
+	ts := httptest.NewServer(east)
+	defer ts.Close()
+
+	configs := ClusterConfigs{
+		"east": {
+			Address:          ts.URL,
+			AdvertiseAddress: "https://vault-east.example.com",
+			Token:            "east-token",
+		},
+	}
+	if err := configs.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	clusters, err := newVaultClusters(env.Broker.log, configs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.Broker.clusters = clusters
+	env.Broker.plans = append(env.Broker.plans, &Plan{Name: "east", Cluster: "east"})
+
+	details := brokerapi.ProvisionDetails{
+		PlanID:           env.Broker.serviceID + ".east",
+		SpaceGUID:        env.SpaceGUID,
+		OrganizationGUID: env.OrganizationGUID,
+	}
+	if _, err := env.Broker.Provision(env.Context, env.InstanceID, details, env.Async); err != nil {
+		t.Fatal(err)
+	}
+	if cluster := env.Broker.instances[env.InstanceID].Cluster; cluster != "east" {
+		t.Fatalf("expected east but received %s", cluster)
+	}
+	for _, request := range []string{
+		"PUT /v1/sys/policy/cf-instance-id",
+		"PUT /v1/auth/token/roles/cf-instance-id",
+		"POST /v1/sys/mounts/cf/instance-id/secret",
+	} {
+		if !east.received(request) {
+			t.Fatalf("expected %s on the east cluster", request)
+		}
+	}
+	if east.received("PUT /v1/cf/broker/instance-id") {
+		t.Fatal("expected instance state to be stored on the default cluster")
+	}
+
+	binding, err := env.Broker.Bind(env.Context, env.InstanceID, env.BindingID, brokerapi.BindDetails{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !east.received("POST /v1/auth/token/create/cf-instance-id") {
+		t.Fatal("expected the token to be created on the east cluster")
+	}
+	credentials := binding.Credentials.(map[string]interface{})
+	if credentials["address"] != "https://vault-east.example.com/" {
+		t.Fatalf("expected https://vault-east.example.com/ but received %s", credentials["address"])
+	}
+
+	if err := env.Broker.Unbind(env.Context, env.InstanceID, env.BindingID, brokerapi.UnbindDetails{}); err != nil {
+		t.Fatal(err)
+	}
+	if !east.received("POST /v1/auth/token/revoke-accessor") {
+		t.Fatal("expected the token to be revoked on the east cluster")
+	}
+
+	if _, err := env.Broker.Deprovision(env.Context, env.InstanceID, brokerapi.DeprovisionDetails{}, env.Async); err != nil {
+		t.Fatal(err)
+	}
+	if !east.received("DELETE /v1/sys/policy/cf-instance-id") {
+		t.Fatal("expected the policy to be deleted on the east cluster")
+	}
+}
+
+func TestBroker_SelectCluster(t *testing.T) {
+	b := &Broker{
+		serviceID: "service",
+		plans: []*Plan{
+			{Name: "shared"},
+			{Name: "east", Cluster: "east"},
+		},
+		clusterOrgs: map[string]string{
+			"west-org": "west",
+		},
+	}
+
+	cases := []struct {
+		name   string
+		planID string
+		org    string
+		e      string
+	}{
+		{"default", "service.shared", "org", ""},
+		{"plan", "service.east", "org", "east"},
+		{"org", "service.shared", "west-org", "west"},
+		{"org-overrides-plan", "service.east", "west-org", "west"},
+		{"unknown-plan", "service.unknown", "org", ""},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if r := b.selectCluster(tc.planID, tc.org); r != tc.e {
+				t.Errorf("expected %q but received %q", tc.e, r)
+			}
+		})
+	}
+}
+
+func TestClusterConfigs_Validate(t *testing.T) {
+	cases := []struct {
+		name     string
+		clusters ClusterConfigs
+		err      bool
+	}{
+		{"valid", ClusterConfigs{"east": {Address: "vault-east:8200", Token: "t"}}, false},
+		{"reserved-name", ClusterConfigs{DefaultClusterName: {Address: "vault:8200", Token: "t"}}, true},
+		{"missing-address", ClusterConfigs{"east": {Token: "t"}}, true},
+		{"missing-token", ClusterConfigs{"east": {Address: "vault-east:8200"}}, true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.clusters.Validate()
+			if tc.err && err == nil {
+				t.Fatal("expected error")
+			}
+			if !tc.err && err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
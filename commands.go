@@ -0,0 +1,276 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+// commandFunc is the signature of a subcommand. It receives the remaining
+// command line arguments and returns the process exit code.
+type commandFunc func(logger *log.Logger, args []string) int
+
+// commands are the subcommands of the broker binary. Running the binary
+// without a subcommand starts the broker.
+var commands = map[string]commandFunc{
+	"doctor":         doctorCommand,
+	"export":         exportCommand,
+	"import":         importCommand,
+	"migrate":        migrateCommand,
+	"migrate-prefix": migratePrefixCommand,
+	"rewrap":         rewrapCommand,
+}
+
+// commandBroker returns a broker suitable for running one-off operations from
+// a subcommand. It is configured like the broker itself, from the environment,
+// the *_FILE variables and CONFIG_FILE, so subcommands act on the same Vault
+// clusters, prefixes and plans.
+func commandBroker(logger *log.Logger) (*Broker, error) {
+	config, err := parseConfig()
+	if err != nil {
+		return nil, err
+	}
+	return newBroker(logger, config)
+}
+
+// doctorCommand checks the capabilities and lifetime of the broker's tokens on
+// every cluster, as the broker does when it starts. It exits with an error if
+// the broker would refuse to start.
+func doctorCommand(logger *log.Logger, args []string) int {
+	flags := flag.NewFlagSet("doctor", flag.ContinueOnError)
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+
+	broker, err := commandBroker(logger)
+	if err != nil {
+		logger.Printf("[ERR] failed to create vault api client: %s", err)
+		return 1
+	}
+
+	reports, err := broker.preflight()
+	if err != nil {
+		logger.Printf("[ERR] %s", err)
+		return 1
+	}
+	writePreflight(os.Stdout, reports)
+
+	for _, r := range reports {
+		if r.fatal() {
+			logger.Printf("[ERR] the token of cluster %s lacks required capabilities", r.Cluster)
+			return 1
+		}
+	}
+	return 0
+}
+
+// exportCommand writes the broker state to a versioned archive.
+func exportCommand(logger *log.Logger, args []string) int {
+	var opts exportOptions
+	var output string
+	var all bool
+
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	flags.StringVar(&output, "output", "-", "path to write the archive to, or - for stdout")
+	flags.BoolVar(&opts.Policies, "policies", false, "include the rendered instance policies")
+	flags.BoolVar(&opts.TokenRoles, "token-roles", false, "include the instance token roles")
+	flags.BoolVar(&opts.Mounts, "mounts", false, "include the configuration of the instance mounts")
+	flags.BoolVar(&all, "all", false, "include policies, token roles and mounts")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	if all {
+		opts.Policies, opts.TokenRoles, opts.Mounts = true, true, true
+	}
+
+	broker, err := commandBroker(logger)
+	if err != nil {
+		logger.Printf("[ERR] failed to create vault api client: %s", err)
+		return 1
+	}
+
+	archive, err := broker.exportState(&opts)
+	if err != nil {
+		logger.Printf("[ERR] failed to export state: %s", err)
+		return 1
+	}
+
+	// Close the archive explicitly, since a failed close can lose the end of
+	// the compressed stream.
+	var w io.Writer = os.Stdout
+	var f *os.File
+	if output != "-" {
+		f, err = os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			logger.Printf("[ERR] failed to open %s: %s", output, err)
+			return 1
+		}
+		w = f
+	}
+	if err := writeStateArchive(w, archive); err != nil {
+		logger.Printf("[ERR] failed to write archive: %s", err)
+		if f != nil {
+			f.Close()
+		}
+		return 1
+	}
+	if f != nil {
+		if err := f.Close(); err != nil {
+			logger.Printf("[ERR] failed to close %s: %s", output, err)
+			return 1
+		}
+	}
+
+	logger.Printf("[INFO] exported %d instances", len(archive.Instances))
+	return 0
+}
+
+// importCommand restores the broker state from an archive written by export.
+func importCommand(logger *log.Logger, args []string) int {
+	var dryRun bool
+
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	flags.BoolVar(&dryRun, "dry-run", false, "log the changes without writing them to Vault")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: vault-service-broker import [options] ARCHIVE\n")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 1
+	}
+
+	f, err := os.Open(flags.Arg(0))
+	if err != nil {
+		logger.Printf("[ERR] failed to open %s: %s", flags.Arg(0), err)
+		return 1
+	}
+	defer f.Close()
+
+	archive, err := readStateArchive(f)
+	if err != nil {
+		logger.Printf("[ERR] failed to read archive: %s", err)
+		return 1
+	}
+
+	broker, err := commandBroker(logger)
+	if err != nil {
+		logger.Printf("[ERR] failed to create vault api client: %s", err)
+		return 1
+	}
+
+	if err := broker.importState(archive, dryRun); err != nil {
+		logger.Printf("[ERR] failed to import state: %s", err)
+		return 1
+	}
+
+	logger.Printf("[INFO] imported %d instances", len(archive.Instances))
+	return 0
+}
+
+// migrateCommand upgrades all stored records to the current schema version.
+func migrateCommand(logger *log.Logger, args []string) int {
+	var dryRun bool
+
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	flags.BoolVar(&dryRun, "dry-run", false, "log the changes without writing them to Vault")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+
+	broker, err := commandBroker(logger)
+	if err != nil {
+		logger.Printf("[ERR] failed to create vault api client: %s", err)
+		return 1
+	}
+
+	n, err := broker.migrateState(dryRun)
+	if err != nil {
+		logger.Printf("[ERR] failed to migrate state: %s", err)
+		return 1
+	}
+
+	logger.Printf("[INFO] migrated %d records", n)
+	return 0
+}
+
+// migratePrefixCommand moves the mounts and state of the broker from the
+// current MOUNT_PREFIX to a new prefix, and rewrites the instance policies to
+// match.
+func migratePrefixCommand(logger *log.Logger, args []string) int {
+	var dryRun bool
+	var namePrefix string
+
+	flags := flag.NewFlagSet("migrate-prefix", flag.ContinueOnError)
+	flags.BoolVar(&dryRun, "dry-run", false, "log the changes without writing them to Vault")
+	flags.StringVar(&namePrefix, "name-prefix", "", "new prefix of policy and token role names, defaults to NAME_PREFIX")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: vault-service-broker migrate-prefix [options] PREFIX\n")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 1
+	}
+
+	broker, err := commandBroker(logger)
+	if err != nil {
+		logger.Printf("[ERR] failed to create vault api client: %s", err)
+		return 1
+	}
+	if namePrefix == "" {
+		namePrefix = broker.namePrefix
+	}
+
+	n, err := broker.migratePrefix(strings.Trim(flags.Arg(0), "/"), namePrefix, dryRun)
+	if err != nil {
+		logger.Printf("[ERR] failed to migrate prefix: %s", err)
+		return 1
+	}
+
+	logger.Printf("[INFO] migrated %d instances", n)
+	return 0
+}
+
+// rewrapCommand optionally rotates the broker's transit key and then rewraps
+// the encrypted token of every binding with the latest key version.
+func rewrapCommand(logger *log.Logger, args []string) int {
+	var rotate bool
+
+	flags := flag.NewFlagSet("rewrap", flag.ContinueOnError)
+	flags.BoolVar(&rotate, "rotate", false, "rotate the transit key before rewrapping")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+
+	broker, err := commandBroker(logger)
+	if err != nil {
+		logger.Printf("[ERR] failed to create vault api client: %s", err)
+		return 1
+	}
+
+	if rotate {
+		if err := broker.rotateTransitKey(); err != nil {
+			logger.Printf("[ERR] %s", err)
+			return 1
+		}
+	}
+
+	n, err := broker.rewrapBindings()
+	if err != nil {
+		logger.Printf("[ERR] failed to rewrap bindings: %s", err)
+		return 1
+	}
+
+	logger.Printf("[INFO] rewrapped %d bindings", n)
+	return 0
+}
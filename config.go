@@ -0,0 +1,313 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/hcl"
+	"github.com/hashicorp/hcl/hcl/ast"
+	"github.com/kelseyhightower/envconfig"
+)
+
+// ConfigFileEnv is the environment variable naming the configuration file.
+const ConfigFileEnv = "CONFIG_FILE"
+
+// reloadableSettings are the settings applied when the broker receives SIGHUP.
+// The others are only read when the broker starts.
+var reloadableSettings = map[string]bool{
+	"LOG_LEVEL":              true,
+	"SECURITY_USER_NAME":     true,
+	"SECURITY_USER_PASSWORD": true,
+	"SERVICE_NAME":           true,
+	"SERVICE_DESCRIPTION":    true,
+	"SERVICE_TAGS":           true,
+	"PLAN_NAME":              true,
+	"PLAN_DESCRIPTION":       true,
+	"PLANS":                  true,
+	"QUOTAS":                 true,
+	"SHARE_INSTANCES":        true,
+}
+
+// settings returns the fields of the configuration keyed by the name of their
+// environment variable.
+func (c *Configuration) settings() map[string]reflect.Value {
+	v := reflect.ValueOf(c).Elem()
+	settings := make(map[string]reflect.Value, v.NumField())
+	for i := 0; i < v.NumField(); i++ {
+		if tag := v.Type().Field(i).Tag.Get("envconfig"); tag != "" {
+			settings[strings.ToUpper(tag)] = v.Field(i)
+		}
+	}
+	return settings
+}
+
+// readSecretFiles sets the settings whose value is in the file named by the
+// *_FILE variant of their variable, such as SECURITY_USER_PASSWORD_FILE, so
+// that secrets need not be in the environment.
+func (c *Configuration) readSecretFiles() error {
+	settings := c.settings()
+	for _, name := range sortedSettings(settings) {
+		path := os.Getenv(name + "_FILE")
+		if path == "" {
+			continue
+		}
+		if _, ok := os.LookupEnv(name); ok {
+			return fmt.Errorf("only one of %s and %s_FILE may be set", name, name)
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read %s_FILE: %s", name, err)
+		}
+		if err := setSetting(settings[name], strings.TrimRight(string(data), "\r\n")); err != nil {
+			return fmt.Errorf("invalid %s_FILE: %s", name, err)
+		}
+	}
+	return nil
+}
+
+// readFile sets the settings in the HCL configuration file. Settings are named
+// after their environment variable in lower case. Lists and objects can be
+// given in HCL, or as they are in the environment.
+func (c *Configuration) readFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %s", err)
+	}
+	file, err := hcl.ParseBytes(data)
+	if err != nil {
+		return fmt.Errorf("failed to parse config file %s: %s", path, err)
+	}
+	list, ok := file.Node.(*ast.ObjectList)
+	if !ok {
+		return fmt.Errorf("config file %s is not an object", path)
+	}
+
+	values := hclObject(list)
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	settings := c.settings()
+	for _, key := range keys {
+		field, ok := settings[strings.ToUpper(key)]
+		if !ok {
+			return fmt.Errorf("unknown setting %q in config file %s", key, path)
+		}
+		value, err := settingValue(field, values[key])
+		if err != nil {
+			return fmt.Errorf("invalid %s in config file %s: %s", key, path, err)
+		}
+		if err := setSetting(field, value); err != nil {
+			return fmt.Errorf("invalid %s in config file %s: %s", key, path, err)
+		}
+	}
+	return nil
+}
+
+// restartRequired returns the settings that differ in the other configuration
+// but are not reloaded.
+func (c *Configuration) restartRequired(other *Configuration) []string {
+	settings, others := c.settings(), other.settings()
+	var names []string
+	for _, name := range sortedSettings(settings) {
+		if reloadableSettings[name] {
+			continue
+		}
+		if !reflect.DeepEqual(settings[name].Interface(), others[name].Interface()) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// reloadConfig reads the configuration again and applies the settings that can
+// change while the broker runs. The current configuration is the one the
+// broker started with. Bindings and their renewers are not affected.
+func reloadConfig(current *Configuration, broker *Broker, auth *brokerAuth, logFilter *levelFilter) error {
+	config, err := parseConfig()
+	if err != nil {
+		return err
+	}
+
+	// The plans may only refer to the clusters the broker started with
+	if err := config.Plans.Validate(current.VaultClusters); err != nil {
+		return err
+	}
+
+	for _, name := range current.restartRequired(config) {
+		broker.log.Printf("[WARN] %s changed, restart the broker to apply it", name)
+	}
+	logFilter.SetLevel(config.LogLevel)
+	auth.set(config.credentials())
+	broker.reload(config)
+	return nil
+}
+
+// sortedSettings returns the names of the settings in order.
+func sortedSettings(settings map[string]reflect.Value) []string {
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// settingValue returns the value from the configuration file as it would be
+// given in the environment.
+func settingValue(field reflect.Value, value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", fmt.Errorf("missing value")
+	case string:
+		return v, nil
+	case bool, int64, float64:
+		return fmt.Sprint(v), nil
+	}
+
+	// Lists and maps of strings are given as in envconfig, and everything else
+	// as JSON
+	switch field.Type() {
+	case reflect.TypeOf([]string(nil)):
+		list, ok := value.([]interface{})
+		if !ok {
+			return "", fmt.Errorf("expected a list")
+		}
+		items := make([]string, len(list))
+		for i, item := range list {
+			items[i] = fmt.Sprint(item)
+		}
+		return strings.Join(items, ","), nil
+	case reflect.TypeOf(map[string]string(nil)):
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return "", fmt.Errorf("expected an object")
+		}
+		pairs := make([]string, 0, len(m))
+		for k, v := range m {
+			pairs = append(pairs, fmt.Sprintf("%s:%v", k, v))
+		}
+		sort.Strings(pairs)
+		return strings.Join(pairs, ","), nil
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// setSetting sets the field to the value as envconfig does, for the types of
+// the configuration.
+func setSetting(field reflect.Value, value string) error {
+	if decoder, ok := field.Addr().Interface().(envconfig.Decoder); ok {
+		return decoder.Decode(value)
+	}
+	if _, ok := field.Interface().(time.Duration); ok {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(d))
+		return nil
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Int:
+		i, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(i))
+	case reflect.Slice:
+		field.Set(reflect.ValueOf(strings.Split(value, ",")))
+	case reflect.Map:
+		m := make(map[string]string)
+		for _, pair := range strings.Split(value, ",") {
+			kv := strings.Split(pair, ":")
+			if len(kv) != 2 {
+				return fmt.Errorf("invalid map item: %q", pair)
+			}
+			m[kv[0]] = kv[1]
+		}
+		field.Set(reflect.ValueOf(m))
+	default:
+		return fmt.Errorf("unsupported setting type %s", field.Type())
+	}
+	return nil
+}
+
+// hclObject converts the HCL object into a map. Blocks with several keys,
+// such as `quotas organization { ... }`, are nested, and repeated blocks are
+// merged.
+func hclObject(list *ast.ObjectList) map[string]interface{} {
+	m := make(map[string]interface{})
+	for _, item := range list.Items {
+		value := hclValue(item.Val)
+		for i := len(item.Keys) - 1; i > 0; i-- {
+			value = map[string]interface{}{hclKey(item.Keys[i]): value}
+		}
+		key := hclKey(item.Keys[0])
+		existing, ok1 := m[key].(map[string]interface{})
+		object, ok2 := value.(map[string]interface{})
+		if ok1 && ok2 {
+			mergeObjects(existing, object)
+			continue
+		}
+		m[key] = value
+	}
+	return m
+}
+
+// hclValue converts the HCL value into strings, numbers, booleans, lists and
+// maps.
+func hclValue(node ast.Node) interface{} {
+	switch n := node.(type) {
+	case *ast.LiteralType:
+		return n.Token.Value()
+	case *ast.ListType:
+		list := make([]interface{}, len(n.List))
+		for i, item := range n.List {
+			list[i] = hclValue(item)
+		}
+		return list
+	case *ast.ObjectType:
+		return hclObject(n.List)
+	}
+	return nil
+}
+
+// hclKey returns the name of the key.
+func hclKey(key *ast.ObjectKey) string {
+	return fmt.Sprint(key.Token.Value())
+}
+
+// mergeObjects merges the object into dst, recursively.
+func mergeObjects(dst, object map[string]interface{}) {
+	for k, v := range object {
+		existing, ok1 := dst[k].(map[string]interface{})
+		nested, ok2 := v.(map[string]interface{})
+		if ok1 && ok2 {
+			mergeObjects(existing, nested)
+			continue
+		}
+		dst[k] = v
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"code.cloudfoundry.org/lager"
+)
+
+// requiredEnv sets the settings every configuration needs.
+func requiredEnv() {
+	os.Clearenv()
+	os.Setenv("SECURITY_USER_NAME", "fizz")
+	os.Setenv("SECURITY_USER_PASSWORD", "buzz")
+	os.Setenv("VAULT_TOKEN", "bang")
+}
+
+// tempDir creates a temporary directory and returns it with a func removing
+// it.
+func tempDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "vault-broker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+// writeFile writes the contents to a file in the directory and returns its
+// path.
+func writeFile(t *testing.T, dir, name, contents string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestParseConfigFile(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	requiredEnv()
+	os.Setenv("SERVICE_NAME", "from-env")
+	os.Setenv("PORT", "9000")
+	os.Setenv(ConfigFileEnv, writeFile(t, dir, "broker.hcl", `
+service_name = "from-file"
+service_tags = ["hello", "world"]
+vault_renew = false
+vault_retry_max = 5
+vault_breaker_cooldown = "1m"
+log_level = "info"
+vault_cluster_orgs {
+  org-guid = "default"
+}
+plans = [
+  { name = "shared", description = "Shared" },
+  { name = "small", description = "Small", mounts = { max_lease_ttl = "1h" } },
+]
+quotas organization {
+  instances = 10
+}
+quotas space {
+  instance_bindings = 3
+}
+rate_limits = "{\"bind\": {\"rate\": 2}}"
+`))
+
+	config, err := parseConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The file takes precedence over the environment, which still provides
+	// the settings the file does not set
+	if config.ServiceName != "from-file" {
+		t.Fatalf("expected %s but received %s", "from-file", config.ServiceName)
+	}
+	if config.Port != ":9000" {
+		t.Fatalf("expected %s but received %s", ":9000", config.Port)
+	}
+	if !reflect.DeepEqual(config.ServiceTags, []string{"hello", "world"}) {
+		t.Fatalf("expected [hello world] but received %v", config.ServiceTags)
+	}
+	if config.VaultRenew || config.VaultRetryMax != 5 || config.VaultBreakerCooldown.String() != "1m0s" {
+		t.Fatalf("expected the scalar settings of the file but received %t %d %s",
+			config.VaultRenew, config.VaultRetryMax, config.VaultBreakerCooldown)
+	}
+	if config.LogLevel != "info" {
+		t.Fatalf("expected %s but received %s", "info", config.LogLevel)
+	}
+	if config.VaultClusterOrgs["org-guid"] != DefaultClusterName {
+		t.Fatalf("expected %s but received %v", DefaultClusterName, config.VaultClusterOrgs)
+	}
+	if len(config.Plans) != 2 || config.Plans[1].Mounts == nil {
+		t.Fatalf("expected 2 plans with mount options but received %+v", config.Plans)
+	}
+	if config.Quotas.Organization.Instances != 10 || config.Quotas.Space.InstanceBindings != 3 {
+		t.Fatalf("expected the quotas of the file but received %+v", config.Quotas)
+	}
+	if limit := config.RateLimits["bind"]; limit == nil || limit.Rate != 2 {
+		t.Fatalf("expected a bind rate limit but received %+v", config.RateLimits)
+	}
+}
+
+func TestParseConfigFile_Invalid(t *testing.T) {
+	cases := []struct {
+		name     string
+		contents string
+	}{
+		{"syntax", `service_name = "vault`},
+		{"unknown-setting", `servce_name = "vault"`},
+		{"invalid-value", `vault_retry_max = "many"`},
+		{"invalid-tags", `service_tags = { a = "b" }`},
+		{"invalid-config", `log_level = "loud"`},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir, cleanup := tempDir(t)
+			defer cleanup()
+
+			requiredEnv()
+			os.Setenv(ConfigFileEnv, writeFile(t, dir, "broker.hcl", tc.contents))
+			if _, err := parseConfig(); err == nil {
+				t.Fatal("expected error")
+			}
+		})
+	}
+}
+
+func TestParseConfigSecretFiles(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	requiredEnv()
+	os.Unsetenv("SECURITY_USER_PASSWORD")
+	os.Setenv("SECURITY_USER_PASSWORD_FILE", writeFile(t, dir, "password", "secret\n"))
+	os.Setenv("QUOTAS_FILE", writeFile(t, dir, "quotas", `{"space": {"instances": 2}}`))
+
+	config, err := parseConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.SecurityUserPassword != "secret" {
+		t.Fatalf("expected %q but received %q", "secret", config.SecurityUserPassword)
+	}
+	if config.Quotas.Space.Instances != 2 {
+		t.Fatalf("expected %d but received %d", 2, config.Quotas.Space.Instances)
+	}
+
+	// A setting may not be given both ways
+	os.Setenv("SECURITY_USER_PASSWORD", "buzz")
+	if _, err := parseConfig(); err == nil {
+		t.Fatal("expected error")
+	}
+
+	// The file must exist
+	os.Unsetenv("SECURITY_USER_PASSWORD")
+	os.Setenv("SECURITY_USER_PASSWORD_FILE", filepath.Join(dir, "missing"))
+	if _, err := parseConfig(); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	var logs bytes.Buffer
+	logFilter := newLevelFilter(&logs)
+	env.Broker.log = log.New(logFilter, "", 0)
+
+	requiredEnv()
+	current, err := parseConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := newBrokerAuth(current.credentials())
+	handler := newHandler(env.Broker, lager.NewLogger("test"), auth, nil)
+
+	// Change reloadable and non-reloadable settings
+	os.Setenv(ConfigFileEnv, writeFile(t, dir, "broker.hcl", `
+service_name = "reloaded"
+security_user_password = "rotated"
+log_level = "WARN"
+plans = [{ name = "shared", description = "Shared" }, { name = "large", description = "Large" }]
+quotas organization {
+  instances = 1
+}
+port = "9000"
+`))
+	if err := reloadConfig(current, env.Broker, auth, logFilter); err != nil {
+		t.Fatal(err)
+	}
+
+	// The catalog and quotas are replaced
+	services := env.Broker.Services(env.Context)
+	if services[0].Name != "reloaded" || len(services[0].Plans) != 2 {
+		t.Fatalf("expected the reloaded catalog but received %+v", services[0])
+	}
+	if env.Broker.quota("organizations", env.OrganizationGUID).Instances != 1 {
+		t.Fatalf("expected the reloaded quotas but received %+v", env.Broker.quotas)
+	}
+
+	// The new credentials are required
+	for _, tc := range []struct {
+		password string
+		code     int
+	}{
+		{"buzz", http.StatusUnauthorized},
+		{"rotated", http.StatusOK},
+	} {
+		r := httptest.NewRequest("GET", "/v2/catalog", nil)
+		r.SetBasicAuth("fizz", tc.password)
+		r.Header.Set("X-Broker-API-Version", "2.14")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tc.code {
+			t.Fatalf("expected %d for %s but received %d", tc.code, tc.password, w.Code)
+		}
+	}
+
+	// Settings that need a restart are reported, and the log level applies
+	if !bytes.Contains(logs.Bytes(), []byte("[WARN] PORT changed")) {
+		t.Fatalf("expected PORT to be reported but logged %q", logs.String())
+	}
+	if bytes.Contains(logs.Bytes(), []byte("[INFO] listing services")) {
+		t.Fatalf("expected info lines to be dropped but logged %q", logs.String())
+	}
+
+	// Invalid configurations are not applied
+	os.Setenv(ConfigFileEnv, writeFile(t, dir, "broker.hcl", `service_name = "vault`))
+	if err := reloadConfig(current, env.Broker, auth, logFilter); err == nil {
+		t.Fatal("expected error")
+	}
+	os.Setenv(ConfigFileEnv, writeFile(t, dir, "broker.hcl", `plans = [{ name = "east", cluster = "east" }]`))
+	if err := reloadConfig(current, env.Broker, auth, logFilter); err == nil {
+		t.Fatal("expected error for a cluster the broker did not start with")
+	}
+	if services := env.Broker.Services(env.Context); services[0].Name != "reloaded" {
+		t.Fatalf("expected the catalog to be kept but received %+v", services[0])
+	}
+}
+
+func TestLevelFilter(t *testing.T) {
+	var out bytes.Buffer
+	filter := newLevelFilter(&out)
+	logger := log.New(filter, "", 0)
+
+	filter.SetLevel("warn")
+	logger.Printf("[DEBUG] dropped")
+	logger.Printf("[INFO] dropped")
+	logger.Printf("[WARN] kept")
+	logger.Printf("[ERR] kept")
+	logger.Printf("no level is kept")
+
+	expected := "[WARN] kept\n[ERR] kept\nno level is kept\n"
+	if out.String() != expected {
+		t.Fatalf("expected %q but received %q", expected, out.String())
+	}
+
+	// Unknown levels are ignored
+	filter.SetLevel("loud")
+	logger.Printf("[INFO] dropped")
+	if out.String() != expected {
+		t.Fatalf("expected %q but received %q", expected, out.String())
+	}
+}
+
+func TestCommandBroker_Config(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	// Subcommands read the configuration like the broker
+	requiredEnv()
+	os.Unsetenv("VAULT_TOKEN")
+	os.Setenv("VAULT_TOKEN_FILE", writeFile(t, dir, "token", "from-file\n"))
+	os.Setenv(ConfigFileEnv, writeFile(t, dir, "broker.hcl", `
+mount_prefix = "/vault/"
+name_prefix = "vault"
+plans = [{ name = "shared", description = "Shared" }]
+`))
+
+	b, err := commandBroker(log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.mountPrefix != "vault" || b.namePrefix != "vault" {
+		t.Fatalf("expected the prefixes from the file but received %q and %q", b.mountPrefix, b.namePrefix)
+	}
+	if b.vaultClient.Token() != "from-file" {
+		t.Fatalf("expected the token from the file but received %q", b.vaultClient.Token())
+	}
+	if len(b.plans) != 1 || b.plans[0].Name != "shared" {
+		t.Fatalf("expected the plans from the file but received %v", b.plans)
+	}
+}
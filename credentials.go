@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	// CredentialsFormatDefault is the nested credentials format with the
+	// address, auth, backends and backends_shared keys.
+	CredentialsFormatDefault = "default"
+
+	// CredentialsFormatSpring is a flat credentials format keyed by Spring
+	// Cloud Vault property names.
+	CredentialsFormatSpring = "spring"
+
+	// CredentialsFormatEnv is a flat credentials format keyed by environment
+	// variable names such as VAULT_ADDR and VAULT_TOKEN.
+	CredentialsFormatEnv = "env"
+)
+
+// credentialsFormats are the formats a plan or binding can choose.
+var credentialsFormats = map[string]bool{
+	CredentialsFormatDefault: true,
+	CredentialsFormatSpring:  true,
+	CredentialsFormatEnv:     true,
+}
+
+// validateCredentialsFormat checks the format is known. The empty string means
+// the default format.
+func validateCredentialsFormat(format string) error {
+	if format != "" && !credentialsFormats[format] {
+		return fmt.Errorf("unknown credentials format %q, expected one of %s",
+			format, strings.Join(credentialsFormatNames(), ", "))
+	}
+	return nil
+}
+
+// parseCredentialsFormat returns the credentials format of a binding. The
+// credentials_format bind parameter takes precedence over the format of the
+// plan.
+func parseCredentialsFormat(raw json.RawMessage, plan *Plan) (string, error) {
+	var params struct {
+		CredentialsFormat string `json:"credentials_format"`
+	}
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &params); err != nil {
+			return "", fmt.Errorf("failed to decode parameters: %s", err)
+		}
+	}
+	format := params.CredentialsFormat
+	if format == "" && plan != nil {
+		format = plan.CredentialsFormat
+	}
+	if err := validateCredentialsFormat(format); err != nil {
+		return "", err
+	}
+	if format == "" {
+		format = CredentialsFormatDefault
+	}
+	return format, nil
+}
+
+// springCredentials returns the credentials of the binding keyed by Spring
+// Cloud Vault property names, so they can be bound to the application's
+// configuration as they are. Values without a Spring Cloud Vault property are
+// keyed under "vault.".
+func (b *Broker) springCredentials(cluster *vaultCluster, instanceID string, instance *instanceInfo, info *bindingInfo, token string) map[string]interface{} {
+	credentials := map[string]interface{}{
+		"spring.cloud.vault.uri":             cluster.advertiseAddr,
+		"spring.cloud.vault.authentication":  "TOKEN",
+		"spring.cloud.vault.token":           token,
+		"spring.cloud.vault.generic.backend": b.mountPath(instanceID, "secret"),
+
+		"vault.token-accessor":        info.Accessor,
+		"vault.backends.transit":      b.mountPath(instanceID, "transit"),
+		"vault.backends.transit-keys": strings.Join(b.transitKeyNames(instance), ","),
+	}
+	if info.AppGUID != "" {
+		credentials["vault.backends.app"] = b.mountPath(instanceID, "apps", info.AppGUID)
+	}
+	if !info.Shared {
+		for name, path := range b.sharedBackends(instance) {
+			credentials["vault.backends-shared."+name] = path
+		}
+	}
+	if instance.PKI != nil {
+		credentials["spring.cloud.vault.pki.enabled"] = "true"
+		credentials["spring.cloud.vault.pki.backend"] = b.mountPath(instanceID, "pki")
+		credentials["spring.cloud.vault.pki.role"] = instance.PKI.Role
+		credentials["vault.pki.ca-chain"] = instance.PKI.CAChain
+	}
+	if instance.Database != nil {
+		credentials["spring.cloud.vault.database.enabled"] = "true"
+		credentials["spring.cloud.vault.database.backend"] = b.mountPath(instanceID, "database")
+		credentials["spring.cloud.vault.database.role"] = info.Binding
+	}
+	return credentials
+}
+
+// envCredentials returns the credentials of the binding keyed by environment
+// variable names. VAULT_ADDR and VAULT_TOKEN configure the Vault CLI and most
+// client libraries as they are.
+func (b *Broker) envCredentials(cluster *vaultCluster, instanceID string, instance *instanceInfo, info *bindingInfo, token string) map[string]interface{} {
+	credentials := map[string]interface{}{
+		"VAULT_ADDR":           cluster.advertiseAddr,
+		"VAULT_TOKEN":          token,
+		"VAULT_TOKEN_ACCESSOR": info.Accessor,
+
+		"VAULT_BACKEND_GENERIC":      b.mountPath(instanceID, "secret"),
+		"VAULT_BACKEND_TRANSIT":      b.mountPath(instanceID, "transit"),
+		"VAULT_BACKEND_TRANSIT_KEYS": strings.Join(b.transitKeyNames(instance), ","),
+	}
+	if info.AppGUID != "" {
+		credentials["VAULT_BACKEND_APP"] = b.mountPath(instanceID, "apps", info.AppGUID)
+	}
+	if !info.Shared {
+		for name, path := range b.sharedBackends(instance) {
+			credentials["VAULT_BACKEND_SHARED_"+strings.ToUpper(name)] = path
+		}
+	}
+	if instance.PKI != nil {
+		credentials["VAULT_PKI_ISSUE_PATH"] = b.mountPath(instanceID, "pki", "issue", instance.PKI.Role)
+		credentials["VAULT_PKI_CA_CHAIN"] = instance.PKI.CAChain
+	}
+	if instance.Database != nil {
+		credentials["VAULT_DATABASE_CREDS_PATH"] = b.mountPath(instanceID, "database", "creds", info.Binding)
+	}
+	return credentials
+}
+
+// credentialsFormatNames returns the known formats in order.
+func credentialsFormatNames() []string {
+	names := make([]string, 0, len(credentialsFormats))
+	for name := range credentialsFormats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
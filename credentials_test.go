@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/pivotal-cf/brokerapi"
+)
+
+var updateGolden = flag.Bool("update", false, "update the golden files in testdata")
+
+func TestParseCredentialsFormat(t *testing.T) {
+	cases := []struct {
+		name     string
+		raw      string
+		plan     *Plan
+		expected string
+		err      bool
+	}{
+		{"default", ``, nil, CredentialsFormatDefault, false},
+		{"other-parameters", `{"transit_keys": []}`, nil, CredentialsFormatDefault, false},
+		{"plan", ``, &Plan{CredentialsFormat: CredentialsFormatSpring}, CredentialsFormatSpring, false},
+		{"parameter", `{"credentials_format": "env"}`, nil, CredentialsFormatEnv, false},
+		{"parameter-over-plan", `{"credentials_format": "env"}`, &Plan{CredentialsFormat: CredentialsFormatSpring}, CredentialsFormatEnv, false},
+		{"unknown", `{"credentials_format": "yaml"}`, nil, "", true},
+		{"invalid-json", `{"credentials_format"`, nil, "", true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			format, err := parseCredentialsFormat(json.RawMessage(tc.raw), tc.plan)
+			if (err != nil) != tc.err {
+				t.Fatalf("expected error %t but received %v", tc.err, err)
+			}
+			if format != tc.expected {
+				t.Fatalf("expected %q but received %q", tc.expected, format)
+			}
+		})
+	}
+}
+
+func TestBindingCredentials_Golden(t *testing.T) {
+	b := &Broker{}
+	cluster := &vaultCluster{name: DefaultClusterName, advertiseAddr: "https://vault.company.internal:8200/"}
+	instances := map[string]*instanceInfo{
+		"basic": {
+			OrganizationGUID: "organization-guid",
+			SpaceGUID:        "space-guid",
+		},
+		"full": {
+			OrganizationGUID: "organization-guid",
+			SpaceGUID:        "space-guid",
+			PKI:              &instancePKI{Role: "cf-instance-id", CAChain: "-----BEGIN CERTIFICATE-----"},
+			Database:         &instanceDatabase{},
+			TransitKeys:      []*transitKey{{Name: "orders"}, {Name: "payments"}},
+		},
+	}
+
+	for _, format := range credentialsFormatNames() {
+		for _, name := range []string{"basic", "full"} {
+			t.Run(format+"-"+name, func(t *testing.T) {
+				info := &bindingInfo{Binding: "binding-id", Accessor: "accessor", CredentialsFormat: format}
+				if name == "full" {
+					info.AppGUID = "app-guid"
+				}
+				credentials := b.bindingCredentials(cluster, "instance-id", instances[name], info, "token")
+				actual, err := json.MarshalIndent(credentials, "", "  ")
+				if err != nil {
+					t.Fatal(err)
+				}
+				actual = append(actual, '\n')
+
+				path := filepath.Join("testdata", fmt.Sprintf("credentials-%s-%s.json", format, name))
+				if *updateGolden {
+					if err := ioutil.WriteFile(path, actual, 0644); err != nil {
+						t.Fatal(err)
+					}
+				}
+				expected, err := ioutil.ReadFile(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(actual, expected) {
+					t.Fatalf("expected %s but received %s", expected, actual)
+				}
+			})
+		}
+	}
+}
+
+func TestBroker_Bind_CredentialsFormat(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	details := brokerapi.ProvisionDetails{
+		SpaceGUID:        env.SpaceGUID,
+		OrganizationGUID: env.OrganizationGUID,
+	}
+	if _, err := env.Broker.Provision(env.Context, env.InstanceID, details, env.Async); err != nil {
+		t.Fatal(err)
+	}
+
+	// The format is chosen by the bind parameters
+	binding, err := env.Broker.Bind(env.Context, env.InstanceID, env.BindingID, brokerapi.BindDetails{
+		RawParameters: json.RawMessage(`{"credentials_format": "env"}`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	credentials := binding.Credentials.(map[string]interface{})
+	if credentials["VAULT_TOKEN"] == nil || credentials["VAULT_ADDR"] == nil {
+		t.Fatalf("expected env credentials but received %v", credentials)
+	}
+	if info := env.Broker.binds[env.BindingID]; info.CredentialsFormat != CredentialsFormatEnv {
+		t.Fatalf("expected %s but received %s", CredentialsFormatEnv, info.CredentialsFormat)
+	}
+
+	// Unknown formats are refused
+	_, err = env.Broker.Bind(env.Context, env.InstanceID, "other-binding-id", brokerapi.BindDetails{
+		RawParameters: json.RawMessage(`{"credentials_format": "yaml"}`),
+	})
+	failure, ok := err.(*brokerapi.FailureResponse)
+	if !ok || failure.ValidatedStatusCode(nil) != http.StatusBadRequest {
+		t.Fatalf("expected %d but received %v", http.StatusBadRequest, err)
+	}
+}
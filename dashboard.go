@@ -0,0 +1,659 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/hashicorp/go-cleanhttp"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+const (
+	// DashboardSessionCookie is the name of the cookie holding the dashboard
+	// session.
+	DashboardSessionCookie = "vault-broker-session"
+
+	// DashboardCSRFHeader is the header requests changing data through the
+	// dashboard must carry the CSRF token of the session in.
+	DashboardCSRFHeader = "X-CSRF-Token"
+
+	// DashboardScope is the scope requested from UAA. It allows the broker to
+	// check the user's permissions on an instance.
+	DashboardScope = "openid cloud_controller_service_permissions.read"
+
+	// DashboardPermissionTTL is how long the permissions of a user on an
+	// instance are cached in the session.
+	DashboardPermissionTTL = time.Minute
+
+	// DashboardMaxLogins is the maximum number of sign ins in progress. Once
+	// it is reached, the sign ins closest to expiring are dropped.
+	DashboardMaxLogins = 1000
+)
+
+// DashboardConfig configures the instance dashboard. The dashboard is a client
+// of UAA that signs users in and checks their permissions against the Cloud
+// Controller.
+type DashboardConfig struct {
+	// URL is the external URL of the broker the dashboard is served from.
+	URL string
+
+	// ClientID and ClientSecret are the UAA client registered through the
+	// catalog.
+	ClientID     string
+	ClientSecret string
+
+	// UAAURL and CFAPIURL are the URLs of UAA and the Cloud Controller.
+	UAAURL   string
+	CFAPIURL string
+}
+
+// redirectURI is the URL UAA redirects users to after signing in.
+func (c *DashboardConfig) redirectURI() string {
+	return c.URL + "/dashboard/callback"
+}
+
+// dashboardClient returns the UAA client of the dashboard registered through
+// the catalog, or nil if the dashboard is disabled.
+func (b *Broker) dashboardClient() *brokerapi.ServiceDashboardClient {
+	if b.dashboard == nil {
+		return nil
+	}
+	return &brokerapi.ServiceDashboardClient{
+		ID:          b.dashboard.ClientID,
+		Secret:      b.dashboard.ClientSecret,
+		RedirectURI: b.dashboard.redirectURI(),
+	}
+}
+
+// dashboardURL returns the URL of the dashboard of the instance, or the empty
+// string if the dashboard is disabled.
+func (b *Broker) dashboardURL(instanceID string) string {
+	if b.dashboard == nil {
+		return ""
+	}
+	return b.dashboard.URL + "/dashboard/" + instanceID
+}
+
+// dashboardSession is a user signed in to the dashboard.
+type dashboardSession struct {
+	accessToken string
+	csrfToken   string
+	expires     time.Time
+
+	// permitted caches when the user was last found to be allowed to manage
+	// an instance, keyed by instance ID.
+	permitted map[string]time.Time
+}
+
+// dashboardLogin is a sign in in progress, keyed by its OAuth2 state.
+type dashboardLogin struct {
+	returnTo string
+	expires  time.Time
+}
+
+// dashboardHandler serves the dashboard of each instance. Users are signed in
+// with the authorization code flow of UAA and may only use the dashboard of
+// instances they can manage, which the Cloud Controller allows space developers
+// to do. Sessions are kept in memory, so users sign in again after the broker
+// restarts.
+type dashboardHandler struct {
+	broker *Broker
+	config *DashboardConfig
+	client *http.Client
+	router *mux.Router
+
+	lock     sync.Mutex
+	logins   map[string]*dashboardLogin
+	sessions map[string]*dashboardSession
+}
+
+// newDashboardHandler returns the handler serving the dashboard of the broker.
+func newDashboardHandler(broker *Broker) *dashboardHandler {
+	client := cleanhttp.DefaultClient()
+	client.Timeout = 10 * time.Second
+
+	h := &dashboardHandler{
+		broker:   broker,
+		config:   broker.dashboard,
+		client:   client,
+		logins:   make(map[string]*dashboardLogin),
+		sessions: make(map[string]*dashboardSession),
+	}
+
+	instancePath := "/dashboard/{instance_id}"
+	secretPath := instancePath + "/secret/{path:.*}"
+	transitPath := instancePath + "/transit/{operation:encrypt|decrypt}/{key}"
+
+	h.router = mux.NewRouter()
+	h.router.HandleFunc("/dashboard/callback", h.callback).Methods("GET")
+	h.router.HandleFunc(instancePath, h.authorize(h.index)).Methods("GET")
+	h.router.HandleFunc(secretPath, h.authorize(h.readSecret)).Methods("GET")
+	h.router.HandleFunc(secretPath, h.authorize(h.writeSecret)).Methods("PUT")
+	h.router.HandleFunc(secretPath, h.authorize(h.deleteSecret)).Methods("DELETE")
+	h.router.HandleFunc(instancePath+"/transit/keys", h.authorize(h.listTransitKeys)).Methods("GET")
+	h.router.HandleFunc(transitPath, h.authorize(h.transit)).Methods("POST")
+	return h
+}
+
+func (h *dashboardHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.router.ServeHTTP(w, r)
+}
+
+// authorize wraps a handler of an instance dashboard. Users without a session
+// are sent to UAA to sign in, and users who cannot manage the instance are
+// refused. Requests other than GET must carry the CSRF token of the session.
+// Requests for instances that do not exist are refused before signing in, so
+// they cannot fill up the sign ins in progress.
+func (h *dashboardHandler) authorize(next func(http.ResponseWriter, *http.Request, *dashboardSession)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		instanceID := mux.Vars(r)["instance_id"]
+
+		h.broker.instancesLock.Lock()
+		_, ok := h.broker.instances[instanceID]
+		h.broker.instancesLock.Unlock()
+		if !ok {
+			respondDashboardError(w, http.StatusNotFound, "instance does not exist")
+			return
+		}
+
+		session := h.session(r)
+		if session == nil {
+			if r.Method == "GET" && r.URL.Path == "/dashboard/"+instanceID {
+				h.login(w, r)
+				return
+			}
+			respondDashboardError(w, http.StatusUnauthorized, "not signed in")
+			return
+		}
+
+		if r.Method != "GET" {
+			token := r.Header.Get(DashboardCSRFHeader)
+			if subtle.ConstantTimeCompare([]byte(token), []byte(session.csrfToken)) != 1 {
+				respondDashboardError(w, http.StatusForbidden, "invalid CSRF token")
+				return
+			}
+		}
+
+		permitted, err := h.permitted(session, instanceID)
+		if err != nil {
+			h.broker.log.Printf("[ERR] dashboard (%s): failed to check permissions: %s", instanceID, err)
+			respondDashboardError(w, http.StatusBadGateway, "failed to check permissions")
+			return
+		}
+		if !permitted {
+			respondDashboardError(w, http.StatusForbidden, "not allowed to manage the instance")
+			return
+		}
+
+		next(w, r, session)
+	}
+}
+
+// session returns the unexpired session of the request, if any.
+func (h *dashboardHandler) session(r *http.Request) *dashboardSession {
+	cookie, err := r.Cookie(DashboardSessionCookie)
+	if err != nil {
+		return nil
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	session, ok := h.sessions[cookie.Value]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(session.expires) {
+		delete(h.sessions, cookie.Value)
+		return nil
+	}
+	return session
+}
+
+// login sends the user to UAA to sign in, returning to the current page once
+// they have.
+func (h *dashboardHandler) login(w http.ResponseWriter, r *http.Request) {
+	state, err := randomToken()
+	if err != nil {
+		respondDashboardError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	h.lock.Lock()
+	now := time.Now()
+	for k, login := range h.logins {
+		if now.After(login.expires) {
+			delete(h.logins, k)
+		}
+	}
+	for len(h.logins) >= DashboardMaxLogins {
+		var oldest string
+		for k, login := range h.logins {
+			if oldest == "" || login.expires.Before(h.logins[oldest].expires) {
+				oldest = k
+			}
+		}
+		delete(h.logins, oldest)
+	}
+	h.logins[state] = &dashboardLogin{
+		returnTo: r.URL.Path,
+		expires:  now.Add(10 * time.Minute),
+	}
+	h.lock.Unlock()
+
+	query := url.Values{
+		"response_type": {"code"},
+		"client_id":     {h.config.ClientID},
+		"redirect_uri":  {h.config.redirectURI()},
+		"scope":         {DashboardScope},
+		"state":         {state},
+	}
+	http.Redirect(w, r, h.config.UAAURL+"/oauth/authorize?"+query.Encode(), http.StatusFound)
+}
+
+// callback completes signing in by exchanging the authorization code for an
+// access token and starting a session.
+func (h *dashboardHandler) callback(w http.ResponseWriter, r *http.Request) {
+	state := r.URL.Query().Get("state")
+	h.lock.Lock()
+	login, ok := h.logins[state]
+	delete(h.logins, state)
+	h.lock.Unlock()
+	if !ok || time.Now().After(login.expires) {
+		respondDashboardError(w, http.StatusBadRequest, "unknown or expired login")
+		return
+	}
+
+	// Exchange the code for a token
+	form := url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {r.URL.Query().Get("code")},
+		"redirect_uri": {h.config.redirectURI()},
+	}
+	req, err := http.NewRequest("POST", h.config.UAAURL+"/oauth/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		respondDashboardError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(h.config.ClientID, h.config.ClientSecret)
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := h.do(req, &token); err != nil || token.AccessToken == "" {
+		h.broker.log.Printf("[ERR] dashboard: failed to exchange authorization code: %v", err)
+		respondDashboardError(w, http.StatusBadGateway, "failed to sign in")
+		return
+	}
+
+	// Start the session
+	id, err := randomToken()
+	if err != nil {
+		respondDashboardError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	csrf, err := randomToken()
+	if err != nil {
+		respondDashboardError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	session := &dashboardSession{
+		accessToken: token.AccessToken,
+		csrfToken:   csrf,
+		expires:     time.Now().Add(time.Duration(token.ExpiresIn) * time.Second),
+		permitted:   make(map[string]time.Time),
+	}
+	h.lock.Lock()
+	now := time.Now()
+	for k, s := range h.sessions {
+		if now.After(s.expires) {
+			delete(h.sessions, k)
+		}
+	}
+	h.sessions[id] = session
+	h.lock.Unlock()
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     DashboardSessionCookie,
+		Value:    id,
+		Path:     "/dashboard",
+		Expires:  session.expires,
+		Secure:   strings.HasPrefix(h.config.URL, "https://"),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, login.returnTo, http.StatusFound)
+}
+
+// permitted reports whether the user of the session may manage the instance,
+// asking the Cloud Controller unless a recent answer is cached.
+func (h *dashboardHandler) permitted(session *dashboardSession, instanceID string) (bool, error) {
+	h.lock.Lock()
+	checked, ok := session.permitted[instanceID]
+	h.lock.Unlock()
+	if ok && time.Since(checked) < DashboardPermissionTTL {
+		return true, nil
+	}
+
+	req, err := http.NewRequest("GET", h.config.CFAPIURL+"/v2/service_instances/"+url.PathEscape(instanceID)+"/permissions", nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Authorization", "Bearer "+session.accessToken)
+	req.Header.Set("Accept", "application/json")
+
+	var permissions struct {
+		Manage bool `json:"manage"`
+	}
+	if err := h.do(req, &permissions); err != nil {
+		return false, err
+	}
+	if permissions.Manage {
+		h.lock.Lock()
+		session.permitted[instanceID] = time.Now()
+		h.lock.Unlock()
+	}
+	return permissions.Manage, nil
+}
+
+// do performs the request against UAA or the Cloud Controller and decodes the
+// JSON response into out.
+func (h *dashboardHandler) do(req *http.Request, out interface{}) error {
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s returned status %d", req.Method, req.URL.Path, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (h *dashboardHandler) index(w http.ResponseWriter, r *http.Request, session *dashboardSession) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	dashboardTemplate.Execute(w, map[string]string{
+		"InstanceID": mux.Vars(r)["instance_id"],
+		"CSRFToken":  session.csrfToken,
+	})
+}
+
+// readSecret reads a secret from the generic backend of the instance, or lists
+// the secrets under a path ending in a slash.
+func (h *dashboardHandler) readSecret(w http.ResponseWriter, r *http.Request, session *dashboardSession) {
+	vars := mux.Vars(r)
+	cluster, err := h.broker.instanceCluster(vars["instance_id"])
+	if err != nil {
+		respondDashboardError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	path := h.broker.mountPath(vars["instance_id"], "secret", vars["path"])
+
+	if vars["path"] == "" || strings.HasSuffix(vars["path"], "/") {
+		secret, err := cluster.client.Logical().List(strings.TrimSuffix(path, "/"))
+		if err != nil {
+			respondDashboardError(w, http.StatusBadGateway, err.Error())
+			return
+		}
+		keys := []interface{}{}
+		if secret != nil {
+			if listed, ok := secret.Data["keys"].([]interface{}); ok {
+				keys = listed
+			}
+		}
+		respondJSON(w, http.StatusOK, map[string]interface{}{"keys": keys})
+		return
+	}
+
+	secret, err := cluster.client.Logical().Read(path)
+	if err != nil {
+		respondDashboardError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	if secret == nil {
+		respondDashboardError(w, http.StatusNotFound, "secret does not exist")
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{"data": secret.Data})
+}
+
+// writeSecret writes the JSON object in the body of the request as a secret to
+// the generic backend of the instance.
+func (h *dashboardHandler) writeSecret(w http.ResponseWriter, r *http.Request, session *dashboardSession) {
+	vars := mux.Vars(r)
+	if vars["path"] == "" || strings.HasSuffix(vars["path"], "/") {
+		respondDashboardError(w, http.StatusBadRequest, "missing secret name")
+		return
+	}
+	var data map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		respondDashboardError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	cluster, err := h.broker.instanceCluster(vars["instance_id"])
+	if err != nil {
+		respondDashboardError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	path := h.broker.mountPath(vars["instance_id"], "secret", vars["path"])
+	if _, err := cluster.client.Logical().Write(path, data); err != nil {
+		respondDashboardError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteSecret deletes a secret from the generic backend of the instance.
+func (h *dashboardHandler) deleteSecret(w http.ResponseWriter, r *http.Request, session *dashboardSession) {
+	vars := mux.Vars(r)
+	cluster, err := h.broker.instanceCluster(vars["instance_id"])
+	if err != nil {
+		respondDashboardError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	path := h.broker.mountPath(vars["instance_id"], "secret", vars["path"])
+	if _, err := cluster.client.Logical().Delete(path); err != nil {
+		respondDashboardError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listTransitKeys lists the keys of the transit backend of the instance.
+func (h *dashboardHandler) listTransitKeys(w http.ResponseWriter, r *http.Request, session *dashboardSession) {
+	vars := mux.Vars(r)
+	cluster, err := h.broker.instanceCluster(vars["instance_id"])
+	if err != nil {
+		respondDashboardError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	secret, err := cluster.client.Logical().List(h.broker.mountPath(vars["instance_id"], "transit", "keys"))
+	if err != nil {
+		respondDashboardError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	keys := []interface{}{}
+	if secret != nil {
+		if listed, ok := secret.Data["keys"].([]interface{}); ok {
+			keys = listed
+		}
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{"keys": keys})
+}
+
+// transit encrypts or decrypts the body of the request with a key of the
+// transit backend of the instance.
+func (h *dashboardHandler) transit(w http.ResponseWriter, r *http.Request, session *dashboardSession) {
+	vars := mux.Vars(r)
+	var data map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		respondDashboardError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	cluster, err := h.broker.instanceCluster(vars["instance_id"])
+	if err != nil {
+		respondDashboardError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	path := h.broker.mountPath(vars["instance_id"], "transit", vars["operation"], vars["key"])
+	secret, err := cluster.client.Logical().Write(path, data)
+	if err != nil {
+		respondDashboardError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	result := map[string]interface{}{}
+	if secret != nil {
+		result = secret.Data
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{"data": result})
+}
+
+// respondDashboardError writes the error message as a JSON response.
+func respondDashboardError(w http.ResponseWriter, status int, message string) {
+	respondJSON(w, status, brokerapi.ErrorResponse{Description: message})
+}
+
+// randomToken returns 32 random bytes, hex encoded.
+func randomToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// dashboardTemplate is the page of an instance dashboard. It browses and edits
+// the secrets of the instance and encrypts and decrypts with its transit keys
+// through the JSON endpoints next to it.
+var dashboardTemplate = template.Must(template.New("dashboard").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Vault - {{ .InstanceID }}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+textarea { width: 100%; height: 8em; font-family: monospace; }
+li a { cursor: pointer; }
+</style>
+</head>
+<body>
+<h1>Vault instance {{ .InstanceID }}</h1>
+
+<h2>Secrets</h2>
+<p>Path: <input id="path" value=""> <button onclick="list()">List</button></p>
+<ul id="keys"></ul>
+<p>Secret: <input id="name"> <button onclick="read()">Read</button>
+<button onclick="write()">Save</button> <button onclick="remove()">Delete</button></p>
+<textarea id="secret">{}</textarea>
+
+<h2>Transit</h2>
+<p>Key: <select id="key"></select>
+<button onclick="transit('encrypt', 'plaintext', btoa(document.getElementById('input').value))">Encrypt</button>
+<button onclick="transit('decrypt', 'ciphertext', document.getElementById('input').value)">Decrypt</button></p>
+<textarea id="input"></textarea>
+<pre id="output"></pre>
+
+<p id="error" style="color: red"></p>
+
+<script>
+var base = "/dashboard/{{ .InstanceID }}";
+var csrf = "{{ .CSRFToken }}";
+
+function call(method, path, body) {
+  document.getElementById("error").textContent = "";
+  var opts = {method: method, credentials: "same-origin", headers: {"X-CSRF-Token": csrf}};
+  if (body !== undefined) {
+    opts.body = JSON.stringify(body);
+    opts.headers["Content-Type"] = "application/json";
+  }
+  return fetch(base + path, opts).then(function(resp) {
+    if (resp.status === 204) { return {}; }
+    return resp.json().then(function(data) {
+      if (!resp.ok) { throw new Error(data.description); }
+      return data;
+    });
+  }).catch(function(err) {
+    document.getElementById("error").textContent = err.message;
+    throw err;
+  });
+}
+
+function list() {
+  var path = document.getElementById("path").value;
+  if (path && path.slice(-1) !== "/") { path += "/"; }
+  call("GET", "/secret/" + path).then(function(data) {
+    var ul = document.getElementById("keys");
+    ul.innerHTML = "";
+    data.keys.forEach(function(key) {
+      var a = document.createElement("a");
+      a.textContent = key;
+      a.onclick = function() {
+        if (key.slice(-1) === "/") {
+          document.getElementById("path").value = path + key;
+          list();
+        } else {
+          document.getElementById("name").value = path + key;
+          read();
+        }
+      };
+      var li = document.createElement("li");
+      li.appendChild(a);
+      ul.appendChild(li);
+    });
+  });
+}
+
+function read() {
+  call("GET", "/secret/" + document.getElementById("name").value).then(function(data) {
+    document.getElementById("secret").value = JSON.stringify(data.data, null, 2);
+  });
+}
+
+function write() {
+  var data = JSON.parse(document.getElementById("secret").value);
+  call("PUT", "/secret/" + document.getElementById("name").value, data).then(list);
+}
+
+function remove() {
+  call("DELETE", "/secret/" + document.getElementById("name").value).then(list);
+}
+
+function transit(operation, field, value) {
+  var body = {};
+  body[field] = value;
+  var key = encodeURIComponent(document.getElementById("key").value);
+  call("POST", "/transit/" + operation + "/" + key, body).then(function(data) {
+    var out = data.data.ciphertext || atob(data.data.plaintext || "");
+    document.getElementById("output").textContent = out;
+  });
+}
+
+call("GET", "/transit/keys").then(function(data) {
+  var select = document.getElementById("key");
+  data.keys.forEach(function(key) {
+    var option = document.createElement("option");
+    option.textContent = key;
+    select.appendChild(option);
+  });
+});
+list();
+</script>
+</body>
+</html>
+`))
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+// dashboardEnvironment starts stand-ins for UAA and the Cloud Controller and
+// enables the dashboard of the broker against them. UAA exchanges the code
+// "developer-code" for a token of a user who can manage every instance, and
+// "auditor-code" for one who cannot.
+func dashboardEnvironment(t *testing.T, env *Environment) func() {
+	uaa := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/oauth/token" || r.Method != "POST" {
+			w.WriteHeader(404)
+			return
+		}
+		if id, secret, ok := r.BasicAuth(); !ok || id != "vault-dashboard" || secret != "dashboard-secret" {
+			w.WriteHeader(401)
+			return
+		}
+		r.ParseForm()
+		if r.Form.Get("redirect_uri") != "https://broker.example.com/dashboard/callback" {
+			w.WriteHeader(400)
+			return
+		}
+		switch r.Form.Get("code") {
+		case "developer-code":
+			w.Write([]byte(`{"access_token": "developer-token", "expires_in": 3600}`))
+		case "auditor-code":
+			w.Write([]byte(`{"access_token": "auditor-token", "expires_in": 3600}`))
+		default:
+			w.WriteHeader(400)
+		}
+	}))
+
+	cc := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/service_instances/"+env.InstanceID+"/permissions" {
+			w.WriteHeader(404)
+			return
+		}
+		switch r.Header.Get("Authorization") {
+		case "Bearer developer-token":
+			w.Write([]byte(`{"manage": true, "read": true}`))
+		case "Bearer auditor-token":
+			w.Write([]byte(`{"manage": false, "read": true}`))
+		default:
+			w.WriteHeader(401)
+		}
+	}))
+
+	env.Broker.dashboard = &DashboardConfig{
+		URL:          "https://broker.example.com",
+		ClientID:     "vault-dashboard",
+		ClientSecret: "dashboard-secret",
+		UAAURL:       uaa.URL,
+		CFAPIURL:     cc.URL,
+	}
+	return func() {
+		uaa.Close()
+		cc.Close()
+	}
+}
+
+// signInDashboard signs in to the dashboard of the instance with the code and
+// returns the session cookie.
+func signInDashboard(t *testing.T, handler http.Handler, instanceID, code string) *http.Cookie {
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/dashboard/"+instanceID, nil))
+	if w.Code != http.StatusFound {
+		t.Fatalf("expected redirect to UAA but received %d", w.Code)
+	}
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if location.Path != "/oauth/authorize" || location.Query().Get("client_id") != "vault-dashboard" {
+		t.Fatalf("unexpected redirect %s", location)
+	}
+
+	w = httptest.NewRecorder()
+	query := url.Values{"code": {code}, "state": {location.Query().Get("state")}}
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/dashboard/callback?"+query.Encode(), nil))
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/dashboard/"+instanceID {
+		t.Fatalf("expected redirect to the dashboard but received %d %s", w.Code, w.Header().Get("Location"))
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != DashboardSessionCookie || !cookies[0].HttpOnly {
+		t.Fatalf("unexpected cookies %v", cookies)
+	}
+	return cookies[0]
+}
+
+func TestDashboard(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+	defer dashboardEnvironment(t, env)()
+
+	var secret map[string]interface{}
+	vault := &requestRecorder{handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/v1/cf/instance-id/secret/db" && r.Method == "PUT":
+			json.NewDecoder(r.Body).Decode(&secret)
+			w.WriteHeader(204)
+		case r.URL.Path == "/v1/cf/instance-id/secret/db" && r.Method == "GET":
+			w.Write([]byte(`{"data": {"password": "hunter2"}}`))
+		default:
+			env.Handler.ServeHTTP(w, r)
+		}
+	})}
+	ts := httptest.NewServer(vault)
+	defer ts.Close()
+	if err := env.Broker.vaultClient.SetAddress(ts.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	details := brokerapi.ProvisionDetails{
+		SpaceGUID:        env.SpaceGUID,
+		OrganizationGUID: env.OrganizationGUID,
+	}
+	spec, err := env.Broker.Provision(env.Context, env.InstanceID, details, env.Async)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spec.DashboardURL != "https://broker.example.com/dashboard/instance-id" {
+		t.Fatalf("expected https://broker.example.com/dashboard/instance-id but received %q", spec.DashboardURL)
+	}
+
+	handler := newHandler(env.Broker, lager.NewLogger("test"), newBrokerAuth(brokerapi.BrokerCredentials{Username: "user", Password: "pass"}), nil)
+
+	// The API refuses requests without a session instead of redirecting
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/dashboard/instance-id/secret/db", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 but received %d", w.Code)
+	}
+
+	// Space developers can use the dashboard
+	cookie := signInDashboard(t, handler, env.InstanceID, "developer-code")
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/dashboard/instance-id", nil)
+	r.AddCookie(cookie)
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200 but received %d: %s", w.Code, w.Body)
+	}
+	match := regexp.MustCompile(`var csrf = "([0-9a-f]+)"`).FindStringSubmatch(w.Body.String())
+	if match == nil {
+		t.Fatalf("expected a CSRF token in %s", w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "/dashboard/instance-id/secret/db", nil)
+	r.AddCookie(cookie)
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "hunter2") {
+		t.Fatalf("expected the secret but received %d: %s", w.Code, w.Body)
+	}
+
+	// Writes require the CSRF token
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("PUT", "/dashboard/instance-id/secret/db", strings.NewReader(`{"password": "changed"}`))
+	r.AddCookie(cookie)
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 but received %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("PUT", "/dashboard/instance-id/secret/db", strings.NewReader(`{"password": "changed"}`))
+	r.AddCookie(cookie)
+	r.Header.Set(DashboardCSRFHeader, match[1])
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204 but received %d: %s", w.Code, w.Body)
+	}
+	if secret["password"] != "changed" {
+		t.Fatalf("expected the secret to be written but received %v", secret)
+	}
+
+	// Users who cannot manage the instance are refused
+	cookie = signInDashboard(t, handler, env.InstanceID, "auditor-code")
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "/dashboard/instance-id/secret/db", nil)
+	r.AddCookie(cookie)
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 but received %d", w.Code)
+	}
+
+	// The broker API still requires the broker credentials
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/v2/catalog", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 but received %d", w.Code)
+	}
+
+	var catalog struct {
+		Services []struct {
+			DashboardClient *brokerapi.ServiceDashboardClient `json:"dashboard_client"`
+		} `json:"services"`
+	}
+	serveBroker(t, env, "GET", "/v2/catalog", "", &catalog)
+	client := catalog.Services[0].DashboardClient
+	if client == nil || client.ID != "vault-dashboard" || client.RedirectURI != "https://broker.example.com/dashboard/callback" {
+		t.Fatalf("unexpected dashboard client %+v", client)
+	}
+}
+
+func TestDashboard_UnknownState(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+	defer dashboardEnvironment(t, env)()
+
+	handler := newHandler(env.Broker, lager.NewLogger("test"), newBrokerAuth(brokerapi.BrokerCredentials{Username: "user", Password: "pass"}), nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/dashboard/callback?code=developer-code&state=forged", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 but received %d", w.Code)
+	}
+	if len(w.Result().Cookies()) != 0 {
+		t.Fatal("expected no session")
+	}
+}
+
+func TestDashboard_Logins(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+	defer dashboardEnvironment(t, env)()
+
+	h := newDashboardHandler(env.Broker)
+
+	// Instances that do not exist are refused before signing in
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/dashboard/unknown", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 but received %d", w.Code)
+	}
+	if len(h.logins) != 0 {
+		t.Fatalf("expected no sign ins but received %d", len(h.logins))
+	}
+
+	// Sign ins in progress are capped, dropping the ones closest to expiring
+	env.Broker.instances[env.InstanceID] = &instanceInfo{}
+	for i := 0; i < DashboardMaxLogins+10; i++ {
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/dashboard/"+env.InstanceID, nil))
+		if w.Code != http.StatusFound {
+			t.Fatalf("expected 302 but received %d", w.Code)
+		}
+	}
+	if len(h.logins) != DashboardMaxLogins {
+		t.Fatalf("expected %d sign ins but received %d", DashboardMaxLogins, len(h.logins))
+	}
+
+	// The latest sign in is kept
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := h.logins[location.Query().Get("state")]; !ok {
+		t.Fatal("expected the latest sign in to be kept")
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/pkg/errors"
+)
+
+const (
+	// DatabaseConnectionName is the name of the connection configured in the
+	// database backend of an instance.
+	DatabaseConnectionName = "default"
+)
+
+// databaseParameters describe the database connection given in the provision
+// parameters. The username and password are the root credentials Vault uses
+// to create the users of the bindings.
+type databaseParameters struct {
+	PluginName    string `json:"plugin_name"`
+	ConnectionURL string `json:"connection_url"`
+	Username      string `json:"username"`
+	Password      string `json:"password"`
+
+	CreationStatements   []string `json:"creation_statements"`
+	RevocationStatements []string `json:"revocation_statements,omitempty"`
+	DefaultTTL           string   `json:"default_ttl,omitempty"`
+	MaxTTL               string   `json:"max_ttl,omitempty"`
+}
+
+// parseDatabaseParameters decodes the database connection from the provision
+// parameters. It returns nil if the parameters do not describe one.
+func parseDatabaseParameters(raw json.RawMessage) (*databaseParameters, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	var params struct {
+		Database *databaseParameters `json:"database"`
+	}
+	if err := json.Unmarshal(raw, &params); err != nil {
+		return nil, fmt.Errorf("failed to decode parameters: %s", err)
+	}
+	db := params.Database
+	if db == nil {
+		return nil, nil
+	}
+
+	switch {
+	case db.PluginName == "":
+		return nil, fmt.Errorf("missing database.plugin_name parameter")
+	case db.ConnectionURL == "":
+		return nil, fmt.Errorf("missing database.connection_url parameter")
+	case len(db.CreationStatements) == 0:
+		return nil, fmt.Errorf("missing database.creation_statements parameter")
+	}
+	return db, nil
+}
+
+// redactParameters removes the database password from the provision
+// parameters so it is not stored with the instance.
+func redactParameters(raw json.RawMessage) (json.RawMessage, error) {
+	if len(raw) == 0 {
+		return raw, nil
+	}
+	var params map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &params); err != nil {
+		return nil, err
+	}
+	var db map[string]json.RawMessage
+	if err := json.Unmarshal(params["database"], &db); err != nil {
+		return raw, nil
+	}
+	if _, ok := db["password"]; !ok {
+		return raw, nil
+	}
+	delete(db, "password")
+
+	redacted, err := json.Marshal(db)
+	if err != nil {
+		return nil, err
+	}
+	params["database"] = redacted
+	return json.Marshal(params)
+}
+
+// instanceDatabase is the database backend of an instance. It holds the
+// settings of the roles created for each binding.
+type instanceDatabase struct {
+	CreationStatements   []string
+	RevocationStatements []string `json:",omitempty"`
+	DefaultTTL           string   `json:",omitempty"`
+	MaxTTL               string   `json:",omitempty"`
+}
+
+// provisionDatabase mounts the database backend of the instance and configures
+// the connection to the database.
+func (b *Broker) provisionDatabase(client *api.Client, instanceID string, params *databaseParameters, event *AuditEvent) (*instanceDatabase, error) {
+	mount := b.mountPath(instanceID, "database")
+
+	// Mount the backend
+	mounts := map[string]string{"/" + mount: "database"}
+	b.log.Printf("[DEBUG] creating mounts %s", mapToKV(mounts, ", "))
+	if err := b.idempotentMount(client, mounts, nil); err != nil {
+		return nil, errors.Wrapf(err, "failed to create mount %s", mount)
+	}
+	event.addArtifact("mount", "/"+mount)
+
+	// Configure the connection
+	path := mount + "/config/" + DatabaseConnectionName
+	b.log.Printf("[DEBUG] configuring database connection %s", path)
+	if _, err := client.Logical().Write(path, map[string]interface{}{
+		"plugin_name":    params.PluginName,
+		"connection_url": params.ConnectionURL,
+		"username":       params.Username,
+		"password":       params.Password,
+		"allowed_roles":  "*",
+	}); err != nil {
+		return nil, errors.Wrapf(err, "failed to configure database connection %s", path)
+	}
+	event.addArtifact("database_connection", path)
+
+	return &instanceDatabase{
+		CreationStatements:   params.CreationStatements,
+		RevocationStatements: params.RevocationStatements,
+		DefaultTTL:           params.DefaultTTL,
+		MaxTTL:               params.MaxTTL,
+	}, nil
+}
+
+// createDatabaseRole creates the role of the binding in the database backend
+// of the instance.
+func (b *Broker) createDatabaseRole(client *api.Client, instanceID, bindingID string, db *instanceDatabase) error {
+	path := b.mountPath(instanceID, "database", "roles", bindingID)
+	b.log.Printf("[DEBUG] creating database role %s", path)
+	data := map[string]interface{}{
+		"db_name":             DatabaseConnectionName,
+		"creation_statements": strings.Join(db.CreationStatements, ";"),
+	}
+	if len(db.RevocationStatements) > 0 {
+		data["revocation_statements"] = strings.Join(db.RevocationStatements, ";")
+	}
+	if db.DefaultTTL != "" {
+		data["default_ttl"] = db.DefaultTTL
+	}
+	if db.MaxTTL != "" {
+		data["max_ttl"] = db.MaxTTL
+	}
+	if _, err := client.Logical().Write(path, data); err != nil {
+		return errors.Wrapf(err, "failed to create database role %s", path)
+	}
+	return nil
+}
+
+// deleteDatabaseRole revokes the leases of the credentials created for the
+// binding and deletes its role.
+func (b *Broker) deleteDatabaseRole(client *api.Client, instanceID, bindingID string) error {
+	prefix := b.mountPath(instanceID, "database", "creds", bindingID)
+	b.log.Printf("[DEBUG] revoking leases under %s", prefix)
+	if err := client.Sys().RevokePrefix(prefix); err != nil {
+		return errors.Wrapf(err, "failed to revoke leases under %s", prefix)
+	}
+
+	path := b.mountPath(instanceID, "database", "roles", bindingID)
+	b.log.Printf("[DEBUG] deleting database role %s", path)
+	if _, err := client.Logical().Delete(path); err != nil {
+		return errors.Wrapf(err, "failed to delete database role %s", path)
+	}
+	return nil
+}
+
+// bindingResourceName returns the name of the policy and token role granting a
+// binding the credentials of its database role.
+func (b *Broker) bindingResourceName(instanceID, bindingID string) string {
+	return b.resourceName(instanceID) + "-binding-" + bindingID
+}
+
+// databasePolicy renders the policy granting a binding the credentials of its
+// database role. The policies of the instance deny the whole database
+// backend, so no binding can read the credentials of another.
+func (b *Broker) databasePolicy(instanceID, bindingID string) (string, error) {
+	var buf bytes.Buffer
+	if err := GenerateDatabasePolicy(&buf, &ServicePolicyTemplateInput{
+		Prefix:    b.mountPath(),
+		ServiceID: instanceID,
+		BindingID: bindingID,
+	}); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// bindingRole returns the token role of a binding with a database role. Its
+// token also has the instance's policy, or its shared policy, and the policy
+// of the binding's application if it has one.
+func (b *Broker) bindingRole(instanceID, bindingID, appGUID string) map[string]interface{} {
+	policies := []string{
+		b.resourceName(instanceID),
+		b.sharedResourceName(instanceID),
+	}
+	if appGUID != "" {
+		policies = append(policies, b.appResourceName(instanceID, appGUID))
+	}
+	policies = append(policies, b.bindingResourceName(instanceID, bindingID))
+	return map[string]interface{}{
+		"allowed_policies": strings.Join(policies, ","),
+		"period":           VaultPeriodicTTL,
+		"renewable":        true,
+	}
+}
+
+// createBindingRole writes the policy and token role of a binding with a
+// database role.
+func (b *Broker) createBindingRole(client *api.Client, instanceID, bindingID, appGUID string, event *AuditEvent) error {
+	name := b.bindingResourceName(instanceID, bindingID)
+	rules, err := b.databasePolicy(instanceID, bindingID)
+	if err != nil {
+		return errors.Wrapf(err, "failed to generate policy for %s", name)
+	}
+
+	b.log.Printf("[DEBUG] writing binding policy %s", name)
+	if err := client.Sys().PutPolicy(name, rules); err != nil {
+		return err
+	}
+	event.addArtifact("policy", name)
+
+	path := "/auth/token/roles/" + name
+	b.log.Printf("[DEBUG] writing binding token role %s", path)
+	if _, err := client.Logical().Write(path, b.bindingRole(instanceID, bindingID, appGUID)); err != nil {
+		return err
+	}
+	event.addArtifact("token_role", path)
+	return nil
+}
+
+// deleteBindingRole deletes the policy and token role of a binding with a
+// database role.
+func (b *Broker) deleteBindingRole(client *api.Client, instanceID, bindingID string) error {
+	name := b.bindingResourceName(instanceID, bindingID)
+
+	path := "/auth/token/roles/" + name
+	b.log.Printf("[DEBUG] deleting binding token role %s", path)
+	if _, err := client.Logical().Delete(path); err != nil {
+		return errors.Wrapf(err, "failed to delete token role %s", path)
+	}
+
+	b.log.Printf("[DEBUG] deleting binding policy %s", name)
+	if err := client.Sys().DeletePolicy(name); err != nil {
+		return errors.Wrapf(err, "failed to delete policy %s", name)
+	}
+	return nil
+}
+
+// databaseCredentials returns the database credentials given to the
+// application of the binding.
+func (b *Broker) databaseCredentials(instanceID, bindingID string) map[string]interface{} {
+	return map[string]interface{}{
+		"creds_path": b.mountPath(instanceID, "database", "creds", bindingID),
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/pivotal-cf/brokerapi"
+)
+
+func TestParseDatabaseParameters(t *testing.T) {
+	cases := []struct {
+		name   string
+		params string
+		db     bool
+		err    bool
+	}{
+		{"none", ``, false, false},
+		{"other", `{"pki": {}}`, false, false},
+		{
+			"complete",
+			`{"database": {"plugin_name": "postgresql-database-plugin", "connection_url": "postgresql://{{username}}:{{password}}@db:5432/app", "creation_statements": ["CREATE ROLE \"{{name}}\""]}}`,
+			true,
+			false,
+		},
+		{"missing-plugin", `{"database": {"connection_url": "db", "creation_statements": ["CREATE"]}}`, false, true},
+		{"missing-url", `{"database": {"plugin_name": "p", "creation_statements": ["CREATE"]}}`, false, true},
+		{"missing-statements", `{"database": {"plugin_name": "p", "connection_url": "db"}}`, false, true},
+		{"bad-json", `{"database": `, false, true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			db, err := parseDatabaseParameters(json.RawMessage(tc.params))
+			if tc.err {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (db != nil) != tc.db {
+				t.Fatalf("expected database %t but received %+v", tc.db, db)
+			}
+		})
+	}
+}
+
+func TestRedactParameters(t *testing.T) {
+	raw := json.RawMessage(`{"database": {"username": "root", "password": "secret"}, "other": 1}`)
+	redacted, err := redactParameters(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(redacted), "secret") {
+		t.Fatalf("expected password to be removed but received %s", redacted)
+	}
+	if !strings.Contains(string(redacted), `"username":"root"`) || !strings.Contains(string(redacted), `"other":1`) {
+		t.Fatalf("expected other parameters to be kept but received %s", redacted)
+	}
+
+	raw = json.RawMessage(`{"other": 1}`)
+	if redacted, err := redactParameters(raw); err != nil || string(redacted) != string(raw) {
+		t.Fatalf("expected %s but received %s (%v)", raw, redacted, err)
+	}
+}
+
+func TestBroker_Database(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	var config, role, instance, token map[string]interface{}
+	var policy string
+	vault := &requestRecorder{handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/sys/policy/cf-instance-id-binding-binding-id",
+			"/v1/auth/token/roles/cf-instance-id-binding-binding-id":
+			if r.Method == "PUT" && strings.HasPrefix(r.URL.Path, "/v1/sys/policy/") {
+				var body struct {
+					Rules string `json:"rules"`
+				}
+				json.NewDecoder(r.Body).Decode(&body)
+				policy = body.Rules
+			}
+			w.WriteHeader(204)
+		case "/v1/auth/token/create/cf-instance-id-binding-binding-id":
+			body, _ := ioutil.ReadAll(r.Body)
+			json.Unmarshal(body, &token)
+			r.URL.Path = "/v1/auth/token/create/cf-instance-id"
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+			env.Handler.ServeHTTP(w, r)
+		case "/v1/sys/mounts/cf/instance-id/database",
+			"/v1/sys/revoke-prefix/cf/instance-id/database/creds/binding-id",
+			"/v1/cf/instance-id/database/roles/binding-id":
+			if r.Method == "PUT" {
+				json.NewDecoder(r.Body).Decode(&role)
+			}
+			w.WriteHeader(204)
+		case "/v1/cf/instance-id/database/config/default":
+			json.NewDecoder(r.Body).Decode(&config)
+			w.WriteHeader(204)
+		case "/v1/cf/broker/instance-id":
+			json.NewDecoder(r.Body).Decode(&instance)
+			w.WriteHeader(204)
+		default:
+			env.Handler.ServeHTTP(w, r)
+		}
+	})}
+	ts := httptest.NewServer(vault)
+	defer ts.Close()
+	if err := env.Broker.vaultClient.SetAddress(ts.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	details := brokerapi.ProvisionDetails{
+		SpaceGUID:        env.SpaceGUID,
+		OrganizationGUID: env.OrganizationGUID,
+		RawParameters: json.RawMessage(`{"database": {
+			"plugin_name": "postgresql-database-plugin",
+			"connection_url": "postgresql://{{username}}:{{password}}@db:5432/app",
+			"username": "root",
+			"password": "root-password",
+			"creation_statements": ["CREATE ROLE \"{{name}}\"", "GRANT SELECT ON ALL TABLES IN SCHEMA public TO \"{{name}}\""],
+			"default_ttl": "1h"
+		}}`),
+	}
+	if _, err := env.Broker.Provision(env.Context, env.InstanceID, details, env.Async); err != nil {
+		t.Fatal(err)
+	}
+	if config["password"] != "root-password" || config["plugin_name"] != "postgresql-database-plugin" {
+		t.Fatalf("unexpected database config %v", config)
+	}
+	if strings.Contains(instance["json"].(string), "root-password") {
+		t.Fatalf("expected the root password not to be stored but received %s", instance["json"])
+	}
+
+	binding, err := env.Broker.Bind(env.Context, env.InstanceID, env.BindingID, brokerapi.BindDetails{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if role["db_name"] != DatabaseConnectionName || role["default_ttl"] != "1h" {
+		t.Fatalf("unexpected database role %v", role)
+	}
+	if !strings.Contains(role["creation_statements"].(string), "GRANT SELECT") {
+		t.Fatalf("expected all creation statements but received %v", role["creation_statements"])
+	}
+
+	// Only the binding's own policy grants its credentials
+	if !strings.Contains(policy, `path "cf/instance-id/database/creds/binding-id"`) {
+		t.Fatalf("expected the binding's credentials in %s", policy)
+	}
+	if policies := fmt.Sprint(token["policies"]); policies != "[cf-instance-id cf-instance-id-binding-binding-id]" {
+		t.Fatalf("expected the instance and binding policies but received %s", policies)
+	}
+	rules, err := env.Broker.instancePolicy(instancePolicyInput(env.InstanceID, env.Broker.instances[env.InstanceID]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(rules, "database/creds") {
+		t.Fatalf("expected no database credentials in %s", rules)
+	}
+	database := binding.Credentials.(map[string]interface{})["database"].(map[string]interface{})
+	if database["creds_path"] != "cf/instance-id/database/creds/binding-id" {
+		t.Fatalf("expected cf/instance-id/database/creds/binding-id but received %s", database["creds_path"])
+	}
+
+	if err := env.Broker.Unbind(env.Context, env.InstanceID, env.BindingID, brokerapi.UnbindDetails{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, request := range []string{
+		"PUT /v1/sys/revoke-prefix/cf/instance-id/database/creds/binding-id",
+		"DELETE /v1/cf/instance-id/database/roles/binding-id",
+		"DELETE /v1/sys/policy/cf-instance-id-binding-binding-id",
+		"DELETE /v1/auth/token/roles/cf-instance-id-binding-binding-id",
+	} {
+		if !vault.received(request) {
+			t.Fatalf("expected %s", request)
+		}
+	}
+}
@@ -0,0 +1,478 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/pkg/errors"
+)
+
+const (
+	// StateArchiveVersion is the version of the archive format written by the
+	// export subcommand. Import refuses archives with a newer version.
+	StateArchiveVersion = 1
+)
+
+// stateArchive is the document produced by export and consumed by import. The
+// instance and binding records are stored exactly as they were read from
+// Vault so that import does not need to understand their contents.
+type stateArchive struct {
+	Version    int                               `json:"version"`
+	ExportedAt time.Time                         `json:"exported_at"`
+	Instances  []*archivedInstance               `json:"instances"`
+	Policies   map[string]string                 `json:"policies,omitempty"`
+	TokenRoles map[string]map[string]interface{} `json:"token_roles,omitempty"`
+	Mounts     map[string]*archivedMount         `json:"mounts,omitempty"`
+
+	// ClusterMounts are the mounts on clusters other than the default, keyed
+	// by cluster name. Mounts on the default cluster are stored in Mounts.
+	ClusterMounts map[string]map[string]*archivedMount `json:"cluster_mounts,omitempty"`
+}
+
+// archivedInstance is a single instance record and all of its bindings.
+type archivedInstance struct {
+	ID       string                            `json:"id"`
+	Data     map[string]interface{}            `json:"data,omitempty"`
+	Bindings map[string]map[string]interface{} `json:"bindings,omitempty"`
+}
+
+// archivedMount is the configuration of a mount created by the broker.
+type archivedMount struct {
+	Type            string `json:"type"`
+	Description     string `json:"description,omitempty"`
+	Local           bool   `json:"local,omitempty"`
+	DefaultLeaseTTL int    `json:"default_lease_ttl,omitempty"`
+	MaxLeaseTTL     int    `json:"max_lease_ttl,omitempty"`
+}
+
+// exportOptions controls which optional data is included in an export.
+type exportOptions struct {
+	Policies   bool
+	TokenRoles bool
+	Mounts     bool
+}
+
+// exportState reads all instance and binding records, and optionally the
+// policies, token roles and mounts belonging to them, into an archive.
+func (b *Broker) exportState(opts *exportOptions) (*stateArchive, error) {
+	archive := &stateArchive{
+		Version:    StateArchiveVersion,
+		ExportedAt: time.Now().UTC(),
+	}
+
+	instances, err := b.listDir(b.statePath() + "/")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list instances")
+	}
+	for _, inst := range uniqueKeys(instances) {
+		path := b.statePath(inst)
+		b.log.Printf("[DEBUG] exporting instance %s", path)
+		secret, err := b.vaultClient.Logical().Read(path)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read instance info at %q", path)
+		}
+
+		ai := &archivedInstance{ID: inst}
+		if secret != nil {
+			ai.Data = secret.Data
+		}
+
+		binds, err := b.listDir(path + "/")
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to list binds for instance %q", inst)
+		}
+		for _, bind := range uniqueKeys(binds) {
+			bindPath := path + "/" + bind
+			b.log.Printf("[DEBUG] exporting bind %s", bindPath)
+			secret, err := b.vaultClient.Logical().Read(bindPath)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to read bind info at %q", bindPath)
+			}
+			if secret == nil || len(secret.Data) == 0 {
+				continue
+			}
+			if ai.Bindings == nil {
+				ai.Bindings = make(map[string]map[string]interface{})
+			}
+			ai.Bindings[bind] = secret.Data
+		}
+		archive.Instances = append(archive.Instances, ai)
+
+		// Policies and token roles live on the instance's cluster
+		client, err := b.archivedInstanceClient(ai)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to find cluster for instance %q", inst)
+		}
+
+		names, err := b.archivedResourceNames(ai)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to decode instance %q", inst)
+		}
+		for _, name := range names {
+			if opts.Policies {
+				b.log.Printf("[DEBUG] exporting policy %s", name)
+				rules, err := client.Sys().GetPolicy(name)
+				if err != nil {
+					return nil, errors.Wrapf(err, "failed to read policy %s", name)
+				}
+				if rules != "" {
+					if archive.Policies == nil {
+						archive.Policies = make(map[string]string)
+					}
+					archive.Policies[name] = rules
+				}
+			}
+			if opts.TokenRoles {
+				rolePath := "auth/token/roles/" + name
+				b.log.Printf("[DEBUG] exporting token role %s", rolePath)
+				secret, err := client.Logical().Read(rolePath)
+				if err != nil {
+					return nil, errors.Wrapf(err, "failed to read token role %s", rolePath)
+				}
+				if secret != nil && len(secret.Data) > 0 {
+					if archive.TokenRoles == nil {
+						archive.TokenRoles = make(map[string]map[string]interface{})
+					}
+					delete(secret.Data, "name")
+					archive.TokenRoles[name] = secret.Data
+				}
+			}
+		}
+	}
+
+	if opts.Mounts {
+		b.log.Printf("[DEBUG] exporting mounts")
+		archive.Mounts, err = b.exportMounts(b.vaultClient)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range b.clusterNames() {
+			b.log.Printf("[DEBUG] exporting mounts on cluster %s", name)
+			mounts, err := b.exportMounts(b.clusters[name].client)
+			if err != nil {
+				return nil, errors.Wrapf(err, "cluster %s", name)
+			}
+			if len(mounts) == 0 {
+				continue
+			}
+			if archive.ClusterMounts == nil {
+				archive.ClusterMounts = make(map[string]map[string]*archivedMount)
+			}
+			archive.ClusterMounts[name] = mounts
+		}
+	}
+
+	return archive, nil
+}
+
+// exportMounts returns the configuration of the mounts created by the broker
+// on the cluster of the client, excluding the broker's own state.
+func (b *Broker) exportMounts(client *api.Client) (map[string]*archivedMount, error) {
+	result, err := client.Sys().ListMounts()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list mounts")
+	}
+
+	var mounts map[string]*archivedMount
+	for k, v := range result {
+		k = strings.Trim(k, "/")
+		if !strings.HasPrefix(k, b.mountPath()+"/") || k == b.statePath() {
+			continue
+		}
+		if mounts == nil {
+			mounts = make(map[string]*archivedMount)
+		}
+		mounts[k] = &archivedMount{
+			Type:            v.Type,
+			Description:     v.Description,
+			Local:           v.Local,
+			DefaultLeaseTTL: v.Config.DefaultLeaseTTL,
+			MaxLeaseTTL:     v.Config.MaxLeaseTTL,
+		}
+	}
+	return mounts, nil
+}
+
+// archivedInstanceClient returns the client for the cluster the archived
+// instance was placed on.
+func (b *Broker) archivedInstanceClient(ai *archivedInstance) (*api.Client, error) {
+	if len(ai.Data) == 0 {
+		return b.vaultClient, nil
+	}
+	info, err := decodeInstanceInfo(ai.Data)
+	if err != nil {
+		return nil, err
+	}
+	cluster, err := b.cluster(info.Cluster)
+	if err != nil {
+		return nil, err
+	}
+	return cluster.client, nil
+}
+
+// archivedResourceNames returns the names of the policies and token roles of
+// the archived instance.
+func (b *Broker) archivedResourceNames(ai *archivedInstance) ([]string, error) {
+	names := []string{b.resourceName(ai.ID)}
+	if len(ai.Data) == 0 {
+		return names, nil
+	}
+	info, err := decodeInstanceInfo(ai.Data)
+	if err != nil {
+		return nil, err
+	}
+	if info.Shared {
+		names = append(names, b.sharedResourceName(ai.ID))
+	}
+	for _, app := range info.Apps {
+		names = append(names, b.appResourceName(ai.ID, app))
+	}
+	if info.Database != nil {
+		bindings := make([]string, 0, len(ai.Bindings))
+		for bind := range ai.Bindings {
+			bindings = append(bindings, bind)
+		}
+		sort.Strings(bindings)
+		for _, bind := range bindings {
+			names = append(names, b.bindingResourceName(ai.ID, bind))
+		}
+	}
+	return names, nil
+}
+
+// importState writes the contents of the archive into Vault. Mounts are
+// created first, followed by policies, token roles and finally the instance
+// and binding records. If dryRun is true, the actions are only logged.
+func (b *Broker) importState(archive *stateArchive, dryRun bool) error {
+	if archive.Version > StateArchiveVersion {
+		return fmt.Errorf("archive version %d is newer than supported version %d",
+			archive.Version, StateArchiveVersion)
+	}
+
+	prefix := ""
+	if dryRun {
+		prefix = "(dry-run) "
+	}
+
+	mounts := map[string]*archivedMount{
+		b.statePath(): {Type: "generic"},
+	}
+	for k, v := range archive.Mounts {
+		mounts[k] = v
+	}
+	if err := b.importMounts(b.vaultClient, mounts, prefix, dryRun); err != nil {
+		return err
+	}
+	for _, name := range sortedClusterKeys(archive.ClusterMounts) {
+		cluster, err := b.cluster(name)
+		if err != nil {
+			return err
+		}
+		if err := b.importMounts(cluster.client, archive.ClusterMounts[name], prefix, dryRun); err != nil {
+			return errors.Wrapf(err, "cluster %s", name)
+		}
+	}
+
+	// Policies and token roles are written to the cluster of their instance
+	clients := make(map[string]*api.Client, len(archive.Instances))
+	for _, inst := range archive.Instances {
+		client, err := b.archivedInstanceClient(inst)
+		if err != nil {
+			return errors.Wrapf(err, "failed to find cluster for instance %q", inst.ID)
+		}
+		names, err := b.archivedResourceNames(inst)
+		if err != nil {
+			return errors.Wrapf(err, "failed to decode instance %q", inst.ID)
+		}
+		for _, name := range names {
+			clients[name] = client
+		}
+	}
+	clientFor := func(name string) *api.Client {
+		if c, ok := clients[name]; ok {
+			return c
+		}
+		return b.vaultClient
+	}
+
+	for name, rules := range archive.Policies {
+		b.log.Printf("[INFO] %swriting policy %s", prefix, name)
+		if dryRun {
+			continue
+		}
+		if err := clientFor(name).Sys().PutPolicy(name, rules); err != nil {
+			return errors.Wrapf(err, "failed to write policy %s", name)
+		}
+	}
+
+	for name, data := range archive.TokenRoles {
+		path := "auth/token/roles/" + name
+		b.log.Printf("[INFO] %swriting token role %s", prefix, path)
+		if dryRun {
+			continue
+		}
+		if _, err := clientFor(name).Logical().Write(path, data); err != nil {
+			return errors.Wrapf(err, "failed to write token role %s", path)
+		}
+	}
+
+	for _, inst := range archive.Instances {
+		path := b.statePath(inst.ID)
+		if len(inst.Data) > 0 {
+			b.log.Printf("[INFO] %swriting instance %s", prefix, path)
+			if !dryRun {
+				if _, err := b.vaultClient.Logical().Write(path, inst.Data); err != nil {
+					return errors.Wrapf(err, "failed to write instance %s", path)
+				}
+			}
+		}
+		for bind, data := range inst.Bindings {
+			bindPath := path + "/" + bind
+			data, err := b.importedBinding(bindPath, data, prefix)
+			if err != nil {
+				return err
+			}
+			b.log.Printf("[INFO] %swriting bind %s", prefix, bindPath)
+			if dryRun {
+				continue
+			}
+			if _, err := b.vaultClient.Logical().Write(bindPath, data); err != nil {
+				return errors.Wrapf(err, "failed to write bind %s", bindPath)
+			}
+		}
+	}
+
+	return nil
+}
+
+// importedBinding returns the binding record to write on import. Binding
+// tokens only exist on the cluster that created them and are encrypted with its
+// transit key, so a token that cannot be decrypted here is removed from the
+// record along with its accessor. The rest of the record is kept as it is.
+func (b *Broker) importedBinding(path string, data map[string]interface{}, prefix string) (map[string]interface{}, error) {
+	info, err := decodeBindingInfo(data)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to decode bind %s", path)
+	}
+	if info.EncryptedToken == "" {
+		return data, nil
+	}
+	if _, err := b.decryptToken(info.EncryptedToken); err == nil {
+		return data, nil
+	}
+	b.log.Printf("[WARN] %sremoving the token of bind %s, which was created on another cluster; "+
+		"the application must be rebound", prefix, path)
+
+	var record map[string]interface{}
+	if err := json.Unmarshal([]byte(data["json"].(string)), &record); err != nil {
+		return nil, errors.Wrapf(err, "failed to decode bind %s", path)
+	}
+	for _, k := range []string{"ClientToken", "EncryptedToken", "Accessor"} {
+		delete(record, k)
+	}
+	return encodeRecord(record)
+}
+
+// importMounts creates the mounts on the cluster of the client unless they
+// already exist.
+func (b *Broker) importMounts(client *api.Client, mounts map[string]*archivedMount, prefix string, dryRun bool) error {
+	existing, err := client.Sys().ListMounts()
+	if err != nil {
+		return errors.Wrap(err, "failed to list mounts")
+	}
+	for _, k := range sortedMountKeys(mounts) {
+		if _, ok := existing[k+"/"]; ok {
+			b.log.Printf("[DEBUG] %smount %s already exists", prefix, k)
+			continue
+		}
+		m := mounts[k]
+		b.log.Printf("[INFO] %smounting %s at %s", prefix, m.Type, k)
+		if dryRun {
+			continue
+		}
+		input := &api.MountInput{
+			Type:        m.Type,
+			Description: m.Description,
+			Local:       m.Local,
+		}
+		if m.DefaultLeaseTTL > 0 {
+			input.Config.DefaultLeaseTTL = fmt.Sprintf("%ds", m.DefaultLeaseTTL)
+		}
+		if m.MaxLeaseTTL > 0 {
+			input.Config.MaxLeaseTTL = fmt.Sprintf("%ds", m.MaxLeaseTTL)
+		}
+		if err := client.Sys().Mount(k, input); err != nil {
+			return errors.Wrapf(err, "failed to mount %s", k)
+		}
+	}
+	return nil
+}
+
+// writeStateArchive encodes the archive as gzipped JSON into w.
+func writeStateArchive(w io.Writer, archive *stateArchive) error {
+	gz := gzip.NewWriter(w)
+	enc := json.NewEncoder(gz)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(archive); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// readStateArchive decodes a gzipped JSON archive from r.
+func readStateArchive(r io.Reader) (*stateArchive, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	var archive stateArchive
+	if err := json.NewDecoder(gz).Decode(&archive); err != nil {
+		return nil, err
+	}
+	return &archive, nil
+}
+
+// uniqueKeys trims the trailing slashes from a directory listing and removes
+// the duplicates that result from a path being both a key and a directory.
+func uniqueKeys(keys []string) []string {
+	seen := make(map[string]struct{}, len(keys))
+	result := make([]string, 0, len(keys))
+	for _, k := range keys {
+		k = strings.Trim(k, "/")
+		if _, ok := seen[k]; ok {
+			continue
+		}
+		seen[k] = struct{}{}
+		result = append(result, k)
+	}
+	return result
+}
+
+// sortedMountKeys returns the mount paths in lexical order so that imports are
+// performed and logged deterministically.
+func sortedMountKeys(m map[string]*archivedMount) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// sortedClusterKeys returns the cluster names in lexical order.
+func sortedClusterKeys(m map[string]map[string]*archivedMount) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestBroker_Export_Import(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	archive, err := env.Broker.exportState(&exportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if archive.Version != StateArchiveVersion {
+		t.Fatalf("expected version %d but received %d", StateArchiveVersion, archive.Version)
+	}
+	if len(archive.Instances) != 1 {
+		t.Fatalf("expected 1 instance but received %d", len(archive.Instances))
+	}
+	inst := archive.Instances[0]
+	if inst.ID != "foo" {
+		t.Fatalf("expected instance foo but received %s", inst.ID)
+	}
+	if _, ok := inst.Data["json"]; !ok {
+		t.Fatalf("expected json key in %+v", inst.Data)
+	}
+	if _, ok := inst.Bindings["foo"]; !ok {
+		t.Fatalf("expected binding foo in %+v", inst.Bindings)
+	}
+
+	var buf bytes.Buffer
+	if err := writeStateArchive(&buf, archive); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := readStateArchive(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(restored.Instances) != 1 || restored.Instances[0].ID != "foo" {
+		t.Fatalf("archive did not round trip: %+v", restored.Instances)
+	}
+
+	vault := &requestRecorder{handler: env.Handler}
+	ts := httptest.NewServer(vault)
+	defer ts.Close()
+	if err := env.Broker.vaultClient.SetAddress(ts.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	// A dry run only reads from Vault
+	if err := env.Broker.importState(restored, true); err != nil {
+		t.Fatal(err)
+	}
+	for request := range vault.requests {
+		if !strings.HasPrefix(request, "GET ") {
+			t.Fatalf("expected no writes but received %s", request)
+		}
+	}
+
+	if err := env.Broker.importState(restored, false); err != nil {
+		t.Fatal(err)
+	}
+	for _, request := range []string{
+		"PUT /v1/cf/broker/foo",
+		"PUT /v1/cf/broker/foo/foo",
+	} {
+		if !vault.received(request) {
+			t.Fatalf("expected %s", request)
+		}
+	}
+}
+
+// stateStore serves the broker's state mount from memory, so that it starts out
+// empty and holds whatever is written to it.
+type stateStore struct {
+	handler http.Handler
+
+	lock    sync.Mutex
+	records map[string]string
+}
+
+func (s *stateStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/v1/")
+	if path != "cf/broker" && !strings.HasPrefix(path, "cf/broker/") {
+		s.handler.ServeHTTP(w, r)
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.records == nil {
+		s.records = make(map[string]string)
+	}
+
+	switch {
+	case r.Method == "PUT" || r.Method == "POST":
+		var data struct {
+			JSON string `json:"json"`
+		}
+		json.NewDecoder(r.Body).Decode(&data)
+		s.records[path] = data.JSON
+		w.WriteHeader(204)
+	case r.Method == "DELETE":
+		delete(s.records, path)
+		w.WriteHeader(204)
+	case r.URL.Query().Get("list") == "true":
+		seen := make(map[string]bool)
+		var keys []string
+		for k := range s.records {
+			if !strings.HasPrefix(k, path+"/") {
+				continue
+			}
+			key := strings.TrimPrefix(k, path+"/")
+			if i := strings.Index(key, "/"); i >= 0 {
+				key = key[:i+1]
+			}
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+		if len(keys) == 0 {
+			w.WriteHeader(404)
+			w.Write([]byte(`{"errors": []}`))
+			return
+		}
+		sort.Strings(keys)
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{"keys": keys}})
+	default:
+		record, ok := s.records[path]
+		if !ok {
+			w.WriteHeader(404)
+			w.Write([]byte(`{"errors": []}`))
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{"json": record}})
+	}
+}
+
+func TestBroker_Import_EmptyCluster(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	// The transit key of the new cluster cannot decrypt the tokens of the old
+	// one
+	store := &stateStore{handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/cf/broker-transit/decrypt/broker" {
+			w.WriteHeader(400)
+			w.Write([]byte(`{"errors": ["cipher: message authentication failed"]}`))
+			return
+		}
+		env.Handler.ServeHTTP(w, r)
+	})}
+	ts := httptest.NewServer(store)
+	defer ts.Close()
+	if err := env.Broker.vaultClient.SetAddress(ts.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	archive := &stateArchive{
+		Version: StateArchiveVersion,
+		Instances: []*archivedInstance{{
+			ID: "imported",
+			Data: map[string]interface{}{
+				"json": `{"OrganizationGUID": "organization-guid", "SpaceGUID": "space-guid"}`,
+			},
+			Bindings: map[string]map[string]interface{}{
+				"binding": {
+					"json": `{"EncryptedToken": "vault:v1:b3RoZXI=", "Accessor": "other-accessor", "State": "succeeded", "AppGUID": "app-guid"}`,
+				},
+			},
+		}},
+	}
+	if err := env.Broker.importState(archive, false); err != nil {
+		t.Fatal(err)
+	}
+
+	record := store.records["cf/broker/imported/binding"]
+	if strings.Contains(record, "EncryptedToken") || strings.Contains(record, "other-accessor") {
+		t.Fatalf("expected the token to be removed but received %s", record)
+	}
+	if !strings.Contains(record, "app-guid") {
+		t.Fatalf("expected the rest of the record to be kept but received %s", record)
+	}
+
+	// The broker starts on the new cluster and still knows the binding
+	if err := env.Broker.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer env.Broker.Stop()
+	if _, ok := env.Broker.instances["imported"]; !ok {
+		t.Fatal("expected the instance to be restored")
+	}
+	if info, ok := env.Broker.binds["binding"]; !ok || info.Accessor != "" {
+		t.Fatalf("expected the binding to be restored without its token but received %+v", info)
+	}
+}
+
+func TestBroker_Import_NewerVersion(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	archive := &stateArchive{Version: StateArchiveVersion + 1}
+	if err := env.Broker.importState(archive, true); err == nil {
+		t.Fatal("expected error importing newer archive")
+	}
+}
+
+func TestUniqueKeys(t *testing.T) {
+	keys := uniqueKeys([]string{"foo", "foo/", "bar/"})
+	if len(keys) != 2 || keys[0] != "foo" || keys[1] != "bar" {
+		t.Fatalf("expected [foo bar] but received %v", keys)
+	}
+}
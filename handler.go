@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"expvar"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/gorilla/mux"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+// catalogService extends the service in the catalog with the fields brokerapi
+// does not know about.
+type catalogService struct {
+	brokerapi.Service
+	InstancesRetrievable bool             `json:"instances_retrievable"`
+	BindingsRetrievable  bool             `json:"bindings_retrievable"`
+	Metadata             *catalogMetadata `json:"metadata,omitempty"`
+}
+
+// catalogMetadata extends the metadata of the service. Cloud Foundry only lets
+// instances of shareable services be shared with other spaces.
+type catalogMetadata struct {
+	brokerapi.ServiceMetadata
+	Shareable bool `json:"shareable,omitempty"`
+}
+
+// catalogResponse is the response to a catalog request.
+type catalogResponse struct {
+	Services []catalogService `json:"services"`
+}
+
+// asyncResponse is the response to a request that is completed
+// asynchronously.
+type asyncResponse struct {
+	Operation string `json:"operation,omitempty"`
+}
+
+// newHandler returns the HTTP handler for the broker. It serves the routes of
+// brokerapi along with the endpoints brokerapi does not implement. Routes are
+// matched in the order they are registered, so the routes registered here take
+// precedence over those of brokerapi, which are only served when none of them
+// match. The dashboard, if enabled, is served
+// under /dashboard/ without the broker credentials, since users sign in to it
+// through UAA. Only requests with the broker credentials count against the
+// limits of limiter, which may be nil.
+func newHandler(broker *Broker, logger lager.Logger, auth *brokerAuth, limiter *rateLimiter) http.Handler {
+	h := &handler{broker: broker}
+
+	bindingPath := "/v2/service_instances/{instance_id}/service_bindings/{binding_id}"
+
+	router := mux.NewRouter()
+	router.Handle("/debug/vars", expvar.Handler()).Methods("GET")
+	router.HandleFunc("/quotas", h.getQuotas).Methods("GET")
+	router.HandleFunc("/quotas/{kind}/{guid}", h.setQuota).Methods("PUT")
+	router.HandleFunc("/quotas/{kind}/{guid}", h.deleteQuota).Methods("DELETE")
+
+	// The broker API routes, both ours and those of brokerapi, require the
+	// API version header, and bindings are validated the same way whether
+	// they are synchronous or not
+	api := mux.NewRouter()
+	brokerapi.AttachRoutes(api, broker, logger)
+	v2 := mux.NewRouter()
+	v2.HandleFunc("/v2/catalog", h.catalog).Methods("GET")
+	v2.HandleFunc("/v2/service_instances/{instance_id}", h.getInstance).Methods("GET")
+	v2.HandleFunc(bindingPath, h.getBinding).Methods("GET")
+	v2.HandleFunc(bindingPath, h.bindAsync).Methods("PUT").Queries("accepts_incomplete", "true")
+	v2.Handle(bindingPath, validBindHandler(api)).Methods("PUT")
+	v2.HandleFunc(bindingPath+"/last_operation", h.bindingLastOperation).Methods("GET")
+	v2.PathPrefix("/").Handler(api)
+	router.PathPrefix("/v2/").Handler(apiVersionHandler(v2))
+
+	// The rate limits and the headers and body of the request are only
+	// looked at once the request is authenticated
+	var authenticated http.Handler = platformContextHandler(broker.log, router)
+	authenticated = rateLimitHandler(broker.log, limiter, authenticated)
+	authenticated = originatingIdentityHandler(broker.log, authenticated)
+	authenticated = auth.wrap(authenticated)
+	if broker.dashboard == nil {
+		return authenticated
+	}
+
+	root := http.NewServeMux()
+	root.Handle("/dashboard/", newDashboardHandler(broker))
+	root.Handle("/", authenticated)
+	return root
+}
+
+// brokerAuth checks the broker credentials of requests. The credentials can be
+// replaced while the broker runs.
+type brokerAuth struct {
+	lock  sync.RWMutex
+	creds brokerapi.BrokerCredentials
+}
+
+func newBrokerAuth(creds brokerapi.BrokerCredentials) *brokerAuth {
+	return &brokerAuth{creds: creds}
+}
+
+// set replaces the credentials.
+func (a *brokerAuth) set(creds brokerapi.BrokerCredentials) {
+	a.lock.Lock()
+	a.creds = creds
+	a.lock.Unlock()
+}
+
+// wrap returns a handler that refuses requests without the credentials.
+func (a *brokerAuth) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !a.authorized(r) {
+			http.Error(w, "Not Authorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authorized reports whether the request carries the credentials.
+func (a *brokerAuth) authorized(r *http.Request) bool {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	a.lock.RLock()
+	creds := a.creds
+	a.lock.RUnlock()
+	userOK := subtle.ConstantTimeCompare([]byte(username), []byte(creds.Username)) == 1
+	passwordOK := subtle.ConstantTimeCompare([]byte(password), []byte(creds.Password)) == 1
+	return userOK && passwordOK
+}
+
+// handler serves the endpoints that are not implemented by brokerapi.
+type handler struct {
+	broker *Broker
+}
+
+func (h *handler) catalog(w http.ResponseWriter, r *http.Request) {
+	services := h.broker.Services(r.Context())
+	shareable := h.broker.sharingEnabled()
+
+	resp := catalogResponse{
+		Services: make([]catalogService, len(services)),
+	}
+	for i, service := range services {
+		resp.Services[i] = catalogService{
+			Service:              service,
+			InstancesRetrievable: true,
+			BindingsRetrievable:  true,
+		}
+		if service.Metadata != nil || shareable {
+			metadata := &catalogMetadata{Shareable: shareable}
+			if service.Metadata != nil {
+				metadata.ServiceMetadata = *service.Metadata
+			}
+			resp.Services[i].Metadata = metadata
+		}
+	}
+	respondJSON(w, http.StatusOK, resp)
+}
+
+func (h *handler) getInstance(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	instance, err := h.broker.GetInstance(r.Context(), vars["instance_id"])
+	if err != nil {
+		respondError(w, err)
+		return
+	}
+	respondJSON(w, http.StatusOK, instance)
+}
+
+func (h *handler) getBinding(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	binding, err := h.broker.GetBinding(r.Context(), vars["instance_id"], vars["binding_id"])
+	if err != nil {
+		respondError(w, err)
+		return
+	}
+	respondJSON(w, http.StatusOK, binding)
+}
+
+// bindAsync starts an asynchronous binding. A binding that already exists with
+// the same details is returned right away. Synchronous bindings, requested
+// without accepts_incomplete, are served by brokerapi.
+func (h *handler) bindAsync(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	details, ok := decodeBindDetails(w, r)
+	if !ok {
+		return
+	}
+
+	binding, operation, err := h.broker.BindAsync(r.Context(), vars["instance_id"], vars["binding_id"], details)
+	if err != nil {
+		respondError(w, err)
+		return
+	}
+	if binding != nil {
+		respondJSON(w, http.StatusOK, binding)
+		return
+	}
+	respondJSON(w, http.StatusAccepted, asyncResponse{Operation: operation})
+}
+
+// decodeBindDetails decodes and validates the body of a bind request. If it is
+// invalid, the error is written to w and false is returned.
+func decodeBindDetails(w http.ResponseWriter, r *http.Request) (brokerapi.BindDetails, bool) {
+	var details brokerapi.BindDetails
+	if err := json.NewDecoder(r.Body).Decode(&details); err != nil {
+		respondJSON(w, http.StatusUnprocessableEntity, brokerapi.ErrorResponse{
+			Description: err.Error(),
+		})
+		return details, false
+	}
+
+	var missing string
+	switch {
+	case details.ServiceID == "":
+		missing = "service_id"
+	case details.PlanID == "":
+		missing = "plan_id"
+	default:
+		return details, true
+	}
+	respondJSON(w, http.StatusBadRequest, brokerapi.ErrorResponse{
+		Description: missing + " missing",
+	})
+	return details, false
+}
+
+// validBindHandler validates the body of synchronous bind requests before
+// they are served by brokerapi, which only checks that it is JSON.
+func validBindHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			respondJSON(w, http.StatusBadRequest, brokerapi.ErrorResponse{
+				Description: err.Error(),
+			})
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		if _, ok := decodeBindDetails(w, r); !ok {
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// apiVersionHandler refuses broker API requests without a 2.x
+// X-Broker-API-Version header, as the Open Service Broker API requires.
+func apiVersionHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		version := r.Header.Get("X-Broker-API-Version")
+		switch {
+		case version == "":
+			respondJSON(w, http.StatusPreconditionFailed, brokerapi.ErrorResponse{
+				Description: "X-Broker-API-Version Header not set",
+			})
+		case !strings.HasPrefix(version, "2."):
+			respondJSON(w, http.StatusPreconditionFailed, brokerapi.ErrorResponse{
+				Description: "X-Broker-API-Version Header must be 2.x",
+			})
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+func (h *handler) bindingLastOperation(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	op, err := h.broker.BindingLastOperation(r.Context(), vars["instance_id"], vars["binding_id"],
+		r.URL.Query().Get("operation"))
+	if err != nil {
+		respondError(w, err)
+		return
+	}
+	respondJSON(w, http.StatusOK, brokerapi.LastOperationResponse{
+		State:       op.State,
+		Description: op.Description,
+	})
+}
+
+func (h *handler) getQuotas(w http.ResponseWriter, r *http.Request) {
+	respondJSON(w, http.StatusOK, h.broker.Quotas())
+}
+
+func (h *handler) setQuota(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	var quota Quota
+	if err := json.NewDecoder(r.Body).Decode(&quota); err != nil {
+		respondJSON(w, http.StatusBadRequest, brokerapi.ErrorResponse{
+			Description: err.Error(),
+		})
+		return
+	}
+
+	if err := h.broker.SetQuota(vars["kind"], vars["guid"], &quota); err != nil {
+		respondError(w, err)
+		return
+	}
+	respondJSON(w, http.StatusOK, quota)
+}
+
+func (h *handler) deleteQuota(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	if err := h.broker.SetQuota(vars["kind"], vars["guid"], nil); err != nil {
+		respondError(w, err)
+		return
+	}
+	respondJSON(w, http.StatusOK, struct{}{})
+}
+
+// respondError writes the error as a JSON response. Failure responses carry
+// their own status code, all other errors are internal server errors.
+func respondError(w http.ResponseWriter, err error) {
+	if failure, ok := err.(*brokerapi.FailureResponse); ok {
+		respondJSON(w, failure.ValidatedStatusCode(nil), failure.ErrorResponse())
+		return
+	}
+	respondJSON(w, http.StatusInternalServerError, brokerapi.ErrorResponse{
+		Description: err.Error(),
+	})
+}
+
+// respondJSON writes v as the JSON body of a response with the given status.
+func respondJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
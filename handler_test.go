@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+// serveBroker performs a request with the given body against the broker's
+// HTTP handler and decodes the JSON response into out.
+func serveBroker(t *testing.T, env *Environment, method, path, body string, out interface{}) int {
+	creds := brokerapi.BrokerCredentials{Username: "user", Password: "pass"}
+	handler := newHandler(env.Broker, lager.NewLogger("test"), newBrokerAuth(creds), nil)
+
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.SetBasicAuth(creds.Username, creds.Password)
+	r.Header.Set("X-Broker-API-Version", "2.14")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	if out != nil {
+		if err := json.Unmarshal(w.Body.Bytes(), out); err != nil {
+			t.Fatalf("failed to decode %q: %s", w.Body.String(), err)
+		}
+	}
+	return w.Code
+}
+
+func TestHandler_Catalog(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	var catalog struct {
+		Services []struct {
+			ID                   string `json:"id"`
+			InstancesRetrievable bool   `json:"instances_retrievable"`
+			BindingsRetrievable  bool   `json:"bindings_retrievable"`
+		} `json:"services"`
+	}
+	if code := serveBroker(t, env, "GET", "/v2/catalog", "", &catalog); code != http.StatusOK {
+		t.Fatalf("expected 200 but received %d", code)
+	}
+	if len(catalog.Services) != 1 {
+		t.Fatalf("expected 1 service but received %d", len(catalog.Services))
+	}
+	service := catalog.Services[0]
+	if service.ID != env.Broker.serviceID {
+		t.Fatalf("expected %s but received %s", env.Broker.serviceID, service.ID)
+	}
+	if !service.InstancesRetrievable || !service.BindingsRetrievable {
+		t.Fatalf("expected instances and bindings to be retrievable but received %+v", service)
+	}
+}
+
+func TestHandler_GetInstance(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	path := "/v2/service_instances/" + env.InstanceID
+	if code := serveBroker(t, env, "GET", path, "", nil); code != http.StatusNotFound {
+		t.Fatalf("expected 404 but received %d", code)
+	}
+
+	env.Broker.instances[env.InstanceID] = &instanceInfo{
+		OrganizationGUID: env.OrganizationGUID,
+		SpaceGUID:        env.SpaceGUID,
+		PlanID:           "plan-id",
+		Parameters:       json.RawMessage(`{"foo":"bar"}`),
+	}
+
+	var instance struct {
+		ServiceID  string            `json:"service_id"`
+		PlanID     string            `json:"plan_id"`
+		Parameters map[string]string `json:"parameters"`
+	}
+	if code := serveBroker(t, env, "GET", path, "", &instance); code != http.StatusOK {
+		t.Fatalf("expected 200 but received %d", code)
+	}
+	if instance.ServiceID != env.Broker.serviceID {
+		t.Fatalf("expected %s but received %s", env.Broker.serviceID, instance.ServiceID)
+	}
+	if instance.PlanID != "plan-id" {
+		t.Fatalf("expected plan-id but received %s", instance.PlanID)
+	}
+	if instance.Parameters["foo"] != "bar" {
+		t.Fatalf("expected parameters but received %+v", instance.Parameters)
+	}
+}
+
+func TestHandler_GetBinding(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	path := "/v2/service_instances/" + env.InstanceID + "/service_bindings/" + env.BindingID
+	if code := serveBroker(t, env, "GET", path, "", nil); code != http.StatusNotFound {
+		t.Fatalf("expected 404 but received %d", code)
+	}
+
+	env.Broker.instances[env.InstanceID] = &instanceInfo{
+		OrganizationGUID: env.OrganizationGUID,
+		SpaceGUID:        env.SpaceGUID,
+	}
+
+	var binding struct {
+		Credentials struct {
+			Address string `json:"address"`
+			Auth    struct {
+				Accessor string `json:"accessor"`
+				Token    string `json:"token"`
+			} `json:"auth"`
+		} `json:"credentials"`
+	}
+	if code := serveBroker(t, env, "GET", path, "", &binding); code != http.StatusOK {
+		t.Fatalf("expected 200 but received %d", code)
+	}
+	if binding.Credentials.Address != env.Broker.vaultAdvertiseAddr {
+		t.Fatalf("expected %s but received %s", env.Broker.vaultAdvertiseAddr, binding.Credentials.Address)
+	}
+	if binding.Credentials.Auth.Token != "ABCD" {
+		t.Fatalf("expected ABCD but received %s", binding.Credentials.Auth.Token)
+	}
+	if binding.Credentials.Auth.Accessor != "accessor" {
+		t.Fatalf("expected accessor but received %s", binding.Credentials.Auth.Accessor)
+	}
+}
+
+func TestHandler_APIVersion(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	creds := brokerapi.BrokerCredentials{Username: "user", Password: "pass"}
+	handler := newHandler(env.Broker, lager.NewLogger("test"), newBrokerAuth(creds), nil)
+
+	cases := []struct {
+		method  string
+		path    string
+		version string
+		code    int
+	}{
+		{"GET", "/v2/catalog", "", http.StatusPreconditionFailed},
+		{"GET", "/v2/catalog", "1.0", http.StatusPreconditionFailed},
+		{"GET", "/v2/catalog", "2.14", http.StatusOK},
+		{"GET", "/v2/service_instances/instance-id/last_operation", "", http.StatusPreconditionFailed},
+		{"PUT", "/v2/service_instances/instance-id/service_bindings/binding-id?accepts_incomplete=true", "", http.StatusPreconditionFailed},
+		{"GET", "/quotas", "", http.StatusOK},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.method+" "+tc.path+" "+tc.version, func(t *testing.T) {
+			r := httptest.NewRequest(tc.method, tc.path, strings.NewReader("{}"))
+			r.SetBasicAuth(creds.Username, creds.Password)
+			if tc.version != "" {
+				r.Header.Set("X-Broker-API-Version", tc.version)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tc.code {
+				t.Fatalf("expected %d but received %d", tc.code, w.Code)
+			}
+		})
+	}
+}
+
+func TestHandler_BindDetails(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	env.Broker.instances[env.InstanceID] = &instanceInfo{
+		SpaceGUID:        env.SpaceGUID,
+		OrganizationGUID: env.OrganizationGUID,
+	}
+	path := "/v2/service_instances/" + env.InstanceID + "/service_bindings/" + env.BindingID
+
+	cases := []struct {
+		name string
+		body string
+		code int
+	}{
+		{"invalid", "{", http.StatusUnprocessableEntity},
+		{"no-service", `{"plan_id": "plan-id"}`, http.StatusBadRequest},
+		{"no-plan", `{"service_id": "service-id"}`, http.StatusBadRequest},
+	}
+
+	// Synchronous and asynchronous bindings are refused alike
+	for _, tc := range cases {
+		for _, query := range []string{"", "?accepts_incomplete=true"} {
+			t.Run(tc.name+query, func(t *testing.T) {
+				if code := serveBroker(t, env, "PUT", path+query, tc.body, nil); code != tc.code {
+					t.Fatalf("expected %d but received %d", tc.code, code)
+				}
+			})
+		}
+	}
+	if len(env.Broker.binds) != 0 || len(env.Broker.pendingBinds) != 0 {
+		t.Fatalf("expected no bindings but received %d", len(env.Broker.binds)+len(env.Broker.pendingBinds))
+	}
+}
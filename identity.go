@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+const (
+	// OriginatingIdentityHeader is the OSB header carrying the identity of the
+	// platform user that initiated the request.
+	OriginatingIdentityHeader = "X-Broker-API-Originating-Identity"
+)
+
+// OriginatingIdentity is the decoded value of the originating identity header.
+// The contents of Value depend on the platform; Cloud Foundry sends a user_id
+// and Kubernetes sends a username and uid.
+type OriginatingIdentity struct {
+	Platform string                 `json:"platform"`
+	Value    map[string]interface{} `json:"value,omitempty"`
+}
+
+// UserID returns the platform-specific identifier of the user, or the empty
+// string if the identity does not contain one.
+func (i *OriginatingIdentity) UserID() string {
+	if i == nil {
+		return ""
+	}
+	for _, k := range []string{"user_id", "uid", "username"} {
+		if v, ok := i.Value[k].(string); ok && v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// String returns the identity as "platform/user".
+func (i *OriginatingIdentity) String() string {
+	if i == nil {
+		return ""
+	}
+	return i.Platform + "/" + i.UserID()
+}
+
+// parseOriginatingIdentity parses the value of the originating identity header,
+// which has the form "<platform> <base64-encoded JSON>".
+func parseOriginatingIdentity(header string) (*OriginatingIdentity, error) {
+	parts := strings.SplitN(strings.TrimSpace(header), " ", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("expected platform and value in %q", header)
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode identity value: %s", err)
+	}
+
+	var value map[string]interface{}
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return nil, fmt.Errorf("failed to parse identity value: %s", err)
+	}
+
+	return &OriginatingIdentity{
+		Platform: parts[0],
+		Value:    value,
+	}, nil
+}
+
+type originatingIdentityKey struct{}
+
+// withOriginatingIdentity returns a copy of ctx carrying the identity.
+func withOriginatingIdentity(ctx context.Context, identity *OriginatingIdentity) context.Context {
+	return context.WithValue(ctx, originatingIdentityKey{}, identity)
+}
+
+// originatingIdentity returns the identity stored in ctx, or nil if the request
+// did not carry one.
+func originatingIdentity(ctx context.Context) *OriginatingIdentity {
+	if ctx == nil {
+		return nil
+	}
+	identity, _ := ctx.Value(originatingIdentityKey{}).(*OriginatingIdentity)
+	return identity
+}
+
+// originatingIdentityHandler decodes the originating identity header of each
+// request and stores it in the request context. Malformed headers are logged
+// and otherwise ignored, since the header is optional.
+func originatingIdentityHandler(logger *log.Logger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if header := r.Header.Get(OriginatingIdentityHeader); header != "" {
+			identity, err := parseOriginatingIdentity(header)
+			if err != nil {
+				logger.Printf("[WARN] ignoring invalid originating identity: %s", err)
+			} else {
+				r = r.WithContext(withOriginatingIdentity(r.Context(), identity))
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
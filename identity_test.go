@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+func TestParseOriginatingIdentity(t *testing.T) {
+	cases := []struct {
+		name     string
+		header   string
+		platform string
+		user     string
+		err      bool
+	}{
+		{
+			"cloudfoundry",
+			"cloudfoundry " + base64.StdEncoding.EncodeToString([]byte(`{"user_id": "683ea748"}`)),
+			"cloudfoundry",
+			"683ea748",
+			false,
+		},
+		{
+			"kubernetes",
+			"kubernetes " + base64.StdEncoding.EncodeToString([]byte(`{"username": "duke", "uid": "c2dde242"}`)),
+			"kubernetes",
+			"c2dde242",
+			false,
+		},
+		{
+			"missing-value",
+			"cloudfoundry",
+			"",
+			"",
+			true,
+		},
+		{
+			"bad-base64",
+			"cloudfoundry !!!",
+			"",
+			"",
+			true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			identity, err := parseOriginatingIdentity(tc.header)
+			if tc.err {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if identity.Platform != tc.platform {
+				t.Errorf("expected platform %q but received %q", tc.platform, identity.Platform)
+			}
+			if identity.UserID() != tc.user {
+				t.Errorf("expected user %q but received %q", tc.user, identity.UserID())
+			}
+		})
+	}
+}
+
+func TestOriginatingIdentityHandler(t *testing.T) {
+	var identity *OriginatingIdentity
+	handler := originatingIdentityHandler(log.New(os.Stdout, "", 0), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity = originatingIdentity(r.Context())
+	}))
+
+	r := httptest.NewRequest("PUT", "/v2/service_instances/instance-id", nil)
+	r.Header.Set(OriginatingIdentityHeader, "cloudfoundry "+base64.StdEncoding.EncodeToString([]byte(`{"user_id": "683ea748"}`)))
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	if identity.String() != "cloudfoundry/683ea748" {
+		t.Fatalf("expected cloudfoundry/683ea748 but received %q", identity.String())
+	}
+
+	if originatingIdentity(context.Background()) != nil {
+		t.Fatal("expected no identity in empty context")
+	}
+}
+
+func TestBroker_OriginatingIdentity(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	// Capture the token create request and the stored binding
+	var tokenRequest api.TokenCreateRequest
+	var binding map[string]interface{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/v1/auth/token/create/cf-instance-id":
+			json.NewDecoder(r.Body).Decode(&tokenRequest)
+		case r.URL.Path == "/v1/cf/broker/instance-id/binding-id" && r.Method == "PUT":
+			json.NewDecoder(r.Body).Decode(&binding)
+			w.WriteHeader(204)
+			return
+		}
+		env.Handler.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+	if err := env.Broker.vaultClient.SetAddress(ts.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := withOriginatingIdentity(env.Context, &OriginatingIdentity{
+		Platform: "cloudfoundry",
+		Value:    map[string]interface{}{"user_id": "user-guid"},
+	})
+
+	details := brokerapi.ProvisionDetails{
+		SpaceGUID:        env.SpaceGUID,
+		OrganizationGUID: env.OrganizationGUID,
+	}
+	if _, err := env.Broker.Provision(ctx, env.InstanceID, details, env.Async); err != nil {
+		t.Fatal(err)
+	}
+	if id := env.Broker.instances[env.InstanceID].OriginatingIdentity; id.String() != "cloudfoundry/user-guid" {
+		t.Fatalf("expected cloudfoundry/user-guid but received %q", id.String())
+	}
+
+	if _, err := env.Broker.Bind(ctx, env.InstanceID, env.BindingID, brokerapi.BindDetails{}); err != nil {
+		t.Fatal(err)
+	}
+	if tokenRequest.Metadata["cf-originating-platform"] != "cloudfoundry" {
+		t.Fatalf("expected cloudfoundry but received %q", tokenRequest.Metadata["cf-originating-platform"])
+	}
+	if tokenRequest.Metadata["cf-originating-user"] != "user-guid" {
+		t.Fatalf("expected user-guid but received %q", tokenRequest.Metadata["cf-originating-user"])
+	}
+
+	info, err := decodeBindingInfo(binding)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.OriginatingIdentity.String() != "cloudfoundry/user-guid" {
+		t.Fatalf("expected cloudfoundry/user-guid but received %q", info.OriginatingIdentity.String())
+	}
+}
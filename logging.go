@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+)
+
+// logLevels are the levels of the broker's log lines, from the most to the
+// least verbose.
+var logLevels = []string{"DEBUG", "INFO", "WARN", "ERR"}
+
+// logLevel returns the index of the level in logLevels.
+func logLevel(name string) (int, bool) {
+	for i, level := range logLevels {
+		if strings.EqualFold(name, level) {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// validateLogLevel checks the name is a known level.
+func validateLogLevel(name string) error {
+	if _, ok := logLevel(name); !ok {
+		return fmt.Errorf("unknown log level %q, expected one of %s", name, strings.Join(logLevels, ", "))
+	}
+	return nil
+}
+
+// levelFilter drops the log lines below its level. Lines are expected to start
+// with their level, such as "[INFO]"; lines without one are always written.
+// The level can be changed while the broker runs.
+type levelFilter struct {
+	out   io.Writer
+	level int32
+}
+
+func newLevelFilter(out io.Writer) *levelFilter {
+	return &levelFilter{out: out}
+}
+
+// SetLevel sets the level. Unknown levels are ignored.
+func (f *levelFilter) SetLevel(name string) {
+	if level, ok := logLevel(name); ok {
+		atomic.StoreInt32(&f.level, int32(level))
+	}
+}
+
+// Write implements io.Writer. The logger writes each line with a single call.
+func (f *levelFilter) Write(p []byte) (int, error) {
+	if bytes.HasPrefix(p, []byte("[")) {
+		if end := bytes.IndexByte(p, ']'); end > 0 {
+			level, ok := logLevel(string(p[1:end]))
+			if ok && int32(level) < atomic.LoadInt32(&f.level) {
+				return len(p), nil
+			}
+		}
+	}
+	return f.out.Write(p)
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"net/url"
@@ -9,6 +10,7 @@ import (
 	"os/signal"
 	"strings"
 	"syscall"
+	"time"
 
 	"code.cloudfoundry.org/lager"
 	"github.com/hashicorp/vault/api"
@@ -19,47 +21,44 @@ import (
 func main() {
 	// Setup the logger - intentionally do not log date or time because it will
 	// be prefixed in the log output by CF.
-	logger := log.New(os.Stdout, "", 0)
+	logFilter := newLevelFilter(os.Stdout)
+	logger := log.New(logFilter, "", 0)
+
+	// Run a subcommand if one was given. Subcommands log to stderr so their
+	// output can be redirected.
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			os.Exit(cmd(log.New(os.Stderr, "", 0), os.Args[2:]))
+		}
+	}
 
 	config, err := parseConfig()
 	if err != nil {
 		logger.Fatal("[ERR] failed to read configuration", err)
 	}
+	logFilter.SetLevel(config.LogLevel)
 
-	// Setup the vault client
-	vaultClient, err := api.NewClient(nil)
+	// Setup the audit sinks
+	auditSinks, err := newAuditSinks(config)
 	if err != nil {
-		logger.Fatal("[ERR] failed to create vault api client", err)
+		logger.Fatal("[ERR] failed to setup audit sinks", err)
 	}
 
 	// Setup the broker
-	broker := &Broker{
-		log:         logger,
-		vaultClient: vaultClient,
-
-		serviceID:          config.ServiceID,
-		serviceName:        config.ServiceName,
-		serviceDescription: config.ServiceDescription,
-		serviceTags:        config.ServiceTags,
-
-		planName:        config.PlanName,
-		planDescription: config.PlanDescription,
-
-		vaultAdvertiseAddr: config.VaultAdvertiseAddr,
-		vaultRenewToken:    config.VaultRenew,
+	broker, err := newBroker(logger, config)
+	if err != nil {
+		logger.Fatal("[ERR] failed to create broker", err)
 	}
+	broker.auditSinks = auditSinks
 	if err := broker.Start(); err != nil {
 		logger.Fatalf("[ERR] failed to start broker: %s", err)
 	}
 
 	// Parse the broker credentials
-	creds := brokerapi.BrokerCredentials{
-		Username: config.SecurityUserName,
-		Password: config.SecurityUserPassword,
-	}
+	auth := newBrokerAuth(config.credentials())
 
 	// Setup the HTTP handler
-	handler := brokerapi.New(broker, lager.NewLogger("vault-broker"), creds)
+	handler := newHandler(broker, lager.NewLogger("vault-broker"), auth, newRateLimiter(config))
 
 	// Listen to incoming connection
 	serverCh := make(chan struct{}, 1)
@@ -72,18 +71,36 @@ func main() {
 	}()
 
 	signalCh := make(chan os.Signal, 1)
-	signal.Notify(signalCh, syscall.SIGTERM, syscall.SIGINT)
+	signal.Notify(signalCh, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
 
-	select {
-	case <-serverCh:
-	case s := <-signalCh:
-		logger.Printf("[INFO] received signal %s", s)
+	// Reload the configuration on SIGHUP until told to stop
+wait:
+	for {
+		select {
+		case <-serverCh:
+			break wait
+		case s := <-signalCh:
+			if s != syscall.SIGHUP {
+				logger.Printf("[INFO] received signal %s", s)
+				break wait
+			}
+			logger.Printf("[INFO] received signal %s, reloading configuration", s)
+			if err := reloadConfig(config, broker, auth, logFilter); err != nil {
+				logger.Printf("[ERR] failed to reload configuration, keeping the current one: %s", err)
+			}
+		}
 	}
 
 	if err := broker.Stop(); err != nil {
 		logger.Fatalf("[ERR] faild to stop broker: %s", err)
 	}
 
+	for _, sink := range auditSinks {
+		if err := sink.Close(); err != nil {
+			logger.Printf("[WARN] failed to close audit sink: %s", err)
+		}
+	}
+
 	os.Exit(0)
 }
 
@@ -130,11 +147,73 @@ func normalizeAddr(s string) string {
 	return u.String()
 }
 
+// newBroker returns the broker for the configuration, with clients for the
+// default cluster and any additional clusters. The broker is not started.
+func newBroker(logger *log.Logger, config *Configuration) (*Broker, error) {
+	// Setup the vault client
+	vaultConfig := api.DefaultConfig()
+	if err := vaultConfig.ReadEnvironment(); err != nil {
+		return nil, fmt.Errorf("failed to read vault api configuration: %s", err)
+	}
+	// The address and token may have been read from files rather than the
+	// environment
+	vaultConfig.Address = config.VaultAddr
+	vaultClient, err := newVaultClient(logger, DefaultClusterName, vaultConfig, config.retry())
+	if err != nil {
+		return nil, fmt.Errorf("failed to create vault api client: %s", err)
+	}
+	vaultClient.SetToken(config.VaultToken)
+
+	// Setup the clients for the additional clusters
+	clusters, err := newVaultClusters(logger, config.VaultClusters, config.retry())
+	if err != nil {
+		return nil, fmt.Errorf("failed to create vault cluster clients: %s", err)
+	}
+
+	// Setup the broker
+	return &Broker{
+		log:         logger,
+		vaultClient: vaultClient,
+
+		serviceID:          config.ServiceID,
+		serviceName:        config.ServiceName,
+		serviceDescription: config.ServiceDescription,
+		serviceTags:        config.ServiceTags,
+
+		plans:          config.Plans,
+		shareInstances: config.ShareInstances,
+
+		vaultAdvertiseAddr: config.VaultAdvertiseAddr,
+		vaultRenewToken:    config.VaultRenew,
+
+		clusters:    clusters,
+		clusterOrgs: config.VaultClusterOrgs,
+
+		mountPrefix:  config.MountPrefix,
+		namePrefix:   config.NamePrefix,
+		foundationID: config.FoundationID,
+
+		dashboard: config.dashboard(),
+		quotas:    config.Quotas,
+
+		operationTimeout:  config.OperationTimeout,
+		operationTimeouts: config.OperationTimeouts,
+	}, nil
+}
+
 func parseConfig() (*Configuration, error) {
 	config := &Configuration{}
 	if err := envconfig.Process("", config); err != nil {
 		return nil, err
 	}
+	if err := config.readSecretFiles(); err != nil {
+		return nil, err
+	}
+	if path := os.Getenv(ConfigFileEnv); path != "" {
+		if err := config.readFile(path); err != nil {
+			return nil, err
+		}
+	}
 	if err := config.Validate(); err != nil {
 		return nil, err
 	}
@@ -159,6 +238,51 @@ type Configuration struct {
 	PlanDescription    string   `envconfig:"plan_description" default:"Secure access to Vault's storage and transit backends"`
 	ServiceTags        []string `envconfig:"service_tags"`
 	VaultRenew         bool     `envconfig:"vault_renew" default:"true"`
+	Plans              Plans    `envconfig:"plans"`
+	LogLevel           string   `envconfig:"log_level" default:"DEBUG"`
+	ShareInstances     bool     `envconfig:"share_instances" default:"false"`
+
+	// Multiple foundations
+	MountPrefix  string `envconfig:"mount_prefix" default:"cf"`
+	NamePrefix   string `envconfig:"name_prefix" default:"cf"`
+	FoundationID string `envconfig:"foundation_id"`
+
+	// Clusters
+	VaultClusters    ClusterConfigs    `envconfig:"vault_clusters"`
+	VaultClusterOrgs map[string]string `envconfig:"vault_cluster_orgs"`
+
+	// Dashboard
+	DashboardURL          string `envconfig:"dashboard_url"`
+	DashboardClientID     string `envconfig:"dashboard_client_id"`
+	DashboardClientSecret string `envconfig:"dashboard_client_secret"`
+	UAAURL                string `envconfig:"uaa_url"`
+	CFAPIURL              string `envconfig:"cf_api_url"`
+
+	// Rate limits
+	RateLimits            RateLimits `envconfig:"rate_limits"`
+	IdentityRateLimit     RateLimit  `envconfig:"identity_rate_limit"`
+	MaxConcurrentRequests int        `envconfig:"max_concurrent_requests"`
+
+	// Quotas
+	Quotas Quotas `envconfig:"quotas"`
+
+	// Retries
+	VaultRetryMax         int           `envconfig:"vault_retry_max" default:"3"`
+	VaultRetryWaitMin     time.Duration `envconfig:"vault_retry_wait_min" default:"250ms"`
+	VaultRetryWaitMax     time.Duration `envconfig:"vault_retry_wait_max" default:"10s"`
+	VaultBreakerThreshold int           `envconfig:"vault_breaker_threshold" default:"5"`
+	VaultBreakerCooldown  time.Duration `envconfig:"vault_breaker_cooldown" default:"30s"`
+
+	// Timeouts
+	OperationTimeout  time.Duration     `envconfig:"operation_timeout" default:"60s"`
+	OperationTimeouts OperationTimeouts `envconfig:"operation_timeouts"`
+
+	// Audit
+	AuditFile          string `envconfig:"audit_file"`
+	AuditSyslog        bool   `envconfig:"audit_syslog"`
+	AuditSyslogAddr    string `envconfig:"audit_syslog_addr"`
+	AuditWebhookURL    string `envconfig:"audit_webhook_url"`
+	AuditWebhookSecret string `envconfig:"audit_webhook_secret"`
 }
 
 func (c *Configuration) Validate() error {
@@ -172,6 +296,24 @@ func (c *Configuration) Validate() error {
 	if c.VaultToken == "" {
 		return errors.New("missing VAULT_TOKEN")
 	}
+	if err := validateLogLevel(c.LogLevel); err != nil {
+		return err
+	}
+	if c.AuditWebhookURL != "" && c.AuditWebhookSecret == "" {
+		return errors.New("missing AUDIT_WEBHOOK_SECRET")
+	}
+	if c.DashboardClientID != "" {
+		for k, v := range map[string]string{
+			"DASHBOARD_URL":           c.DashboardURL,
+			"DASHBOARD_CLIENT_SECRET": c.DashboardClientSecret,
+			"UAA_URL":                 c.UAAURL,
+			"CF_API_URL":              c.CFAPIURL,
+		} {
+			if v == "" {
+				return fmt.Errorf("missing %s", k)
+			}
+		}
+	}
 
 	// If these values aren't perfect, we can fix them
 	if !strings.HasPrefix(c.Port, ":") {
@@ -182,5 +324,89 @@ func (c *Configuration) Validate() error {
 	}
 	c.VaultAddr = normalizeAddr(c.VaultAddr)
 	c.VaultAdvertiseAddr = normalizeAddr(c.VaultAdvertiseAddr)
+	c.MountPrefix = strings.Trim(c.MountPrefix, "/")
+	c.DashboardURL = strings.TrimRight(c.DashboardURL, "/")
+	c.UAAURL = strings.TrimRight(c.UAAURL, "/")
+	c.CFAPIURL = strings.TrimRight(c.CFAPIURL, "/")
+	if err := validatePrefixes(c.MountPrefix, c.NamePrefix); err != nil {
+		return err
+	}
+
+	// Validate the clusters and the plans and organizations mapped to them
+	if err := c.VaultClusters.Validate(); err != nil {
+		return err
+	}
+	for org, name := range c.VaultClusterOrgs {
+		if _, ok := c.VaultClusters[name]; !ok && name != DefaultClusterName {
+			return fmt.Errorf("organization %q is mapped to unknown cluster %q", org, name)
+		}
+	}
+	// Validate the rate limits
+	if err := c.RateLimits.Validate(); err != nil {
+		return err
+	}
+	if c.IdentityRateLimit != (RateLimit{}) {
+		if err := c.IdentityRateLimit.Validate(); err != nil {
+			return fmt.Errorf("invalid IDENTITY_RATE_LIMIT: %s", err)
+		}
+	}
+	if c.MaxConcurrentRequests < 0 {
+		return errors.New("MAX_CONCURRENT_REQUESTS must not be negative")
+	}
+
+	if err := c.retry().Validate(); err != nil {
+		return err
+	}
+	if c.OperationTimeout < 0 {
+		return errors.New("OPERATION_TIMEOUT must not be negative")
+	}
+	if err := c.OperationTimeouts.Validate(); err != nil {
+		return err
+	}
+
+	if len(c.Plans) == 0 {
+		c.Plans = Plans{{Name: c.PlanName, Description: c.PlanDescription}}
+	}
+	if err := c.Plans.Validate(c.VaultClusters); err != nil {
+		return err
+	}
+	if err := c.Quotas.Validate(c.Plans); err != nil {
+		return err
+	}
 	return nil
 }
+
+// credentials returns the broker credentials.
+func (c *Configuration) credentials() brokerapi.BrokerCredentials {
+	return brokerapi.BrokerCredentials{
+		Username: c.SecurityUserName,
+		Password: c.SecurityUserPassword,
+	}
+}
+
+// retry returns the configuration of Vault request retries and the circuit
+// breaker.
+func (c *Configuration) retry() *RetryConfig {
+	return &RetryConfig{
+		MaxRetries:       c.VaultRetryMax,
+		MinWait:          c.VaultRetryWaitMin,
+		MaxWait:          c.VaultRetryWaitMax,
+		BreakerThreshold: c.VaultBreakerThreshold,
+		BreakerCooldown:  c.VaultBreakerCooldown,
+	}
+}
+
+// dashboard returns the configuration of the instance dashboard, or nil if it
+// is disabled.
+func (c *Configuration) dashboard() *DashboardConfig {
+	if c.DashboardClientID == "" {
+		return nil
+	}
+	return &DashboardConfig{
+		URL:          c.DashboardURL,
+		ClientID:     c.DashboardClientID,
+		ClientSecret: c.DashboardClientSecret,
+		UAAURL:       c.UAAURL,
+		CFAPIURL:     c.CFAPIURL,
+	}
+}
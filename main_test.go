@@ -112,6 +112,12 @@ func TestParseConfigDefaults(t *testing.T) {
 	if config.VaultRenew != true {
 		t.Fatal("expected true but received false")
 	}
+	if len(config.Plans) != 1 || config.Plans[0].Name != "shared" {
+		t.Fatalf("expected the shared plan but received %+v", config.Plans)
+	}
+	if config.MountPrefix != DefaultMountPrefix || config.NamePrefix != DefaultNamePrefix {
+		t.Fatalf("expected the default prefixes but received %q and %q", config.MountPrefix, config.NamePrefix)
+	}
 }
 
 func TestParseConfigFromEnv(t *testing.T) {
@@ -179,3 +185,80 @@ func TestParseConfigFromEnv(t *testing.T) {
 		t.Fatal("expected false but received true")
 	}
 }
+
+func TestParseConfigClusters(t *testing.T) {
+	os.Clearenv()
+
+	os.Setenv("SECURITY_USER_NAME", "fizz")
+	os.Setenv("SECURITY_USER_PASSWORD", "buzz")
+	os.Setenv("VAULT_TOKEN", "bang")
+
+	os.Setenv("VAULT_CLUSTERS", `{"east": {"address": "https://vault-east:8200", "token": "east-token"}}`)
+	os.Setenv("VAULT_CLUSTER_ORGS", "org-guid:east")
+	os.Setenv("PLANS", `[{"name": "shared", "description": "Shared"}, {"name": "east", "description": "East", "cluster": "east"}]`)
+
+	config, err := parseConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	east, ok := config.VaultClusters["east"]
+	if !ok {
+		t.Fatalf("expected east cluster but received %+v", config.VaultClusters)
+	}
+	if east.Address != "https://vault-east:8200/" {
+		t.Fatalf("expected %s but received %s", `"https://vault-east:8200/"`, east.Address)
+	}
+	if east.AdvertiseAddress != "https://vault-east:8200/" {
+		t.Fatalf("expected %s but received %s", `"https://vault-east:8200/"`, east.AdvertiseAddress)
+	}
+	if config.VaultClusterOrgs["org-guid"] != "east" {
+		t.Fatalf("expected %s but received %s", `"east"`, config.VaultClusterOrgs["org-guid"])
+	}
+	if len(config.Plans) != 2 || config.Plans[1].Cluster != "east" {
+		t.Fatalf("expected 2 plans but received %+v", config.Plans)
+	}
+
+	os.Setenv("VAULT_CLUSTER_ORGS", "org-guid:west")
+	if _, err := parseConfig(); err == nil {
+		t.Fatal("expected error for unknown cluster")
+	}
+}
+
+func TestParseConfigRateLimits(t *testing.T) {
+	os.Clearenv()
+
+	os.Setenv("SECURITY_USER_NAME", "fizz")
+	os.Setenv("SECURITY_USER_PASSWORD", "buzz")
+	os.Setenv("VAULT_TOKEN", "bang")
+
+	config, err := parseConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limiter := newRateLimiter(config); limiter != nil {
+		t.Fatalf("expected no rate limiter but received %+v", limiter)
+	}
+
+	os.Setenv("RATE_LIMITS", `{"bind": {"rate": 0.5}, "provision": {"rate": 2, "burst": 10}}`)
+	os.Setenv("IDENTITY_RATE_LIMIT", `{"rate": 5, "burst": 20}`)
+	os.Setenv("MAX_CONCURRENT_REQUESTS", "50")
+
+	config, err = parseConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bind := config.RateLimits["bind"]; bind == nil || bind.Burst != 1 {
+		t.Fatalf("expected the bind burst to default to 1 but received %+v", bind)
+	}
+	if config.IdentityRateLimit.Burst != 20 {
+		t.Fatalf("expected %d but received %d", 20, config.IdentityRateLimit.Burst)
+	}
+	if config.MaxConcurrentRequests != 50 {
+		t.Fatalf("expected %d but received %d", 50, config.MaxConcurrentRequests)
+	}
+
+	os.Setenv("RATE_LIMITS", `{"bnid": {"rate": 1}}`)
+	if _, err := parseConfig(); err == nil {
+		t.Fatal("expected error for unknown endpoint")
+	}
+}
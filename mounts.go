@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/pkg/errors"
+)
+
+// MountOptions configure the backends mounted for each instance of a plan.
+// The TTLs are Go durations such as "768h". Unset values are left to Vault's
+// defaults. Only the description, the TTLs and the audit keys can be tuned
+// after a backend is mounted.
+type MountOptions struct {
+	Description     string `json:"description,omitempty"`
+	DefaultLeaseTTL string `json:"default_lease_ttl,omitempty"`
+	MaxLeaseTTL     string `json:"max_lease_ttl,omitempty"`
+	SealWrap        bool   `json:"seal_wrap,omitempty"`
+	Local           bool   `json:"local,omitempty"`
+
+	AuditNonHMACRequestKeys  []string `json:"audit_non_hmac_request_keys,omitempty"`
+	AuditNonHMACResponseKeys []string `json:"audit_non_hmac_response_keys,omitempty"`
+}
+
+// Validate checks that the TTLs are valid durations.
+func (o *MountOptions) Validate() error {
+	var defaultTTL, maxTTL time.Duration
+	var err error
+	if o.DefaultLeaseTTL != "" {
+		if defaultTTL, err = time.ParseDuration(o.DefaultLeaseTTL); err != nil {
+			return fmt.Errorf("invalid default_lease_ttl: %s", err)
+		}
+	}
+	if o.MaxLeaseTTL != "" {
+		if maxTTL, err = time.ParseDuration(o.MaxLeaseTTL); err != nil {
+			return fmt.Errorf("invalid max_lease_ttl: %s", err)
+		}
+	}
+	if defaultTTL > 0 && maxTTL > 0 && defaultTTL > maxTTL {
+		return fmt.Errorf("default_lease_ttl %s exceeds max_lease_ttl %s", defaultTTL, maxTTL)
+	}
+	return nil
+}
+
+// mountBody returns the body of the request mounting a backend of the given
+// type with the options. The vendored api.MountInput predates seal wrapping
+// and the audit keys, so the request is built by hand.
+func (o *MountOptions) mountBody(mountType string) map[string]interface{} {
+	return map[string]interface{}{
+		"type":        mountType,
+		"description": o.Description,
+		"local":       o.Local,
+		"seal_wrap":   o.SealWrap,
+		"config":      o.configBody(),
+	}
+}
+
+// tuneBody returns the body of the request tuning a backend to the options.
+func (o *MountOptions) tuneBody() map[string]interface{} {
+	body := o.configBody()
+	if o.Description != "" {
+		body["description"] = o.Description
+	}
+	return body
+}
+
+// configBody returns the tunable configuration of the options.
+func (o *MountOptions) configBody() map[string]interface{} {
+	body := make(map[string]interface{})
+	if o.DefaultLeaseTTL != "" {
+		body["default_lease_ttl"] = o.DefaultLeaseTTL
+	}
+	if o.MaxLeaseTTL != "" {
+		body["max_lease_ttl"] = o.MaxLeaseTTL
+	}
+	if len(o.AuditNonHMACRequestKeys) > 0 {
+		body["audit_non_hmac_request_keys"] = o.AuditNonHMACRequestKeys
+	}
+	if len(o.AuditNonHMACResponseKeys) > 0 {
+		body["audit_non_hmac_response_keys"] = o.AuditNonHMACResponseKeys
+	}
+	return body
+}
+
+// drifted reports whether the tune values read from a mount differ from the
+// options. Values the options leave unset never drift.
+func (o *MountOptions) drifted(current map[string]interface{}) bool {
+	for k, ttl := range map[string]string{
+		"default_lease_ttl": o.DefaultLeaseTTL,
+		"max_lease_ttl":     o.MaxLeaseTTL,
+	} {
+		if ttl == "" {
+			continue
+		}
+		d, _ := time.ParseDuration(ttl)
+		seconds, err := strconv.ParseInt(fmt.Sprint(current[k]), 10, 64)
+		if err != nil || seconds != int64(d/time.Second) {
+			return true
+		}
+	}
+
+	if o.Description != "" && current["description"] != o.Description {
+		return true
+	}
+
+	for k, keys := range map[string][]string{
+		"audit_non_hmac_request_keys":  o.AuditNonHMACRequestKeys,
+		"audit_non_hmac_response_keys": o.AuditNonHMACResponseKeys,
+	} {
+		if len(keys) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(sortedStrings(keys), sortedStrings(toStrings(current[k]))) {
+			return true
+		}
+	}
+	return false
+}
+
+// instanceMounts returns the backends mounted for the instance alone, keyed
+// by path with the type of the backend as value.
+func (b *Broker) instanceMounts(instanceID string) map[string]string {
+	return map[string]string{
+		"/" + b.mountPath(instanceID, "secret"):  "generic",
+		"/" + b.mountPath(instanceID, "transit"): "transit",
+		"/" + b.mountPath(instanceID, "apps"):    "generic",
+	}
+}
+
+// instanceMountOptions returns the mount options of the plan of the instance,
+// or nil if the plan does not configure its mounts.
+func (b *Broker) instanceMountOptions(instance *instanceInfo) *MountOptions {
+	plan := b.plan(instance.PlanID)
+	if plan == nil {
+		return nil
+	}
+	return plan.Mounts
+}
+
+// tuneInstanceMounts re-tunes the backends of the instance whose tune values
+// drifted from the mount options of its plan. The Vault requests are bound to
+// the context.
+func (b *Broker) tuneInstanceMounts(ctx context.Context, instanceID string, instance *instanceInfo) error {
+	opts := b.instanceMountOptions(instance)
+	if opts == nil {
+		return nil
+	}
+	cluster, err := b.cluster(instance.Cluster)
+	if err != nil {
+		return err
+	}
+	return b.tuneMounts(withContext(ctx, cluster.client), sortedKeys(b.instanceMounts(instanceID)), opts)
+}
+
+// tuneMounts re-tunes the mounts at the given paths whose tune values drifted
+// from the options. Paths that are not mounted are skipped.
+func (b *Broker) tuneMounts(client *api.Client, paths []string, opts *MountOptions) error {
+	for _, p := range paths {
+		p = strings.Trim(p, "/")
+		path := "sys/mounts/" + p + "/tune"
+		secret, err := client.Logical().Read(path)
+		if err != nil {
+			return errors.Wrapf(err, "failed to read %s", path)
+		}
+		if secret == nil || len(secret.Data) == 0 {
+			continue
+		}
+		if !opts.drifted(secret.Data) {
+			continue
+		}
+
+		b.log.Printf("[INFO] tuning mount %s", p)
+		if _, err := client.Logical().Write(path, opts.tuneBody()); err != nil {
+			return errors.Wrapf(err, "failed to tune mount %s", p)
+		}
+	}
+	return nil
+}
+
+// toStrings converts a decoded JSON list to a list of strings.
+func toStrings(v interface{}) []string {
+	list, _ := v.([]interface{})
+	result := make([]string, 0, len(list))
+	for _, item := range list {
+		result = append(result, fmt.Sprint(item))
+	}
+	return result
+}
+
+// sortedStrings returns a sorted copy of the list.
+func sortedStrings(l []string) []string {
+	result := append([]string{}, l...)
+	sort.Strings(result)
+	return result
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/pivotal-cf/brokerapi"
+)
+
+func TestMountOptions_Validate(t *testing.T) {
+	cases := []struct {
+		name string
+		opts MountOptions
+		err  bool
+	}{
+		{"empty", MountOptions{}, false},
+		{"ttls", MountOptions{DefaultLeaseTTL: "1h", MaxLeaseTTL: "24h"}, false},
+		{"bad-default", MountOptions{DefaultLeaseTTL: "1 hour"}, true},
+		{"bad-max", MountOptions{MaxLeaseTTL: "forever"}, true},
+		{"default-exceeds-max", MountOptions{DefaultLeaseTTL: "48h", MaxLeaseTTL: "24h"}, true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.opts.Validate()
+			if tc.err && err == nil {
+				t.Fatal("expected error")
+			}
+			if !tc.err && err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestMountOptions_Drifted(t *testing.T) {
+	opts := &MountOptions{
+		Description:             "instance secrets",
+		DefaultLeaseTTL:         "1h",
+		AuditNonHMACRequestKeys: []string{"b", "a"},
+	}
+
+	cases := []struct {
+		name    string
+		current string
+		drifted bool
+	}{
+		{
+			"matching",
+			`{"description": "instance secrets", "default_lease_ttl": 3600, "max_lease_ttl": 0, "audit_non_hmac_request_keys": ["a", "b"]}`,
+			false,
+		},
+		{
+			"ttl",
+			`{"description": "instance secrets", "default_lease_ttl": 2764800, "audit_non_hmac_request_keys": ["a", "b"]}`,
+			true,
+		},
+		{
+			"description",
+			`{"description": "", "default_lease_ttl": 3600, "audit_non_hmac_request_keys": ["a", "b"]}`,
+			true,
+		},
+		{
+			"audit-keys",
+			`{"description": "instance secrets", "default_lease_ttl": 3600}`,
+			true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var current map[string]interface{}
+			if err := json.Unmarshal([]byte(tc.current), &current); err != nil {
+				t.Fatal(err)
+			}
+			if drifted := opts.drifted(current); drifted != tc.drifted {
+				t.Fatalf("expected %t but received %t", tc.drifted, drifted)
+			}
+		})
+	}
+}
+
+// mountRecorder accepts mount and tune requests and records their bodies,
+// passing all other requests on to the handler.
+type mountRecorder struct {
+	handler http.Handler
+
+	// tune is the response to reading the tune values of every mount.
+	tune string
+
+	lock   sync.Mutex
+	bodies map[string]map[string]interface{}
+}
+
+func (m *mountRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, "/v1/sys/mounts/") {
+		m.handler.ServeHTTP(w, r)
+		return
+	}
+	if r.Method == "GET" {
+		w.Write([]byte(m.tune))
+		return
+	}
+
+	var body map[string]interface{}
+	json.NewDecoder(r.Body).Decode(&body)
+	m.lock.Lock()
+	if m.bodies == nil {
+		m.bodies = make(map[string]map[string]interface{})
+	}
+	m.bodies[r.Method+" "+r.URL.Path] = body
+	m.lock.Unlock()
+	w.WriteHeader(204)
+}
+
+func (m *mountRecorder) body(request string) map[string]interface{} {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.bodies[request]
+}
+
+func TestBroker_Provision_MountOptions(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	vault := &mountRecorder{handler: env.Handler}
+	ts := httptest.NewServer(vault)
+	defer ts.Close()
+	if err := env.Broker.vaultClient.SetAddress(ts.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	env.Broker.plans[0].Mounts = &MountOptions{
+		DefaultLeaseTTL:         "1h",
+		SealWrap:                true,
+		AuditNonHMACRequestKeys: []string{"plaintext"},
+	}
+
+	details := brokerapi.ProvisionDetails{
+		PlanID:           env.Broker.planID(env.Broker.plans[0]),
+		SpaceGUID:        env.SpaceGUID,
+		OrganizationGUID: env.OrganizationGUID,
+	}
+	if _, err := env.Broker.Provision(env.Context, env.InstanceID, details, env.Async); err != nil {
+		t.Fatal(err)
+	}
+
+	body := vault.body("PUT /v1/sys/mounts/cf/instance-id/transit")
+	if body == nil {
+		t.Fatal("expected transit backend to be mounted with options")
+	}
+	if body["type"] != "transit" || body["seal_wrap"] != true {
+		t.Fatalf("unexpected mount body %v", body)
+	}
+	config := body["config"].(map[string]interface{})
+	if config["default_lease_ttl"] != "1h" {
+		t.Fatalf("expected 1h but received %v", config["default_lease_ttl"])
+	}
+
+	// The shared backends are mounted without the options of the plan
+	body = vault.body("POST /v1/sys/mounts/cf/space-guid/secret")
+	if body == nil || body["seal_wrap"] != nil {
+		t.Fatalf("unexpected shared mount body %v", body)
+	}
+}
+
+func TestBroker_Update_TuneMounts(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	vault := &mountRecorder{
+		handler: env.Handler,
+		tune:    `{"data": {"default_lease_ttl": 2764800, "max_lease_ttl": 2764800}}`,
+	}
+	ts := httptest.NewServer(vault)
+	defer ts.Close()
+	if err := env.Broker.vaultClient.SetAddress(ts.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	plan := env.Broker.plans[0]
+	plan.Mounts = &MountOptions{DefaultLeaseTTL: "1h"}
+	env.Broker.instances = map[string]*instanceInfo{
+		env.InstanceID: {PlanID: env.Broker.planID(plan)},
+	}
+
+	if _, err := env.Broker.Update(env.Context, env.InstanceID, brokerapi.UpdateDetails{}, env.Async); err != nil {
+		t.Fatal(err)
+	}
+	for _, request := range []string{
+		"PUT /v1/sys/mounts/cf/instance-id/secret/tune",
+		"PUT /v1/sys/mounts/cf/instance-id/transit/tune",
+	} {
+		body := vault.body(request)
+		if body == nil || body["default_lease_ttl"] != "1h" {
+			t.Fatalf("expected %s to tune default_lease_ttl but received %v", request, body)
+		}
+	}
+
+	// Mounts that match the plan are left alone
+	vault.bodies = nil
+	vault.tune = `{"data": {"default_lease_ttl": 3600, "max_lease_ttl": 2764800}}`
+	if _, err := env.Broker.Update(env.Context, env.InstanceID, brokerapi.UpdateDetails{}, env.Async); err != nil {
+		t.Fatal(err)
+	}
+	if len(vault.bodies) != 0 {
+		t.Fatalf("expected no tune requests but received %v", vault.bodies)
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultPKITTL is the default lifetime of the intermediate CA of an
+	// instance.
+	DefaultPKITTL = "8760h"
+
+	// DefaultPKIMaxTTL is the default maximum lifetime of the certificates
+	// issued by an instance.
+	DefaultPKIMaxTTL = "72h"
+)
+
+// PKIOptions enable a PKI backend for each instance of a plan. The backend
+// holds an intermediate CA signed by the root CA mounted at RootMount.
+type PKIOptions struct {
+	RootMount string `json:"root_mount"`
+	TTL       string `json:"ttl,omitempty"`
+	MaxTTL    string `json:"max_ttl,omitempty"`
+
+	// AllowedDomains restricts the domains instances may request. The domains
+	// requested in the parameters must equal or be a subdomain of one of
+	// them. If empty, any domain may be requested.
+	AllowedDomains []string `json:"allowed_domains,omitempty"`
+}
+
+// Validate checks that the root mount is set and the TTLs are valid durations.
+func (o *PKIOptions) Validate() error {
+	if strings.Trim(o.RootMount, "/") == "" {
+		return fmt.Errorf("missing pki root_mount")
+	}
+	for k, ttl := range map[string]string{"ttl": o.TTL, "max_ttl": o.MaxTTL} {
+		if ttl == "" {
+			continue
+		}
+		if _, err := time.ParseDuration(ttl); err != nil {
+			return fmt.Errorf("invalid pki %s: %s", k, err)
+		}
+	}
+	return nil
+}
+
+// pkiParameters are the PKI settings given in the provision parameters.
+type pkiParameters struct {
+	AllowedDomains  []string `json:"allowed_domains"`
+	AllowSubdomains bool     `json:"allow_subdomains"`
+}
+
+// parsePKIParameters decodes the PKI settings from the provision parameters and
+// checks them against the options of the plan.
+func parsePKIParameters(raw json.RawMessage, opts *PKIOptions) (*pkiParameters, error) {
+	var params struct {
+		PKI *pkiParameters `json:"pki"`
+	}
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &params); err != nil {
+			return nil, fmt.Errorf("failed to decode parameters: %s", err)
+		}
+	}
+	if params.PKI == nil || len(params.PKI.AllowedDomains) == 0 {
+		return nil, fmt.Errorf("missing pki.allowed_domains parameter")
+	}
+
+	for _, domain := range params.PKI.AllowedDomains {
+		if !domainAllowed(domain, opts.AllowedDomains) {
+			return nil, fmt.Errorf("domain %q is not allowed by the plan", domain)
+		}
+	}
+	return params.PKI, nil
+}
+
+// domainAllowed reports whether the domain equals or is a subdomain of one of
+// the allowed domains. An empty list allows every domain.
+func domainAllowed(domain string, allowed []string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	for _, a := range allowed {
+		if domain == a || strings.HasSuffix(domain, "."+a) {
+			return true
+		}
+	}
+	return false
+}
+
+// instancePKI is the PKI backend of an instance.
+type instancePKI struct {
+	// Role is the name of the role certificates are issued against.
+	Role string
+
+	// CAChain is the PEM encoded chain of the intermediate CA.
+	CAChain string
+}
+
+// provisionPKI mounts the PKI backend of the instance, has the root CA sign a
+// newly generated intermediate CA, and creates the role certificates are
+// issued against.
+func (b *Broker) provisionPKI(client *api.Client, instanceID string, opts *PKIOptions, params *pkiParameters, event *AuditEvent) (*instancePKI, error) {
+	ttl := opts.TTL
+	if ttl == "" {
+		ttl = DefaultPKITTL
+	}
+	maxTTL := opts.MaxTTL
+	if maxTTL == "" {
+		maxTTL = DefaultPKIMaxTTL
+	}
+	mount := b.mountPath(instanceID, "pki")
+	root := strings.Trim(opts.RootMount, "/")
+
+	// Mount the backend with a max lease TTL covering the intermediate CA
+	mounts := map[string]string{"/" + mount: "pki"}
+	b.log.Printf("[DEBUG] creating mounts %s", mapToKV(mounts, ", "))
+	if err := b.idempotentMount(client, mounts, &MountOptions{MaxLeaseTTL: ttl}); err != nil {
+		return nil, errors.Wrapf(err, "failed to create mount %s", mount)
+	}
+	event.addArtifact("mount", "/"+mount)
+
+	// Generate the intermediate CA
+	path := mount + "/intermediate/generate/internal"
+	b.log.Printf("[DEBUG] generating intermediate CA at %s", path)
+	secret, err := client.Logical().Write(path, map[string]interface{}{
+		"common_name": instanceID + " Intermediate Authority",
+		"ttl":         ttl,
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to generate intermediate CA at %s", path)
+	}
+	csr, err := pkiField(secret, "csr")
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to generate intermediate CA at %s", path)
+	}
+
+	// Sign it with the root CA
+	path = root + "/root/sign-intermediate"
+	b.log.Printf("[DEBUG] signing intermediate CA with %s", path)
+	secret, err = client.Logical().Write(path, map[string]interface{}{
+		"csr":    csr,
+		"format": "pem_bundle",
+		"ttl":    ttl,
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to sign intermediate CA with %s", path)
+	}
+	certificate, err := pkiField(secret, "certificate")
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to sign intermediate CA with %s", path)
+	}
+	chain := certificate
+	if issuer, err := pkiField(secret, "issuing_ca"); err == nil && !strings.Contains(certificate, issuer) {
+		chain = certificate + "\n" + issuer
+	}
+
+	path = mount + "/intermediate/set-signed"
+	b.log.Printf("[DEBUG] importing signed intermediate CA at %s", path)
+	if _, err := client.Logical().Write(path, map[string]interface{}{
+		"certificate": chain,
+	}); err != nil {
+		return nil, errors.Wrapf(err, "failed to import intermediate CA at %s", path)
+	}
+
+	// Create the role restricted to the requested domains
+	role := b.resourceName(instanceID)
+	path = mount + "/roles/" + role
+	b.log.Printf("[DEBUG] creating pki role %s", path)
+	if _, err := client.Logical().Write(path, map[string]interface{}{
+		"allowed_domains":    params.AllowedDomains,
+		"allow_subdomains":   params.AllowSubdomains,
+		"allow_bare_domains": true,
+		"max_ttl":            maxTTL,
+	}); err != nil {
+		return nil, errors.Wrapf(err, "failed to create pki role %s", path)
+	}
+	event.addArtifact("pki_role", path)
+
+	return &instancePKI{
+		Role:    role,
+		CAChain: chain,
+	}, nil
+}
+
+// pkiCredentials returns the PKI credentials given to an application bound to
+// the instance.
+func (b *Broker) pkiCredentials(instanceID string, pki *instancePKI) map[string]interface{} {
+	return map[string]interface{}{
+		"issue_path": b.mountPath(instanceID, "pki", "issue", pki.Role),
+		"ca_chain":   pki.CAChain,
+	}
+}
+
+// pkiField returns the string value of key in the response of the PKI backend.
+func pkiField(secret *api.Secret, key string) (string, error) {
+	if secret == nil {
+		return "", fmt.Errorf("pki response is empty")
+	}
+	raw, ok := secret.Data[key]
+	if !ok {
+		return "", fmt.Errorf("pki response is missing %q", key)
+	}
+	typed, ok := raw.(string)
+	if !ok {
+		return "", fmt.Errorf("pki response %q is %T, not string", key, raw)
+	}
+	return typed, nil
+}
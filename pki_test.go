@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/pivotal-cf/brokerapi"
+)
+
+func TestParsePKIParameters(t *testing.T) {
+	opts := &PKIOptions{
+		RootMount:      "pki-root",
+		AllowedDomains: []string{"apps.example.com"},
+	}
+
+	cases := []struct {
+		name   string
+		params string
+		err    bool
+	}{
+		{"exact", `{"pki": {"allowed_domains": ["apps.example.com"]}}`, false},
+		{"subdomain", `{"pki": {"allowed_domains": ["billing.apps.example.com"], "allow_subdomains": true}}`, false},
+		{"missing", ``, true},
+		{"empty", `{"pki": {"allowed_domains": []}}`, true},
+		{"suffix-only", `{"pki": {"allowed_domains": ["evilapps.example.com"]}}`, true},
+		{"other-domain", `{"pki": {"allowed_domains": ["example.org"]}}`, true},
+		{"bad-json", `{"pki": `, true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := parsePKIParameters(json.RawMessage(tc.params), opts)
+			if tc.err && err == nil {
+				t.Fatal("expected error")
+			}
+			if !tc.err && err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestBroker_Provision_PKI(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	var policy, role map[string]interface{}
+	vault := &requestRecorder{handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/sys/mounts/cf/instance-id/pki",
+			"/v1/cf/instance-id/pki/intermediate/set-signed":
+			w.WriteHeader(204)
+		case "/v1/cf/instance-id/pki/intermediate/generate/internal":
+			w.Write([]byte(`{"data": {"csr": "CSR"}}`))
+		case "/v1/pki-root/root/sign-intermediate":
+			w.Write([]byte(`{"data": {"certificate": "INTERMEDIATE", "issuing_ca": "ROOT"}}`))
+		case "/v1/cf/instance-id/pki/roles/cf-instance-id":
+			json.NewDecoder(r.Body).Decode(&role)
+			w.WriteHeader(204)
+		case "/v1/sys/policy/cf-instance-id":
+			json.NewDecoder(r.Body).Decode(&policy)
+			w.WriteHeader(204)
+		default:
+			env.Handler.ServeHTTP(w, r)
+		}
+	})}
+	ts := httptest.NewServer(vault)
+	defer ts.Close()
+	if err := env.Broker.vaultClient.SetAddress(ts.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	plan := env.Broker.plans[0]
+	plan.PKI = &PKIOptions{RootMount: "pki-root"}
+	details := brokerapi.ProvisionDetails{
+		PlanID:           env.Broker.planID(plan),
+		SpaceGUID:        env.SpaceGUID,
+		OrganizationGUID: env.OrganizationGUID,
+	}
+
+	// The allowed domains are required
+	_, err := env.Broker.Provision(env.Context, env.InstanceID, details, env.Async)
+	if failure, ok := err.(*brokerapi.FailureResponse); !ok || failure.ValidatedStatusCode(nil) != http.StatusBadRequest {
+		t.Fatalf("expected bad request but received %v", err)
+	}
+
+	details.RawParameters = json.RawMessage(`{"pki": {"allowed_domains": ["apps.example.com"], "allow_subdomains": true}}`)
+	if _, err := env.Broker.Provision(env.Context, env.InstanceID, details, env.Async); err != nil {
+		t.Fatal(err)
+	}
+	for _, request := range []string{
+		"PUT /v1/sys/mounts/cf/instance-id/pki",
+		"PUT /v1/cf/instance-id/pki/intermediate/set-signed",
+	} {
+		if !vault.received(request) {
+			t.Fatalf("expected %s", request)
+		}
+	}
+	if role["allow_subdomains"] != true {
+		t.Fatalf("expected subdomains to be allowed but received %v", role)
+	}
+	rules, _ := policy["rules"].(string)
+	if !strings.Contains(rules, `path "cf/instance-id/pki/issue/cf-instance-id"`) {
+		t.Fatalf("expected policy to allow issuing but received %s", rules)
+	}
+
+	binding, err := env.Broker.Bind(env.Context, env.InstanceID, env.BindingID, brokerapi.BindDetails{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pki := binding.Credentials.(map[string]interface{})["pki"].(map[string]interface{})
+	if pki["issue_path"] != "cf/instance-id/pki/issue/cf-instance-id" {
+		t.Fatalf("expected cf/instance-id/pki/issue/cf-instance-id but received %s", pki["issue_path"])
+	}
+	if pki["ca_chain"] != "INTERMEDIATE\nROOT" {
+		t.Fatalf("expected the intermediate and root CA but received %q", pki["ca_chain"])
+	}
+}
+
+func TestGeneratePolicy_WithoutPKI(t *testing.T) {
+	b := &Broker{}
+	rules, err := b.instancePolicy(&ServicePolicyTemplateInput{
+		ServiceID: "instance-id",
+		SpaceID:   "space-guid",
+		OrgID:     "organization-guid",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(rules, "pki/issue") {
+		t.Fatalf("expected no pki issue path but received %s", rules)
+	}
+	if !strings.Contains(rules, `path "cf/instance-id/pki/*"`) {
+		t.Fatalf("expected pki to be denied but received %s", rules)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Plan is a service plan offered in the catalog.
+type Plan struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+
+	// Cluster is the name of the Vault cluster instances of the plan are
+	// placed on. The empty string means the default cluster.
+	Cluster string `json:"cluster,omitempty"`
+
+	// Mounts configure the secret and transit backends mounted for each
+	// instance of the plan.
+	Mounts *MountOptions `json:"mounts,omitempty"`
+
+	// PKI enables a PKI backend for each instance of the plan.
+	PKI *PKIOptions `json:"pki,omitempty"`
+
+	// CredentialsFormat is the format of the credentials of bindings to
+	// instances of the plan, unless the bind parameters choose another.
+	CredentialsFormat string `json:"credentials_format,omitempty"`
+}
+
+// Plans is the list of plans offered in the catalog. It is decoded from a
+// JSON array by envconfig.
+type Plans []*Plan
+
+// Decode implements envconfig.Decoder.
+func (p *Plans) Decode(value string) error {
+	var plans Plans
+	if err := json.Unmarshal([]byte(value), &plans); err != nil {
+		return fmt.Errorf("failed to parse plans: %s", err)
+	}
+	*p = plans
+	return nil
+}
+
+// Validate checks that every plan has a unique name, refers to a known
+// cluster and has valid mount and PKI options and credentials format.
+func (p Plans) Validate(clusters ClusterConfigs) error {
+	seen := make(map[string]struct{}, len(p))
+	for _, plan := range p {
+		if plan == nil || plan.Name == "" {
+			return fmt.Errorf("missing plan name")
+		}
+		if _, ok := seen[plan.Name]; ok {
+			return fmt.Errorf("duplicate plan %q", plan.Name)
+		}
+		seen[plan.Name] = struct{}{}
+
+		if plan.Mounts != nil {
+			if err := plan.Mounts.Validate(); err != nil {
+				return fmt.Errorf("plan %q: %s", plan.Name, err)
+			}
+		}
+		if plan.PKI != nil {
+			if err := plan.PKI.Validate(); err != nil {
+				return fmt.Errorf("plan %q: %s", plan.Name, err)
+			}
+		}
+		if err := validateCredentialsFormat(plan.CredentialsFormat); err != nil {
+			return fmt.Errorf("plan %q: %s", plan.Name, err)
+		}
+
+		if plan.Cluster == "" || plan.Cluster == DefaultClusterName {
+			continue
+		}
+		if _, ok := clusters[plan.Cluster]; !ok {
+			return fmt.Errorf("plan %q refers to unknown cluster %q", plan.Name, plan.Cluster)
+		}
+	}
+	return nil
+}
+
+// planID returns the catalog ID of the plan.
+func (b *Broker) planID(plan *Plan) string {
+	return fmt.Sprintf("%s.%s", b.serviceID, plan.Name)
+}
+
+// plan returns the plan with the given catalog ID, or nil if there is none.
+func (b *Broker) plan(id string) *Plan {
+	b.catalogLock.RLock()
+	defer b.catalogLock.RUnlock()
+	for _, plan := range b.plans {
+		if b.planID(plan) == id {
+			return plan
+		}
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+)
+
+const (
+	// PlatformCloudFoundry and PlatformKubernetes are the platforms the broker
+	// knows how to map onto its tenancy model.
+	PlatformCloudFoundry = "cloudfoundry"
+	PlatformKubernetes   = "kubernetes"
+
+	// MaxRequestBodySize is the largest request body the broker reads.
+	MaxRequestBodySize = 1 << 20
+)
+
+// PlatformContext is the OSB context object sent with provision, update and
+// bind requests. It describes where the request came from on the platform.
+type PlatformContext struct {
+	Platform string `json:"platform"`
+
+	// Cloud Foundry
+	OrganizationGUID string `json:"organization_guid,omitempty"`
+	SpaceGUID        string `json:"space_guid,omitempty"`
+
+	// Kubernetes
+	Namespace string `json:"namespace,omitempty"`
+	ClusterID string `json:"clusterid,omitempty"`
+}
+
+// tenant is the organization and space the shared backends of an instance
+// are keyed on.
+type tenant struct {
+	OrganizationID string
+	SpaceID        string
+
+	// Namespace is set if the organization and space were mapped from the
+	// cluster and namespace of the platform.
+	Namespace string
+}
+
+// tenant maps the context onto the organization and space of the instance.
+// Cloud Foundry requests use the organization and space GUIDs from the
+// request, falling back to those in the context. Other platforms that send a
+// namespace use the cluster ID as the organization, and the namespace within
+// the cluster as the space.
+func (c *PlatformContext) tenant(organizationGUID, spaceGUID string) (*tenant, error) {
+	if c != nil && c.Platform != PlatformCloudFoundry && c.Namespace != "" {
+		if c.ClusterID == "" {
+			return nil, fmt.Errorf("missing clusterid in %s context", c.Platform)
+		}
+		return &tenant{
+			OrganizationID: c.ClusterID,
+			SpaceID:        c.ClusterID + "." + c.Namespace,
+			Namespace:      c.Namespace,
+		}, nil
+	}
+
+	if c != nil {
+		if organizationGUID == "" {
+			organizationGUID = c.OrganizationGUID
+		}
+		if spaceGUID == "" {
+			spaceGUID = c.SpaceGUID
+		}
+	}
+	if organizationGUID == "" || spaceGUID == "" {
+		return nil, fmt.Errorf("missing organization or space")
+	}
+	return &tenant{
+		OrganizationID: organizationGUID,
+		SpaceID:        spaceGUID,
+	}, nil
+}
+
+// platform returns the name of the platform, defaulting to Cloud Foundry for
+// requests without a context.
+func (c *PlatformContext) platform() string {
+	if c == nil || c.Platform == "" {
+		return PlatformCloudFoundry
+	}
+	return c.Platform
+}
+
+type platformContextKey struct{}
+
+// withPlatformContext returns a copy of ctx carrying the platform context.
+func withPlatformContext(ctx context.Context, pc *PlatformContext) context.Context {
+	return context.WithValue(ctx, platformContextKey{}, pc)
+}
+
+// platformContext returns the platform context stored in ctx, or nil if the
+// request did not carry one.
+func platformContext(ctx context.Context) *PlatformContext {
+	if ctx == nil {
+		return nil
+	}
+	pc, _ := ctx.Value(platformContextKey{}).(*PlatformContext)
+	return pc
+}
+
+// platformContextHandler decodes the context object from the body of PUT and
+// PATCH requests and stores it in the request context, since the request
+// details passed to the broker by brokerapi do not include it. The body is
+// left intact for the next handler. Bodies that cannot be decoded are passed
+// on unchanged so the next handler can reject them, and bodies larger than
+// MaxRequestBodySize are refused. It must only wrap authenticated routes.
+func platformContextHandler(logger *log.Logger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "PUT" && r.Method != "PATCH" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, MaxRequestBodySize))
+		r.Body.Close()
+		if err != nil {
+			logger.Printf("[WARN] failed to read request body: %s", err)
+			if len(body) >= MaxRequestBodySize {
+				http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+			} else {
+				http.Error(w, "Bad Request", http.StatusBadRequest)
+			}
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		var req struct {
+			Context *PlatformContext `json:"context"`
+		}
+		if err := json.Unmarshal(body, &req); err == nil && req.Context != nil {
+			r = r.WithContext(withPlatformContext(r.Context(), req.Context))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+func TestPlatformContext_Tenant(t *testing.T) {
+	cases := []struct {
+		name    string
+		context *PlatformContext
+		org     string
+		space   string
+		e       *tenant
+		err     bool
+	}{
+		{
+			"no-context",
+			nil,
+			"org", "space",
+			&tenant{OrganizationID: "org", SpaceID: "space"},
+			false,
+		},
+		{
+			"cloudfoundry-context",
+			&PlatformContext{Platform: PlatformCloudFoundry, OrganizationGUID: "org", SpaceGUID: "space"},
+			"", "",
+			&tenant{OrganizationID: "org", SpaceID: "space"},
+			false,
+		},
+		{
+			"kubernetes",
+			&PlatformContext{Platform: PlatformKubernetes, Namespace: "default", ClusterID: "cluster"},
+			"", "",
+			&tenant{OrganizationID: "cluster", SpaceID: "cluster.default", Namespace: "default"},
+			false,
+		},
+		{
+			"kubernetes-missing-cluster",
+			&PlatformContext{Platform: PlatformKubernetes, Namespace: "default"},
+			"", "",
+			nil,
+			true,
+		},
+		{
+			"missing-space",
+			&PlatformContext{Platform: "other"},
+			"org", "",
+			nil,
+			true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := tc.context.tenant(tc.org, tc.space)
+			if tc.err {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *r != *tc.e {
+				t.Errorf("expected %+v but received %+v", tc.e, r)
+			}
+		})
+	}
+}
+
+func TestPlatformContextHandler(t *testing.T) {
+	var pc *PlatformContext
+	var body []byte
+	handler := platformContextHandler(log.New(os.Stdout, "", 0), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pc = platformContext(r.Context())
+		body, _ = ioutil.ReadAll(r.Body)
+	}))
+
+	payload := `{"context": {"platform": "kubernetes", "namespace": "default", "clusterid": "cluster"}}`
+	r := httptest.NewRequest("PUT", "/v2/service_instances/instance-id", strings.NewReader(payload))
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	if pc == nil || pc.Platform != PlatformKubernetes || pc.Namespace != "default" || pc.ClusterID != "cluster" {
+		t.Fatalf("unexpected context %+v", pc)
+	}
+	if string(body) != payload {
+		t.Fatalf("expected body %s but received %s", payload, body)
+	}
+
+	// Bodies over the limit are refused
+	w := httptest.NewRecorder()
+	large := strings.NewReader(`{"parameters": "` + strings.Repeat("a", MaxRequestBodySize) + `"}`)
+	handler.ServeHTTP(w, httptest.NewRequest("PUT", "/v2/service_instances/instance-id", large))
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected %d but received %d", http.StatusRequestEntityTooLarge, w.Code)
+	}
+}
+
+func TestHandler_PlatformContext_Unauthorized(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	// Unauthenticated requests are refused before their body is read
+	body := &countingReader{r: strings.NewReader(`{"context": {"platform": "cloudfoundry"}}`)}
+	r := httptest.NewRequest("PUT", "/v2/service_instances/instance-id", body)
+	w := httptest.NewRecorder()
+	auth := newBrokerAuth(brokerapi.BrokerCredentials{Username: "user", Password: "pass"})
+	newHandler(env.Broker, lager.NewLogger("test"), auth, nil).ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected %d but received %d", http.StatusUnauthorized, w.Code)
+	}
+	if body.n != 0 {
+		t.Fatalf("expected the body not to be read but %d bytes were", body.n)
+	}
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
+func TestBroker_Provision_Kubernetes(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	// Accept the cluster and namespace mounts on the default cluster
+	vault := &requestRecorder{handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/sys/mounts/cf/cluster-id/secret", "/v1/sys/mounts/cf/cluster-id.default/secret":
+			w.WriteHeader(204)
+		default:
+			env.Handler.ServeHTTP(w, r)
+		}
+	})}
+	ts := httptest.NewServer(vault)
+	defer ts.Close()
+	if err := env.Broker.vaultClient.SetAddress(ts.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := withPlatformContext(env.Context, &PlatformContext{
+		Platform:  PlatformKubernetes,
+		Namespace: "default",
+		ClusterID: "cluster-id",
+	})
+	if _, err := env.Broker.Provision(ctx, env.InstanceID, brokerapi.ProvisionDetails{}, env.Async); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, request := range []string{
+		"POST /v1/sys/mounts/cf/cluster-id/secret",
+		"POST /v1/sys/mounts/cf/cluster-id.default/secret",
+	} {
+		if !vault.received(request) {
+			t.Fatalf("expected %s", request)
+		}
+	}
+
+	instance := env.Broker.instances[env.InstanceID]
+	if instance.Platform != PlatformKubernetes {
+		t.Fatalf("expected %s but received %s", PlatformKubernetes, instance.Platform)
+	}
+
+	binding, err := env.Broker.Bind(env.Context, env.InstanceID, env.BindingID, brokerapi.BindDetails{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared := binding.Credentials.(map[string]interface{})["backends_shared"].(map[string]interface{})
+	if shared["cluster"] != "cf/cluster-id/secret" {
+		t.Fatalf("expected cf/cluster-id/secret but received %s", shared["cluster"])
+	}
+	if shared["namespace"] != "cf/cluster-id.default/secret" {
+		t.Fatalf("expected cf/cluster-id.default/secret but received %s", shared["namespace"])
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultMountPrefix is the path prefix of the mounts and state created by
+	// the broker.
+	DefaultMountPrefix = "cf"
+
+	// DefaultNamePrefix is the prefix of the names of the policies and token
+	// roles created by the broker.
+	DefaultNamePrefix = "cf"
+)
+
+// validatePrefixes checks that the mount and name prefixes can be used in
+// Vault paths and names.
+func validatePrefixes(mountPrefix, namePrefix string) error {
+	if mountPrefix == "" || strings.HasPrefix(mountPrefix, "/") || strings.HasSuffix(mountPrefix, "/") {
+		return fmt.Errorf("invalid mount prefix %q", mountPrefix)
+	}
+	for _, part := range strings.Split(mountPrefix, "/") {
+		if part == "" || part == "." || part == ".." {
+			return fmt.Errorf("invalid mount prefix %q", mountPrefix)
+		}
+	}
+	if namePrefix == "" || strings.ContainsAny(namePrefix, "/ ") {
+		return fmt.Errorf("invalid name prefix %q", namePrefix)
+	}
+	return nil
+}
+
+// mountPath returns the path made of the elements under the broker's mount
+// prefix.
+func (b *Broker) mountPath(elems ...string) string {
+	prefix := b.mountPrefix
+	if prefix == "" {
+		prefix = DefaultMountPrefix
+	}
+	return strings.Join(append([]string{prefix}, elems...), "/")
+}
+
+// statePath returns the path of a record in the broker's own state, or the
+// root of the state if no elements are given.
+func (b *Broker) statePath(elems ...string) string {
+	return b.mountPath(append([]string{"broker"}, elems...)...)
+}
+
+// transitPath returns the path of the transit backend used to encrypt the
+// broker's own state.
+func (b *Broker) transitPath() string {
+	return b.mountPath("broker-transit")
+}
+
+// metaPath returns the path of the generic backend holding the settings of the
+// broker that can be changed at runtime.
+func (b *Broker) metaPath() string {
+	return b.mountPath("broker-meta")
+}
+
+// resourceName returns the name of the policy and token role of the instance.
+func (b *Broker) resourceName(instanceID string) string {
+	prefix := b.namePrefix
+	if prefix == "" {
+		prefix = DefaultNamePrefix
+	}
+	return prefix + "-" + instanceID
+}
+
+// instancePolicy renders the policy of an instance. The prefix of the input is
+// set to the broker's mount prefix.
+func (b *Broker) instancePolicy(inp *ServicePolicyTemplateInput) (string, error) {
+	var buf bytes.Buffer
+	inp.Prefix = b.mountPath()
+	if err := GeneratePolicy(&buf, inp); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// instancePolicyInput returns the input rendering the policy of a provisioned
+// instance.
+func instancePolicyInput(instanceID string, info *instanceInfo) *ServicePolicyTemplateInput {
+	inp := &ServicePolicyTemplateInput{
+		ServiceID: instanceID,
+		SpaceID:   info.SpaceGUID,
+		OrgID:     info.OrganizationGUID,
+	}
+	if info.PKI != nil {
+		inp.PKIRole = info.PKI.Role
+	}
+	return inp
+}
+
+// migratePrefix moves the mounts and state of the broker from its current
+// mount prefix to mountPrefix, and rewrites the policies of all instances to
+// grant access to the new paths. If namePrefix differs from the current name
+// prefix, a policy and token role are created under the new name for every
+// instance. The old policies are kept, pointing at the new paths, so tokens
+// issued to existing bindings keep working. If dryRun is true, the actions
+// are only logged. It returns the number of instances migrated.
+func (b *Broker) migratePrefix(mountPrefix, namePrefix string, dryRun bool) (int, error) {
+	if err := validatePrefixes(mountPrefix, namePrefix); err != nil {
+		return 0, err
+	}
+
+	prefix := ""
+	if dryRun {
+		prefix = "(dry-run) "
+	}
+
+	// Read the instances before their state is moved, along with the
+	// bindings of those with a database backend
+	instances := make(map[string]*instanceInfo)
+	bindings := make(map[string][]*bindingInfo)
+	keys, err := b.listDir(b.statePath() + "/")
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to list instances")
+	}
+	for _, inst := range uniqueKeys(keys) {
+		path := b.statePath(inst)
+		secret, err := b.vaultClient.Logical().Read(path)
+		if err != nil {
+			return 0, errors.Wrapf(err, "failed to read instance info at %q", path)
+		}
+		if secret == nil || len(secret.Data) == 0 {
+			continue
+		}
+		info, err := decodeInstanceInfo(secret.Data)
+		if err != nil {
+			return 0, errors.Wrapf(err, "failed to decode instance info at %q", path)
+		}
+		instances[inst] = info
+		if info.Database == nil {
+			continue
+		}
+
+		binds, err := b.listDir(path + "/")
+		if err != nil {
+			return 0, errors.Wrapf(err, "failed to list binds for instance %q", inst)
+		}
+		for _, bind := range uniqueKeys(binds) {
+			bindPath := path + "/" + bind
+			secret, err := b.vaultClient.Logical().Read(bindPath)
+			if err != nil {
+				return 0, errors.Wrapf(err, "failed to read bind info at %q", bindPath)
+			}
+			if secret == nil || len(secret.Data) == 0 {
+				continue
+			}
+			bindInfo, err := decodeBindingInfo(secret.Data)
+			if err != nil {
+				return 0, errors.Wrapf(err, "failed to decode bind info at %q", bindPath)
+			}
+			bindInfo.Binding = bind
+			bindings[inst] = append(bindings[inst], bindInfo)
+		}
+	}
+
+	// Move the mounts on every cluster
+	if err := b.remountPrefix(b.vaultClient, mountPrefix, prefix, dryRun); err != nil {
+		return 0, err
+	}
+	for _, name := range b.clusterNames() {
+		if err := b.remountPrefix(b.clusters[name].client, mountPrefix, prefix, dryRun); err != nil {
+			return 0, errors.Wrapf(err, "cluster %s", name)
+		}
+	}
+
+	// Rewrite the policies against the new prefix
+	oldNames := make(map[string]string, len(instances))
+	for inst := range instances {
+		oldNames[inst] = b.resourceName(inst)
+	}
+	b.mountPrefix, b.namePrefix = mountPrefix, namePrefix
+
+	insts := make([]string, 0, len(instances))
+	for inst := range instances {
+		insts = append(insts, inst)
+	}
+	sort.Strings(insts)
+
+	for _, inst := range insts {
+		info := instances[inst]
+		cluster, err := b.cluster(info.Cluster)
+		if err != nil {
+			return 0, errors.Wrapf(err, "failed to find cluster for instance %q", inst)
+		}
+
+		// Shared instances also have a policy and token role for the bindings
+		// from other spaces, each application bound to the instance has a
+		// policy and token role granting it its private area, and so does each
+		// binding to an instance with a database backend for its credentials
+		type resource struct {
+			oldName, name, rules string
+			role                 map[string]interface{}
+		}
+		var resources []resource
+		suffixes := []string{""}
+		if info.Shared {
+			suffixes = append(suffixes, SharedResourceSuffix)
+		}
+		for _, suffix := range suffixes {
+			inp := instancePolicyInput(inst, info)
+			if suffix == SharedResourceSuffix {
+				inp = sharedPolicyInput(inst, info)
+			}
+			rules, err := b.instancePolicy(inp)
+			if err != nil {
+				return 0, errors.Wrapf(err, "failed to generate policy for %s", inst)
+			}
+			name := b.resourceName(inst) + suffix
+			resources = append(resources, resource{oldNames[inst] + suffix, name, rules, map[string]interface{}{
+				"allowed_policies": name,
+				"period":           VaultPeriodicTTL,
+				"renewable":        true,
+			}})
+		}
+		for _, app := range info.Apps {
+			rules, err := b.appPolicy(inst, app)
+			if err != nil {
+				return 0, errors.Wrapf(err, "failed to generate policy for %s", inst)
+			}
+			resources = append(resources, resource{oldNames[inst] + "-app-" + app,
+				b.appResourceName(inst, app), rules, b.appRole(inst, app)})
+		}
+		for _, bind := range bindings[inst] {
+			rules, err := b.databasePolicy(inst, bind.Binding)
+			if err != nil {
+				return 0, errors.Wrapf(err, "failed to generate policy for %s", inst)
+			}
+			resources = append(resources, resource{oldNames[inst] + "-binding-" + bind.Binding,
+				b.bindingResourceName(inst, bind.Binding), rules, b.bindingRole(inst, bind.Binding, bind.AppGUID)})
+		}
+
+		for _, r := range resources {
+			names := []string{r.oldName}
+			if r.name != r.oldName {
+				names = append(names, r.name)
+			}
+			for _, name := range names {
+				b.log.Printf("[INFO] %swriting policy %s", prefix, name)
+				if dryRun {
+					continue
+				}
+				if err := cluster.client.Sys().PutPolicy(name, r.rules); err != nil {
+					return 0, errors.Wrapf(err, "failed to write policy %s", name)
+				}
+			}
+			if len(names) == 1 {
+				continue
+			}
+
+			path := "auth/token/roles/" + r.name
+			b.log.Printf("[INFO] %swriting token role %s", prefix, path)
+			if dryRun {
+				continue
+			}
+			if _, err := cluster.client.Logical().Write(path, r.role); err != nil {
+				return 0, errors.Wrapf(err, "failed to write token role %s", path)
+			}
+			b.log.Printf("[INFO] policy and token role %s can be removed once the bindings of %s are recreated",
+				r.oldName, inst)
+		}
+	}
+
+	return len(instances), nil
+}
+
+// remountPrefix moves every mount under the broker's current mount prefix on
+// the cluster of the client to the same path under mountPrefix.
+func (b *Broker) remountPrefix(client *api.Client, mountPrefix, prefix string, dryRun bool) error {
+	mounts, err := client.Sys().ListMounts()
+	if err != nil {
+		return errors.Wrap(err, "failed to list mounts")
+	}
+
+	var paths []string
+	for k := range mounts {
+		k = strings.Trim(k, "/")
+		if strings.HasPrefix(k, b.mountPath()+"/") {
+			paths = append(paths, k)
+		}
+	}
+	sort.Strings(paths)
+
+	for _, from := range paths {
+		to := mountPrefix + strings.TrimPrefix(from, b.mountPath())
+		b.log.Printf("[INFO] %sremounting %s to %s", prefix, from, to)
+		if dryRun {
+			continue
+		}
+		if err := client.Sys().Remount(from, to); err != nil {
+			return errors.Wrapf(err, "failed to remount %s to %s", from, to)
+		}
+	}
+	return nil
+}
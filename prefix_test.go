@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/pivotal-cf/brokerapi"
+)
+
+func TestValidatePrefixes(t *testing.T) {
+	cases := []struct {
+		name        string
+		mountPrefix string
+		namePrefix  string
+		err         bool
+	}{
+		{"default", "cf", "cf", false},
+		{"nested", "foundations/east", "east", false},
+		{"empty-mount", "", "cf", true},
+		{"leading-slash", "/cf", "cf", true},
+		{"double-slash", "foundations//east", "cf", true},
+		{"dot-dot", "cf/..", "cf", true},
+		{"empty-name", "cf", "", true},
+		{"slash-name", "cf", "east/west", true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := validatePrefixes(tc.mountPrefix, tc.namePrefix)
+			if tc.err && err == nil {
+				t.Fatal("expected error")
+			}
+			if !tc.err && err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestBroker_Prefix(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	// Accept the mounts, policy and token role under the new prefix
+	vault := &requestRecorder{handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/v1/east/broker-transit/"):
+			r.URL.Path = "/v1/cf/broker-transit/" + strings.TrimPrefix(r.URL.Path, "/v1/east/broker-transit/")
+			env.Handler.ServeHTTP(w, r)
+		case strings.HasPrefix(r.URL.Path, "/v1/sys/mounts/east/"),
+			strings.HasPrefix(r.URL.Path, "/v1/east/broker/"),
+			strings.HasPrefix(r.URL.Path, "/v1/east/broker-meta/journal/"),
+			r.URL.Path == "/v1/sys/policy/east-instance-id",
+			r.URL.Path == "/v1/auth/token/roles/east-instance-id":
+			w.WriteHeader(204)
+		case r.URL.Path == "/v1/auth/token/create/east-instance-id":
+			r.URL.Path = "/v1/auth/token/create/cf-instance-id"
+			env.Handler.ServeHTTP(w, r)
+		default:
+			env.Handler.ServeHTTP(w, r)
+		}
+	})}
+	ts := httptest.NewServer(vault)
+	defer ts.Close()
+	if err := env.Broker.vaultClient.SetAddress(ts.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	env.Broker.mountPrefix = "east"
+	env.Broker.namePrefix = "east"
+	env.Broker.foundationID = "foundation-east"
+
+	details := brokerapi.ProvisionDetails{
+		SpaceGUID:        env.SpaceGUID,
+		OrganizationGUID: env.OrganizationGUID,
+	}
+	if _, err := env.Broker.Provision(env.Context, env.InstanceID, details, env.Async); err != nil {
+		t.Fatal(err)
+	}
+	for _, request := range []string{
+		"PUT /v1/sys/policy/east-instance-id",
+		"PUT /v1/auth/token/roles/east-instance-id",
+		"POST /v1/sys/mounts/east/instance-id/secret",
+		"POST /v1/sys/mounts/east/organization-guid/secret",
+		"PUT /v1/east/broker/instance-id",
+	} {
+		if !vault.received(request) {
+			t.Fatalf("expected %s", request)
+		}
+	}
+	if id := env.Broker.instances[env.InstanceID].FoundationID; id != "foundation-east" {
+		t.Fatalf("expected foundation-east but received %s", id)
+	}
+
+	binding, err := env.Broker.Bind(env.Context, env.InstanceID, env.BindingID, brokerapi.BindDetails{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	credentials := binding.Credentials.(map[string]interface{})
+	backends := credentials["backends"].(map[string]interface{})
+	if backends["generic"] != "east/instance-id/secret" {
+		t.Fatalf("expected east/instance-id/secret but received %s", backends["generic"])
+	}
+	shared := credentials["backends_shared"].(map[string]interface{})
+	if shared["space"] != "east/space-guid/secret" {
+		t.Fatalf("expected east/space-guid/secret but received %s", shared["space"])
+	}
+}
+
+func TestBroker_InstancePolicy(t *testing.T) {
+	b := &Broker{mountPrefix: "foundations/east"}
+
+	rules, err := b.instancePolicy(&ServicePolicyTemplateInput{
+		ServiceID: "instance-id",
+		SpaceID:   "space-guid",
+		OrgID:     "organization-guid",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{
+		`path "foundations/east/instance-id/*"`,
+		`path "foundations/east/space-guid/*"`,
+		`path "foundations/east/organization-guid/*"`,
+	} {
+		if !strings.Contains(rules, path) {
+			t.Fatalf("expected %s in %s", path, rules)
+		}
+	}
+}
+
+func TestBroker_RestoreInstance_Foundation(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"data": {"json": "{\"SchemaVersion\":3,\"OrganizationGUID\":\"organization-guid\",\"SpaceGUID\":\"space-guid\",\"FoundationID\":\"foundation-west\"}"}}`))
+	}))
+	defer ts.Close()
+	if err := env.Broker.vaultClient.SetAddress(ts.URL); err != nil {
+		t.Fatal(err)
+	}
+	env.Broker.instances = make(map[string]*instanceInfo)
+
+	env.Broker.foundationID = "foundation-east"
+	if err := env.Broker.restoreInstance(env.InstanceID); err == nil {
+		t.Fatal("expected error restoring instance of another foundation")
+	}
+
+	env.Broker.foundationID = "foundation-west"
+	if err := env.Broker.restoreInstance(env.InstanceID); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBroker_MigratePrefix(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	var remounts []string
+	vault := &requestRecorder{handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/v1/sys/mounts" && r.Method == "GET":
+			w.Write([]byte(`{
+				"cf/broker/": {"type": "generic", "config": {}},
+				"cf/foo/secret/": {"type": "generic", "config": {}},
+				"cfx/secret/": {"type": "generic", "config": {}},
+				"sys/": {"type": "system", "config": {}}
+			}`))
+		case r.URL.Path == "/v1/sys/remount":
+			var body struct{ From, To string }
+			json.NewDecoder(r.Body).Decode(&body)
+			remounts = append(remounts, body.From+" -> "+body.To)
+			w.WriteHeader(204)
+		case strings.HasPrefix(r.URL.Path, "/v1/sys/policy/"),
+			strings.HasPrefix(r.URL.Path, "/v1/auth/token/roles/"):
+			w.WriteHeader(204)
+		default:
+			env.Handler.ServeHTTP(w, r)
+		}
+	})}
+	ts := httptest.NewServer(vault)
+	defer ts.Close()
+	if err := env.Broker.vaultClient.SetAddress(ts.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	// A dry run only reads
+	n, err := env.Broker.migratePrefix("east", "cf", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 || len(remounts) != 0 || vault.received("PUT /v1/sys/policy/cf-foo") {
+		t.Fatalf("expected dry run to only read but received %v", vault.requests)
+	}
+
+	env.Broker.mountPrefix, env.Broker.namePrefix = "cf", "cf"
+	if _, err := env.Broker.migratePrefix("east", "east", false); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"cf/broker -> east/broker", "cf/foo/secret -> east/foo/secret"}
+	if !reflect.DeepEqual(remounts, expected) {
+		t.Fatalf("expected %v but received %v", expected, remounts)
+	}
+	for _, request := range []string{
+		"PUT /v1/sys/policy/cf-foo",
+		"PUT /v1/sys/policy/east-foo",
+		"PUT /v1/auth/token/roles/east-foo",
+	} {
+		if !vault.received(request) {
+			t.Fatalf("expected %s", request)
+		}
+	}
+	if env.Broker.statePath() != "east/broker" {
+		t.Fatalf("expected east/broker but received %s", env.Broker.statePath())
+	}
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/hashicorp/vault/helper/parseutil"
+	"github.com/pkg/errors"
+)
+
+// preflightInstanceID is the instance ID used to build the paths of instance
+// resources whose capabilities are checked. Policies grant access to them by
+// prefix, so any ID will do.
+const preflightInstanceID = "preflight"
+
+// capabilityCheck is a path the broker's token needs capabilities on.
+type capabilityCheck struct {
+	Path         string
+	Capabilities []string
+
+	// Purpose describes what the broker uses the path for.
+	Purpose string
+
+	// Fatal checks prevent the broker from starting. The others only affect
+	// features the broker can run without.
+	Fatal bool
+}
+
+// requiredCapabilities returns the checks for the token of the cluster. The
+// broker's own state is only stored on the default cluster.
+func (b *Broker) requiredCapabilities(cluster string) []*capabilityCheck {
+	var checks []*capabilityCheck
+	if cluster == DefaultClusterName {
+		checks = append(checks,
+			&capabilityCheck{
+				Path:         b.statePath(preflightInstanceID),
+				Capabilities: []string{"create", "read", "update", "delete", "list"},
+				Purpose:      "store instance and binding records",
+				Fatal:        true,
+			},
+			&capabilityCheck{
+				Path:         b.journalPath(preflightInstanceID),
+				Capabilities: []string{"create", "read", "update", "delete", "list"},
+				Purpose:      "journal operations",
+				Fatal:        true,
+			},
+			&capabilityCheck{
+				Path:         b.quotasPath(),
+				Capabilities: []string{"read", "update"},
+				Purpose:      "store quota overrides",
+				Fatal:        true,
+			},
+			&capabilityCheck{
+				Path:         b.transitPath() + "/keys/" + BrokerTransitKey,
+				Capabilities: []string{"update"},
+				Purpose:      "create the transit key",
+				Fatal:        true,
+			},
+			&capabilityCheck{
+				Path:         b.transitPath() + "/encrypt/" + BrokerTransitKey,
+				Capabilities: []string{"update"},
+				Purpose:      "encrypt binding tokens",
+				Fatal:        true,
+			},
+			&capabilityCheck{
+				Path:         b.transitPath() + "/decrypt/" + BrokerTransitKey,
+				Capabilities: []string{"update"},
+				Purpose:      "decrypt binding tokens",
+				Fatal:        true,
+			},
+		)
+	}
+
+	name := b.resourceName(preflightInstanceID)
+	appName := b.appResourceName(preflightInstanceID, preflightInstanceID)
+	bindingName := b.bindingResourceName(preflightInstanceID, preflightInstanceID)
+	mount := "sys/mounts/" + b.mountPath(preflightInstanceID, "secret")
+	checks = append(checks,
+		&capabilityCheck{
+			Path:         "sys/mounts",
+			Capabilities: []string{"read"},
+			Purpose:      "list mounts",
+			Fatal:        true,
+		},
+		&capabilityCheck{
+			Path:         mount,
+			Capabilities: []string{"update", "delete"},
+			Purpose:      "mount and unmount instance backends",
+			Fatal:        true,
+		},
+		&capabilityCheck{
+			Path:         mount + "/tune",
+			Capabilities: []string{"read", "update"},
+			Purpose:      "tune instance backends to their plan",
+		},
+		&capabilityCheck{
+			Path:         "sys/policy/" + name,
+			Capabilities: []string{"update", "delete"},
+			Purpose:      "write and delete instance policies",
+			Fatal:        true,
+		},
+		&capabilityCheck{
+			Path:         "auth/token/roles/" + name,
+			Capabilities: []string{"update", "delete"},
+			Purpose:      "write and delete instance token roles",
+			Fatal:        true,
+		},
+		&capabilityCheck{
+			Path:         "auth/token/create/" + name,
+			Capabilities: []string{"update"},
+			Purpose:      "create binding tokens",
+			Fatal:        true,
+		},
+		&capabilityCheck{
+			Path:         "auth/token/revoke-accessor",
+			Capabilities: []string{"update"},
+			Purpose:      "revoke binding tokens",
+			Fatal:        true,
+		},
+		&capabilityCheck{
+			Path:         "sys/mounts/" + b.mountPath(preflightInstanceID, "apps"),
+			Capabilities: []string{"update", "delete"},
+			Purpose:      "mount and unmount the application areas of instances",
+			Fatal:        true,
+		},
+		&capabilityCheck{
+			Path:         b.mountPath(preflightInstanceID, "apps", preflightInstanceID),
+			Capabilities: []string{"delete", "list"},
+			Purpose:      "delete the application areas of unbound applications",
+		},
+		&capabilityCheck{
+			Path:         "sys/policy/" + appName,
+			Capabilities: []string{"update", "delete"},
+			Purpose:      "write and delete application policies",
+			Fatal:        true,
+		},
+		&capabilityCheck{
+			Path:         "auth/token/roles/" + appName,
+			Capabilities: []string{"update", "delete"},
+			Purpose:      "write and delete application token roles",
+			Fatal:        true,
+		},
+		&capabilityCheck{
+			Path:         "auth/token/create/" + appName,
+			Capabilities: []string{"update"},
+			Purpose:      "create application binding tokens",
+			Fatal:        true,
+		},
+		&capabilityCheck{
+			Path:         "sys/mounts/" + b.mountPath(preflightInstanceID, "pki"),
+			Capabilities: []string{"update", "delete"},
+			Purpose:      "mount and unmount the PKI backends of instances",
+		},
+		&capabilityCheck{
+			Path:         b.mountPath(preflightInstanceID, "pki", "intermediate", "generate", "internal"),
+			Capabilities: []string{"update"},
+			Purpose:      "generate the intermediate CAs of instances",
+		},
+		&capabilityCheck{
+			Path:         "sys/mounts/" + b.mountPath(preflightInstanceID, "database"),
+			Capabilities: []string{"update", "delete"},
+			Purpose:      "mount and unmount the database backends of instances",
+		},
+		&capabilityCheck{
+			Path:         b.mountPath(preflightInstanceID, "database", "roles", preflightInstanceID),
+			Capabilities: []string{"update", "delete"},
+			Purpose:      "write and delete the database roles of bindings",
+		},
+		&capabilityCheck{
+			Path:         "sys/policy/" + bindingName,
+			Capabilities: []string{"update", "delete"},
+			Purpose:      "write and delete database binding policies",
+		},
+		&capabilityCheck{
+			Path:         "auth/token/roles/" + bindingName,
+			Capabilities: []string{"update", "delete"},
+			Purpose:      "write and delete database binding token roles",
+		},
+		&capabilityCheck{
+			Path:         "auth/token/create/" + bindingName,
+			Capabilities: []string{"update"},
+			Purpose:      "create database binding tokens",
+		},
+		&capabilityCheck{
+			Path:         "sys/revoke-prefix/" + b.mountPath(preflightInstanceID, "database", "creds", preflightInstanceID),
+			Capabilities: []string{"update", "sudo"},
+			Purpose:      "revoke the database credentials of bindings",
+		},
+	)
+	if b.vaultRenewToken {
+		checks = append(checks, &capabilityCheck{
+			Path:         "auth/token/renew-self",
+			Capabilities: []string{"update"},
+			Purpose:      "renew the broker's token",
+		})
+	}
+	return checks
+}
+
+// missingCapabilities returns the required capabilities that are not granted.
+// The root capability grants everything and deny grants nothing.
+func missingCapabilities(required, granted []string) []string {
+	has := make(map[string]bool, len(granted))
+	for _, c := range granted {
+		has[c] = true
+	}
+	if has["root"] && !has["deny"] {
+		return nil
+	}
+
+	var missing []string
+	for _, c := range required {
+		if has["deny"] || !has[c] {
+			missing = append(missing, c)
+		}
+	}
+	return missing
+}
+
+// missingCapability is a check the token failed.
+type missingCapability struct {
+	*capabilityCheck
+	Missing []string
+}
+
+// preflightReport describes the token of a cluster.
+type preflightReport struct {
+	Cluster string
+	Missing []*missingCapability
+
+	Root      bool
+	Periodic  bool
+	Period    time.Duration
+	Renewable bool
+	Expires   bool
+	TTL       time.Duration
+	Policies  []string
+
+	// Warnings are problems with the token that do not prevent the broker
+	// from starting.
+	Warnings []string
+}
+
+// fatal returns whether the token lacks capabilities the broker cannot run
+// without.
+func (r *preflightReport) fatal() bool {
+	for _, m := range r.Missing {
+		if m.Fatal {
+			return true
+		}
+	}
+	return false
+}
+
+// preflight checks the capabilities and lifetime of the broker's token on
+// every cluster.
+func (b *Broker) preflight() ([]*preflightReport, error) {
+	names := append([]string{DefaultClusterName}, b.clusterNames()...)
+	reports := make([]*preflightReport, 0, len(names))
+	for _, name := range names {
+		cluster, err := b.cluster(name)
+		if err != nil {
+			return nil, err
+		}
+		report, err := b.preflightCluster(cluster)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to check the token of cluster %q", name)
+		}
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
+
+// preflightCluster checks the token of the cluster.
+func (b *Broker) preflightCluster(cluster *vaultCluster) (*preflightReport, error) {
+	report := &preflightReport{Cluster: cluster.name}
+
+	// Look up the token
+	secret, err := cluster.client.Auth().Token().LookupSelf()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to lookup token")
+	}
+	if secret == nil || secret.Data == nil {
+		return nil, errors.New("token lookup returned no data")
+	}
+	report.Policies = toStrings(secret.Data["policies"])
+	sort.Strings(report.Policies)
+	for _, p := range report.Policies {
+		if p == "root" {
+			report.Root = true
+		}
+	}
+	report.Renewable, _ = secret.Data["renewable"].(bool)
+	if v, ok := secret.Data["period"]; ok && v != nil {
+		if report.Period, err = parseutil.ParseDurationSecond(v); err != nil {
+			return nil, errors.Wrap(err, "failed to parse token period")
+		}
+		report.Periodic = report.Period > 0
+	}
+	if v, ok := secret.Data["expire_time"]; ok && v != nil {
+		report.Expires = true
+		if report.TTL, err = parseutil.ParseDurationSecond(secret.Data["ttl"]); err != nil {
+			return nil, errors.Wrap(err, "failed to parse token ttl")
+		}
+	}
+
+	// Check the capabilities on each path
+	for _, check := range b.requiredCapabilities(cluster.name) {
+		granted, err := capabilitiesSelf(cluster.client, check.Path)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to check capabilities on %s", check.Path)
+		}
+		if missing := missingCapabilities(check.Capabilities, granted); len(missing) > 0 {
+			report.Missing = append(report.Missing, &missingCapability{check, missing})
+		}
+	}
+
+	// Warn about tokens that will stop working
+	switch {
+	case report.Root:
+		report.Warnings = append(report.Warnings,
+			"token is a root token, use a periodic token with a policy for the broker instead")
+	case !report.Expires:
+	case !report.Renewable:
+		report.Warnings = append(report.Warnings,
+			fmt.Sprintf("token expires in %s and is not renewable", report.TTL))
+	case !b.vaultRenewToken:
+		report.Warnings = append(report.Warnings,
+			fmt.Sprintf("token expires in %s and VAULT_RENEW is disabled", report.TTL))
+	case !report.Periodic:
+		report.Warnings = append(report.Warnings,
+			fmt.Sprintf("token is not periodic, it expires in %s unless renewed and stops working at its max TTL", report.TTL))
+	}
+	return report, nil
+}
+
+// capabilitiesSelf returns the capabilities of the client's token on the
+// path. Unlike Sys().CapabilitiesSelf, a malformed response is an error.
+func capabilitiesSelf(client *api.Client, path string) ([]string, error) {
+	r := client.NewRequest("POST", "/v1/sys/capabilities-self")
+	if err := r.SetJSONBody(map[string]string{"path": path}); err != nil {
+		return nil, err
+	}
+	resp, err := client.RawRequest(r)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var result struct {
+		Capabilities []string `json:"capabilities"`
+	}
+	if err := resp.DecodeJSON(&result); err != nil {
+		return nil, err
+	}
+	if result.Capabilities == nil {
+		return nil, errors.New("response has no capabilities")
+	}
+	return result.Capabilities, nil
+}
+
+// logPreflight logs the reports and returns an error if the broker cannot run
+// with the tokens.
+func (b *Broker) logPreflight(reports []*preflightReport) error {
+	var fatal []string
+	for _, r := range reports {
+		b.log.Printf("[INFO] preflight: cluster %s token has policies %s (%s)",
+			r.Cluster, strings.Join(r.Policies, ", "), r.lifetime())
+		for _, m := range r.Missing {
+			level := "[WARN]"
+			if m.Fatal {
+				level = "[ERR]"
+			}
+			b.log.Printf("%s preflight: cluster %s token lacks %s on %s, needed to %s",
+				level, r.Cluster, strings.Join(m.Missing, ", "), m.Path, m.Purpose)
+		}
+		for _, w := range r.Warnings {
+			b.log.Printf("[WARN] preflight: cluster %s %s", r.Cluster, w)
+		}
+		if r.fatal() {
+			fatal = append(fatal, r.Cluster)
+		}
+	}
+	if len(fatal) > 0 {
+		return fmt.Errorf("vault token lacks required capabilities on clusters %s", strings.Join(fatal, ", "))
+	}
+	return nil
+}
+
+// lifetime describes how long the token lives.
+func (r *preflightReport) lifetime() string {
+	var parts []string
+	switch {
+	case r.Root:
+		parts = append(parts, "root token")
+	case r.Periodic:
+		parts = append(parts, fmt.Sprintf("periodic token (%s)", r.Period))
+	}
+	if r.Expires {
+		parts = append(parts, fmt.Sprintf("ttl %s", r.TTL))
+	} else {
+		parts = append(parts, "never expires")
+	}
+	if r.Renewable {
+		parts = append(parts, "renewable")
+	} else {
+		parts = append(parts, "not renewable")
+	}
+	return strings.Join(parts, ", ")
+}
+
+// writePreflight writes the reports for an operator.
+func writePreflight(w io.Writer, reports []*preflightReport) {
+	for i, r := range reports {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintf(w, "Cluster %s\n", r.Cluster)
+		fmt.Fprintf(w, "  Token:    %s\n", r.lifetime())
+		fmt.Fprintf(w, "  Policies: %s\n", strings.Join(r.Policies, ", "))
+		if len(r.Missing) == 0 {
+			fmt.Fprintf(w, "  Capabilities: ok\n")
+		}
+		for _, m := range r.Missing {
+			severity := "warning"
+			if m.Fatal {
+				severity = "fatal"
+			}
+			fmt.Fprintf(w, "  Missing (%s): %s on %s, needed to %s\n",
+				severity, strings.Join(m.Missing, ", "), m.Path, m.Purpose)
+		}
+		for _, warning := range r.Warnings {
+			fmt.Fprintf(w, "  Warning: %s\n", warning)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMissingCapabilities(t *testing.T) {
+	cases := []struct {
+		name     string
+		required []string
+		granted  []string
+		expected []string
+	}{
+		{"granted", []string{"read", "update"}, []string{"create", "read", "update"}, nil},
+		{"missing", []string{"read", "update"}, []string{"read"}, []string{"update"}},
+		{"root", []string{"read", "update"}, []string{"root"}, nil},
+		{"deny", []string{"read"}, []string{"deny", "read"}, []string{"read"}},
+		{"none", []string{"update"}, nil, []string{"update"}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			missing := missingCapabilities(tc.required, tc.granted)
+			if !reflect.DeepEqual(missing, tc.expected) {
+				t.Fatalf("expected %v but received %v", tc.expected, missing)
+			}
+		})
+	}
+}
+
+func TestBroker_Preflight(t *testing.T) {
+	// policy grants what the sample policy in the README grants
+	policy := func(path string) []string {
+		switch {
+		case path == "sys/mounts":
+			return []string{"read", "list"}
+		case strings.HasPrefix(path, "sys/mounts/cf/"):
+			return []string{"create", "update", "delete"}
+		case strings.HasPrefix(path, "cf/"), strings.HasPrefix(path, "sys/policy/cf-"),
+			strings.HasPrefix(path, "auth/token/roles/cf-"):
+			return []string{"create", "read", "update", "delete", "list"}
+		case strings.HasPrefix(path, "auth/token/create/cf-"), path == "auth/token/revoke-accessor",
+			path == "auth/token/renew-self":
+			return []string{"create", "update"}
+		case strings.HasPrefix(path, "sys/revoke-prefix/cf/"):
+			return []string{"update", "sudo"}
+		}
+		return []string{"deny"}
+	}
+
+	cases := []struct {
+		name         string
+		token        string
+		capabilities func(path string) []string
+		missing      []string
+		fatal        bool
+		warnings     int
+	}{
+		{
+			"root",
+			`{"policies": ["root"], "renewable": false, "expire_time": null, "ttl": 0}`,
+			func(string) []string { return []string{"root"} },
+			nil, false, 1,
+		},
+		{
+			"periodic",
+			`{"policies": ["cf-broker", "default"], "renewable": true, "period": 1800, "expire_time": "2026-10-18T12:00:00Z", "ttl": 1790}`,
+			policy,
+			[]string{"sys/mounts/cf/preflight/secret/tune"}, false, 0,
+		},
+		{
+			"missing-policy",
+			`{"policies": ["default"], "renewable": true, "period": 1800, "expire_time": "2026-10-18T12:00:00Z", "ttl": 1790}`,
+			func(path string) []string {
+				if strings.HasPrefix(path, "sys/policy/") {
+					return []string{"read"}
+				}
+				return policy(path)
+			},
+			[]string{
+				"sys/mounts/cf/preflight/secret/tune",
+				"sys/policy/cf-preflight",
+				"sys/policy/cf-preflight-app-preflight",
+				"sys/policy/cf-preflight-binding-preflight",
+			}, true, 0,
+		},
+		{
+			"instance-roles-only",
+			`{"policies": ["cf-broker"], "renewable": true, "period": 1800, "expire_time": "2026-10-18T12:00:00Z", "ttl": 1790}`,
+			func(path string) []string {
+				if strings.HasPrefix(path, "sys/revoke-prefix/") ||
+					(strings.HasPrefix(path, "auth/token/") && strings.Contains(path, "cf-preflight-")) {
+					return []string{"deny"}
+				}
+				return policy(path)
+			},
+			[]string{
+				"sys/mounts/cf/preflight/secret/tune",
+				"auth/token/roles/cf-preflight-app-preflight",
+				"auth/token/create/cf-preflight-app-preflight",
+				"auth/token/roles/cf-preflight-binding-preflight",
+				"auth/token/create/cf-preflight-binding-preflight",
+				"sys/revoke-prefix/cf/preflight/database/creds/preflight",
+			}, true, 0,
+		},
+		{
+			"expiring",
+			`{"policies": ["cf-broker"], "renewable": false, "expire_time": "2026-10-18T12:00:00Z", "ttl": 600}`,
+			func(string) []string { return []string{"create", "read", "update", "delete", "list", "sudo"} },
+			nil, false, 1,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			env, closer := defaultEnvironment(t)
+			defer closer()
+
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch {
+				case r.URL.Path == "/v1/auth/token/lookup-self":
+					w.Write([]byte(`{"data": ` + tc.token + `}`))
+				case r.URL.Path == "/v1/sys/capabilities-self":
+					var body struct {
+						Path string `json:"path"`
+					}
+					if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+						w.WriteHeader(400)
+						return
+					}
+					json.NewEncoder(w).Encode(map[string]interface{}{
+						"capabilities": tc.capabilities(body.Path),
+					})
+				default:
+					env.Handler.ServeHTTP(w, r)
+				}
+			}))
+			defer ts.Close()
+			env.Broker.vaultClient = boundableClient(t, ts)
+			env.Broker.vaultRenewToken = true
+
+			reports, err := env.Broker.preflight()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(reports) != 1 {
+				t.Fatalf("expected 1 report but received %d", len(reports))
+			}
+			report := reports[0]
+
+			var missing []string
+			for _, m := range report.Missing {
+				missing = append(missing, m.Path)
+			}
+			if !reflect.DeepEqual(missing, tc.missing) {
+				t.Fatalf("expected %v but received %v", tc.missing, missing)
+			}
+			if report.fatal() != tc.fatal {
+				t.Fatalf("expected fatal %t but received %t", tc.fatal, report.fatal())
+			}
+			if len(report.Warnings) != tc.warnings {
+				t.Fatalf("expected %d warnings but received %v", tc.warnings, report.Warnings)
+			}
+
+			// The broker refuses to start on fatal gaps
+			err = env.Broker.Start()
+			if tc.fatal && err == nil {
+				t.Fatal("expected error")
+			}
+			if !tc.fatal {
+				if err != nil {
+					t.Fatal(err)
+				}
+				env.Broker.Stop()
+			}
+		})
+	}
+}
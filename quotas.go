@@ -0,0 +1,379 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/pivotal-cf/brokerapi"
+	"github.com/pkg/errors"
+)
+
+// Quota limits the instances and bindings of an organization or space. Zero
+// means unlimited.
+type Quota struct {
+	// Instances is the maximum number of instances.
+	Instances int `json:"instances,omitempty"`
+
+	// PlanInstances is the maximum number of instances of each plan, keyed by
+	// plan name.
+	PlanInstances map[string]int `json:"plan_instances,omitempty"`
+
+	// InstanceBindings is the maximum number of bindings of each instance.
+	InstanceBindings int `json:"instance_bindings,omitempty"`
+}
+
+// Validate checks that no limit is negative.
+func (q *Quota) Validate() error {
+	if q.Instances < 0 || q.InstanceBindings < 0 {
+		return fmt.Errorf("quota limits must not be negative")
+	}
+	for plan, limit := range q.PlanInstances {
+		if limit < 0 {
+			return fmt.Errorf("quota limit of plan %q must not be negative", plan)
+		}
+	}
+	return nil
+}
+
+// Quotas are the default quotas of every organization and space. It is
+// decoded from a JSON object by envconfig.
+type Quotas struct {
+	Organization Quota `json:"organization"`
+	Space        Quota `json:"space"`
+}
+
+// Decode implements envconfig.Decoder.
+func (q *Quotas) Decode(value string) error {
+	var quotas Quotas
+	if err := json.Unmarshal([]byte(value), &quotas); err != nil {
+		return fmt.Errorf("failed to parse quotas: %s", err)
+	}
+	*q = quotas
+	return nil
+}
+
+// Validate checks the quotas and that they only refer to known plans.
+func (q *Quotas) Validate(plans Plans) error {
+	names := make(map[string]bool, len(plans))
+	for _, plan := range plans {
+		names[plan.Name] = true
+	}
+	for kind, quota := range map[string]*Quota{"organization": &q.Organization, "space": &q.Space} {
+		if err := quota.Validate(); err != nil {
+			return fmt.Errorf("invalid %s quota: %s", kind, err)
+		}
+		for plan := range quota.PlanInstances {
+			if !names[plan] {
+				return fmt.Errorf("%s quota refers to unknown plan %q", kind, plan)
+			}
+		}
+	}
+	return nil
+}
+
+// quotaOverrides replace the default quota of individual organizations and
+// spaces, keyed by GUID. They are stored at <prefix>/broker-meta/quotas.
+type quotaOverrides struct {
+	Organizations map[string]*Quota `json:"organizations"`
+	Spaces        map[string]*Quota `json:"spaces"`
+}
+
+// quotaKinds are the kinds of quota overrides, as used in the quota API.
+var quotaKinds = map[string]bool{
+	"organizations": true,
+	"spaces":        true,
+}
+
+// quotasResponse is the response to fetching the quotas.
+type quotasResponse struct {
+	Defaults      Quotas            `json:"defaults"`
+	Organizations map[string]*Quota `json:"organizations"`
+	Spaces        map[string]*Quota `json:"spaces"`
+}
+
+// quotasPath returns the path the quota overrides are stored at.
+func (b *Broker) quotasPath() string {
+	return b.metaPath() + "/quotas"
+}
+
+// restoreQuotas reads the quota overrides.
+func (b *Broker) restoreQuotas() error {
+	path := b.quotasPath()
+	b.log.Printf("[DEBUG] reading quota overrides from %s", path)
+	secret, err := b.vaultClient.Logical().Read(path)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read quota overrides at %q", path)
+	}
+
+	overrides := &quotaOverrides{}
+	if secret != nil {
+		raw, ok := secret.Data["json"].(string)
+		if !ok {
+			return fmt.Errorf("quota overrides at %q have no json", path)
+		}
+		if err := json.Unmarshal([]byte(raw), overrides); err != nil {
+			return errors.Wrapf(err, "failed to decode quota overrides at %q", path)
+		}
+	}
+	if overrides.Organizations == nil {
+		overrides.Organizations = make(map[string]*Quota)
+	}
+	if overrides.Spaces == nil {
+		overrides.Spaces = make(map[string]*Quota)
+	}
+
+	b.quotaLock.Lock()
+	b.quotaOverrides = overrides
+	b.quotaLock.Unlock()
+	return nil
+}
+
+// Quotas returns the default quotas and the overrides.
+func (b *Broker) Quotas() *quotasResponse {
+	b.quotaLock.Lock()
+	defer b.quotaLock.Unlock()
+
+	resp := &quotasResponse{
+		Defaults:      b.quotas,
+		Organizations: make(map[string]*Quota),
+		Spaces:        make(map[string]*Quota),
+	}
+	if b.quotaOverrides != nil {
+		for k, v := range b.quotaOverrides.Organizations {
+			resp.Organizations[k] = v
+		}
+		for k, v := range b.quotaOverrides.Spaces {
+			resp.Spaces[k] = v
+		}
+	}
+	return resp
+}
+
+// SetQuota overrides the quota of the organization or space with the GUID. A
+// nil quota removes the override, restoring the default.
+func (b *Broker) SetQuota(kind, guid string, quota *Quota) error {
+	if !quotaKinds[kind] {
+		return brokerapi.NewFailureResponse(
+			fmt.Errorf("unknown quota kind %q", kind), http.StatusNotFound, "unknown-quota-kind")
+	}
+	if quota != nil {
+		if err := quota.Validate(); err != nil {
+			return brokerapi.NewFailureResponse(err, http.StatusBadRequest, "invalid-quota")
+		}
+	}
+	b.log.Printf("[INFO] setting quota of %s %s to %+v", kind, guid, quota)
+
+	b.quotaLock.Lock()
+	defer b.quotaLock.Unlock()
+
+	// Apply the change to a copy, so the overrides are only changed once they
+	// are stored
+	overrides := &quotaOverrides{
+		Organizations: make(map[string]*Quota),
+		Spaces:        make(map[string]*Quota),
+	}
+	if b.quotaOverrides != nil {
+		for k, v := range b.quotaOverrides.Organizations {
+			overrides.Organizations[k] = v
+		}
+		for k, v := range b.quotaOverrides.Spaces {
+			overrides.Spaces[k] = v
+		}
+	}
+	m := overrides.Organizations
+	if kind == "spaces" {
+		m = overrides.Spaces
+	}
+	if quota == nil {
+		delete(m, guid)
+	} else {
+		m[guid] = quota
+	}
+
+	payload, err := json.Marshal(overrides)
+	if err != nil {
+		return b.wErrorf(err, "failed to encode quota overrides")
+	}
+	path := b.quotasPath()
+	b.log.Printf("[DEBUG] storing quota overrides at %s", path)
+	if _, err := b.vaultClient.Logical().Write(path, map[string]interface{}{
+		"json": string(payload),
+	}); err != nil {
+		return b.wErrorf(err, "failed to commit quota overrides %s", path)
+	}
+	b.quotaOverrides = overrides
+	return nil
+}
+
+// quota returns the quota of the organization or space, which is its override
+// or the default.
+func (b *Broker) quota(kind, guid string) Quota {
+	b.quotaLock.Lock()
+	defer b.quotaLock.Unlock()
+	return b.quotaLocked(kind, guid)
+}
+
+// quotaLocked is quota with quotaLock held.
+func (b *Broker) quotaLocked(kind, guid string) Quota {
+	defaults, overrides := b.quotas.Organization, map[string]*Quota(nil)
+	if kind == "spaces" {
+		defaults = b.quotas.Space
+	}
+	if b.quotaOverrides != nil {
+		overrides = b.quotaOverrides.Organizations
+		if kind == "spaces" {
+			overrides = b.quotaOverrides.Spaces
+		}
+	}
+	if quota, ok := overrides[guid]; ok {
+		return *quota
+	}
+	return defaults
+}
+
+// reserveInstanceQuota returns ErrServiceQuotaExceeded if the organization or
+// space already has as many instances as its quota allows, and
+// ErrPlanQuotaExceeded if it has as many of the plan. Otherwise the instance
+// is counted against the quotas until the returned func is called, so
+// instances provisioned at the same time cannot exceed them. The instance
+// itself is not counted, so provisioning it again is not refused.
+func (b *Broker) reserveInstanceQuota(instanceID, orgID, spaceID, planID string) (func(), error) {
+	planName := ""
+	if plan := b.plan(planID); plan != nil {
+		planName = plan.Name
+	}
+
+	b.quotaLock.Lock()
+	defer b.quotaLock.Unlock()
+
+	orgQuota := b.quotaLocked("organizations", orgID)
+	spaceQuota := b.quotaLocked("spaces", spaceID)
+
+	// Count the instances, and those being provisioned
+	instances := make(map[string]*instanceInfo)
+	b.instancesLock.Lock()
+	for id, instance := range b.instances {
+		instances[id] = instance
+	}
+	b.instancesLock.Unlock()
+	for id, instance := range b.reservedInstances {
+		if _, ok := instances[id]; !ok {
+			instances[id] = instance
+		}
+	}
+
+	var orgInstances, orgPlanInstances, spaceInstances, spacePlanInstances int
+	for id, instance := range instances {
+		if id == instanceID || instance.OrganizationGUID != orgID {
+			continue
+		}
+		samePlan := instance.PlanID == planID
+		orgInstances++
+		if samePlan {
+			orgPlanInstances++
+		}
+		if instance.SpaceGUID == spaceID {
+			spaceInstances++
+			if samePlan {
+				spacePlanInstances++
+			}
+		}
+	}
+
+	for _, check := range []struct {
+		kind, guid string
+		quota      Quota
+		instances  int
+		planned    int
+	}{
+		{"organization", orgID, orgQuota, orgInstances, orgPlanInstances},
+		{"space", spaceID, spaceQuota, spaceInstances, spacePlanInstances},
+	} {
+		if limit := check.quota.Instances; limit > 0 && check.instances >= limit {
+			b.log.Printf("[WARN] %s %s reached its quota of %d instances", check.kind, check.guid, limit)
+			return nil, brokerapi.ErrServiceQuotaExceeded
+		}
+		if limit := check.quota.PlanInstances[planName]; limit > 0 && check.planned >= limit {
+			b.log.Printf("[WARN] %s %s reached its quota of %d instances of plan %s",
+				check.kind, check.guid, limit, planName)
+			return nil, brokerapi.ErrPlanQuotaExceeded
+		}
+	}
+
+	// Reserve the instance
+	reservation := &instanceInfo{OrganizationGUID: orgID, SpaceGUID: spaceID, PlanID: planID}
+	if b.reservedInstances == nil {
+		b.reservedInstances = make(map[string]*instanceInfo)
+	}
+	b.reservedInstances[instanceID] = reservation
+	return func() {
+		b.quotaLock.Lock()
+		if b.reservedInstances[instanceID] == reservation {
+			delete(b.reservedInstances, instanceID)
+		}
+		b.quotaLock.Unlock()
+	}, nil
+}
+
+// reserveBindingQuota returns ErrServiceQuotaExceeded if the instance already
+// has as many bindings as the quota of its organization or space allows.
+// Otherwise the binding is counted against the quota until the returned func
+// is called. Bindings being created asynchronously are counted as well. The
+// binding itself is not counted, so creating it again is not refused.
+func (b *Broker) reserveBindingQuota(instanceID, bindingID string, instance *instanceInfo) (func(), error) {
+	b.quotaLock.Lock()
+	defer b.quotaLock.Unlock()
+
+	limits := []int{
+		b.quotaLocked("organizations", instance.OrganizationGUID).InstanceBindings,
+		b.quotaLocked("spaces", instance.SpaceGUID).InstanceBindings,
+	}
+	sort.Ints(limits)
+
+	limit := 0
+	for _, l := range limits {
+		if l > 0 {
+			limit = l
+			break
+		}
+	}
+	if limit == 0 {
+		return func() {}, nil
+	}
+
+	// Count the bindings, and those being created
+	bindings := make(map[string]bool)
+	b.bindLock.Lock()
+	for _, binds := range []map[string]*bindingInfo{b.binds, b.pendingBinds} {
+		for id, info := range binds {
+			if info.instanceID == instanceID {
+				bindings[id] = true
+			}
+		}
+	}
+	b.bindLock.Unlock()
+	for id, reserved := range b.reservedBindings {
+		if reserved == instanceID {
+			bindings[id] = true
+		}
+	}
+	delete(bindings, bindingID)
+
+	if len(bindings) >= limit {
+		b.log.Printf("[WARN] instance %s reached its quota of %d bindings", instanceID, limit)
+		return nil, brokerapi.ErrServiceQuotaExceeded
+	}
+
+	// Reserve the binding
+	if b.reservedBindings == nil {
+		b.reservedBindings = make(map[string]string)
+	}
+	b.reservedBindings[bindingID] = instanceID
+	return func() {
+		b.quotaLock.Lock()
+		delete(b.reservedBindings, bindingID)
+		b.quotaLock.Unlock()
+	}, nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/pivotal-cf/brokerapi"
+)
+
+func TestQuotas_Validate(t *testing.T) {
+	plans := Plans{{Name: "shared"}}
+
+	cases := []struct {
+		name   string
+		quotas Quotas
+		err    bool
+	}{
+		{"empty", Quotas{}, false},
+		{"limits", Quotas{Organization: Quota{Instances: 10}, Space: Quota{PlanInstances: map[string]int{"shared": 2}}}, false},
+		{"negative", Quotas{Space: Quota{InstanceBindings: -1}}, true},
+		{"negative-plan", Quotas{Space: Quota{PlanInstances: map[string]int{"shared": -1}}}, true},
+		{"unknown-plan", Quotas{Organization: Quota{PlanInstances: map[string]int{"dedicated": 1}}}, true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.quotas.Validate(plans)
+			if tc.err && err == nil {
+				t.Fatal("expected error")
+			}
+			if !tc.err && err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestBroker_InstanceQuota(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	plan := env.Broker.plans[0]
+	planID := env.Broker.planID(plan)
+	env.Broker.quotas = Quotas{
+		Organization: Quota{Instances: 3},
+		Space:        Quota{PlanInstances: map[string]int{plan.Name: 1}},
+	}
+	env.Broker.instances = map[string]*instanceInfo{
+		"existing": {OrganizationGUID: env.OrganizationGUID, SpaceGUID: env.SpaceGUID, PlanID: planID},
+		"other":    {OrganizationGUID: env.OrganizationGUID, SpaceGUID: "other-space", PlanID: planID},
+	}
+
+	details := brokerapi.ProvisionDetails{
+		PlanID:           planID,
+		SpaceGUID:        env.SpaceGUID,
+		OrganizationGUID: env.OrganizationGUID,
+	}
+	if _, err := env.Broker.Provision(env.Context, env.InstanceID, details, env.Async); err != brokerapi.ErrPlanQuotaExceeded {
+		t.Fatalf("expected %v but received %v", brokerapi.ErrPlanQuotaExceeded, err)
+	}
+
+	// Provisioning an instance again does not count the instance itself
+	release, err := env.Broker.reserveInstanceQuota("existing", env.OrganizationGUID, env.SpaceGUID, planID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+
+	// Overrides replace the default quota
+	if err := env.Broker.SetQuota("spaces", env.SpaceGUID, &Quota{}); err != nil {
+		t.Fatal(err)
+	}
+	release, err = env.Broker.reserveInstanceQuota(env.InstanceID, env.OrganizationGUID, env.SpaceGUID, planID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The reservation counts until it is released
+	if _, err := env.Broker.reserveInstanceQuota("third", env.OrganizationGUID, "other-space", planID); err != brokerapi.ErrServiceQuotaExceeded {
+		t.Fatalf("expected %v but received %v", brokerapi.ErrServiceQuotaExceeded, err)
+	}
+	release()
+
+	env.Broker.instances["third"] = &instanceInfo{OrganizationGUID: env.OrganizationGUID, SpaceGUID: "other-space"}
+	if _, err := env.Broker.reserveInstanceQuota(env.InstanceID, env.OrganizationGUID, env.SpaceGUID, planID); err != brokerapi.ErrServiceQuotaExceeded {
+		t.Fatalf("expected %v but received %v", brokerapi.ErrServiceQuotaExceeded, err)
+	}
+
+	// Removing the override restores the default
+	if err := env.Broker.SetQuota("spaces", env.SpaceGUID, nil); err != nil {
+		t.Fatal(err)
+	}
+	if quota := env.Broker.quota("spaces", env.SpaceGUID); quota.PlanInstances[plan.Name] != 1 {
+		t.Fatalf("expected the default quota but received %+v", quota)
+	}
+}
+
+func TestBroker_BindingQuota(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	env.Broker.quotas = Quotas{
+		Organization: Quota{InstanceBindings: 5},
+		Space:        Quota{InstanceBindings: 1},
+	}
+	env.Broker.instances = map[string]*instanceInfo{
+		env.InstanceID: {OrganizationGUID: env.OrganizationGUID, SpaceGUID: env.SpaceGUID},
+	}
+	env.Broker.binds = map[string]*bindingInfo{
+		"existing":  {instanceID: env.InstanceID},
+		"elsewhere": {instanceID: "other-instance"},
+	}
+
+	// The lower of the organization and space limits applies
+	if _, err := env.Broker.Bind(env.Context, env.InstanceID, env.BindingID, brokerapi.BindDetails{}); err != brokerapi.ErrServiceQuotaExceeded {
+		t.Fatalf("expected %v but received %v", brokerapi.ErrServiceQuotaExceeded, err)
+	}
+	if _, _, err := env.Broker.BindAsync(env.Context, env.InstanceID, env.BindingID, brokerapi.BindDetails{}); err != brokerapi.ErrServiceQuotaExceeded {
+		t.Fatalf("expected %v but received %v", brokerapi.ErrServiceQuotaExceeded, err)
+	}
+
+	// Bindings being created count against the quota until they are
+	delete(env.Broker.binds, "existing")
+	release, err := env.Broker.reserveBindingQuota(env.InstanceID, "reserved", env.Broker.instances[env.InstanceID])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := env.Broker.Bind(env.Context, env.InstanceID, env.BindingID, brokerapi.BindDetails{}); err != brokerapi.ErrServiceQuotaExceeded {
+		t.Fatalf("expected %v but received %v", brokerapi.ErrServiceQuotaExceeded, err)
+	}
+	release()
+
+	env.Broker.pendingBinds = map[string]*bindingInfo{"pending": {instanceID: env.InstanceID}}
+	if _, err := env.Broker.Bind(env.Context, env.InstanceID, env.BindingID, brokerapi.BindDetails{}); err != brokerapi.ErrServiceQuotaExceeded {
+		t.Fatalf("expected %v but received %v", brokerapi.ErrServiceQuotaExceeded, err)
+	}
+	delete(env.Broker.pendingBinds, "pending")
+
+	if _, err := env.Broker.Bind(env.Context, env.InstanceID, env.BindingID, brokerapi.BindDetails{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(env.Broker.reservedBindings) != 0 {
+		t.Fatalf("expected the reservation to be released but received %v", env.Broker.reservedBindings)
+	}
+}
+
+func TestHandler_Quotas(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	env.Broker.quotas = Quotas{Space: Quota{Instances: 2}}
+
+	var quota Quota
+	if code := serveBroker(t, env, "PUT", "/quotas/spaces/space-guid", `{"instances": 10}`, &quota); code != 200 {
+		t.Fatalf("expected 200 but received %d", code)
+	}
+
+	var quotas quotasResponse
+	if code := serveBroker(t, env, "GET", "/quotas", "", &quotas); code != 200 {
+		t.Fatalf("expected 200 but received %d", code)
+	}
+	if quotas.Defaults.Space.Instances != 2 {
+		t.Fatalf("expected %d but received %d", 2, quotas.Defaults.Space.Instances)
+	}
+	if override := quotas.Spaces["space-guid"]; override == nil || override.Instances != 10 {
+		t.Fatalf("expected an override of 10 instances but received %+v", override)
+	}
+
+	var failure brokerapi.ErrorResponse
+	if code := serveBroker(t, env, "PUT", "/quotas/spaces/space-guid", `{"instances": -1}`, &failure); code != 400 {
+		t.Fatalf("expected 400 but received %d", code)
+	}
+	if code := serveBroker(t, env, "PUT", "/quotas/clusters/space-guid", `{}`, &failure); code != 404 {
+		t.Fatalf("expected 404 but received %d", code)
+	}
+
+	if code := serveBroker(t, env, "DELETE", "/quotas/spaces/space-guid", "", nil); code != 200 {
+		t.Fatalf("expected 200 but received %d", code)
+	}
+	if quota := env.Broker.quota("spaces", "space-guid"); quota.Instances != 2 {
+		t.Fatalf("expected the default quota but received %+v", quota)
+	}
+}
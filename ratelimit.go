@@ -0,0 +1,354 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pivotal-cf/brokerapi"
+)
+
+// rateLimitRejections counts the requests rejected by the rate limiter, keyed
+// by "endpoint.<name>", "identity" and "concurrency". It is served with the
+// other metrics at /debug/vars.
+var rateLimitRejections = expvar.NewMap("rate_limit_rejections")
+
+// osbEndpoints are the names of the OSB endpoints rate limits and operation
+// timeouts can be configured for.
+var osbEndpoints = map[string]bool{
+	"catalog":                true,
+	"provision":              true,
+	"deprovision":            true,
+	"update":                 true,
+	"get_instance":           true,
+	"last_operation":         true,
+	"bind":                   true,
+	"unbind":                 true,
+	"get_binding":            true,
+	"binding_last_operation": true,
+}
+
+// RateLimit allows Rate requests per second on average, with bursts of up to
+// Burst requests. Burst defaults to Rate rounded up.
+type RateLimit struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+}
+
+// Validate checks the rate is positive and defaults the burst.
+func (l *RateLimit) Validate() error {
+	if l.Rate <= 0 {
+		return fmt.Errorf("rate must be positive")
+	}
+	if l.Burst < 0 {
+		return fmt.Errorf("burst must not be negative")
+	}
+	if l.Burst == 0 {
+		l.Burst = int(math.Ceil(l.Rate))
+	}
+	return nil
+}
+
+// Decode implements envconfig.Decoder.
+func (l *RateLimit) Decode(value string) error {
+	if err := json.Unmarshal([]byte(value), l); err != nil {
+		return fmt.Errorf("failed to parse rate limit: %s", err)
+	}
+	return nil
+}
+
+// RateLimits are the rate limits of OSB endpoints keyed by endpoint name. It is
+// decoded from a JSON object by envconfig.
+type RateLimits map[string]*RateLimit
+
+// Decode implements envconfig.Decoder.
+func (l *RateLimits) Decode(value string) error {
+	limits := make(RateLimits)
+	if err := json.Unmarshal([]byte(value), &limits); err != nil {
+		return fmt.Errorf("failed to parse rate limits: %s", err)
+	}
+	*l = limits
+	return nil
+}
+
+// Validate checks the endpoint names and limits.
+func (l RateLimits) Validate() error {
+	for name, limit := range l {
+		if !osbEndpoints[name] {
+			return fmt.Errorf("unknown rate limit endpoint %q", name)
+		}
+		if limit == nil {
+			return fmt.Errorf("missing rate limit for %q", name)
+		}
+		if err := limit.Validate(); err != nil {
+			return fmt.Errorf("invalid rate limit for %q: %s", name, err)
+		}
+	}
+	return nil
+}
+
+// tokenBucket is a token bucket refilled at rate tokens per second up to
+// burst tokens. It is not safe for concurrent use.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(limit *RateLimit, now time.Time) *tokenBucket {
+	return &tokenBucket{
+		rate:   limit.Rate,
+		burst:  float64(limit.Burst),
+		tokens: float64(limit.Burst),
+		last:   now,
+	}
+}
+
+// refill adds the tokens accumulated since the last call.
+func (b *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(b.burst, b.tokens+elapsed*b.rate)
+		b.last = now
+	}
+}
+
+// check reports whether a token is available. If not, it returns how long
+// until one is.
+func (b *tokenBucket) check(now time.Time) (bool, time.Duration) {
+	b.refill(now)
+	if b.tokens >= 1 {
+		return true, 0
+	}
+	wait := (1 - b.tokens) / b.rate
+	return false, time.Duration(wait * float64(time.Second))
+}
+
+// take takes a token if one is available.
+func (b *tokenBucket) take(now time.Time) bool {
+	if ok, _ := b.check(now); !ok {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// rateLimiter limits the OSB requests served by the broker. Each endpoint with
+// a limit has a bucket shared by all callers, each originating identity has a
+// bucket shared by all endpoints, and a limited number of requests are served
+// at a time.
+type rateLimiter struct {
+	endpoints RateLimits
+	identity  *RateLimit
+
+	// concurrency holds a token for each request being served. It is nil if
+	// concurrency is not limited.
+	concurrency chan struct{}
+
+	// now returns the current time. It is replaced in tests.
+	now func() time.Time
+
+	lock       sync.Mutex
+	buckets    map[string]*tokenBucket
+	lastPruned time.Time
+}
+
+// newRateLimiter returns a rate limiter for the limits in the configuration,
+// or nil if none are configured.
+func newRateLimiter(config *Configuration) *rateLimiter {
+	identity := &config.IdentityRateLimit
+	if identity.Rate == 0 {
+		identity = nil
+	}
+	if len(config.RateLimits) == 0 && identity == nil && config.MaxConcurrentRequests == 0 {
+		return nil
+	}
+	l := &rateLimiter{
+		endpoints: config.RateLimits,
+		identity:  identity,
+		now:       time.Now,
+		buckets:   make(map[string]*tokenBucket),
+	}
+	if config.MaxConcurrentRequests > 0 {
+		l.concurrency = make(chan struct{}, config.MaxConcurrentRequests)
+	}
+	return l
+}
+
+// allow takes a token from the bucket of the endpoint and of the identity. If
+// either is empty, it returns the reason and how long until the request may
+// be retried.
+func (l *rateLimiter) allow(endpoint, identity string) (string, time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := l.now()
+	l.prune(now)
+
+	// Check both buckets before taking from either, so a request rejected by
+	// one does not use up the other.
+	buckets := make(map[string]*tokenBucket, 2)
+	reasons := make([]string, 0, 2)
+	if limit, ok := l.endpoints[endpoint]; ok {
+		reason := "endpoint." + endpoint
+		buckets[reason] = l.bucket(reason, limit, now)
+		reasons = append(reasons, reason)
+	}
+	if l.identity != nil {
+		buckets["identity"] = l.bucket("identity."+identity, l.identity, now)
+		reasons = append(reasons, "identity")
+	}
+	for _, reason := range reasons {
+		if ok, wait := buckets[reason].check(now); !ok {
+			return reason, wait
+		}
+	}
+	for _, bucket := range buckets {
+		bucket.take(now)
+	}
+	return "", 0
+}
+
+// bucket returns the bucket with the key, creating it if necessary. The lock
+// must be held.
+func (l *rateLimiter) bucket(key string, limit *RateLimit, now time.Time) *tokenBucket {
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = newTokenBucket(limit, now)
+		l.buckets[key] = bucket
+	}
+	return bucket
+}
+
+// prune removes the buckets that have refilled completely, since they are the
+// same as new ones. This keeps the buckets of identities that stopped sending
+// requests from piling up. The lock must be held.
+func (l *rateLimiter) prune(now time.Time) {
+	if now.Sub(l.lastPruned) < time.Minute {
+		return
+	}
+	l.lastPruned = now
+	for key, bucket := range l.buckets {
+		bucket.refill(now)
+		if bucket.tokens >= bucket.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// acquire takes a concurrency token, returning false if all are taken.
+func (l *rateLimiter) acquire() bool {
+	if l.concurrency == nil {
+		return true
+	}
+	select {
+	case l.concurrency <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// release returns a concurrency token taken by acquire.
+func (l *rateLimiter) release() {
+	if l.concurrency != nil {
+		<-l.concurrency
+	}
+}
+
+// rateLimitHandler rejects OSB requests that exceed the limits of the limiter
+// with a 429 and a Retry-After header. It must be wrapped by
+// originatingIdentityHandler so the identity of the request is known, and by
+// the broker's authentication so unauthenticated requests neither count nor
+// pick the identity whose bucket is used. Requests outside of /v2/ are passed
+// through.
+func rateLimitHandler(logger *log.Logger, limiter *rateLimiter, next http.Handler) http.Handler {
+	if limiter == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/v2/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		endpoint := osbEndpoint(r)
+		identity := originatingIdentity(r.Context()).String()
+		if identity == "" {
+			identity = "anonymous"
+		}
+
+		if reason, wait := limiter.allow(endpoint, identity); reason != "" {
+			logger.Printf("[WARN] rate limited %s request from %s (%s)", endpoint, identity, reason)
+			rejectRateLimited(w, reason, wait)
+			return
+		}
+
+		if !limiter.acquire() {
+			logger.Printf("[WARN] rejected %s request from %s: too many concurrent requests", endpoint, identity)
+			rejectRateLimited(w, "concurrency", time.Second)
+			return
+		}
+		defer limiter.release()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// rejectRateLimited counts the rejection and responds with a 429 asking the
+// caller to retry after wait, rounded up to whole seconds.
+func rejectRateLimited(w http.ResponseWriter, reason string, wait time.Duration) {
+	rateLimitRejections.Add(reason, 1)
+
+	seconds := int(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	respondJSON(w, http.StatusTooManyRequests, brokerapi.ErrorResponse{
+		Error:       "RateLimited",
+		Description: "too many requests, retry later",
+	})
+}
+
+// osbEndpoint returns the name of the OSB endpoint of the request, or the
+// empty string if it is not one.
+func osbEndpoint(r *http.Request) string {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(parts) == 2 && parts[1] == "catalog":
+		return "catalog"
+	case len(parts) == 3 && parts[1] == "service_instances":
+		switch r.Method {
+		case "PUT":
+			return "provision"
+		case "DELETE":
+			return "deprovision"
+		case "PATCH":
+			return "update"
+		case "GET":
+			return "get_instance"
+		}
+	case len(parts) == 4 && parts[1] == "service_instances" && parts[3] == "last_operation":
+		return "last_operation"
+	case len(parts) == 5 && parts[3] == "service_bindings":
+		switch r.Method {
+		case "PUT":
+			return "bind"
+		case "DELETE":
+			return "unbind"
+		case "GET":
+			return "get_binding"
+		}
+	case len(parts) == 6 && parts[3] == "service_bindings" && parts[5] == "last_operation":
+		return "binding_last_operation"
+	}
+	return ""
+}
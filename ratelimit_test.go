@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+func TestOSBEndpoint(t *testing.T) {
+	cases := []struct {
+		method   string
+		path     string
+		endpoint string
+	}{
+		{"GET", "/v2/catalog", "catalog"},
+		{"PUT", "/v2/service_instances/instance-id", "provision"},
+		{"PATCH", "/v2/service_instances/instance-id", "update"},
+		{"DELETE", "/v2/service_instances/instance-id", "deprovision"},
+		{"GET", "/v2/service_instances/instance-id", "get_instance"},
+		{"GET", "/v2/service_instances/instance-id/last_operation", "last_operation"},
+		{"PUT", "/v2/service_instances/instance-id/service_bindings/binding-id", "bind"},
+		{"DELETE", "/v2/service_instances/instance-id/service_bindings/binding-id", "unbind"},
+		{"GET", "/v2/service_instances/instance-id/service_bindings/binding-id", "get_binding"},
+		{"GET", "/v2/service_instances/instance-id/service_bindings/binding-id/last_operation", "binding_last_operation"},
+		{"GET", "/v2/unknown", ""},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.method+" "+tc.path, func(t *testing.T) {
+			r := httptest.NewRequest(tc.method, tc.path, nil)
+			if endpoint := osbEndpoint(r); endpoint != tc.endpoint {
+				t.Fatalf("expected %q but received %q", tc.endpoint, endpoint)
+			}
+		})
+	}
+}
+
+func TestRateLimitHandler(t *testing.T) {
+	now := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	limiter := &rateLimiter{
+		endpoints: RateLimits{"bind": {Rate: 0.5, Burst: 2}},
+		identity:  &RateLimit{Rate: 10, Burst: 3},
+		now:       func() time.Time { return now },
+		buckets:   make(map[string]*tokenBucket),
+	}
+	handler := rateLimitHandler(log.New(ioutil.Discard, "", 0), limiter, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	handler = originatingIdentityHandler(log.New(ioutil.Discard, "", 0), handler)
+
+	serve := func(method, path, user string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, nil)
+		if user != "" {
+			r.Header.Set(OriginatingIdentityHeader, "cloudfoundry "+base64.StdEncoding.EncodeToString([]byte(`{"user_id": "`+user+`"}`)))
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+	bind := "/v2/service_instances/instance-id/service_bindings/binding-id"
+	rejected := func(reason string) int64 {
+		if v, ok := rateLimitRejections.Get(reason).(interface{ Value() int64 }); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	endpointRejections := rejected("endpoint.bind")
+
+	// The burst of the endpoint is shared by all users
+	for _, user := range []string{"alice", "bob"} {
+		if w := serve("PUT", bind, user); w.Code != http.StatusOK {
+			t.Fatalf("expected 200 but received %d", w.Code)
+		}
+	}
+	w := serve("PUT", bind, "carol")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429 but received %d", w.Code)
+	}
+	if retry, _ := strconv.Atoi(w.Header().Get("Retry-After")); retry != 2 {
+		t.Fatalf("expected a retry after 2s but received %q", w.Header().Get("Retry-After"))
+	}
+	if n := rejected("endpoint.bind"); n != endpointRejections+1 {
+		t.Fatalf("expected %d rejections but received %d", endpointRejections+1, n)
+	}
+
+	// Other endpoints are only limited per user
+	identityRejections := rejected("identity")
+	for i := 0; i < 2; i++ {
+		if w := serve("GET", "/v2/catalog", "alice"); w.Code != http.StatusOK {
+			t.Fatalf("expected 200 but received %d", w.Code)
+		}
+	}
+	if w := serve("GET", "/v2/catalog", "alice"); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429 but received %d", w.Code)
+	}
+	if w := serve("GET", "/v2/catalog", "bob"); w.Code != http.StatusOK {
+		t.Fatalf("expected 200 but received %d", w.Code)
+	}
+	if n := rejected("identity"); n != identityRejections+1 {
+		t.Fatalf("expected %d rejections but received %d", identityRejections+1, n)
+	}
+
+	// Buckets refill over time
+	now = now.Add(2 * time.Second)
+	if w := serve("PUT", bind, "carol"); w.Code != http.StatusOK {
+		t.Fatalf("expected 200 but received %d", w.Code)
+	}
+
+	// Requests outside of the broker API are not limited
+	for i := 0; i < 5; i++ {
+		if w := serve("GET", "/dashboard/instance-id", "alice"); w.Code != http.StatusOK {
+			t.Fatalf("expected 200 but received %d", w.Code)
+		}
+	}
+}
+
+func TestRateLimitHandler_Concurrency(t *testing.T) {
+	limiter := &rateLimiter{
+		concurrency: make(chan struct{}, 1),
+		now:         time.Now,
+		buckets:     make(map[string]*tokenBucket),
+	}
+	started, release := make(chan struct{}), make(chan struct{})
+	handler := rateLimitHandler(log.New(ioutil.Discard, "", 0), limiter, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	}))
+
+	done := make(chan struct{})
+	go func() {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/v2/catalog", nil))
+		close(done)
+	}()
+	<-started
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/v2/catalog", nil))
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "1" {
+		t.Fatalf("expected 429 with a retry after 1s but received %d %q", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	close(release)
+	<-done
+	if !limiter.acquire() {
+		t.Fatal("expected the concurrency token to be released")
+	}
+}
+
+func TestHandler_RateLimit_Authenticated(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	limiter := &rateLimiter{
+		endpoints: RateLimits{"catalog": {Rate: 0.001, Burst: 1}},
+		now:       time.Now,
+		buckets:   make(map[string]*tokenBucket),
+	}
+	auth := newBrokerAuth(brokerapi.BrokerCredentials{Username: "user", Password: "pass"})
+	handler := newHandler(env.Broker, lager.NewLogger("test"), auth, limiter)
+
+	serve := func(password string) int {
+		r := httptest.NewRequest("GET", "/v2/catalog", nil)
+		r.SetBasicAuth("user", password)
+		r.Header.Set("X-Broker-API-Version", "2.14")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	// Unauthenticated requests are refused without using up the limit
+	for i := 0; i < 3; i++ {
+		if code := serve("wrong"); code != http.StatusUnauthorized {
+			t.Fatalf("expected 401 but received %d", code)
+		}
+	}
+	if code := serve("pass"); code != http.StatusOK {
+		t.Fatalf("expected 200 but received %d", code)
+	}
+	if code := serve("pass"); code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429 but received %d", code)
+	}
+}
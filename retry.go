@@ -0,0 +1,457 @@
+package main
+
+import (
+	"bytes"
+	"expvar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/pivotal-cf/brokerapi"
+	"github.com/pkg/errors"
+	"github.com/sethgrid/pester"
+)
+
+const (
+	// VaultMaxRedirects is the number of standby redirects followed for each
+	// attempt of a request.
+	VaultMaxRedirects = 3
+)
+
+// ErrVaultUnavailable is returned for Vault requests while the circuit breaker
+// is open.
+var ErrVaultUnavailable = errors.New("vault is unavailable, not sending requests until it recovers")
+
+// vaultRetryStats counts the "retries" of Vault requests, the "redirects"
+// followed, the "breaker_trips" and the "breaker_rejections" of requests while
+// the breaker was open. It is served with the other metrics at /debug/vars.
+var vaultRetryStats = expvar.NewMap("vault_retries")
+
+// idempotentMethods are the methods of the Vault requests that are safe to
+// send again. Vault uses PUT and POST for writes that are not idempotent, such
+// as creating tokens, so they are not retried unless Vault did not process
+// them.
+var idempotentMethods = map[string]bool{
+	"GET":     true,
+	"HEAD":    true,
+	"OPTIONS": true,
+	"LIST":    true,
+	"DELETE":  true,
+}
+
+// RetryConfig configures how Vault requests are retried and when the circuit
+// breaker opens.
+type RetryConfig struct {
+	// MaxRetries is the number of times a request is retried. Zero disables
+	// retries.
+	MaxRetries int
+
+	// MinWait and MaxWait bound the exponential backoff between retries.
+	MinWait time.Duration
+	MaxWait time.Duration
+
+	// BreakerThreshold is the number of consecutive failed requests that
+	// opens the circuit breaker. Zero disables the breaker.
+	BreakerThreshold int
+
+	// BreakerCooldown is how long the breaker stays open before a request is
+	// let through to test whether Vault has recovered.
+	BreakerCooldown time.Duration
+}
+
+// Validate checks the configuration.
+func (c *RetryConfig) Validate() error {
+	if c.MaxRetries < 0 {
+		return fmt.Errorf("VAULT_RETRY_MAX must not be negative")
+	}
+	if c.MinWait <= 0 || c.MaxWait < c.MinWait {
+		return fmt.Errorf("VAULT_RETRY_WAIT_MIN must be positive and at most VAULT_RETRY_WAIT_MAX")
+	}
+	if c.BreakerThreshold < 0 {
+		return fmt.Errorf("VAULT_BREAKER_THRESHOLD must not be negative")
+	}
+	if c.BreakerThreshold > 0 && c.BreakerCooldown <= 0 {
+		return fmt.Errorf("VAULT_BREAKER_COOLDOWN must be positive")
+	}
+	return nil
+}
+
+// newVaultClient creates a client for the Vault configuration whose requests
+// are retried and guarded by a circuit breaker. A nil retry configuration
+// leaves the client as it is. The requests of the client can be bound to a
+// context with withContext.
+func newVaultClient(logger *log.Logger, name string, vaultConfig *api.Config, retry *RetryConfig) (*api.Client, error) {
+	client, err := api.NewClient(vaultConfig)
+	if err != nil {
+		return nil, err
+	}
+	vaultConfigsLock.Lock()
+	vaultConfigs[client] = vaultConfig
+	vaultConfigsLock.Unlock()
+	if retry == nil {
+		return client, nil
+	}
+
+	// Retry in the transport rather than in the client, whose pester client
+	// would retry every request with a 5xx, including writes, and ignore
+	// Retry-After
+	client.SetMaxRetries(0)
+	vaultConfig.HttpClient.Transport = &retryTransport{
+		next:    vaultConfig.HttpClient.Transport,
+		config:  retry,
+		breaker: newCircuitBreaker(logger, name, retry),
+		log:     logger,
+	}
+	return client, nil
+}
+
+// retryTransport sends Vault requests with pester, following standby
+// redirects and retrying failed requests with jittered exponential backoff.
+type retryTransport struct {
+	next    http.RoundTripper
+	config  *RetryConfig
+	breaker *circuitBreaker
+	log     *log.Logger
+}
+
+// RoundTrip implements http.RoundTripper. pester sends the attempts of the
+// request and waits between them, while attempt decides which failures are
+// retried.
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	a := &attempt{
+		transport:  t,
+		method:     req.Method,
+		path:       req.URL.Path,
+		idempotent: idempotentMethods[req.Method],
+	}
+	client := pester.NewExtendedClient(&http.Client{
+		Transport: a,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			// Leave the redirects follow did not take to the Vault client
+			return http.ErrUseLastResponse
+		},
+	})
+	// pester counts the first attempt as a retry
+	client.MaxRetries = t.config.MaxRetries + 1
+	client.Backoff = a.backoff
+
+	// pester replaces the body of the request it is given for each attempt
+	resp, err := client.Do(req.WithContext(req.Context()))
+	if urlErr, ok := err.(*url.Error); ok {
+		// The Vault client wraps the error itself
+		err = urlErr.Err
+	}
+	return resp, err
+}
+
+// attempt sends the attempts of a request for pester. Requests are only
+// retried if they are idempotent or Vault did not process them, that is if the
+// connection was refused or Vault responded with a 503. pester retries every
+// error and 5xx, so once the outcome of the request is final, it is returned
+// again for the remaining attempts without sending the request.
+type attempt struct {
+	transport  *retryTransport
+	method     string
+	path       string
+	idempotent bool
+
+	// sent is the number of attempts sent, wait is how long to wait before
+	// the next one and reason is why the last one failed.
+	sent   int
+	wait   time.Duration
+	reason string
+
+	// done is set once the outcome is final, and resp, body and err hold it.
+	done bool
+	resp *http.Response
+	body []byte
+	err  error
+}
+
+// RoundTrip implements http.RoundTripper.
+func (a *attempt) RoundTrip(req *http.Request) (*http.Response, error) {
+	if a.done {
+		return a.replay()
+	}
+
+	t := a.transport
+	if !t.breaker.allow() {
+		vaultRetryStats.Add("breaker_rejections", 1)
+		return a.final(nil, ErrVaultUnavailable)
+	}
+
+	resp, err := t.follow(req)
+	if err != nil && req.Context().Err() != nil {
+		// The caller gave up, which says nothing about Vault
+		t.breaker.abort()
+		return a.final(nil, err)
+	}
+	t.breaker.record(err == nil && !vaultDown(resp.StatusCode))
+
+	// Determine whether to retry the request
+	switch {
+	case err != nil:
+		if !a.idempotent && !refused(err) {
+			return a.final(nil, err)
+		}
+		a.reason = err.Error()
+	case resp.StatusCode == http.StatusServiceUnavailable:
+		a.reason = resp.Status
+	case resp.StatusCode >= 500:
+		if !a.idempotent {
+			return a.final(resp, nil)
+		}
+		a.reason = resp.Status
+	default:
+		return resp, nil
+	}
+
+	a.wait = t.backoff(a.sent)
+	a.sent++
+	if resp != nil {
+		if after, ok := retryAfter(resp, time.Now()); ok {
+			if after > t.config.MaxWait {
+				return a.final(resp, nil)
+			}
+			a.wait = after
+		}
+	}
+	return resp, err
+}
+
+// backoff is the backoff strategy of pester. It logs the retry of the
+// attempt that failed.
+func (a *attempt) backoff(int) time.Duration {
+	if a.done {
+		// The remaining attempts are not sent, so they are not waited for
+		return 0
+	}
+	a.transport.log.Printf("[WARN] retrying %s %s in %s (%d of %d): %s",
+		a.method, a.path, a.wait, a.sent, a.transport.config.MaxRetries, a.reason)
+	vaultRetryStats.Add("retries", 1)
+	return a.wait
+}
+
+// final records the outcome of the request. The body of the response is read
+// so it can be returned for each remaining attempt.
+func (a *attempt) final(resp *http.Response, err error) (*http.Response, error) {
+	a.done = true
+	a.err = err
+	if resp != nil {
+		body, readErr := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if readErr != nil {
+			a.err = readErr
+		} else {
+			a.resp, a.body = resp, body
+		}
+	}
+	return a.replay()
+}
+
+// replay returns the final outcome of the request.
+func (a *attempt) replay() (*http.Response, error) {
+	if a.resp == nil {
+		return nil, a.err
+	}
+	resp := *a.resp
+	resp.Body = ioutil.NopCloser(bytes.NewReader(a.body))
+	return &resp, nil
+}
+
+// follow sends the request, following redirects from standby nodes to the
+// active node. Redirects that would downgrade from https are refused.
+func (t *retryTransport) follow(req *http.Request) (*http.Response, error) {
+	r, err := rewind(req, req.URL)
+	if err != nil {
+		return nil, err
+	}
+	for redirects := 0; ; redirects++ {
+		resp, err := t.next.RoundTrip(r)
+		if err != nil || redirects >= VaultMaxRedirects {
+			return resp, err
+		}
+		if resp.StatusCode != http.StatusTemporaryRedirect && resp.StatusCode != http.StatusPermanentRedirect {
+			return resp, nil
+		}
+		location, err := resp.Location()
+		if err != nil || (r.URL.Scheme == "https" && location.Scheme != "https") {
+			// Leave the redirect to the client, which reports the error
+			return resp, nil
+		}
+		next, err := rewind(req, location)
+		if err != nil {
+			return resp, nil
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+
+		t.log.Printf("[DEBUG] following redirect of %s %s to %s", req.Method, req.URL.Path, location.Host)
+		vaultRetryStats.Add("redirects", 1)
+		r = next
+	}
+}
+
+// backoff returns how long to wait before the retry after the attempt. It
+// doubles with each attempt, up to MaxWait, and half of it is random so
+// brokers do not retry in lockstep.
+func (t *retryTransport) backoff(attempt int) time.Duration {
+	wait := t.config.MaxWait
+	if attempt < 32 {
+		if d := t.config.MinWait << uint(attempt); d > 0 && d < wait {
+			wait = d
+		}
+	}
+	return wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+}
+
+// rewind returns a copy of the request for the URL with a fresh body.
+func rewind(req *http.Request, u *url.URL) (*http.Request, error) {
+	r := req.WithContext(req.Context())
+	r.URL = u
+	r.Host = u.Host
+	if req.Body != nil && req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		r.Body = body
+	}
+	return r, nil
+}
+
+// vaultDown reports whether the status code means Vault, rather than the
+// request, is failing.
+func vaultDown(code int) bool {
+	return code == http.StatusBadGateway || code == http.StatusServiceUnavailable || code == http.StatusGatewayTimeout
+}
+
+// refused reports whether the error is a failure to connect, in which case
+// Vault never saw the request.
+func refused(err error) bool {
+	opErr, ok := err.(*net.OpError)
+	return ok && opErr.Op == "dial"
+}
+
+// retryAfter returns the wait in the Retry-After header of the response, given
+// in seconds or as a date.
+func retryAfter(resp *http.Response, now time.Time) (time.Duration, bool) {
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if wait := date.Sub(now); wait > 0 {
+			return wait, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// circuitBreaker stops requests to Vault after too many consecutive failures.
+// Once open, it lets a single request through after the cooldown: if it
+// succeeds the breaker closes, otherwise it stays open for another cooldown.
+type circuitBreaker struct {
+	name      string
+	threshold int
+	cooldown  time.Duration
+	log       *log.Logger
+
+	// now returns the current time. It is replaced in tests.
+	now func() time.Time
+
+	lock     sync.Mutex
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func newCircuitBreaker(logger *log.Logger, name string, config *RetryConfig) *circuitBreaker {
+	return &circuitBreaker{
+		name:      name,
+		threshold: config.BreakerThreshold,
+		cooldown:  config.BreakerCooldown,
+		log:       logger,
+		now:       time.Now,
+	}
+}
+
+// allow reports whether a request may be sent.
+func (b *circuitBreaker) allow() bool {
+	if b.threshold == 0 {
+		return true
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.failures < b.threshold {
+		return true
+	}
+	if b.probing || b.now().Sub(b.openedAt) < b.cooldown {
+		return false
+	}
+	b.log.Printf("[INFO] testing whether vault cluster %s has recovered", b.name)
+	b.probing = true
+	return true
+}
+
+// record records the outcome of a request let through by allow.
+func (b *circuitBreaker) record(ok bool) {
+	if b.threshold == 0 {
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.probing = false
+	if ok {
+		if b.failures >= b.threshold {
+			b.log.Printf("[INFO] vault cluster %s recovered, closing circuit breaker", b.name)
+		}
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.failures >= b.threshold {
+		if b.failures == b.threshold {
+			b.log.Printf("[ERR] %d consecutive requests to vault cluster %s failed, opening circuit breaker for %s",
+				b.failures, b.name, b.cooldown)
+			vaultRetryStats.Add("breaker_trips", 1)
+		}
+		b.openedAt = b.now()
+	}
+}
+
+// abort records that a request let through by allow has no outcome.
+func (b *circuitBreaker) abort() {
+	b.lock.Lock()
+	b.probing = false
+	b.lock.Unlock()
+}
+
+// vaultUnavailable converts errors caused by an open circuit breaker into a
+// 503, so the platform knows to try again later.
+func vaultUnavailable(err error) error {
+	cause := errors.Cause(err)
+	if urlErr, ok := cause.(*url.Error); ok {
+		cause = urlErr.Err
+	}
+	if cause != ErrVaultUnavailable {
+		return err
+	}
+	return brokerapi.NewFailureResponse(err, http.StatusServiceUnavailable, "vault-unavailable")
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/pivotal-cf/brokerapi"
+	"github.com/pkg/errors"
+)
+
+// testRetryConfig retries quickly so tests do not wait.
+func testRetryConfig() *RetryConfig {
+	return &RetryConfig{
+		MaxRetries:       2,
+		MinWait:          time.Millisecond,
+		MaxWait:          10 * time.Millisecond,
+		BreakerThreshold: 2,
+		BreakerCooldown:  time.Minute,
+	}
+}
+
+// retryingClient returns a retrying client for the server and its transport.
+func retryingClient(t *testing.T, ts *httptest.Server, retry *RetryConfig) (*api.Client, *retryTransport) {
+	vaultConfig := api.DefaultConfig()
+	vaultConfig.Address = ts.URL
+	client, err := newVaultClient(log.New(os.Stdout, "", 0), "test", vaultConfig, retry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, vaultConfig.HttpClient.Transport.(*retryTransport)
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2017, 8, 1, 12, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		value string
+		wait  time.Duration
+		ok    bool
+	}{
+		{"", 0, false},
+		{"5", 5 * time.Second, true},
+		{"-1", 0, false},
+		{"Tue, 01 Aug 2017 12:00:30 GMT", 30 * time.Second, true},
+		{"Tue, 01 Aug 2017 11:00:00 GMT", 0, true},
+		{"soon", 0, false},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.value, func(t *testing.T) {
+			resp := &http.Response{Header: http.Header{}}
+			resp.Header.Set("Retry-After", tc.value)
+			wait, ok := retryAfter(resp, now)
+			if wait != tc.wait || ok != tc.ok {
+				t.Fatalf("expected %s %t but received %s %t", tc.wait, tc.ok, wait, ok)
+			}
+		})
+	}
+}
+
+func TestRetryTransport(t *testing.T) {
+	cases := []struct {
+		name     string
+		method   string
+		status   int
+		header   string
+		requests int32
+	}{
+		{"read-503", "GET", 503, "", 3},
+		{"read-500", "GET", 500, "", 3},
+		{"write-503", "PUT", 503, "", 3},
+		{"write-429", "PUT", 429, "0", 1},
+		{"write-500", "PUT", 500, "", 1},
+		{"read-400", "GET", 400, "", 1},
+		{"long-retry-after", "GET", 503, "60", 1},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var requests int32
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&requests, 1)
+				if tc.header != "" {
+					w.Header().Set("Retry-After", tc.header)
+				}
+				w.WriteHeader(tc.status)
+			}))
+			defer ts.Close()
+
+			retry := testRetryConfig()
+			retry.BreakerThreshold = 0
+			client, _ := retryingClient(t, ts, retry)
+
+			if tc.method == "GET" {
+				client.Logical().Read("cf/broker/instance-id")
+			} else {
+				client.Logical().Write("cf/broker/instance-id", map[string]interface{}{"json": "{}"})
+			}
+			if requests != tc.requests {
+				t.Fatalf("expected %d requests but received %d", tc.requests, requests)
+			}
+		})
+	}
+}
+
+func TestRetryTransport_Recovers(t *testing.T) {
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) < 3 {
+			w.WriteHeader(502)
+			return
+		}
+		w.Write([]byte(`{"data": {"json": "{}"}}`))
+	}))
+	defer ts.Close()
+
+	retry := testRetryConfig()
+	retry.BreakerThreshold = 3
+	client, _ := retryingClient(t, ts, retry)
+	secret, err := client.Logical().Read("cf/broker/instance-id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secret.Data["json"] != "{}" {
+		t.Fatalf("expected {} but received %v", secret.Data["json"])
+	}
+}
+
+func TestRetryTransport_Final(t *testing.T) {
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(500)
+		w.Write([]byte(`{"errors": ["token store is broken"]}`))
+	}))
+	defer ts.Close()
+
+	// The write is not retried, and the response of its only attempt is
+	// returned
+	client, _ := retryingClient(t, ts, testRetryConfig())
+	_, err := client.Logical().Write("auth/token/create", map[string]interface{}{"policies": "default"})
+	if err == nil || !strings.Contains(err.Error(), "token store is broken") {
+		t.Fatalf("expected the error of the response but received %v", err)
+	}
+	if requests != 1 {
+		t.Fatalf("expected %d requests but received %d", 1, requests)
+	}
+}
+
+func TestRetryTransport_StandbyRedirect(t *testing.T) {
+	var body string
+	active := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf, _ := ioutil.ReadAll(r.Body)
+		body = strings.TrimSpace(string(buf))
+		w.WriteHeader(204)
+	}))
+	defer active.Close()
+
+	// The first standby points to another standby, which points to the active
+	// node, as happens while a new leader is elected
+	second := httptest.NewServer(http.RedirectHandler(active.URL+"/v1/cf/broker/instance-id", 307))
+	defer second.Close()
+	first := httptest.NewServer(http.RedirectHandler(second.URL+"/v1/cf/broker/instance-id", 307))
+	defer first.Close()
+
+	client, _ := retryingClient(t, first, testRetryConfig())
+	if _, err := client.Logical().Write("cf/broker/instance-id", map[string]interface{}{"json": "{}"}); err != nil {
+		t.Fatal(err)
+	}
+	if body != `{"json":"{}"}` {
+		t.Fatalf("expected the body to be sent to the active node but received %q", body)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	var requests int32
+	var healthy atomic.Value
+	healthy.Store(false)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if !healthy.Load().(bool) {
+			w.WriteHeader(503)
+			return
+		}
+		w.WriteHeader(204)
+	}))
+	defer ts.Close()
+
+	retry := testRetryConfig()
+	retry.MaxRetries = 0
+	client, transport := retryingClient(t, ts, retry)
+	now := time.Now()
+	transport.breaker.now = func() time.Time { return now }
+
+	// Two failures open the breaker
+	for i := 0; i < 2; i++ {
+		if _, err := client.Logical().Read("cf/broker/instance-id"); err == nil {
+			t.Fatal("expected error")
+		}
+	}
+
+	// Requests now fail without reaching Vault, and the broker reports a 503
+	_, err := client.Logical().Read("cf/broker/instance-id")
+	if requests != 2 {
+		t.Fatalf("expected %d requests but received %d", 2, requests)
+	}
+	b := &Broker{log: log.New(os.Stdout, "", 0)}
+	failure, ok := b.wErrorf(err, "failed to read instance").(*brokerapi.FailureResponse)
+	if !ok {
+		t.Fatalf("expected a failure response but received %v", err)
+	}
+	if code := failure.ValidatedStatusCode(nil); code != http.StatusServiceUnavailable {
+		t.Fatalf("expected %d but received %d", http.StatusServiceUnavailable, code)
+	}
+	if other := b.wErrorf(errors.New("boom"), "failed"); errors.Cause(other).Error() != "boom" {
+		t.Fatalf("expected other errors to be returned as they are but received %v", other)
+	}
+
+	// After the cooldown, a failing probe keeps the breaker open
+	now = now.Add(time.Minute)
+	client.Logical().Read("cf/broker/instance-id")
+	client.Logical().Read("cf/broker/instance-id")
+	if requests != 3 {
+		t.Fatalf("expected %d requests but received %d", 3, requests)
+	}
+
+	// A successful probe closes it
+	healthy.Store(true)
+	now = now.Add(time.Minute)
+	for i := 0; i < 2; i++ {
+		if _, err := client.Logical().Delete("cf/broker/instance-id"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if requests != 5 {
+		t.Fatalf("expected %d requests but received %d", 5, requests)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/pivotal-cf/brokerapi"
+	"github.com/pkg/errors"
+)
+
+// SharedResourceSuffix is appended to the name of an instance's policy and
+// token role to name those of bindings from other spaces.
+const SharedResourceSuffix = "-shared"
+
+// errSharingDisabled is returned when an application in another space binds to
+// an instance while sharing is disabled.
+var errSharingDisabled = brokerapi.NewFailureResponse(
+	errors.New("instance sharing is disabled"), http.StatusForbidden, "sharing-disabled")
+
+// sharedResourceName returns the name of the policy and token role of the
+// bindings to the instance from other spaces.
+func (b *Broker) sharedResourceName(instanceID string) string {
+	return b.resourceName(instanceID) + SharedResourceSuffix
+}
+
+// sharedPolicyInput returns the input rendering the policy of the bindings to
+// the instance from other spaces. It only covers the paths of the instance,
+// not the shared backends of the organization and space that own it.
+func sharedPolicyInput(instanceID string, info *instanceInfo) *ServicePolicyTemplateInput {
+	inp := instancePolicyInput(instanceID, info)
+	inp.SpaceID, inp.OrgID = "", ""
+	return inp
+}
+
+// sharingEnabled returns whether applications in other spaces may bind to
+// instances.
+func (b *Broker) sharingEnabled() bool {
+	b.catalogLock.RLock()
+	defer b.catalogLock.RUnlock()
+	return b.shareInstances
+}
+
+type sharedBindingKey struct{}
+
+// withSharedBinding returns a copy of ctx marking the binding as one from
+// another space. It is used when resuming bindings, whose platform context is
+// not stored.
+func withSharedBinding(ctx context.Context) context.Context {
+	return context.WithValue(ctx, sharedBindingKey{}, true)
+}
+
+// foreignBinding returns whether the binding request comes from a space other
+// than the one that owns the instance, as it does when the instance is shared.
+// Requests without a context are assumed to come from the owning space.
+func (b *Broker) foreignBinding(ctx context.Context, instance *instanceInfo) bool {
+	if shared, _ := ctx.Value(sharedBindingKey{}).(bool); shared {
+		return true
+	}
+	pc := platformContext(ctx)
+	if pc == nil {
+		return false
+	}
+	tenant, err := pc.tenant("", "")
+	if err != nil {
+		return false
+	}
+	return tenant.SpaceID != instance.SpaceGUID
+}
+
+// ensureSharedRole writes the policy and token role of the bindings to the
+// instance from other spaces, and records that the instance is shared so they
+// are removed with it. They belong to the instance and are written on every
+// shared binding, so they are not undone if the binding fails.
+func (b *Broker) ensureSharedRole(client *api.Client, instanceID string, instance *instanceInfo, event *AuditEvent) error {
+	name := b.sharedResourceName(instanceID)
+	b.instancesLock.Lock()
+	rules, err := b.instancePolicy(sharedPolicyInput(instanceID, instance))
+	shared := instance.Shared
+	b.instancesLock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	b.log.Printf("[DEBUG] writing shared policy %s", name)
+	if err := client.Sys().PutPolicy(name, rules); err != nil {
+		return err
+	}
+	event.addArtifact("policy", name)
+
+	path := "/auth/token/roles/" + name
+	b.log.Printf("[DEBUG] writing shared token role %s", path)
+	if _, err := client.Logical().Write(path, map[string]interface{}{
+		"allowed_policies": name,
+		"period":           VaultPeriodicTTL,
+		"renewable":        true,
+	}); err != nil {
+		return err
+	}
+	event.addArtifact("token_role", path)
+
+	if shared {
+		return nil
+	}
+	b.instancesLock.Lock()
+	instance.Shared = true
+	b.instancesLock.Unlock()
+	return b.storeInstance(instanceID, instance)
+}
+
+// deleteSharedRole deletes the policy and token role of the bindings to the
+// instance from other spaces.
+func (b *Broker) deleteSharedRole(client *api.Client, instanceID string, event *AuditEvent) error {
+	name := b.sharedResourceName(instanceID)
+
+	path := "/auth/token/roles/" + name
+	b.log.Printf("[DEBUG] deleting shared token role %s", path)
+	if _, err := client.Logical().Delete(path); err != nil {
+		return err
+	}
+	event.addArtifact("token_role", path)
+
+	b.log.Printf("[DEBUG] deleting shared policy %s", name)
+	if err := client.Sys().DeletePolicy(name); err != nil {
+		return err
+	}
+	event.addArtifact("policy", name)
+	return nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/pivotal-cf/brokerapi"
+)
+
+func TestBroker_Bind_Shared(t *testing.T) {
+	cases := []struct {
+		name    string
+		context *PlatformContext
+		enabled bool
+		shared  bool
+		status  int
+	}{
+		{"no-context", nil, true, false, 0},
+		{"owning-space", &PlatformContext{Platform: PlatformCloudFoundry, OrganizationGUID: "organization-guid", SpaceGUID: "space-guid"}, true, false, 0},
+		{"other-space", &PlatformContext{Platform: PlatformCloudFoundry, OrganizationGUID: "organization-guid", SpaceGUID: "other-space-guid"}, true, true, 0},
+		{"sharing-disabled", &PlatformContext{Platform: PlatformCloudFoundry, OrganizationGUID: "organization-guid", SpaceGUID: "other-space-guid"}, false, false, http.StatusForbidden},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			env, closer := defaultEnvironment(t)
+			defer closer()
+
+			// Vault accepts the shared policy and token role, and creates
+			// tokens against the shared role like the instance role
+			var lock sync.Mutex
+			var sharedRules string
+			vault := &requestRecorder{handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch {
+				case r.URL.Path == "/v1/sys/policy/cf-instance-id-shared" && r.Method == "PUT":
+					var body struct {
+						Rules string `json:"rules"`
+					}
+					json.NewDecoder(r.Body).Decode(&body)
+					lock.Lock()
+					sharedRules = body.Rules
+					lock.Unlock()
+					w.WriteHeader(204)
+				case strings.HasPrefix(r.URL.Path, "/v1/sys/policy/cf-instance-id-shared"),
+					strings.HasPrefix(r.URL.Path, "/v1/auth/token/roles/cf-instance-id-shared"):
+					w.WriteHeader(204)
+				case r.URL.Path == "/v1/auth/token/create/cf-instance-id-shared":
+					r.URL.Path = "/v1/auth/token/create/cf-instance-id"
+					env.Handler.ServeHTTP(w, r)
+				default:
+					env.Handler.ServeHTTP(w, r)
+				}
+			})}
+			ts := httptest.NewServer(vault)
+			defer ts.Close()
+			env.Broker.vaultClient = boundableClient(t, ts)
+			env.Broker.shareInstances = tc.enabled
+
+			details := brokerapi.ProvisionDetails{
+				SpaceGUID:        env.SpaceGUID,
+				OrganizationGUID: env.OrganizationGUID,
+			}
+			if _, err := env.Broker.Provision(env.Context, env.InstanceID, details, env.Async); err != nil {
+				t.Fatal(err)
+			}
+
+			ctx := env.Context
+			if tc.context != nil {
+				ctx = withPlatformContext(ctx, tc.context)
+			}
+			binding, err := env.Broker.Bind(ctx, env.InstanceID, env.BindingID, brokerapi.BindDetails{})
+			if tc.status != 0 {
+				failure, ok := err.(*brokerapi.FailureResponse)
+				if !ok || failure.ValidatedStatusCode(nil) != tc.status {
+					t.Fatalf("expected %d but received %v", tc.status, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Shared bindings get a token from the shared role, whose policy
+			// only covers the instance, and no shared backends
+			credentials := binding.Credentials.(map[string]interface{})
+			if _, ok := credentials["backends_shared"]; ok == tc.shared {
+				t.Fatalf("expected backends_shared %t but received %v", !tc.shared, credentials)
+			}
+			if vault.received("POST /v1/auth/token/create/cf-instance-id-shared") != tc.shared {
+				t.Fatalf("expected a token from the shared role %t", tc.shared)
+			}
+			if info := env.Broker.binds[env.BindingID]; info.Shared != tc.shared {
+				t.Fatalf("expected shared %t but received %t", tc.shared, info.Shared)
+			}
+			if tc.shared {
+				lock.Lock()
+				rules := sharedRules
+				lock.Unlock()
+				if !strings.Contains(rules, `"cf/instance-id/*"`) {
+					t.Fatalf("expected the instance paths in %s", rules)
+				}
+				if strings.Contains(rules, "space-guid") || strings.Contains(rules, "organization-guid") {
+					t.Fatalf("expected no space or organization paths in %s", rules)
+				}
+			}
+
+			// The shared policy and token role are removed with the instance
+			if _, err := env.Broker.Deprovision(env.Context, env.InstanceID, brokerapi.DeprovisionDetails{}, env.Async); err != nil {
+				t.Fatal(err)
+			}
+			for _, request := range []string{
+				"DELETE /v1/sys/policy/cf-instance-id-shared",
+				"DELETE /v1/auth/token/roles/cf-instance-id-shared",
+			} {
+				if vault.received(request) != tc.shared {
+					t.Fatalf("expected %s %t", request, tc.shared)
+				}
+			}
+		})
+	}
+}
+
+func TestBroker_ForeignBinding_Resumed(t *testing.T) {
+	b := &Broker{}
+	instance := &instanceInfo{SpaceGUID: "space-guid"}
+	if b.foreignBinding(context.Background(), instance) {
+		t.Fatal("expected a binding from the owning space")
+	}
+	if !b.foreignBinding(withSharedBinding(context.Background()), instance) {
+		t.Fatal("expected a binding from another space")
+	}
+}
+
+func TestHandler_Catalog_Shareable(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	for _, enabled := range []bool{false, true} {
+		env.Broker.shareInstances = enabled
+
+		var catalog struct {
+			Services []struct {
+				Metadata *struct {
+					Shareable bool `json:"shareable"`
+				} `json:"metadata"`
+			} `json:"services"`
+		}
+		if code := serveBroker(t, env, "GET", "/v2/catalog", "", &catalog); code != http.StatusOK {
+			t.Fatalf("expected %d but received %d", http.StatusOK, code)
+		}
+		shareable := catalog.Services[0].Metadata != nil && catalog.Services[0].Metadata.Shareable
+		if shareable != enabled {
+			t.Fatalf("expected shareable %t but received %t", enabled, shareable)
+		}
+	}
+}
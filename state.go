@@ -0,0 +1,263 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/pivotal-cf/brokerapi"
+	"github.com/pkg/errors"
+)
+
+const (
+	// InstanceSchemaVersion is the current schema version of instance records
+	// stored at <prefix>/broker/<instance_id>.
+	InstanceSchemaVersion = 3
+
+	// BindingSchemaVersion is the current schema version of binding records
+	// stored at <prefix>/broker/<instance_id>/<binding_id>.
+	BindingSchemaVersion = 3
+)
+
+// The schema versions are only bumped when a field needs a migration to be
+// read correctly. Fields that are simply added are not: older records decode
+// to their zero value, and older brokers ignore them.
+
+// migration upgrades a decoded record in place by exactly one schema version.
+type migration func(record map[string]interface{}) error
+
+// instanceMigrations upgrade instance records. The migration at index i
+// upgrades a record from version i to version i+1, so the length of the slice
+// must always equal InstanceSchemaVersion.
+var instanceMigrations = []migration{
+	// v0 -> v1: records written before schema versioning was introduced. The
+	// fields are unchanged, only the version is added.
+	func(record map[string]interface{}) error { return nil },
+
+	// v1 -> v2: instances record the Vault cluster they were placed on. All
+	// instances created before clusters were introduced are on the default
+	// cluster.
+	func(record map[string]interface{}) error {
+		record["Cluster"] = DefaultClusterName
+		return nil
+	},
+
+	// v2 -> v3: instances record the platform they were provisioned from.
+	// Older records were always keyed on a Cloud Foundry organization and
+	// space.
+	func(record map[string]interface{}) error {
+		record["Platform"] = PlatformCloudFoundry
+		return nil
+	},
+}
+
+// bindingMigrations upgrade binding records. The migration at index i upgrades
+// a record from version i to version i+1, so the length of the slice must
+// always equal BindingSchemaVersion.
+var bindingMigrations = []migration{
+	// v0 -> v1: records written before schema versioning was introduced. The
+	// fields are unchanged, only the version is added.
+	func(record map[string]interface{}) error { return nil },
+
+	// v1 -> v2: bindings record the state of the operation creating them.
+	// Older records were always created synchronously, so they succeeded.
+	func(record map[string]interface{}) error {
+		record["State"] = string(brokerapi.Succeeded)
+		return nil
+	},
+
+	// v2 -> v3: bindings record the format of their credentials. Older
+	// records always returned the default format.
+	func(record map[string]interface{}) error {
+		record["CredentialsFormat"] = CredentialsFormatDefault
+		return nil
+	},
+}
+
+// decodeRecord extracts the JSON payload from the data of a Vault secret,
+// applies any migrations required to bring it to the current version and
+// decodes the result into out. It returns the version the record was stored
+// with.
+func decodeRecord(m map[string]interface{}, migrations []migration, out interface{}) (int, error) {
+	data, ok := m["json"]
+	if !ok {
+		return 0, fmt.Errorf("missing 'json' key")
+	}
+
+	typed, ok := data.(string)
+	if !ok {
+		return 0, fmt.Errorf("json data is %T, not string", data)
+	}
+
+	var record map[string]interface{}
+	if err := json.Unmarshal([]byte(typed), &record); err != nil {
+		return 0, err
+	}
+
+	version, err := recordVersion(record)
+	if err != nil {
+		return 0, err
+	}
+	// Records written by a newer broker are decoded as they are, so that the
+	// broker can be rolled back. Fields it does not know about are ignored,
+	// and the record keeps its version so it is not written back without
+	// them.
+	current := len(migrations)
+	for v := version; v < current; v++ {
+		if err := migrations[v](record); err != nil {
+			return version, fmt.Errorf("failed to migrate record from version %d: %s", v, err)
+		}
+		record["SchemaVersion"] = v + 1
+	}
+
+	// Round-trip through JSON to decode the upgraded record into the struct.
+	upgraded, err := json.Marshal(record)
+	if err != nil {
+		return version, err
+	}
+	if err := json.Unmarshal(upgraded, out); err != nil {
+		return version, err
+	}
+	return version, nil
+}
+
+// recordVersion returns the schema version of a decoded record. Records
+// without a version were written before versioning and are version 0.
+func recordVersion(record map[string]interface{}) (int, error) {
+	raw, ok := record["SchemaVersion"]
+	if !ok || raw == nil {
+		return 0, nil
+	}
+	f, ok := raw.(float64)
+	if !ok || f < 0 || f != float64(int(f)) {
+		return 0, fmt.Errorf("invalid schema version %v", raw)
+	}
+	return int(f), nil
+}
+
+// encodeRecord encodes the record as the data of a Vault secret.
+func encodeRecord(record interface{}) (map[string]interface{}, error) {
+	payload, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"json": string(payload),
+	}, nil
+}
+
+func decodeBindingInfo(m map[string]interface{}) (*bindingInfo, error) {
+	var info bindingInfo
+	if _, err := decodeRecord(m, bindingMigrations, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+func encodeBindingInfo(info *bindingInfo) (map[string]interface{}, error) {
+	if info.SchemaVersion > BindingSchemaVersion {
+		return nil, newerRecordError(info.SchemaVersion, BindingSchemaVersion)
+	}
+	info.SchemaVersion = BindingSchemaVersion
+	return encodeRecord(info)
+}
+
+func decodeInstanceInfo(m map[string]interface{}) (*instanceInfo, error) {
+	var info instanceInfo
+	if _, err := decodeRecord(m, instanceMigrations, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+func encodeInstanceInfo(info *instanceInfo) (map[string]interface{}, error) {
+	if info.SchemaVersion > InstanceSchemaVersion {
+		return nil, newerRecordError(info.SchemaVersion, InstanceSchemaVersion)
+	}
+	info.SchemaVersion = InstanceSchemaVersion
+	return encodeRecord(info)
+}
+
+// newerRecordError is returned when rewriting a record written by a newer
+// broker, which would drop the fields this broker does not know about.
+func newerRecordError(version, current int) error {
+	return fmt.Errorf("record version %d was written by a newer broker and cannot be rewritten by version %d",
+		version, current)
+}
+
+// migrateState upgrades every stored instance and binding record to the
+// current schema version and writes it back to Vault. It returns the number of
+// records that were upgraded. If dryRun is true, the upgrades are only logged.
+func (b *Broker) migrateState(dryRun bool) (int, error) {
+	prefix := ""
+	if dryRun {
+		prefix = "(dry-run) "
+	}
+
+	migrated := 0
+	migrate := func(path string, migrations []migration, info interface{}) error {
+		secret, err := b.vaultClient.Logical().Read(path)
+		if err != nil {
+			return errors.Wrapf(err, "failed to read %s", path)
+		}
+		if secret == nil || len(secret.Data) == 0 {
+			return nil
+		}
+
+		version, err := decodeRecord(secret.Data, migrations, info)
+		if err != nil {
+			return errors.Wrapf(err, "failed to decode %s", path)
+		}
+		if version >= len(migrations) {
+			// Records written by a newer broker are left alone, since
+			// rewriting them would drop the fields this broker does not know.
+			return nil
+		}
+
+		var data map[string]interface{}
+		switch typed := info.(type) {
+		case *instanceInfo:
+			data, err = encodeInstanceInfo(typed)
+		case *bindingInfo:
+			data, err = encodeBindingInfo(typed)
+		default:
+			err = fmt.Errorf("unknown record type %T", info)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "failed to encode %s", path)
+		}
+
+		b.log.Printf("[INFO] %smigrating %s from version %d to %d",
+			prefix, path, version, len(migrations))
+		migrated++
+		if dryRun {
+			return nil
+		}
+		if _, err := b.vaultClient.Logical().Write(path, data); err != nil {
+			return errors.Wrapf(err, "failed to write %s", path)
+		}
+		return nil
+	}
+
+	instances, err := b.listDir(b.statePath() + "/")
+	if err != nil {
+		return migrated, errors.Wrap(err, "failed to list instances")
+	}
+	for _, inst := range uniqueKeys(instances) {
+		path := b.statePath(inst)
+		if err := migrate(path, instanceMigrations, &instanceInfo{}); err != nil {
+			return migrated, err
+		}
+
+		binds, err := b.listDir(path + "/")
+		if err != nil {
+			return migrated, errors.Wrapf(err, "failed to list binds for instance %q", inst)
+		}
+		for _, bind := range uniqueKeys(binds) {
+			if err := migrate(path+"/"+bind, bindingMigrations, &bindingInfo{}); err != nil {
+				return migrated, err
+			}
+		}
+	}
+
+	return migrated, nil
+}
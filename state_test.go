@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/pivotal-cf/brokerapi"
+)
+
+func loadFixture(t *testing.T, name string) map[string]interface{} {
+	b, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal(b, &m); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestSchemaVersions(t *testing.T) {
+	if len(instanceMigrations) != InstanceSchemaVersion {
+		t.Fatalf("expected %d instance migrations but found %d", InstanceSchemaVersion, len(instanceMigrations))
+	}
+	if len(bindingMigrations) != BindingSchemaVersion {
+		t.Fatalf("expected %d binding migrations but found %d", BindingSchemaVersion, len(bindingMigrations))
+	}
+}
+
+func TestDecodeInstanceInfo_Fixtures(t *testing.T) {
+	for v := 0; v <= InstanceSchemaVersion; v++ {
+		t.Run(fmt.Sprintf("v%d", v), func(t *testing.T) {
+			info, err := decodeInstanceInfo(loadFixture(t, fmt.Sprintf("instance-v%d.json", v)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.SchemaVersion != InstanceSchemaVersion {
+				t.Fatalf("expected version %d but received %d", InstanceSchemaVersion, info.SchemaVersion)
+			}
+			if info.OrganizationGUID != "organization-guid" {
+				t.Fatalf("expected organization-guid but received %s", info.OrganizationGUID)
+			}
+			if info.SpaceGUID != "space-guid" {
+				t.Fatalf("expected space-guid but received %s", info.SpaceGUID)
+			}
+			if info.Cluster != DefaultClusterName {
+				t.Fatalf("expected %s but received %s", DefaultClusterName, info.Cluster)
+			}
+			if info.Platform != PlatformCloudFoundry {
+				t.Fatalf("expected %s but received %s", PlatformCloudFoundry, info.Platform)
+			}
+		})
+	}
+}
+
+func TestDecodeBindingInfo_Fixtures(t *testing.T) {
+	for v := 0; v <= BindingSchemaVersion; v++ {
+		t.Run(fmt.Sprintf("v%d", v), func(t *testing.T) {
+			info, err := decodeBindingInfo(loadFixture(t, fmt.Sprintf("binding-v%d.json", v)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.SchemaVersion != BindingSchemaVersion {
+				t.Fatalf("expected version %d but received %d", BindingSchemaVersion, info.SchemaVersion)
+			}
+			if info.Organization != "organization-guid" {
+				t.Fatalf("expected organization-guid but received %s", info.Organization)
+			}
+			if info.Space != "space-guid" {
+				t.Fatalf("expected space-guid but received %s", info.Space)
+			}
+			if info.Binding != "binding-id" {
+				t.Fatalf("expected binding-id but received %s", info.Binding)
+			}
+			if info.Accessor != "accessor" {
+				t.Fatalf("expected accessor but received %s", info.Accessor)
+			}
+			if info.State != brokerapi.Succeeded {
+				t.Fatalf("expected %s but received %s", brokerapi.Succeeded, info.State)
+			}
+			if info.CredentialsFormat == "" {
+				t.Fatal("expected a credentials format")
+			}
+		})
+	}
+}
+
+func TestDecodeRecord_NewerVersion(t *testing.T) {
+	m := map[string]interface{}{
+		"json": fmt.Sprintf(`{"SchemaVersion": %d, "SpaceGUID": "space-guid", "Unknown": true}`,
+			InstanceSchemaVersion+1),
+	}
+	info, err := decodeInstanceInfo(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.SpaceGUID != "space-guid" {
+		t.Fatalf("expected %q but received %q", "space-guid", info.SpaceGUID)
+	}
+	if info.SchemaVersion != InstanceSchemaVersion+1 {
+		t.Fatalf("expected version %d but received %d", InstanceSchemaVersion+1, info.SchemaVersion)
+	}
+
+	// Writing the record back would drop the fields of the newer broker
+	if _, err := encodeInstanceInfo(info); err == nil {
+		t.Fatal("expected error encoding newer record")
+	}
+}
+
+func TestEncodeInstanceInfo_RoundTrip(t *testing.T) {
+	data, err := encodeInstanceInfo(&instanceInfo{
+		OrganizationGUID: "organization-guid",
+		SpaceGUID:        "space-guid",
+		Parameters:       json.RawMessage(`{"foo":"bar"}`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := decodeInstanceInfo(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.SchemaVersion != InstanceSchemaVersion {
+		t.Fatalf("expected version %d but received %d", InstanceSchemaVersion, info.SchemaVersion)
+	}
+	if string(info.Parameters) != `{"foo":"bar"}` {
+		t.Fatalf("expected parameters %s but received %s", `{"foo":"bar"}`, info.Parameters)
+	}
+}
+
+func TestBroker_MigrateState(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	// The environment serves unversioned records for the instance and binding.
+	n, err := env.Broker.migrateState(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatalf("expected 2 migrated records but received %d", n)
+	}
+}
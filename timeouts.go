@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-cleanhttp"
+	"github.com/hashicorp/vault/api"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+// OperationTimeouts are the deadlines of broker operations keyed by the name of
+// their OSB endpoint. It is decoded from a JSON object of durations such as
+// "30s" by envconfig.
+type OperationTimeouts map[string]time.Duration
+
+// Decode implements envconfig.Decoder.
+func (t *OperationTimeouts) Decode(value string) error {
+	var raw map[string]string
+	if err := json.Unmarshal([]byte(value), &raw); err != nil {
+		return fmt.Errorf("failed to parse operation timeouts: %s", err)
+	}
+	timeouts := make(OperationTimeouts, len(raw))
+	for name, s := range raw {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return fmt.Errorf("failed to parse operation timeout for %q: %s", name, err)
+		}
+		timeouts[name] = d
+	}
+	*t = timeouts
+	return nil
+}
+
+// Validate checks the endpoint names and timeouts.
+func (t OperationTimeouts) Validate() error {
+	for name, d := range t {
+		if !osbEndpoints[name] {
+			return fmt.Errorf("unknown operation timeout endpoint %q", name)
+		}
+		if d <= 0 {
+			return fmt.Errorf("operation timeout for %q must be positive", name)
+		}
+	}
+	return nil
+}
+
+// vaultConfigs are the configurations of the clients created by
+// newVaultClient, so that withContext can create clients sharing their
+// transport.
+var (
+	vaultConfigs     = make(map[*api.Client]*api.Config)
+	vaultConfigsLock sync.Mutex
+)
+
+// boundClients are the clients withContext created for contexts that are not
+// done yet, so a client is only bound once to each context. They are removed
+// when the context is done.
+var (
+	boundClients     = make(map[boundClientKey]*api.Client)
+	boundClientsLock sync.Mutex
+)
+
+type boundClientKey struct {
+	client *api.Client
+	ctx    context.Context
+}
+
+// withContext returns a client that sends the requests of the client bound to
+// the context, so they are aborted when it is done. The returned client shares
+// the address, token and connections of the client, and is reused for the
+// context until it is done. Contexts that are never done need no binding, so
+// the client is returned as it is, as are clients not created by
+// newVaultClient.
+func withContext(ctx context.Context, client *api.Client) *api.Client {
+	if ctx.Done() == nil {
+		return client
+	}
+	vaultConfigsLock.Lock()
+	config, ok := vaultConfigs[client]
+	vaultConfigsLock.Unlock()
+	if !ok {
+		return client
+	}
+
+	key := boundClientKey{client: client, ctx: ctx}
+	boundClientsLock.Lock()
+	defer boundClientsLock.Unlock()
+	if bound, ok := boundClients[key]; ok {
+		return bound
+	}
+
+	// The client requires a plain transport when it is created, so the
+	// transport is swapped in afterwards
+	boundConfig := &api.Config{
+		Address:    client.Address(),
+		HttpClient: cleanhttp.DefaultClient(),
+		MaxRetries: config.MaxRetries,
+	}
+	bound, err := api.NewClient(boundConfig)
+	if err != nil {
+		return client
+	}
+	boundConfig.HttpClient.Transport = &contextTransport{
+		ctx:  ctx,
+		next: config.HttpClient.Transport,
+	}
+	boundConfig.HttpClient.Timeout = config.HttpClient.Timeout
+	bound.SetToken(client.Token())
+
+	boundClients[key] = bound
+	go func() {
+		<-ctx.Done()
+		boundClientsLock.Lock()
+		delete(boundClients, key)
+		boundClientsLock.Unlock()
+	}()
+	return bound
+}
+
+// contextTransport sends requests bound to a context.
+type contextTransport struct {
+	ctx  context.Context
+	next http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper. The request is aborted when either
+// the context or the request's own context, which carries the timeout of the
+// client, is done. The derived context is released once the response body is
+// closed.
+func (t *contextTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(t.ctx)
+	reqCtx := req.Context()
+	go func() {
+		select {
+		case <-reqCtx.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	resp, err := t.next.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// cancelBody cancels the context of a request when its response body is
+// closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+// Close implements io.Closer.
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// operationTimeoutFor returns the deadline of the operation, or zero if it has
+// none.
+func (b *Broker) operationTimeoutFor(operation string) time.Duration {
+	if d, ok := b.operationTimeouts[operation]; ok {
+		return d
+	}
+	return b.operationTimeout
+}
+
+// operationContext returns the context the Vault requests of the operation are
+// bound to. It is done when the platform disconnects or the deadline of the
+// operation passes.
+func (b *Broker) operationContext(ctx context.Context, operation string) (context.Context, context.CancelFunc) {
+	if d := b.operationTimeoutFor(operation); d > 0 {
+		return context.WithTimeout(ctx, d)
+	}
+	return context.WithCancel(ctx)
+}
+
+// operationError converts the error of an operation whose deadline passed into
+// a 504, so the platform knows the operation did not complete. Its changes
+// were rolled back by then.
+func (b *Broker) operationError(ctx context.Context, operation string, err error) error {
+	if err == nil || ctx.Err() != context.DeadlineExceeded {
+		return err
+	}
+	d := b.operationTimeoutFor(operation)
+	b.log.Printf("[WARN] %s did not complete within %s", operation, d)
+	return brokerapi.NewFailureResponse(
+		fmt.Errorf("%s did not complete within %s", operation, d),
+		http.StatusGatewayTimeout, "operation-timeout")
+}
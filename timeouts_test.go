@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+// hangingHandler blocks requests until the client gives up. The body is read
+// first, since the server only notices the client is gone after that.
+var hangingHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	ioutil.ReadAll(r.Body)
+	<-r.Context().Done()
+})
+
+// boundableClient returns a client for the server whose requests can be bound
+// to a context.
+func boundableClient(t *testing.T, ts *httptest.Server) *api.Client {
+	vaultConfig := api.DefaultConfig()
+	vaultConfig.Address = ts.URL
+	client, err := newVaultClient(log.New(os.Stdout, "", 0), DefaultClusterName, vaultConfig, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetToken("root")
+	return client
+}
+
+func TestOperationTimeouts_Decode(t *testing.T) {
+	cases := []struct {
+		name  string
+		value string
+		err   bool
+	}{
+		{"valid", `{"provision": "2m", "get_binding": "5s"}`, false},
+		{"invalid-json", `{"provision"`, true},
+		{"invalid-duration", `{"provision": "soon"}`, true},
+		{"unknown-endpoint", `{"provision_all": "2m"}`, true},
+		{"zero", `{"bind": "0s"}`, true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var timeouts OperationTimeouts
+			err := timeouts.Decode(tc.value)
+			if err == nil {
+				err = timeouts.Validate()
+			}
+			if (err != nil) != tc.err {
+				t.Fatalf("expected error %t but received %v", tc.err, err)
+			}
+		})
+	}
+}
+
+func TestWithContext(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "root" {
+			w.WriteHeader(403)
+			return
+		}
+		if r.URL.Path == "/v1/cf/hang" {
+			hangingHandler(w, r)
+			return
+		}
+		w.Write([]byte(`{"data": {"json": "{}"}}`))
+	}))
+	defer ts.Close()
+	client := boundableClient(t, ts)
+
+	// Requests are aborted when the context is done
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	bound := withContext(ctx, client)
+	start := time.Now()
+	if _, err := bound.Logical().Read("cf/hang"); err == nil {
+		t.Fatal("expected error")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("expected the request to be aborted but it took %s", elapsed)
+	}
+
+	// The client is left as it is, and the bound client shares its token
+	if bound == client {
+		t.Fatal("expected a new client")
+	}
+	if _, err := client.Logical().Read("cf/broker/instance-id"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The client is bound once to each context, and contexts that are never
+	// done need no binding
+	other, cancelOther := context.WithCancel(context.Background())
+	first := withContext(other, client)
+	if _, err := first.Logical().Read("cf/broker/instance-id"); err != nil {
+		t.Fatal(err)
+	}
+	if withContext(other, client) != first {
+		t.Fatal("expected the bound client to be reused")
+	}
+	cancelOther()
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		boundClientsLock.Lock()
+		_, ok := boundClients[boundClientKey{client: client, ctx: other}]
+		boundClientsLock.Unlock()
+		if !ok {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("expected the bound client to be released")
+		}
+	}
+	if withContext(context.Background(), client) != client {
+		t.Fatal("expected the client to be returned as it is")
+	}
+
+	// Clients not created by newVaultClient are not bound
+	plain, err := api.NewClient(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if withContext(ctx, plain) != plain {
+		t.Fatal("expected the client to be returned as it is")
+	}
+}
+
+func TestBroker_ProvisionAborted(t *testing.T) {
+	cases := []struct {
+		name    string
+		timeout time.Duration
+		cancel  bool
+		status  int
+	}{
+		{"deadline", 50 * time.Millisecond, false, http.StatusGatewayTimeout},
+		{"disconnect", 0, true, 0},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			env, closer := defaultEnvironment(t)
+			defer closer()
+
+			// Vault hangs when the token role is written
+			vault := &requestRecorder{handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch {
+				case r.URL.Path == "/v1/auth/token/roles/cf-instance-id" && r.Method == "PUT":
+					hangingHandler(w, r)
+				case r.URL.Path == "/v1/sys/policy/cf-instance-id" && r.Method == "DELETE":
+					w.WriteHeader(204)
+				default:
+					env.Handler.ServeHTTP(w, r)
+				}
+			})}
+			ts := httptest.NewServer(vault)
+			defer ts.Close()
+			env.Broker.vaultClient = boundableClient(t, ts)
+			env.Broker.operationTimeout = tc.timeout
+
+			ctx := env.Context
+			if tc.cancel {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithCancel(ctx)
+				time.AfterFunc(50*time.Millisecond, cancel)
+			}
+
+			details := brokerapi.ProvisionDetails{
+				SpaceGUID:        env.SpaceGUID,
+				OrganizationGUID: env.OrganizationGUID,
+			}
+			_, err := env.Broker.Provision(ctx, env.InstanceID, details, env.Async)
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			failure, ok := err.(*brokerapi.FailureResponse)
+			if tc.status != 0 && (!ok || failure.ValidatedStatusCode(nil) != tc.status) {
+				t.Fatalf("expected %d but received %v", tc.status, err)
+			}
+			if tc.status == 0 && ok {
+				t.Fatalf("expected the error to be returned as it is but received %v", err)
+			}
+
+			// The changes made so far are rolled back
+			for _, request := range []string{
+				"DELETE /v1/auth/token/roles/cf-instance-id",
+				"DELETE /v1/sys/policy/cf-instance-id",
+			} {
+				if !vault.received(request) {
+					t.Fatalf("expected %s", request)
+				}
+			}
+		})
+	}
+}
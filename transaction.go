@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/pivotal-cf/brokerapi"
+	"github.com/pkg/errors"
+)
+
+// txnStep is a change an operation made to Vault, or is about to make. Name
+// identifies what is changed: "policy" creates the policy Name,
+// "token_role" writes the token role at the path Name, "mount" mounts a
+// backend at Name, "database_role" creates the database role of the binding
+// Name, "token" creates the token with the accessor Name and "transit_key"
+// creates the transit key Name of the instance.
+type txnStep struct {
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+}
+
+// txn is the journal of an operation that changes Vault in several steps. Each
+// step is recorded before it is taken, or right after when it cannot be named
+// before, and the journal is stored at <prefix>/broker-meta/journal/<id> so
+// that the steps can be undone if the operation fails or the broker stops
+// before it completes. Undoing a step that was never taken does nothing.
+type txn struct {
+	ID         string     `json:"id"`
+	Operation  string     `json:"operation"`
+	InstanceID string     `json:"instance_id"`
+	BindingID  string     `json:"binding_id,omitempty"`
+	Cluster    string     `json:"cluster"`
+	Started    time.Time  `json:"started"`
+	Steps      []*txnStep `json:"steps"`
+
+	broker *Broker
+}
+
+// journalPath returns the path the journal of the transaction is stored at,
+// or the directory of the journals if the ID is empty.
+func (b *Broker) journalPath(id string) string {
+	if id == "" {
+		return b.metaPath() + "/journal"
+	}
+	return b.metaPath() + "/journal/" + id
+}
+
+// beginTxn starts a transaction for the operation on the instance or binding
+// on the cluster. Nothing is stored until the first step is recorded.
+func (b *Broker) beginTxn(operation, instanceID, bindingID, cluster string) (*txn, error) {
+	id, err := randomToken()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to generate transaction id")
+	}
+	return &txn{
+		ID:         id,
+		Operation:  operation,
+		InstanceID: instanceID,
+		BindingID:  bindingID,
+		Cluster:    cluster,
+		Started:    time.Now().UTC(),
+		broker:     b,
+	}, nil
+}
+
+// record adds the step to the journal and stores it. The step must not be
+// taken if this fails, since it could not be undone.
+func (tx *txn) record(kind, name string) error {
+	tx.Steps = append(tx.Steps, &txnStep{Kind: kind, Name: name})
+	if err := tx.store(); err != nil {
+		tx.Steps = tx.Steps[:len(tx.Steps)-1]
+		return err
+	}
+	return nil
+}
+
+// store writes the journal.
+func (tx *txn) store() error {
+	payload, err := json.Marshal(tx)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode journal")
+	}
+	path := tx.broker.journalPath(tx.ID)
+	tx.broker.log.Printf("[DEBUG] storing journal of %s %s at %s", tx.Operation, tx.subject(), path)
+	if _, err := tx.broker.vaultClient.Logical().Write(path, map[string]interface{}{
+		"json": string(payload),
+	}); err != nil {
+		return errors.Wrapf(err, "failed to store journal %s", path)
+	}
+	return nil
+}
+
+// end commits the transaction if the operation succeeded, and rolls it back
+// otherwise.
+func (tx *txn) end(err error) {
+	if err != nil {
+		tx.rollback()
+		return
+	}
+	tx.commit()
+}
+
+// commit deletes the journal, keeping the steps. If the journal cannot be
+// deleted, the broker finds the operation complete when it next starts.
+func (tx *txn) commit() {
+	if len(tx.Steps) == 0 {
+		return
+	}
+	tx.deleteJournal()
+}
+
+// deleteJournal deletes the stored journal.
+func (tx *txn) deleteJournal() {
+	path := tx.broker.journalPath(tx.ID)
+	tx.broker.log.Printf("[DEBUG] deleting journal %s", path)
+	if _, err := tx.broker.vaultClient.Logical().Delete(path); err != nil {
+		tx.broker.log.Printf("[WARN] failed to delete journal %s: %s", path, err)
+	}
+}
+
+// rollback undoes the steps in reverse order. Steps that cannot be undone are
+// kept in the journal to be retried when the broker next starts.
+func (tx *txn) rollback() {
+	if len(tx.Steps) == 0 {
+		return
+	}
+	tx.broker.log.Printf("[INFO] rolling back %s %s", tx.Operation, tx.subject())
+
+	var failed []*txnStep
+	for i := len(tx.Steps) - 1; i >= 0; i-- {
+		step := tx.Steps[i]
+		if err := tx.undo(step); err != nil {
+			tx.broker.log.Printf("[WARN] failed to undo %s %s of %s %s: %s",
+				step.Kind, step.Name, tx.Operation, tx.subject(), err)
+			failed = append([]*txnStep{step}, failed...)
+		}
+	}
+
+	tx.Steps = failed
+	if len(failed) > 0 {
+		if err := tx.store(); err != nil {
+			tx.broker.log.Printf("[WARN] %s", err)
+		}
+		return
+	}
+	tx.deleteJournal()
+}
+
+// undo undoes the step.
+func (tx *txn) undo(step *txnStep) error {
+	b := tx.broker
+	cluster, err := b.cluster(tx.Cluster)
+	if err != nil {
+		return err
+	}
+	client := cluster.client
+
+	b.log.Printf("[DEBUG] undoing %s %s", step.Kind, step.Name)
+	switch step.Kind {
+	case "policy":
+		return client.Sys().DeletePolicy(step.Name)
+	case "token_role":
+		_, err := client.Logical().Delete(step.Name)
+		return err
+	case "mount":
+		return b.idempotentUnmount(client, []string{step.Name})
+	case "database_role":
+		return b.deleteDatabaseRole(client, tx.InstanceID, step.Name)
+	case "binding_role":
+		return b.deleteBindingRole(client, tx.InstanceID, step.Name)
+	case "token":
+		return client.Auth().Token().RevokeAccessor(step.Name)
+	case "transit_key":
+		return b.deleteTransitKey(client, tx.InstanceID, step.Name)
+	}
+	return fmt.Errorf("unknown step %q", step.Kind)
+}
+
+// subject returns the instance or binding the transaction changes, for logs.
+func (tx *txn) subject() string {
+	if tx.BindingID != "" {
+		return tx.InstanceID + "/" + tx.BindingID
+	}
+	return tx.InstanceID
+}
+
+// recoverTxns finishes the transactions of operations that were interrupted
+// when the broker stopped. An operation whose record was stored completed
+// and only its journal is deleted, the others are rolled back. It must be
+// called after the instances are restored and before the bindings are.
+func (b *Broker) recoverTxns() error {
+	ids, err := b.listDir(b.journalPath("") + "/")
+	if err != nil {
+		return errors.Wrap(err, "failed to list journals")
+	}
+
+	for _, id := range ids {
+		path := b.journalPath(id)
+		secret, err := b.vaultClient.Logical().Read(path)
+		if err != nil {
+			return errors.Wrapf(err, "failed to read journal %s", path)
+		}
+		if secret == nil {
+			continue
+		}
+		raw, ok := secret.Data["json"].(string)
+		if !ok {
+			return fmt.Errorf("journal at %q has no json", path)
+		}
+		tx := &txn{broker: b}
+		if err := json.Unmarshal([]byte(raw), tx); err != nil {
+			return errors.Wrapf(err, "failed to decode journal %s", path)
+		}
+
+		completed, err := b.txnCompleted(tx)
+		if err != nil {
+			return err
+		}
+		if completed {
+			b.log.Printf("[INFO] %s %s completed before the broker stopped", tx.Operation, tx.subject())
+			tx.commit()
+			continue
+		}
+		tx.rollback()
+	}
+	return nil
+}
+
+// txnCompleted reports whether the operation of the transaction stored its
+// record, which is the last thing it does.
+func (b *Broker) txnCompleted(tx *txn) (bool, error) {
+	path := b.statePath(tx.InstanceID)
+	if tx.BindingID != "" {
+		path = b.statePath(tx.InstanceID, tx.BindingID)
+	}
+	secret, err := b.vaultClient.Logical().Read(path)
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to read %s", path)
+	}
+	if secret == nil || len(secret.Data) == 0 {
+		return false, nil
+	}
+	if tx.BindingID == "" {
+		return true, nil
+	}
+
+	// Asynchronous bindings store their record before they are created
+	info, err := decodeBindingInfo(secret.Data)
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to decode binding info for %s", path)
+	}
+	return info.State == brokerapi.Succeeded, nil
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/pivotal-cf/brokerapi"
+)
+
+// mountTable wraps the handler of the test environment so that the mounts it
+// creates are listed and can be removed again.
+type mountTable struct {
+	handler http.Handler
+
+	lock   sync.Mutex
+	mounts map[string]bool
+}
+
+func (m *mountTable) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.mounts == nil {
+		m.mounts = make(map[string]bool)
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/v1/sys/mounts/")
+	switch {
+	case r.URL.Path == "/v1/sys/mounts" && r.Method == "GET":
+		mounts := make(map[string]interface{})
+		for k := range m.mounts {
+			mounts[k+"/"] = map[string]interface{}{"type": "generic"}
+		}
+		json.NewEncoder(w).Encode(mounts)
+	case path != r.URL.Path && r.Method == "POST":
+		m.mounts[path] = true
+		m.handler.ServeHTTP(w, r)
+	case path != r.URL.Path && r.Method == "DELETE":
+		delete(m.mounts, path)
+		w.WriteHeader(204)
+	default:
+		m.handler.ServeHTTP(w, r)
+	}
+}
+
+func TestBroker_ProvisionRollback(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	mounts := &mountTable{handler: env.Handler}
+	vault := &requestRecorder{handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/v1/cf/broker/instance-id" && r.Method == "PUT":
+			w.WriteHeader(500)
+		case r.URL.Path == "/v1/sys/policy/cf-instance-id" && r.Method == "DELETE":
+			w.WriteHeader(204)
+		default:
+			mounts.ServeHTTP(w, r)
+		}
+	})}
+	ts := httptest.NewServer(vault)
+	defer ts.Close()
+	if err := env.Broker.vaultClient.SetAddress(ts.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	details := brokerapi.ProvisionDetails{
+		SpaceGUID:        env.SpaceGUID,
+		OrganizationGUID: env.OrganizationGUID,
+	}
+	if _, err := env.Broker.Provision(env.Context, env.InstanceID, details, env.Async); err == nil {
+		t.Fatal("expected error")
+	}
+
+	// Everything created for the instance is removed again
+	for _, request := range []string{
+		"DELETE /v1/sys/mounts/cf/instance-id/secret",
+		"DELETE /v1/sys/mounts/cf/instance-id/transit",
+		"DELETE /v1/auth/token/roles/cf-instance-id",
+		"DELETE /v1/sys/policy/cf-instance-id",
+	} {
+		if !vault.received(request) {
+			t.Fatalf("expected %s", request)
+		}
+	}
+
+	// The shared backends are kept
+	for _, mount := range []string{"cf/organization-guid/secret", "cf/space-guid/secret"} {
+		if !mounts.mounts[mount] {
+			t.Fatalf("expected %s to be kept", mount)
+		}
+	}
+	if _, ok := env.Broker.instances[env.InstanceID]; ok {
+		t.Fatal("expected the instance to be forgotten")
+	}
+}
+
+func TestBroker_ProvisionRollback_Existing(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	var fail bool
+	mounts := &mountTable{handler: env.Handler}
+	vault := &requestRecorder{handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case fail && r.Method != "GET":
+			w.WriteHeader(500)
+		default:
+			mounts.ServeHTTP(w, r)
+		}
+	})}
+	ts := httptest.NewServer(vault)
+	defer ts.Close()
+	if err := env.Broker.vaultClient.SetAddress(ts.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	details := brokerapi.ProvisionDetails{
+		SpaceGUID:        env.SpaceGUID,
+		OrganizationGUID: env.OrganizationGUID,
+	}
+	if _, err := env.Broker.Provision(env.Context, env.InstanceID, details, env.Async); err != nil {
+		t.Fatal(err)
+	}
+
+	// Provisioning the instance again does not touch Vault, so a failure
+	// cannot roll back the live instance
+	fail = true
+	if _, err := env.Broker.Provision(env.Context, env.InstanceID, details, env.Async); err != nil {
+		t.Fatal(err)
+	}
+	details.SpaceGUID = "other-space"
+	if _, err := env.Broker.Provision(env.Context, env.InstanceID, details, env.Async); err != brokerapi.ErrInstanceAlreadyExists {
+		t.Fatalf("expected %v but received %v", brokerapi.ErrInstanceAlreadyExists, err)
+	}
+
+	for _, mount := range []string{"cf/instance-id/secret", "cf/instance-id/transit", "cf/instance-id/apps"} {
+		if !mounts.mounts[mount] {
+			t.Fatalf("expected %s to be kept", mount)
+		}
+	}
+	for _, request := range []string{
+		"DELETE /v1/auth/token/roles/cf-instance-id",
+		"DELETE /v1/sys/policy/cf-instance-id",
+	} {
+		if vault.received(request) {
+			t.Fatalf("expected no %s", request)
+		}
+	}
+	if _, ok := env.Broker.instances[env.InstanceID]; !ok {
+		t.Fatal("expected the instance to be kept")
+	}
+}
+
+func TestBroker_BindRollback(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	var journals []string
+	vault := &requestRecorder{handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/v1/cf/broker/instance-id/binding-id" && r.Method == "PUT":
+			w.WriteHeader(500)
+		case strings.HasPrefix(r.URL.Path, "/v1/cf/broker-meta/journal/") && r.Method == "PUT":
+			journals = append(journals, r.URL.Path)
+			env.Handler.ServeHTTP(w, r)
+		default:
+			env.Handler.ServeHTTP(w, r)
+		}
+	})}
+	ts := httptest.NewServer(vault)
+	defer ts.Close()
+	if err := env.Broker.vaultClient.SetAddress(ts.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	env.Broker.instances = map[string]*instanceInfo{
+		env.InstanceID: {OrganizationGUID: env.OrganizationGUID, SpaceGUID: env.SpaceGUID},
+	}
+	if _, err := env.Broker.Bind(env.Context, env.InstanceID, env.BindingID, brokerapi.BindDetails{}); err == nil {
+		t.Fatal("expected error")
+	}
+
+	// The token is revoked and the journal deleted
+	if !vault.received("POST /v1/auth/token/revoke-accessor") {
+		t.Fatal("expected the token to be revoked")
+	}
+	if len(journals) != 1 || !vault.received("DELETE "+journals[0]) {
+		t.Fatalf("expected the journal to be deleted but stored %v", journals)
+	}
+	if _, ok := env.Broker.binds[env.BindingID]; ok {
+		t.Fatal("expected the binding to be forgotten")
+	}
+}
+
+func TestBroker_RecoverTxns(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	// One provision was interrupted and one completed, but its journal was not
+	// deleted
+	journal := func(instanceID string) string {
+		tx := &txn{
+			ID:         instanceID + "-txn",
+			Operation:  "provision",
+			InstanceID: instanceID,
+			Cluster:    DefaultClusterName,
+			Steps: []*txnStep{
+				{Kind: "policy", Name: "cf-" + instanceID},
+				{Kind: "token_role", Name: "/auth/token/roles/cf-" + instanceID},
+			},
+		}
+		payload, _ := json.Marshal(tx)
+		data, _ := json.Marshal(map[string]interface{}{
+			"data": map[string]interface{}{"json": string(payload)},
+		})
+		return string(data)
+	}
+
+	vault := &requestRecorder{handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.String() == "/v1/cf/broker-meta/journal?list=true":
+			w.Write([]byte(`{"data": {"keys": ["interrupted-txn", "completed-txn"]}}`))
+		case r.URL.Path == "/v1/cf/broker-meta/journal/interrupted-txn" && r.Method == "GET":
+			w.Write([]byte(journal("interrupted")))
+		case r.URL.Path == "/v1/cf/broker-meta/journal/completed-txn" && r.Method == "GET":
+			w.Write([]byte(journal("completed")))
+		case r.URL.Path == "/v1/cf/broker/interrupted" && r.Method == "GET":
+			w.WriteHeader(404)
+		case r.URL.Path == "/v1/cf/broker/completed" && r.Method == "GET":
+			w.Write([]byte(`{"data": {"json": "{}"}}`))
+		case r.URL.Path == "/v1/sys/policy/cf-interrupted" && r.Method == "DELETE",
+			r.URL.Path == "/v1/auth/token/roles/cf-interrupted" && r.Method == "DELETE":
+			w.WriteHeader(204)
+		default:
+			env.Handler.ServeHTTP(w, r)
+		}
+	})}
+	ts := httptest.NewServer(vault)
+	defer ts.Close()
+	if err := env.Broker.vaultClient.SetAddress(ts.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	env.Broker.instances = make(map[string]*instanceInfo)
+	if err := env.Broker.recoverTxns(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, request := range []string{
+		"DELETE /v1/sys/policy/cf-interrupted",
+		"DELETE /v1/auth/token/roles/cf-interrupted",
+		"DELETE /v1/cf/broker-meta/journal/interrupted-txn",
+		"DELETE /v1/cf/broker-meta/journal/completed-txn",
+	} {
+		if !vault.received(request) {
+			t.Fatalf("expected %s", request)
+		}
+	}
+	if vault.received("DELETE /v1/sys/policy/cf-completed") {
+		t.Fatal("expected the completed provision to be kept")
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/pkg/errors"
+)
+
+const (
+	// BrokerTransitKey is the name of the transit key used to encrypt binding
+	// tokens before they are stored.
+	BrokerTransitKey = "broker"
+)
+
+// ensureTransitKey creates the broker's transit key if it does not exist yet.
+// Creating a key that already exists is a no-op in Vault.
+func (b *Broker) ensureTransitKey() error {
+	path := b.transitPath() + "/keys/" + BrokerTransitKey
+	b.log.Printf("[DEBUG] ensuring transit key %s", path)
+	if _, err := b.vaultClient.Logical().Write(path, nil); err != nil {
+		return errors.Wrapf(err, "failed to create transit key %s", path)
+	}
+	return nil
+}
+
+// encryptToken encrypts the given token with the broker's transit key and
+// returns the ciphertext.
+func (b *Broker) encryptToken(token string) (string, error) {
+	path := b.transitPath() + "/encrypt/" + BrokerTransitKey
+	secret, err := b.vaultClient.Logical().Write(path, map[string]interface{}{
+		"plaintext": base64.StdEncoding.EncodeToString([]byte(token)),
+	})
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to encrypt token with %s", path)
+	}
+	return transitField(secret, "ciphertext")
+}
+
+// decryptToken decrypts a token previously encrypted with encryptToken.
+func (b *Broker) decryptToken(ciphertext string) (string, error) {
+	path := b.transitPath() + "/decrypt/" + BrokerTransitKey
+	secret, err := b.vaultClient.Logical().Write(path, map[string]interface{}{
+		"ciphertext": ciphertext,
+	})
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to decrypt token with %s", path)
+	}
+	encoded, err := transitField(secret, "plaintext")
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to decode plaintext")
+	}
+	return string(plaintext), nil
+}
+
+// rewrapToken re-encrypts the ciphertext with the latest version of the
+// broker's transit key without exposing the plaintext.
+func (b *Broker) rewrapToken(ciphertext string) (string, error) {
+	path := b.transitPath() + "/rewrap/" + BrokerTransitKey
+	secret, err := b.vaultClient.Logical().Write(path, map[string]interface{}{
+		"ciphertext": ciphertext,
+	})
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to rewrap token with %s", path)
+	}
+	return transitField(secret, "ciphertext")
+}
+
+// bindingToken returns the plaintext client token of the binding, decrypting
+// it if necessary. Bindings written before encryption was introduced store the
+// token in plaintext.
+func (b *Broker) bindingToken(info *bindingInfo) (string, error) {
+	if info.EncryptedToken == "" {
+		return info.ClientToken, nil
+	}
+	return b.decryptToken(info.EncryptedToken)
+}
+
+// rotateTransitKey rotates the broker's transit key. Existing ciphertexts
+// remain decryptable until they are rewrapped.
+func (b *Broker) rotateTransitKey() error {
+	path := b.transitPath() + "/keys/" + BrokerTransitKey + "/rotate"
+	b.log.Printf("[INFO] rotating transit key %s", path)
+	if _, err := b.vaultClient.Logical().Write(path, nil); err != nil {
+		return errors.Wrapf(err, "failed to rotate transit key %s", path)
+	}
+	return nil
+}
+
+// rewrapBindings walks every binding record and rewraps its encrypted token
+// with the latest key version. Plaintext tokens left by older versions of the
+// broker are encrypted. It returns the number of records rewritten.
+func (b *Broker) rewrapBindings() (int, error) {
+	rewrapped := 0
+
+	instances, err := b.listDir(b.statePath() + "/")
+	if err != nil {
+		return rewrapped, errors.Wrap(err, "failed to list instances")
+	}
+	for _, inst := range uniqueKeys(instances) {
+		binds, err := b.listDir(b.statePath(inst) + "/")
+		if err != nil {
+			return rewrapped, errors.Wrapf(err, "failed to list binds for instance %q", inst)
+		}
+		for _, bind := range uniqueKeys(binds) {
+			path := b.statePath(inst, bind)
+			secret, err := b.vaultClient.Logical().Read(path)
+			if err != nil {
+				return rewrapped, errors.Wrapf(err, "failed to read bind info at %q", path)
+			}
+			if secret == nil || len(secret.Data) == 0 {
+				continue
+			}
+			info, err := decodeBindingInfo(secret.Data)
+			if err != nil {
+				return rewrapped, errors.Wrapf(err, "failed to decode binding info for %s", path)
+			}
+			if info.SchemaVersion > BindingSchemaVersion {
+				b.log.Printf("[WARN] skipping %s, which was written by a newer broker", path)
+				continue
+			}
+
+			switch {
+			case info.EncryptedToken != "":
+				b.log.Printf("[DEBUG] rewrapping token for %s", path)
+				info.EncryptedToken, err = b.rewrapToken(info.EncryptedToken)
+			case info.ClientToken != "":
+				b.log.Printf("[DEBUG] encrypting plaintext token for %s", path)
+				info.EncryptedToken, err = b.encryptToken(info.ClientToken)
+				info.ClientToken = ""
+			default:
+				continue
+			}
+			if err != nil {
+				return rewrapped, err
+			}
+
+			data, err := encodeBindingInfo(info)
+			if err != nil {
+				return rewrapped, errors.Wrapf(err, "failed to encode binding info for %s", path)
+			}
+			if _, err := b.vaultClient.Logical().Write(path, data); err != nil {
+				return rewrapped, errors.Wrapf(err, "failed to write bind info at %s", path)
+			}
+			rewrapped++
+		}
+	}
+
+	return rewrapped, nil
+}
+
+// transitField extracts a string field from a transit response.
+func transitField(secret *api.Secret, key string) (string, error) {
+	if secret == nil {
+		return "", fmt.Errorf("transit response is empty")
+	}
+	raw, ok := secret.Data[key]
+	if !ok {
+		return "", fmt.Errorf("transit response is missing %q", key)
+	}
+	typed, ok := raw.(string)
+	if !ok {
+		return "", fmt.Errorf("transit response %q is %T, not string", key, raw)
+	}
+	return typed, nil
+}
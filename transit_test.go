@@ -0,0 +1,70 @@
+package main
+
+import "testing"
+
+func TestBroker_EncryptDecryptToken(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	ciphertext, err := env.Broker.encryptToken("ABCD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ciphertext != "vault:v1:QUJDRA==" {
+		t.Fatalf("expected vault:v1:QUJDRA== but received %s", ciphertext)
+	}
+
+	plaintext, err := env.Broker.decryptToken(ciphertext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plaintext != "ABCD" {
+		t.Fatalf("expected ABCD but received %s", plaintext)
+	}
+}
+
+func TestBroker_BindingToken(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	cases := []struct {
+		name string
+		info *bindingInfo
+		e    string
+	}{
+		{
+			"plaintext",
+			&bindingInfo{ClientToken: "plaintext-token"},
+			"plaintext-token",
+		},
+		{
+			"encrypted",
+			&bindingInfo{EncryptedToken: "vault:v1:QUJDRA=="},
+			"ABCD",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			token, err := env.Broker.bindingToken(tc.info)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if token != tc.e {
+				t.Fatalf("expected %q but received %q", tc.e, token)
+			}
+		})
+	}
+}
+
+func TestBroker_RotateRewrap(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	if err := env.Broker.rotateTransitKey(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := env.Broker.rewrapBindings(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/pkg/errors"
+)
+
+const (
+	// TransitKeyRotationInterval is how often the broker checks whether any
+	// managed transit key is due for rotation.
+	TransitKeyRotationInterval = 10 * time.Minute
+
+	// MinTransitKeyRotationPeriod is the shortest rotation period a managed
+	// transit key may have.
+	MinTransitKeyRotationPeriod = time.Hour
+)
+
+// transitKeyTypes are the key types managed transit keys may have. The value
+// reports whether the type supports convergent encryption.
+var transitKeyTypes = map[string]bool{
+	"aes256-gcm96":      true,
+	"chacha20-poly1305": true,
+	"ed25519":           false,
+	"ecdsa-p256":        false,
+	"rsa-2048":          false,
+	"rsa-4096":          false,
+}
+
+// transitKeyNameRe matches the names managed transit keys may have.
+var transitKeyNameRe = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// transitKeyParameters describe a transit key given in the provision or bind
+// parameters.
+type transitKeyParameters struct {
+	Name                 string `json:"name"`
+	Type                 string `json:"type"`
+	Exportable           bool   `json:"exportable"`
+	ConvergentEncryption bool   `json:"convergent_encryption"`
+	DeletionAllowed      bool   `json:"deletion_allowed"`
+	RotationPeriod       string `json:"rotation_period"`
+}
+
+// parseTransitKeyParameters decodes the transit keys from the provision or
+// bind parameters. It returns nil if the parameters do not describe any.
+func parseTransitKeyParameters(raw json.RawMessage) ([]*transitKeyParameters, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	var params struct {
+		TransitKeys []*transitKeyParameters `json:"transit_keys"`
+	}
+	if err := json.Unmarshal(raw, &params); err != nil {
+		return nil, fmt.Errorf("failed to decode parameters: %s", err)
+	}
+
+	names := make(map[string]bool, len(params.TransitKeys))
+	for _, key := range params.TransitKeys {
+		if key == nil || !transitKeyNameRe.MatchString(key.Name) {
+			return nil, fmt.Errorf("invalid transit_keys name, must match %s", transitKeyNameRe)
+		}
+		if names[key.Name] {
+			return nil, fmt.Errorf("duplicate transit key %q", key.Name)
+		}
+		names[key.Name] = true
+
+		if key.Type == "" {
+			key.Type = "aes256-gcm96"
+		}
+		convergent, ok := transitKeyTypes[key.Type]
+		if !ok {
+			return nil, fmt.Errorf("unsupported type %q for transit key %q", key.Type, key.Name)
+		}
+		if key.ConvergentEncryption && !convergent {
+			return nil, fmt.Errorf("type %q of transit key %q does not support convergent encryption", key.Type, key.Name)
+		}
+		if key.RotationPeriod != "" {
+			period, err := time.ParseDuration(key.RotationPeriod)
+			if err != nil {
+				return nil, fmt.Errorf("invalid rotation_period for transit key %q: %s", key.Name, err)
+			}
+			if period < MinTransitKeyRotationPeriod {
+				return nil, fmt.Errorf("rotation_period for transit key %q must be at least %s", key.Name, MinTransitKeyRotationPeriod)
+			}
+		}
+	}
+	return params.TransitKeys, nil
+}
+
+// transitKey is a transit key the broker created in the transit backend of an
+// instance.
+type transitKey struct {
+	Name string
+	Type string
+
+	// RotationPeriod is how often the broker rotates the key. Keys without
+	// one are never rotated by the broker.
+	RotationPeriod string `json:",omitempty"`
+
+	// LastRotated is when the key was created or last rotated.
+	LastRotated time.Time
+}
+
+// due reports whether the key is due for rotation at now.
+func (k *transitKey) due(now time.Time) bool {
+	if k.RotationPeriod == "" {
+		return false
+	}
+	period, err := time.ParseDuration(k.RotationPeriod)
+	if err != nil {
+		return false
+	}
+	return !now.Before(k.LastRotated.Add(period))
+}
+
+// createTransitKeys creates the keys in the transit backend of the instance.
+// Keys the instance already has are refused, since creating them again would
+// silently keep the settings of the existing key.
+func (b *Broker) createTransitKeys(client *api.Client, instanceID string, instance *instanceInfo, params []*transitKeyParameters, event *AuditEvent) ([]*transitKey, error) {
+	existing := make(map[string]bool)
+	if instance != nil {
+		for _, name := range b.transitKeyNames(instance) {
+			existing[name] = true
+		}
+	}
+	for _, p := range params {
+		if existing[p.Name] {
+			return nil, fmt.Errorf("transit key %q already exists", p.Name)
+		}
+	}
+
+	keys := make([]*transitKey, 0, len(params))
+	for _, p := range params {
+		// Create the key
+		path := b.mountPath(instanceID, "transit", "keys", p.Name)
+		b.log.Printf("[DEBUG] creating transit key %s", path)
+		if _, err := client.Logical().Write(path, map[string]interface{}{
+			"type":                  p.Type,
+			"exportable":            p.Exportable,
+			"convergent_encryption": p.ConvergentEncryption,
+			"derived":               p.ConvergentEncryption,
+		}); err != nil {
+			return nil, errors.Wrapf(err, "failed to create transit key %s", path)
+		}
+		event.addArtifact("transit_key", path)
+
+		// Allow it to be deleted, if requested
+		if p.DeletionAllowed {
+			b.log.Printf("[DEBUG] allowing deletion of transit key %s", path)
+			if _, err := client.Logical().Write(path+"/config", map[string]interface{}{
+				"deletion_allowed": true,
+			}); err != nil {
+				return nil, errors.Wrapf(err, "failed to configure transit key %s", path)
+			}
+		}
+
+		keys = append(keys, &transitKey{
+			Name:           p.Name,
+			Type:           p.Type,
+			RotationPeriod: p.RotationPeriod,
+			LastRotated:    time.Now().UTC(),
+		})
+	}
+	return keys, nil
+}
+
+// deleteTransitKey removes the managed transit key from the instance and
+// deletes it, allowing its deletion first. Keys that do not exist are
+// ignored.
+func (b *Broker) deleteTransitKey(client *api.Client, instanceID, name string) error {
+	// Remove the key from the instance
+	b.instancesLock.Lock()
+	instance, ok := b.instances[instanceID]
+	removed := false
+	if ok {
+		keys := make([]*transitKey, 0, len(instance.TransitKeys))
+		for _, key := range instance.TransitKeys {
+			if key.Name == name {
+				removed = true
+				continue
+			}
+			keys = append(keys, key)
+		}
+		instance.TransitKeys = keys
+	}
+	b.instancesLock.Unlock()
+	if removed {
+		if err := b.storeInstance(instanceID, instance); err != nil {
+			return err
+		}
+	}
+
+	// Delete the key
+	path := b.mountPath(instanceID, "transit", "keys", name)
+	secret, err := client.Logical().Read(path)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read transit key %s", path)
+	}
+	if secret == nil {
+		return nil
+	}
+	b.log.Printf("[DEBUG] deleting transit key %s", path)
+	if _, err := client.Logical().Write(path+"/config", map[string]interface{}{
+		"deletion_allowed": true,
+	}); err != nil {
+		return errors.Wrapf(err, "failed to allow deletion of transit key %s", path)
+	}
+	if _, err := client.Logical().Delete(path); err != nil {
+		return errors.Wrapf(err, "failed to delete transit key %s", path)
+	}
+	return nil
+}
+
+// transitKeyNames returns the names of the managed transit keys of the
+// instance.
+func (b *Broker) transitKeyNames(instance *instanceInfo) []string {
+	b.instancesLock.Lock()
+	defer b.instancesLock.Unlock()
+
+	names := make([]string, 0, len(instance.TransitKeys))
+	for _, key := range instance.TransitKeys {
+		names = append(names, key.Name)
+	}
+	return names
+}
+
+// storeInstance writes the info of an existing instance back to the state
+// backend. Nothing is written if the info is no longer the instance's, since
+// the instance was deprovisioned or replaced after the info was read.
+func (b *Broker) storeInstance(instanceID string, info *instanceInfo) error {
+	b.stateLock.Lock()
+	defer b.stateLock.Unlock()
+
+	b.instancesLock.Lock()
+	current := b.instances[instanceID]
+	if current != info {
+		b.instancesLock.Unlock()
+		b.log.Printf("[DEBUG] instance %s no longer exists, not storing it", instanceID)
+		return nil
+	}
+	payload, err := encodeInstanceInfo(info)
+	b.instancesLock.Unlock()
+	if err != nil {
+		return errors.Wrap(err, "failed to encode instance json")
+	}
+
+	path := b.statePath(instanceID)
+	b.log.Printf("[DEBUG] storing instance metadata at %s", path)
+	if _, err := b.vaultClient.Logical().Write(path, payload); err != nil {
+		return errors.Wrapf(err, "failed to commit instance %s", path)
+	}
+	return nil
+}
+
+// runTransitKeyRotation rotates the managed transit keys that are due every
+// interval until the broker is stopped. It is designed to be called as a
+// goroutine.
+func (b *Broker) runTransitKeyRotation(interval time.Duration, stopCh <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			b.rotateTransitKeys(now.UTC())
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+// rotateTransitKeys rotates the managed transit keys of all instances that are
+// due at now. Failures are logged and retried on the next call.
+func (b *Broker) rotateTransitKeys(now time.Time) {
+	// Find the keys that are due
+	due := make(map[string][]*transitKey)
+	instances := make(map[string]*instanceInfo)
+	b.instancesLock.Lock()
+	for id, instance := range b.instances {
+		for _, key := range instance.TransitKeys {
+			if key.due(now) {
+				due[id] = append(due[id], key)
+				instances[id] = instance
+			}
+		}
+	}
+	b.instancesLock.Unlock()
+
+	ids := make([]string, 0, len(instances))
+	for id := range instances {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		cluster, err := b.cluster(instances[id].Cluster)
+		if err != nil {
+			b.log.Printf("[ERR] rotate-transit-keys (%s): failed to find cluster: %s", id, err)
+			continue
+		}
+
+		rotated := 0
+		for _, key := range due[id] {
+			path := b.mountPath(id, "transit", "keys", key.Name, "rotate")
+			b.log.Printf("[DEBUG] rotating transit key %s", path)
+			if _, err := cluster.client.Logical().Write(path, nil); err != nil {
+				b.log.Printf("[ERR] rotate-transit-keys (%s): failed to rotate %s: %s", id, key.Name, err)
+				continue
+			}
+			b.instancesLock.Lock()
+			key.LastRotated = now
+			b.instancesLock.Unlock()
+			rotated++
+		}
+		if rotated == 0 {
+			continue
+		}
+
+		// Record the rotation so it is not repeated after a restart
+		if err := b.storeInstance(id, instances[id]); err != nil {
+			b.log.Printf("[ERR] rotate-transit-keys (%s): %s", id, err)
+			continue
+		}
+		b.log.Printf("[INFO] rotate-transit-keys (%s): rotated %d keys", id, rotated)
+	}
+}
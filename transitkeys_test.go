@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pivotal-cf/brokerapi"
+)
+
+func TestParseTransitKeyParameters(t *testing.T) {
+	cases := []struct {
+		name   string
+		params string
+		keys   int
+		err    bool
+	}{
+		{"none", ``, 0, false},
+		{"other", `{"pki": {}}`, 0, false},
+		{"default-type", `{"transit_keys": [{"name": "orders"}]}`, 1, false},
+		{
+			"complete",
+			`{"transit_keys": [{"name": "orders", "type": "aes256-gcm96", "exportable": true, "convergent_encryption": true, "deletion_allowed": true, "rotation_period": "720h"}, {"name": "signing", "type": "ed25519"}]}`,
+			2,
+			false,
+		},
+		{"missing-name", `{"transit_keys": [{"type": "aes256-gcm96"}]}`, 0, true},
+		{"bad-name", `{"transit_keys": [{"name": "../orders"}]}`, 0, true},
+		{"duplicate", `{"transit_keys": [{"name": "orders"}, {"name": "orders"}]}`, 0, true},
+		{"bad-type", `{"transit_keys": [{"name": "orders", "type": "des"}]}`, 0, true},
+		{"convergent-rsa", `{"transit_keys": [{"name": "orders", "type": "rsa-2048", "convergent_encryption": true}]}`, 0, true},
+		{"bad-period", `{"transit_keys": [{"name": "orders", "rotation_period": "monthly"}]}`, 0, true},
+		{"short-period", `{"transit_keys": [{"name": "orders", "rotation_period": "1m"}]}`, 0, true},
+		{"bad-json", `{"transit_keys": `, 0, true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			keys, err := parseTransitKeyParameters(json.RawMessage(tc.params))
+			if tc.err {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(keys) != tc.keys {
+				t.Fatalf("expected %d keys but received %d", tc.keys, len(keys))
+			}
+			for _, key := range keys {
+				if key.Type == "" {
+					t.Fatalf("expected a default type for %s", key.Name)
+				}
+			}
+		})
+	}
+}
+
+func TestBroker_TransitKeys(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	var key, config map[string]interface{}
+	vault := &requestRecorder{handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/cf/instance-id/transit/keys/orders":
+			json.NewDecoder(r.Body).Decode(&key)
+			w.WriteHeader(204)
+		case "/v1/cf/instance-id/transit/keys/orders/config":
+			json.NewDecoder(r.Body).Decode(&config)
+			w.WriteHeader(204)
+		case "/v1/cf/instance-id/transit/keys/signing",
+			"/v1/cf/instance-id/transit/keys/orders/rotate":
+			w.WriteHeader(204)
+		default:
+			env.Handler.ServeHTTP(w, r)
+		}
+	})}
+	ts := httptest.NewServer(vault)
+	defer ts.Close()
+	if err := env.Broker.vaultClient.SetAddress(ts.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	details := brokerapi.ProvisionDetails{
+		SpaceGUID:        env.SpaceGUID,
+		OrganizationGUID: env.OrganizationGUID,
+		RawParameters: json.RawMessage(`{"transit_keys": [
+			{"name": "orders", "convergent_encryption": true, "deletion_allowed": true, "rotation_period": "720h"}
+		]}`),
+	}
+	if _, err := env.Broker.Provision(env.Context, env.InstanceID, details, env.Async); err != nil {
+		t.Fatal(err)
+	}
+	if key["type"] != "aes256-gcm96" || key["convergent_encryption"] != true || key["derived"] != true {
+		t.Fatalf("unexpected transit key %v", key)
+	}
+	if config["deletion_allowed"] != true {
+		t.Fatalf("expected deletion to be allowed but received %v", config)
+	}
+
+	// Keys requested by a binding are added to the instance
+	binding, err := env.Broker.Bind(env.Context, env.InstanceID, env.BindingID, brokerapi.BindDetails{
+		RawParameters: json.RawMessage(`{"transit_keys": [{"name": "signing", "type": "ed25519"}]}`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	backends := binding.Credentials.(map[string]interface{})["backends"].(map[string]interface{})
+	if names := backends["transit_keys"]; !reflect.DeepEqual(names, []string{"orders", "signing"}) {
+		t.Fatalf("expected [orders signing] but received %v", names)
+	}
+
+	// Existing keys are not created again
+	_, err = env.Broker.Bind(env.Context, env.InstanceID, "other-binding", brokerapi.BindDetails{
+		RawParameters: json.RawMessage(`{"transit_keys": [{"name": "orders"}]}`),
+	})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+
+	// Only keys with a rotation period that has passed are rotated
+	created := env.Broker.instances[env.InstanceID].TransitKeys[0].LastRotated
+	env.Broker.rotateTransitKeys(created.Add(24 * time.Hour))
+	if vault.received("PUT /v1/cf/instance-id/transit/keys/orders/rotate") {
+		t.Fatal("expected orders not to be rotated yet")
+	}
+
+	now := created.Add(721 * time.Hour)
+	env.Broker.rotateTransitKeys(now)
+	if !vault.received("PUT /v1/cf/instance-id/transit/keys/orders/rotate") {
+		t.Fatal("expected orders to be rotated")
+	}
+	if vault.received("PUT /v1/cf/instance-id/transit/keys/signing/rotate") {
+		t.Fatal("expected signing not to be rotated")
+	}
+	if last := env.Broker.instances[env.InstanceID].TransitKeys[0].LastRotated; !last.Equal(now) {
+		t.Fatalf("expected %s but received %s", now, last)
+	}
+}
+
+func TestBroker_RotateTransitKeys_Deprovisioned(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	// The instance is deprovisioned while its key is rotated
+	vault := &requestRecorder{handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/cf/instance-id/transit/keys/orders/rotate":
+			env.Broker.instancesLock.Lock()
+			delete(env.Broker.instances, env.InstanceID)
+			env.Broker.instancesLock.Unlock()
+			w.WriteHeader(204)
+		default:
+			env.Handler.ServeHTTP(w, r)
+		}
+	})}
+	ts := httptest.NewServer(vault)
+	defer ts.Close()
+	if err := env.Broker.vaultClient.SetAddress(ts.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	env.Broker.instances[env.InstanceID] = &instanceInfo{
+		Cluster:     DefaultClusterName,
+		TransitKeys: []*transitKey{{Name: "orders", RotationPeriod: "1h"}},
+	}
+	env.Broker.rotateTransitKeys(time.Now())
+	if !vault.received("PUT /v1/cf/instance-id/transit/keys/orders/rotate") {
+		t.Fatal("expected orders to be rotated")
+	}
+	if vault.received("PUT /v1/cf/broker/instance-id") {
+		t.Fatal("expected the deprovisioned instance not to be written back")
+	}
+}
@@ -9,48 +9,123 @@ const (
 	// ServicePolicyTemplate is the template used to generate a Vault policy on
 	// service create.
 	ServicePolicyTemplate string = `
-path "cf/{{ .ServiceID }}" {
+path "{{ .Prefix }}/{{ .ServiceID }}" {
   capabilities = ["list"]
 }
 
-path "cf/{{ .ServiceID }}/*" {
+path "{{ .Prefix }}/{{ .ServiceID }}/*" {
 	capabilities = ["create", "read", "update", "delete", "list"]
 }
-
-path "cf/{{ .SpaceID }}" {
+{{ if .SpaceID }}
+path "{{ .Prefix }}/{{ .SpaceID }}" {
   capabilities = ["list"]
 }
 
-path "cf/{{ .SpaceID }}/*" {
+path "{{ .Prefix }}/{{ .SpaceID }}/*" {
   capabilities = ["create", "read", "update", "delete", "list"]
 }
-
-path "cf/{{ .OrgID }}" {
+{{ end }}{{ if .OrgID }}
+path "{{ .Prefix }}/{{ .OrgID }}" {
   capabilities = ["list"]
 }
 
-path "cf/{{ .OrgID }}/*" {
+path "{{ .Prefix }}/{{ .OrgID }}/*" {
   capabilities = ["read", "list"]
 }
+{{ end }}` + AppsPolicyTemplate + `
+path "{{ .Prefix }}/{{ .ServiceID }}/pki/*" {
+  capabilities = ["deny"]
+}
+{{ if .PKIRole }}
+path "{{ .Prefix }}/{{ .ServiceID }}/pki/issue/{{ .PKIRole }}" {
+  capabilities = ["create", "update"]
+}
+{{ end }}
+path "{{ .Prefix }}/{{ .ServiceID }}/database/*" {
+  capabilities = ["deny"]
+}
+`
+
+	// AppsPolicyTemplate is the part of ServicePolicyTemplate denying access
+	// to the private areas of the applications bound to the service. It is
+	// appended to the policies of services created before those areas.
+	AppsPolicyTemplate string = `
+path "{{ .Prefix }}/{{ .ServiceID }}/apps/*" {
+  capabilities = ["deny"]
+}
+`
+
+	// AppPolicyTemplate is the template used to generate the Vault policy
+	// granting an application its private area of the service.
+	AppPolicyTemplate string = `
+path "{{ .Prefix }}/{{ .ServiceID }}/apps/{{ .AppID }}" {
+  capabilities = ["list"]
+}
+
+path "{{ .Prefix }}/{{ .ServiceID }}/apps/{{ .AppID }}/*" {
+  capabilities = ["create", "read", "update", "delete", "list"]
+}
+`
+
+	// DatabasePolicyTemplate is the template used to generate the Vault
+	// policy granting a binding the credentials of its database role.
+	DatabasePolicyTemplate string = `
+path "{{ .Prefix }}/{{ .ServiceID }}/database/creds/{{ .BindingID }}" {
+  capabilities = ["read"]
+}
 `
 )
 
 // ServicePolicyTemplateInput is used as input to the ServicePolicyTemplate.
 type ServicePolicyTemplateInput struct {
+	// Prefix is the path prefix of the mounts.
+	Prefix string
+
 	// ServiceID is the unique ID of the service.
 	ServiceID string
 
-	// SpaceID is the unique ID of the space.
+	// SpaceID is the unique ID of the space. The space paths are left out of
+	// the policy if it is empty, as it is for bindings from other spaces.
 	SpaceID string
 
-	// OrgID is the unique ID of the space.
+	// OrgID is the unique ID of the space. The organization paths are left
+	// out of the policy if it is empty.
 	OrgID string
+
+	// PKIRole is the name of the role of the instance's PKI backend, if it
+	// has one.
+	PKIRole string
+
+	// AppID is the GUID of the application, for AppPolicyTemplate.
+	AppID string
+
+	// BindingID is the ID of the binding, for DatabasePolicyTemplate.
+	BindingID string
 }
 
 // GeneratePolicy takes an io.Writer object and template input and renders the
 // resulting template into the writer.
 func GeneratePolicy(w io.Writer, i *ServicePolicyTemplateInput) error {
-	tmpl, err := template.New("service").Parse(ServicePolicyTemplate)
+	return generatePolicy(w, "service", ServicePolicyTemplate, i)
+}
+
+// GenerateAppsPolicy renders the AppsPolicyTemplate into the writer.
+func GenerateAppsPolicy(w io.Writer, i *ServicePolicyTemplateInput) error {
+	return generatePolicy(w, "apps", AppsPolicyTemplate, i)
+}
+
+// GenerateAppPolicy renders the AppPolicyTemplate into the writer.
+func GenerateAppPolicy(w io.Writer, i *ServicePolicyTemplateInput) error {
+	return generatePolicy(w, "app", AppPolicyTemplate, i)
+}
+
+// GenerateDatabasePolicy renders the DatabasePolicyTemplate into the writer.
+func GenerateDatabasePolicy(w io.Writer, i *ServicePolicyTemplateInput) error {
+	return generatePolicy(w, "database", DatabasePolicyTemplate, i)
+}
+
+func generatePolicy(w io.Writer, name, text string, i *ServicePolicyTemplateInput) error {
+	tmpl, err := template.New(name).Parse(text)
 	if err != nil {
 		return err
 	}